@@ -2,31 +2,153 @@ package main
 
 import (
 	"flag"
+	"io"
 	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/decay"
+	fiwarecontext "github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/context"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fusion"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/importer"
 	intmsg "github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/messaging"
 	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/messaging/commands"
 	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/messaging/events"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/servicearea"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/subscriptions"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/surfacetype"
 	"github.com/iot-for-tillgenglighet/api-transportation/pkg/handler"
 	"github.com/iot-for-tillgenglighet/messaging-golang/pkg/messaging"
 )
 
-func openSegmentsFile(path string) *os.File {
+//openSegmentsFile returns the file to seed the datastore from, or nil if no file should
+//be used. The returned reader is an untyped nil in that case, so that the datastore does
+//not mistake a nil *os.File for a file to read from.
+func openSegmentsFile(path string) (io.ReadCloser, error) {
+	if path == "" {
+		log.Info("No segments file given. The road network will be loaded from the database.")
+		return nil, nil
+	}
+
 	datafile, err := os.Open(path)
 	if err != nil {
-		log.Infof("Failed to open the segments database file %s. Datastore will not be seeded.", path)
-		return nil
+		return nil, err
 	}
-	return datafile
+
+	return datafile, nil
+}
+
+//loadServiceArea returns the service area from a GeoJSON file, which then replaces the service
+//area stored in the database, or the stored service area if no file is given. The default
+//service area is used if neither exists.
+func loadServiceArea(db database.Datastore, path string) (*servicearea.ServiceArea, error) {
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		area, err := servicearea.Load(file)
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err := area.Rows()
+		if err != nil {
+			return nil, err
+		}
+
+		return area, db.ReplaceServiceAreas(rows)
+	}
+
+	rows, err := db.GetServiceAreas()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		log.Warn("No service area has been configured. Falling back to the default service area.")
+		return servicearea.Default(), nil
+	}
+
+	return servicearea.NewFromRows(rows)
+}
+
+//loadVocabulary returns the surface types from a JSON file, or the default vocabulary if
+//no file is given
+func loadVocabulary(path string) (*surfacetype.Vocabulary, error) {
+	if path == "" {
+		return surfacetype.Default(), nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return surfacetype.Load(file)
+}
+
+//loadDecayRules returns the decay rules from a JSON file, or the default rules if no file
+//is given
+func loadDecayRules(path string, vocabulary *surfacetype.Vocabulary) (*decay.Rules, error) {
+	if path == "" {
+		return decay.Default(vocabulary)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return decay.Load(file, vocabulary)
 }
 
 var segmentsFileName string
+var segmentsFormat string
+var propertyNames importer.PropertyNames
+var osmTagFilter string
+var datastoreType string
+var snapDistance uint64
+var serviceAreaFileName string
+var vocabularyFileName string
+var fusionWindow time.Duration
+var fusionHalfLife time.Duration
+var sourceTrust string
+var decayRulesFileName string
+var decayInterval time.Duration
+var outboxInterval time.Duration
+var outboxRetryDelay time.Duration
+var retryPolicy intmsg.RetryPolicy
+var instanceID string
 
 func main() {
 	flag.StringVar(&segmentsFileName, "segsfile", "", "The file to seed road segments from")
+	flag.StringVar(&segmentsFormat, "segsformat", importer.FormatAuto, "The format of the segments file (auto, text, geojson, gpkg, nvdb or osm)")
+	flag.StringVar(&propertyNames.RoadID, "roadidprop", "", "The feature property that holds the road ID (default roadID)")
+	flag.StringVar(&propertyNames.SegmentID, "segmentidprop", "", "The feature property that holds the segment ID (default segmentID)")
+	flag.StringVar(&propertyNames.Name, "nameprop", "", "The feature property that holds the segment name (default name)")
+	flag.StringVar(&propertyNames.RoadClass, "roadclassprop", "", "The feature property that holds the road class (default roadClass)")
+	flag.StringVar(&osmTagFilter, "osmfilter", importer.DefaultOSMTagFilter, "The tags that OSM ways must have to be imported, such as highway=footway,cycleway;access!=private")
+	flag.StringVar(&datastoreType, "datastore", "memory", "Where the road network is queried, memory or postgis")
+	flag.Uint64Var(&snapDistance, "snapdistance", fiwarecontext.DefaultSnapDistance, "The maximum distance in meters between a road surface observation and the road segment it is matched to, or 0 to not match observations")
+	flag.StringVar(&serviceAreaFileName, "servicearea", "", "A GeoJSON file with the polygons that make up the service area, replacing the one stored in the database")
+	flag.StringVar(&vocabularyFileName, "surfacetypes", "", "A JSON file with the surface types, aliases and hierarchy to use instead of the built in vocabulary")
+	flag.DurationVar(&fusionWindow, "fusionwindow", fusion.DefaultWindow, "How far back surface type predictions of a segment are fused")
+	flag.DurationVar(&fusionHalfLife, "fusionhalflife", fusion.DefaultHalfLife, "The age at which a surface type prediction carries half the weight of a new one")
+	flag.StringVar(&sourceTrust, "sourcetrust", "", "The trust in each source of surface type predictions, such as observation=0.5,api=1 (default 1 for every source)")
+	flag.StringVar(&decayRulesFileName, "decayrules", "", "A JSON file with the rules for how surface types decay and expire when they are not confirmed")
+	flag.DurationVar(&decayInterval, "decayinterval", 10*time.Minute, "How often expired surface types are published as updates, or 0 to only apply the rules to queries")
+	flag.DurationVar(&outboxInterval, "outboxinterval", 10*time.Second, "How often the outbox is checked for events that are still to be published")
+	flag.DurationVar(&outboxRetryDelay, "outboxretrydelay", intmsg.DefaultOutboxRetryDelay, "The delay before an event that failed to be published is retried, which doubles with every attempt")
+	flag.IntVar(&retryPolicy.MaxAttempts, "retryattempts", intmsg.DefaultRetryPolicy().MaxAttempts, "How many times a command or event is attempted before it is dead lettered")
+	flag.DurationVar(&retryPolicy.Delay, "retrydelay", intmsg.DefaultRetryPolicy().Delay, "The delay before a command or event that failed to be handled is retried, which doubles with every attempt")
+	flag.StringVar(&instanceID, "instanceid", "", "A stable id of this instance, that its failed events are stored under so that they are retried after a restart (default the host name)")
 	flag.Parse()
 
 	log.SetFormatter(&log.JSONFormatter{})
@@ -40,13 +162,111 @@ func main() {
 
 	defer messenger.Close()
 
-	datafile := openSegmentsFile(segmentsFileName)
-	db, _ := database.NewDatabaseConnection(database.NewPostgreSQLConnector(), datafile)
-	defer datafile.Close()
+	segmentsFile, err := openSegmentsFile(segmentsFileName)
+	if err != nil {
+		log.Fatalf("Failed to open the segments file %s: %s", segmentsFileName, err.Error())
+	}
+
+	newDatastore := database.NewDatabaseConnection
+	if datastoreType == "postgis" {
+		newDatastore = database.NewSpatialDatabaseConnection
+	} else if datastoreType != "memory" {
+		log.Fatalf("Unknown datastore %s. Use memory or postgis.", datastoreType)
+	}
+
+	db, err := newDatastore(
+		database.NewPostgreSQLConnector(), segmentsFile,
+		importer.WithFormat(segmentsFormat), importer.WithPropertyNames(propertyNames), importer.WithTagFilter(osmTagFilter),
+	)
+
+	if segmentsFile != nil {
+		segmentsFile.Close()
+	}
 
-	messenger.RegisterTopicMessageHandler((&events.RoadSegmentSurfaceUpdated{}).TopicName(), intmsg.CreateRoadSegmentSurfaceUpdatedReceiver(db))
+	if err != nil {
+		log.Fatalf("Failed to set up the datastore: %s", err.Error())
+	}
 
-	messenger.RegisterCommandHandler(commands.UpdateRoadSegmentSurfaceContentType, intmsg.CreateUpdateRoadSegmentSurfaceCommandHandler(db, messenger))
+	area, err := loadServiceArea(db, serviceAreaFileName)
+	if err != nil {
+		log.Fatalf("Failed to load the service area: %s", err.Error())
+	}
+
+	for _, a := range area.Areas() {
+		log.Infof("Serving the area %s.", a.Name)
+	}
+
+	vocabulary, err := loadVocabulary(vocabularyFileName)
+	if err != nil {
+		log.Fatalf("Failed to load the surface types: %s", err.Error())
+	}
+
+	model := fusion.DefaultModel()
+	model.Window = fusionWindow
+	model.HalfLife = fusionHalfLife
+	model.Trust, err = fusion.ParseTrust(sourceTrust)
+	if err != nil {
+		log.Fatalf("Failed to parse the source trust: %s", err.Error())
+	}
+
+	decayRules, err := loadDecayRules(decayRulesFileName, vocabulary)
+	if err != nil {
+		log.Fatalf("Failed to load the decay rules: %s", err.Error())
+	}
+
+	notifier := subscriptions.NewNotifier(db, vocabulary)
+
+	if instanceID == "" {
+		instanceID, err = os.Hostname()
+		if err != nil {
+			log.Fatalf("Failed to get the host name to use as instance id: %s", err.Error())
+		}
+	}
+
+	if retryPolicy.Delay <= 0 {
+		log.Fatalf("The retry delay must be positive, but was %s.", retryPolicy.Delay)
+	}
+
+	retryPolicy.MaxDelay = intmsg.DefaultRetryPolicy().MaxDelay
+	deadLetters := intmsg.NewDeadLetters(db, instanceID, retryPolicy)
+
+	messenger.RegisterTopicMessageHandler((&events.RoadSegmentSurfaceUpdated{}).TopicName(), intmsg.CreateRoadSegmentSurfaceUpdatedReceiver(db, deadLetters))
+
+	if outboxInterval <= 0 {
+		log.Fatalf("The outbox interval must be positive, but was %s.", outboxInterval)
+	}
+
+	relay := intmsg.CreateOutboxRelay(db, messenger, notifier, outboxRetryDelay)
+
+	messenger.RegisterCommandHandler(commands.UpdateRoadSegmentSurfaceContentType, intmsg.CreateUpdateRoadSegmentSurfaceCommandHandler(db, vocabulary, model, relay, deadLetters))
+	messenger.RegisterCommandHandler(commands.RetractRoadSegmentSurfaceContentType, intmsg.CreateRetractRoadSegmentSurfaceCommandHandler(db, model, relay, deadLetters))
+
+	// Retry the commands and events that failed to be handled
+	go func() {
+		for now := range time.Tick(retryPolicy.Delay) {
+			deadLetters.Retry(now.UTC())
+		}
+	}()
+
+	// Publish whatever was left in the outbox by a previous run, and retry failed events
+	go func() {
+		relay(time.Now().UTC())
+		for now := range time.Tick(outboxInterval) {
+			relay(now.UTC())
+		}
+	}()
+
+	if decayInterval > 0 {
+		expire := intmsg.CreateSurfaceExpiryJob(db, decayRules, relay)
+		go func() {
+			for now := range time.Tick(decayInterval) {
+				expire(now)
+			}
+		}()
+	}
 
-	handler.CreateRouterAndStartServing(messenger, db)
+	handler.CreateRouterAndStartServing(
+		messenger, db, area, deadLetters, fiwarecontext.WithSnapDistance(snapDistance), fiwarecontext.WithVocabulary(vocabulary),
+		fiwarecontext.WithDecayRules(decayRules),
+	)
 }
@@ -8,6 +8,7 @@ require (
 	github.com/iot-for-tillgenglighet/messaging-golang v0.0.0-20201230002037-e79e8e927ae9
 	github.com/iot-for-tillgenglighet/ngsi-ld-golang v0.0.0-20210324163824-c4cc759daab0
 	github.com/kr/text v0.2.0 // indirect
+	github.com/mattn/go-sqlite3 v1.14.5
 	github.com/rs/cors v1.7.0
 	github.com/sirupsen/logrus v1.7.0
 	github.com/streadway/amqp v1.0.0
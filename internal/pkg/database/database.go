@@ -1,15 +1,20 @@
 package database
 
 import (
-	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/decay"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fusion"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/importer"
 	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/persistence"
 	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/diwise"
 	log "github.com/sirupsen/logrus"
@@ -20,9 +25,6 @@ import (
 	"gorm.io/gorm/logger"
 )
 
-//TODO: This is a proof of concept that is in need to be refactored to use a
-// 		proper 3rd party geometry library like S2 or something like that. // Isak
-
 //Point encapsulates a WGS84 coordinate
 type Point struct {
 	lat float64
@@ -34,6 +36,10 @@ func NewPoint(lat, lon float64) Point {
 	return Point{lat: lat, lon: lon}
 }
 
+func (p Point) toGeometry() geometry.Point {
+	return geometry.NewPoint(p.lat, p.lon)
+}
+
 //IsBoundedBy returns true if the point is bounded by the provided bounding box
 func (p Point) IsBoundedBy(box *Rectangle) bool {
 	if box.northWest.lon < p.lon && box.southEast.lon > p.lon &&
@@ -78,21 +84,16 @@ func NewBoundingBoxFromRectangles(rect1, rect2 Rectangle) Rectangle {
 	return result
 }
 
-//DistanceFromPoint calculates the distance from a rectangle and an exterior point. For
-//points within the rectangle, 0 is returned
+//DistanceFromPoint calculates the distance in meters from a rectangle to an exterior
+//point, measured to the closest point on the rectangle's edge. For points within the
+//rectangle, 0 is returned
 func (r Rectangle) DistanceFromPoint(pt Point) uint64 {
-	latdelta := math.Max(math.Max(r.southEast.lat-pt.lat, 0), pt.lat-r.northWest.lat)
-	londelta := math.Max(math.Max(r.northWest.lon-pt.lon, 0), pt.lon-r.southEast.lon)
-	distance := 0.0
-
-	if latdelta > 0 || londelta > 0 {
-		LatB := latdelta * math.Pi / 180
-		LngB := londelta * math.Pi / 180
+	closest := NewPoint(
+		math.Max(r.southEast.lat, math.Min(pt.lat, r.northWest.lat)),
+		math.Max(r.northWest.lon, math.Min(pt.lon, r.southEast.lon)),
+	)
 
-		distance = 6371000 * math.Acos(math.Cos(LatB)*math.Cos(LngB))
-	}
-
-	return uint64(distance)
+	return uint64(geometry.Distance(pt.toGeometry(), closest.toGeometry()))
 }
 
 //Intersects returns true if the two rectangles overlap in any way
@@ -105,9 +106,13 @@ func (r Rectangle) Intersects(other Rectangle) bool {
 	return true
 }
 
-//Road is a road
+//Road is a road. Roads and segments that have been added to a Datastore are immutable
+//snapshots, that are replaced as a whole when a segment is updated, so they can be
+//safely read from any goroutine.
 type Road interface {
 	ID() string
+	Name() string
+	RoadClass() string
 
 	AddSegment(RoadSegment)
 	GetSegment(id string) (RoadSegment, error)
@@ -116,13 +121,17 @@ type Road interface {
 	GetSegmentsWithinRect(Rectangle) ([]RoadSegment, uint64)
 
 	BoundingBox() Rectangle
+	DistanceFromPoint(pt Point) float64
 	IsWithinDistanceFromPoint(maxDistance uint64, pt Point) bool
 
-	setLastModified(timestamp *time.Time)
+	allSegments() []RoadSegment
+	withUpdatedSegment(segment RoadSegment) Road
 }
 
 type roadImpl struct {
-	id string
+	id        string
+	name      string
+	roadClass string
 
 	segments []RoadSegment
 
@@ -132,6 +141,20 @@ type roadImpl struct {
 
 func (r *roadImpl) AddSegment(segment RoadSegment) {
 	r.segments = append(r.segments, segment)
+	r.bbox = NewBoundingBoxFromRectangles(r.bbox, segment.BoundingBox())
+	r.inheritNameAndClass(segment)
+}
+
+//inheritNameAndClass lets a road take its name and class from the first of its segments
+//that has them, since road network files describe segments and not roads
+func (r *roadImpl) inheritNameAndClass(segment RoadSegment) {
+	if r.name == "" {
+		r.name = segment.Name()
+	}
+
+	if seg, ok := segment.(*roadSegmentImpl); ok && r.roadClass == "" {
+		r.roadClass = seg.roadClass
+	}
 }
 
 func (r *roadImpl) GetSegment(id string) (RoadSegment, error) {
@@ -157,6 +180,10 @@ func (r *roadImpl) BoundingBox() Rectangle {
 	return r.bbox
 }
 
+func (r *roadImpl) allSegments() []RoadSegment {
+	return r.segments
+}
+
 func (r *roadImpl) GetSegmentsWithinDistanceFromPoint(maxDistance uint64, pt Point) ([]RoadSegment, uint64) {
 	matchingSegments := []RoadSegment{}
 	count := uint64(0)
@@ -189,18 +216,66 @@ func (r *roadImpl) ID() string {
 	return r.id
 }
 
+func (r *roadImpl) Name() string {
+	return r.name
+}
+
+func (r *roadImpl) RoadClass() string {
+	return r.roadClass
+}
+
+func (r *roadImpl) DistanceFromPoint(pt Point) float64 {
+	distance := math.Inf(1)
+
+	for _, segment := range r.segments {
+		distance = math.Min(distance, segment.DistanceFromPoint(pt))
+	}
+
+	return distance
+}
+
 func (r *roadImpl) IsWithinDistanceFromPoint(maxDistance uint64, pt Point) bool {
-	return (maxDistance > r.bbox.DistanceFromPoint(pt))
+	if r.bbox.DistanceFromPoint(pt) > maxDistance {
+		return false
+	}
+
+	for _, segment := range r.segments {
+		if segment.IsWithinDistanceFromPoint(maxDistance, pt) {
+			return true
+		}
+	}
+
+	return false
 }
 
-func (r *roadImpl) setLastModified(timestamp *time.Time) {
-	r.modified = timestamp
+//withUpdatedSegment returns a copy of the road where the segment with the same id has
+//been replaced by the supplied one
+func (r *roadImpl) withUpdatedSegment(segment RoadSegment) Road {
+	updated := *r
+	updated.segments = make([]RoadSegment, len(r.segments))
+
+	for idx := range r.segments {
+		if r.segments[idx].ID() == segment.ID() {
+			updated.segments[idx] = segment
+		} else {
+			updated.segments[idx] = r.segments[idx]
+		}
+	}
+
+	if modified := segment.DateModified(); modified != nil {
+		if updated.modified == nil || updated.modified.Before(*modified) {
+			updated.modified = modified
+		}
+	}
+
+	return &updated
 }
 
 func newRoad(id string, segment RoadSegment) Road {
 	road := &roadImpl{id: id}
 	road.segments = append(road.segments, segment)
 	road.bbox = segment.BoundingBox()
+	road.inheritNameAndClass(segment)
 
 	return road
 }
@@ -209,29 +284,41 @@ func newRoad(id string, segment RoadSegment) Road {
 type RoadSegment interface {
 	ID() string
 	RoadID() string
+	Name() string
+	Attributes() map[string]string
 	BoundingBox() Rectangle
 	Coordinates() [][2]float64
+	DistanceFromPoint(Point) float64
 	IsWithinDistanceFromPoint(uint64, Point) bool
 	SurfaceType() (string, float64)
-
-	setSurfaceType(surfaceType string, probability float64)
+	SurfaceTypeDistribution() fusion.Distribution
 
 	DateModified() *time.Time
+	DateConfirmed() *time.Time
 	IsModified() bool
-	setLastModified(timestamp *time.Time)
+
+	withSurfaceUpdate(update SurfaceUpdate) RoadSegment
+	isNewerThan(update SurfaceUpdate) bool
 }
 
 type roadSegmentImpl struct {
 	id     string
 	roadID string
 
+	name       string
+	roadClass  string
+	attributes map[string]string
+
 	lines []RoadSegmentLine
 	bbox  Rectangle
 
 	surfaceType            string
 	surfaceTypeProbability float64
+	surfaceDistribution    fusion.Distribution
+	surfaceSequence        uint64
 
-	modified *time.Time
+	modified  *time.Time
+	confirmed *time.Time
 }
 
 func (seg *roadSegmentImpl) ID() string {
@@ -242,6 +329,16 @@ func (seg *roadSegmentImpl) RoadID() string {
 	return seg.roadID
 }
 
+func (seg *roadSegmentImpl) Name() string {
+	return seg.name
+}
+
+//Attributes returns any additional information about the segment that was read from
+//the road network file. The returned map must not be modified.
+func (seg *roadSegmentImpl) Attributes() map[string]string {
+	return seg.attributes
+}
+
 func (seg *roadSegmentImpl) BoundingBox() Rectangle {
 	return seg.bbox
 }
@@ -256,10 +353,25 @@ func (seg *roadSegmentImpl) Coordinates() [][2]float64 {
 	return coords
 }
 
+func (seg *roadSegmentImpl) DistanceFromPoint(pt Point) float64 {
+	distance := math.Inf(1)
+
+	for _, line := range seg.lines {
+		distance = math.Min(distance, line.DistanceFromPoint(pt))
+	}
+
+	return distance
+}
+
 func (seg *roadSegmentImpl) IsWithinDistanceFromPoint(maxDistance uint64, pt Point) bool {
+	if seg.bbox.DistanceFromPoint(pt) > maxDistance {
+		return false
+	}
 
 	for _, line := range seg.lines {
-		if line.BoundingBox().DistanceFromPoint(pt) < maxDistance {
+		// Use the cheaper bounding box distance to rule out lines before measuring
+		if line.BoundingBox().DistanceFromPoint(pt) <= maxDistance &&
+			line.DistanceFromPoint(pt) <= float64(maxDistance) {
 			return true
 		}
 	}
@@ -271,23 +383,62 @@ func (seg *roadSegmentImpl) SurfaceType() (string, float64) {
 	return seg.surfaceType, seg.surfaceTypeProbability
 }
 
-func (seg *roadSegmentImpl) setSurfaceType(surfaceType string, probability float64) {
-	seg.surfaceType = surfaceType
-	seg.surfaceTypeProbability = probability
+//SurfaceTypeDistribution returns the fused probabilities of every surface type that the
+//segment may have. The returned map must not be modified.
+func (seg *roadSegmentImpl) SurfaceTypeDistribution() fusion.Distribution {
+	return seg.surfaceDistribution
 }
 
 func (seg *roadSegmentImpl) DateModified() *time.Time {
 	return seg.modified
 }
 
+//DateConfirmed returns when the surface of the segment was last confirmed by a prediction,
+//which is earlier than DateModified if the surface has decayed since
+func (seg *roadSegmentImpl) DateConfirmed() *time.Time {
+	return seg.confirmed
+}
+
 func (seg *roadSegmentImpl) IsModified() bool {
 	return seg.modified != nil
 }
 
-func (seg *roadSegmentImpl) setLastModified(timestamp *time.Time) {
-	if seg.modified == nil || seg.modified.Before(*timestamp) {
-		seg.modified = timestamp
+//withSurfaceUpdate returns a copy of the segment with a new distribution over surface
+//types, and the most likely of them as its surface type. The geometry is shared between
+//the copies, since it never changes.
+func (seg *roadSegmentImpl) withSurfaceUpdate(update SurfaceUpdate) RoadSegment {
+	updated := *seg
+	updated.surfaceType, updated.surfaceTypeProbability = update.Distribution.MostLikely()
+	updated.surfaceDistribution = update.Distribution
+	updated.surfaceSequence = update.Sequence
+
+	timestamp, confirmed := update.Timestamp, update.ConfirmedAt()
+	updated.modified = &timestamp
+	updated.confirmed = &confirmed
+
+	return &updated
+}
+
+//isNewerThan returns true if the segment's surface is at least as recent as an update, which
+//means that the update is either a duplicate or has arrived out of order. Updates are ordered
+//by their sequence numbers, and by their timestamps if they have none.
+func (seg *roadSegmentImpl) isNewerThan(update SurfaceUpdate) bool {
+	if update.Sequence > 0 {
+		return seg.surfaceSequence >= update.Sequence
 	}
+
+	return seg.modified != nil && !seg.modified.Before(update.Timestamp)
+}
+
+//newLineString returns the polyline of a road segment
+func newLineString(segment RoadSegment) geometry.LineString {
+	line := geometry.LineString{}
+
+	for _, coord := range segment.Coordinates() {
+		line = append(line, geometry.NewPoint(coord[1], coord[0]))
+	}
+
+	return line
 }
 
 func newRoadSegment(id string, roadID string, coordinates []Point) RoadSegment {
@@ -313,6 +464,7 @@ func newRoadSegment(id string, roadID string, coordinates []Point) RoadSegment {
 //RoadSegmentLine represents a straight part of a road segment
 type RoadSegmentLine interface {
 	BoundingBox() Rectangle
+	DistanceFromPoint(Point) float64
 	StartPoint() [2]float64
 	EndPoint() [2]float64
 }
@@ -327,6 +479,10 @@ func (line roadSegmentLineImpl) BoundingBox() Rectangle {
 	return line.bbox
 }
 
+func (line roadSegmentLineImpl) DistanceFromPoint(pt Point) float64 {
+	return geometry.DistanceToLine(pt.toGeometry(), line.startPt.toGeometry(), line.endPt.toGeometry())
+}
+
 func (line roadSegmentLineImpl) EndPoint() [2]float64 {
 	return [2]float64{line.endPt.lon, line.endPt.lat}
 }
@@ -341,91 +497,144 @@ func newRoadSegmentLine(startPt Point, endPt Point) RoadSegmentLine {
 	return line
 }
 
+//ErrNotFound is returned when a requested entity does not exist in the datastore
+var ErrNotFound = errors.New("not found")
+
+//ErrDuplicate is returned when a command that has already been applied is applied again, or
+//something is stored with the id of something that already exists
+var ErrDuplicate = errors.New("duplicate")
+
+//ObservationExistsError is returned when an observation is stored with the id of an
+//observation that already exists, or that has been deleted
+type ObservationExistsError struct {
+	ID string
+}
+
+func (e *ObservationExistsError) Error() string {
+	return fmt.Sprintf("an observation with id %s has already been stored", e.ID)
+}
+
+func (e *ObservationExistsError) Unwrap() error {
+	return ErrDuplicate
+}
+
+//errSurfaceChanged is returned when the surface of a segment has been changed by someone else
+//since it was read, in which case the change that was based on it is not stored
+var errSurfaceChanged = errors.New("the surface has been changed concurrently")
+
+//isUniqueViolation tells if an error is a violation of a unique index, as reported by SQLite
+//or PostgreSQL
+func isUniqueViolation(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "UNIQUE constraint failed") || strings.Contains(msg, "SQLSTATE 23505")
+}
+
+//ErrRetracted is returned when a prediction is made from an observation that has been deleted
+var ErrRetracted = errors.New("retracted")
+
+//SurfaceUpdate is a change of the fused surface of a segment. Every change that is stored
+//is given the next sequence number of its segment, so that replicas can drop updates that
+//are redelivered or arrive out of order. Updates without a sequence number are ordered by
+//their timestamps. Confirmed is when the distribution was last confirmed by a prediction,
+//which is earlier than the timestamp when the update stores a distribution that has decayed.
+//A zero Confirmed means that the distribution was confirmed at the time of the update.
+type SurfaceUpdate struct {
+	Distribution fusion.Distribution
+	Timestamp    time.Time
+	Confirmed    time.Time
+	Sequence     uint64
+}
+
+//ConfirmedAt returns when the distribution of an update was last confirmed by a prediction
+func (u SurfaceUpdate) ConfirmedAt() time.Time {
+	if u.Confirmed.IsZero() {
+		return u.Timestamp
+	}
+
+	return u.Confirmed
+}
+
 //Datastore is an interface that is used to inject the database into different handlers to improve testability
 type Datastore interface {
 	AddRoad(Road) error
 
+	GetAllRoads() ([]Road, error)
 	GetRoadByID(id string) (Road, error)
 	GetRoadBySegmentID(segmentID string) (Road, error)
 	GetRoadCount() int
 	GetRoadsNearPoint(lat, lon float64, maxDistance uint64) ([]Road, error)
 	GetRoadsWithinRect(lat0, lon0, lat1, lon1 float64) ([]Road, error)
+	GetRoadsMatchingGeometry(relation geometry.Relation, g geometry.Geometry) ([]Road, error)
 
+	GetAllSegments() ([]RoadSegment, error)
 	GetRoadSegmentByID(id string) (RoadSegment, error)
+	GetNearestSegment(lat, lon float64, maxDistance uint64) (RoadSegment, error)
 
 	GetSegmentsNearPoint(lat, lon float64, maxDistance uint64) ([]RoadSegment, error)
 	GetSegmentsWithinRect(lat0, lon0, lat1, lon1 float64) ([]RoadSegment, error)
+	GetSegmentsMatchingGeometry(relation geometry.Relation, g geometry.Geometry) ([]RoadSegment, error)
+
+	RoadSegmentSurfaceUpdated(segmentID string, update SurfaceUpdate) error
+	UpdateRoadSegmentSurface(segmentID, messageID, observationID string, prediction fusion.Prediction, model fusion.Model) (SurfaceUpdate, error)
+	RetractRoadSegmentSurface(segmentID, observationID string, predictionIDs []uint, model fusion.Model) (SurfaceUpdate, bool, error)
+	ExpireRoadSegmentSurface(segmentID string, rules *decay.Rules, now time.Time) (SurfaceUpdate, bool, error)
+
+	ClaimOutboxMessages(now time.Time, lease time.Duration, limit int) ([]persistence.OutboxMessage, error)
+	OutboxMessagePublished(id uint) error
+	OutboxMessageFailed(id uint, reason string, nextAttempt time.Time) error
+
+	CreateFailedMessage(message *persistence.FailedMessage) error
+	ClaimFailedMessages(owner string, now time.Time, lease time.Duration, limit int) ([]persistence.FailedMessage, error)
+	FailedMessageRetried(id uint, reason string, nextAttempt *time.Time) error
+	GetDeadLetters(owner string) ([]persistence.FailedMessage, error)
+	GetDeadLetterByID(owner string, id uint) (*persistence.FailedMessage, error)
+	DeleteFailedMessage(id uint) error
+
+	GetSurfaceTypePredictions(segmentIDs []string, from, to *time.Time) (map[string][]persistence.SurfaceTypePrediction, error)
+
+	CreateRoadSurfaceObserved(src *diwise.RoadSurfaceObserved, segmentID string) (*persistence.RoadSurfaceObserved, error)
+	CreateRoadSurfacesObserved(observations []*diwise.RoadSurfaceObserved, segmentIDs []string) ([]persistence.RoadSurfaceObserved, error)
+	DeleteRoadSurfacesObserved(ids []string) error
+	GetRoadSurfaceObservedByID(id string) (*persistence.RoadSurfaceObserved, error)
+	GetRoadSurfacesObserved() ([]persistence.RoadSurfaceObserved, error)
+	GetRoadSurfacesObservedBetween(ids []string, from, to *time.Time) ([]persistence.RoadSurfaceObserved, error)
 
-	RoadSegmentSurfaceUpdated(segmentID, surfaceType string, probability float64, timestamp time.Time) error
-	UpdateRoadSegmentSurface(segmentID, surfaceType string, probability float64, timestamp time.Time) error
+	CreateSubscription(subscription *persistence.Subscription) error
+	GetSubscriptionByID(id string) (*persistence.Subscription, error)
+	GetSubscriptions() ([]persistence.Subscription, error)
+	UpdateSubscription(subscription *persistence.Subscription) error
+	DeleteSubscription(id string) error
+	SubscriptionNotified(id string, success bool, timestamp time.Time) error
 
-	CreateRoadSurfaceObserved(src *diwise.RoadSurfaceObserved) (*persistence.RoadSurfaceObserved, error)
-	GetRoadSurfacesObserved() ([]persistence.RoadSurfaceObserved, error)
+	GetServiceAreas() ([]persistence.ServiceArea, error)
+	ReplaceServiceAreas(areas []persistence.ServiceArea) error
 }
 
-//InitFromReader takes a reader interface and initialises the datastore
-func initFromReader(db *myDB, rd io.Reader) error {
-	// Start reading from the file with a reader.
-	reader := bufio.NewReader(rd)
-	var line string
-	var err error
-
+//initFromReader reads a road network file of any of the formats supported by the importer
+//and seeds the datastore with its roads and segments
+func initFromReader(db *myDB, rd io.Reader, options ...importer.Option) error {
 	log.Infof("Seeding datastore ...")
 
-	roads := map[string]Road{}
-
-	for {
-		line, err = reader.ReadString('\n')
-		if err != nil && err != io.EOF {
-			break
-		}
-
-		parts := strings.Split(line, ";")
-		numberOfParts := len(parts)
-
-		if numberOfParts >= 6 {
-			coordinates := []Point{}
-
-			parts[numberOfParts-1] = strings.TrimRight(parts[numberOfParts-1], "\r\n")
-
-			for i := 2; i < numberOfParts; i += 2 {
-				lat, laterr := strconv.ParseFloat(parts[i], 64)
-				lon, lonerr := strconv.ParseFloat(parts[i+1], 64)
-
-				if laterr != nil || lonerr != nil {
-					log.Errorf("Failed to parse (%f,%f) as a coordinate. Skipping record.", lat, lon)
-					continue
-				}
-
-				coordinates = append(coordinates, NewPoint(lat, lon))
-			}
-
-			segment := newRoadSegment(parts[1], parts[0], coordinates)
+	segments, err := importer.Read(rd, options...)
+	if err != nil {
+		log.Errorf(" > Failed with error: %v\n", err)
+		return err
+	}
 
-			road, ok := roads[parts[0]]
-			if !ok {
-				road = newRoad(parts[0], segment)
-				roads[parts[0]] = road
-			} else {
-				road.AddSegment(segment)
-			}
+	return seedFromSegments(db, segments)
+}
 
-			// Add a mapping from segment ID to road ID
-			db.seg2road[segment.ID()] = road.ID()
-		}
+//seedFromSegments groups imported segments into roads, stores them in the database as the
+//new road network and adds them to the datastore
+func seedFromSegments(db *myDB, segments []importer.Segment) error {
+	roads := newRoadsFromSegments(segments)
 
-		if err != nil {
-			break
-		}
-	}
-
-	if err != io.EOF {
-		log.Errorf(" > Failed with error: %v\n", err)
-		return err
+	if err := db.persistRoads(roads, true); err != nil {
+		return fmt.Errorf("failed to store the road network in the database: %s", err.Error())
 	}
 
 	for _, road := range roads {
-		db.AddRoad(road)
+		db.addRoad(road)
 	}
 
 	return nil
@@ -473,6 +682,11 @@ func NewSQLiteConnector() ConnectorFunc {
 		})
 
 		if err == nil {
+			// Every new connection would open a separate, empty, in-memory database
+			if sqlDB, err := db.DB(); err == nil {
+				sqlDB.SetMaxOpenConns(1)
+			}
+
 			db.Exec("PRAGMA foreign_keys = ON")
 		}
 
@@ -481,22 +695,26 @@ func NewSQLiteConnector() ConnectorFunc {
 }
 
 //NewDatabaseConnection creates and returns a new instance of the Datastore interface
-func NewDatabaseConnection(connect ConnectorFunc, datafile io.Reader) (Datastore, error) {
+//Options are passed on to the importer and control how the datafile is read.
+func NewDatabaseConnection(connect ConnectorFunc, datafile io.Reader, options ...importer.Option) (Datastore, error) {
 	impl, err := connect()
 	if err != nil {
 		return nil, err
 	}
 
 	db := &myDB{
-		impl:     impl.Debug(),
-		roads:    map[string]Road{},
-		seg2road: map[string]string{},
+		impl:         impl.Debug(),
+		roads:        map[string]Road{},
+		seg2road:     map[string]string{},
+		segments:     map[string]RoadSegment{},
+		roadIndex:    newSpatialIndex(defaultIndexCellSize),
+		segmentIndex: newSpatialIndex(defaultIndexCellSize),
 	}
 
-	db.impl.AutoMigrate(&persistence.Road{}, &persistence.RoadSegment{}, &persistence.SurfaceTypePrediction{}, &persistence.RoadSurfaceObserved{})
+	migrate(db.impl)
 
 	if datafile != nil {
-		err := initFromReader(db, datafile)
+		err := initFromReader(db, datafile, options...)
 		if err != nil {
 			return nil, err
 		}
@@ -510,72 +728,154 @@ func NewDatabaseConnection(connect ConnectorFunc, datafile io.Reader) (Datastore
 		//db.UpdateRoadSegmentSurface("21277:153930", "snow", 0.56, time.Now().Add(time.Duration(-5)*time.Second).UTC())
 		//db.UpdateRoadSegmentSurface("21277:153930", "snow", 0.60, time.Now().Add(time.Duration(2)*time.Second).UTC())
 		//db.UpdateRoadSegmentSurface("21277:153930", "snow", 0.70, time.Now().UTC())
+	} else {
+		// Without a datafile the network that has been stored by an earlier seeding, by this
+		// or any other instance sharing the database, is used
+		err := db.loadFromDatabase()
+		if err != nil {
+			return nil, err
+		}
 
-		log.Info("Reading and annotating surfaceType predictions ...")
-
-		persistedRoads := []persistence.Road{}
-		result := db.impl.Preload("RoadSegments").Preload("RoadSegments.SurfaceTypePredictions").Find(&persistedRoads)
-		if result.Error != nil {
-			log.Errorf("Restore of surfaceType predictions failed with error %s", result.Error.Error())
+		if db.GetRoadCount() == 0 {
+			log.Warn("No road network found in database. Start with a segments file to seed it.")
 		} else {
-			for _, r := range persistedRoads {
-				for _, rs := range r.RoadSegments {
-					if len(rs.SurfaceTypePredictions) > 0 {
-						mostRecentPrediction := rs.SurfaceTypePredictions[0]
-
-						for _, stp := range rs.SurfaceTypePredictions {
-							if stp.Timestamp.After(mostRecentPrediction.Timestamp) {
-								mostRecentPrediction = stp
-							}
-						}
-
-						log.Infof("Annotating road segment %s: surface was %s with probability %f at %s",
-							rs.SegmentID, mostRecentPrediction.SurfaceType, mostRecentPrediction.Probability,
-							mostRecentPrediction.Timestamp.Format(time.RFC3339),
-						)
-
-						err = db.RoadSegmentSurfaceUpdated(
-							rs.SegmentID,
-							mostRecentPrediction.SurfaceType,
-							mostRecentPrediction.Probability,
-							mostRecentPrediction.Timestamp,
-						)
-						if err != nil {
-							log.Errorf("Failed to annotate road segment %s: %s", rs.SegmentID, err.Error())
-						}
+			log.Infof("Datastore loaded with %d roads.", db.GetRoadCount())
+		}
+	}
+
+	annotateSurfaceTypes(db.impl, db.RoadSegmentSurfaceUpdated)
+
+	return db, nil
+}
+
+func migrate(impl *gorm.DB) {
+	impl.AutoMigrate(&persistence.Road{}, &persistence.RoadSegment{}, &persistence.SurfaceTypePrediction{}, &persistence.RoadSurfaceObserved{}, &persistence.Subscription{}, &persistence.ServiceArea{}, &persistence.OutboxMessage{}, &persistence.FailedMessage{})
+}
+
+//annotateSurfaceTypes restores the fused surface type distribution of every segment. Segments
+//that have been updated before distributions were stored fall back to their most recent prediction.
+func annotateSurfaceTypes(impl *gorm.DB, surfaceUpdated func(segmentID string, update SurfaceUpdate) error) {
+	log.Info("Reading and annotating surfaceType predictions ...")
+
+	persistedRoads := []persistence.Road{}
+	result := impl.Preload("RoadSegments").Preload("RoadSegments.SurfaceTypePredictions").Find(&persistedRoads)
+	if result.Error != nil {
+		log.Errorf("Restore of surfaceType predictions failed with error %s", result.Error.Error())
+		return
+	}
+
+	for _, r := range persistedRoads {
+		for _, rs := range r.RoadSegments {
+			var update SurfaceUpdate
+
+			if rs.SurfaceModified != nil {
+				update = newSurfaceUpdateFromRow(rs)
+			} else if len(rs.SurfaceTypePredictions) > 0 {
+				mostRecentPrediction := rs.SurfaceTypePredictions[0]
+
+				for _, stp := range rs.SurfaceTypePredictions {
+					if stp.Timestamp.After(mostRecentPrediction.Timestamp) {
+						mostRecentPrediction = stp
 					}
 				}
+
+				update.Distribution = fusion.Distribution{mostRecentPrediction.SurfaceType: mostRecentPrediction.Probability}
+				update.Timestamp = mostRecentPrediction.Timestamp
+			} else {
+				continue
+			}
+
+			surfaceType, probability := update.Distribution.MostLikely()
+			log.Infof("Annotating road segment %s: surface was %s with probability %f at %s",
+				rs.SegmentID, surfaceType, probability, update.Timestamp.Format(time.RFC3339),
+			)
+
+			err := surfaceUpdated(rs.SegmentID, update)
+			if err != nil {
+				log.Errorf("Failed to annotate road segment %s: %s", rs.SegmentID, err.Error())
 			}
 		}
 	}
-
-	return db, nil
 }
 
+//AddRoad stores a road and its segments in the database and adds it to the datastore,
+//replacing any road with the same id
 func (db *myDB) AddRoad(road Road) error {
-	db.roads[road.ID()] = road
+	if err := db.persistRoads([]Road{road}, false); err != nil {
+		return err
+	}
+
+	db.addRoad(road)
+
 	return nil
 }
 
+func (db *myDB) addRoad(road Road) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if existing, ok := db.roads[road.ID()]; ok {
+		db.roadIndex.remove(existing.ID(), existing.BoundingBox())
+
+		for _, segment := range existing.allSegments() {
+			db.segmentIndex.remove(segment.ID(), segment.BoundingBox())
+			delete(db.segments, segment.ID())
+			delete(db.seg2road, segment.ID())
+		}
+	}
+
+	db.roads[road.ID()] = road
+	db.roadIndex.insert(road.ID(), road.BoundingBox())
+
+	for _, segment := range road.allSegments() {
+		db.segments[segment.ID()] = segment
+		db.segmentIndex.insert(segment.ID(), segment.BoundingBox())
+
+		// Add a mapping from segment ID to road ID
+		db.seg2road[segment.ID()] = road.ID()
+	}
+}
+
+func (db *myDB) GetAllRoads() ([]Road, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	roads := make([]Road, 0, len(db.roads))
+	for _, road := range db.roads {
+		roads = append(roads, road)
+	}
+
+	return roads, nil
+}
+
 func (db *myDB) GetRoadByID(id string) (Road, error) {
+	db.mu.RLock()
 	road, ok := db.roads[id]
+	db.mu.RUnlock()
+
 	if !ok {
-		return nil, fmt.Errorf("no road with id %s in datastore", id)
+		return nil, fmt.Errorf("no road with id %s in datastore: %w", id, ErrNotFound)
 	}
 
 	return road, nil
 }
 
 func (db *myDB) GetRoadBySegmentID(segmentID string) (Road, error) {
+	db.mu.RLock()
 	roadID, ok := db.seg2road[segmentID]
+	db.mu.RUnlock()
+
 	if !ok {
-		return nil, fmt.Errorf("no road mapping exists from segment %s", segmentID)
+		return nil, fmt.Errorf("no road mapping exists from segment %s: %w", segmentID, ErrNotFound)
 	}
 
 	return db.GetRoadByID(roadID)
 }
 
 func (db *myDB) GetRoadCount() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
 	return len(db.roads)
 }
 
@@ -584,11 +884,15 @@ func (db *myDB) GetRoadsNearPoint(lat, lon float64, maxDistance uint64) ([]Road,
 
 	pt := NewPoint(lat, lon)
 
-	for _, road := range db.roads {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	db.roadIndex.search(newRectangleAroundPoint(pt, maxDistance), func(id string) {
+		road := db.roads[id]
 		if road.IsWithinDistanceFromPoint(maxDistance, pt) {
 			roads = append(roads, road)
 		}
-	}
+	})
 
 	return roads, nil
 }
@@ -598,27 +902,110 @@ func (db *myDB) GetRoadsWithinRect(lat0, lon0, lat1, lon1 float64) ([]Road, erro
 
 	rect := NewRectangle(NewPoint(lat0, lon0), NewPoint(lat1, lon1))
 
-	for _, road := range db.roads {
+	db.mu.RLock()
+	db.roadIndex.search(rect, func(id string) {
+		road := db.roads[id]
 		if rect.Intersects(road.BoundingBox()) {
 			roads = append(roads, road)
 		}
-	}
+	})
+	db.mu.RUnlock()
 
 	log.Infof("Found %d roads within rect (%f,%f)(%f,%f).", len(roads), rect.northWest.lat, rect.northWest.lon, rect.southEast.lat, rect.southEast.lon)
 
 	return roads, nil
 }
 
+func (db *myDB) GetRoadsMatchingGeometry(relation geometry.Relation, g geometry.Geometry) ([]Road, error) {
+	roads := []Road{}
+
+	matches := func(road Road) bool {
+		lines := []geometry.LineString{}
+		for _, segment := range road.allSegments() {
+			lines = append(lines, newLineString(segment))
+		}
+		return geometry.Relates(relation, g, lines...)
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	candidates := map[string]bool{}
+	db.roadIndex.search(newRectangleFromGeometry(g), func(id string) {
+		candidates[id] = true
+	})
+
+	if relation == geometry.RelationDisjoint {
+		// Roads outside of the geometry's bounding box are disjoint by definition
+		for id, road := range db.roads {
+			if !candidates[id] || matches(road) {
+				roads = append(roads, road)
+			}
+		}
+		return roads, nil
+	}
+
+	for id := range candidates {
+		road := db.roads[id]
+		if matches(road) {
+			roads = append(roads, road)
+		}
+	}
+
+	return roads, nil
+}
+
+func (db *myDB) GetAllSegments() ([]RoadSegment, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	segments := make([]RoadSegment, 0, len(db.segments))
+	for _, segment := range db.segments {
+		segments = append(segments, segment)
+	}
+
+	return segments, nil
+}
+
 func (db *myDB) GetRoadSegmentByID(id string) (RoadSegment, error) {
+	db.mu.RLock()
+	segment, ok := db.segments[id]
+	db.mu.RUnlock()
 
-	for idx := range db.roads {
-		segment, err := db.roads[idx].GetSegment(id)
-		if err == nil {
-			return segment, nil
+	if !ok {
+		return nil, fmt.Errorf("unable to find RoadSegment with id %s: %w", id, ErrNotFound)
+	}
+
+	return segment, nil
+}
+
+//GetNearestSegment returns the segment that is closest to a point, or ErrNotFound if no
+//segment is within maxDistance meters from it
+func (db *myDB) GetNearestSegment(lat, lon float64, maxDistance uint64) (RoadSegment, error) {
+	segments, err := db.GetSegmentsNearPoint(lat, lon, maxDistance)
+	if err != nil {
+		return nil, err
+	}
+
+	return nearestSegment(segments, NewPoint(lat, lon))
+}
+
+func nearestSegment(segments []RoadSegment, pt Point) (RoadSegment, error) {
+	var nearest RoadSegment
+	nearestDistance := math.Inf(1)
+
+	for _, segment := range segments {
+		if distance := segment.DistanceFromPoint(pt); distance < nearestDistance ||
+			(distance == nearestDistance && segment.ID() < nearest.ID()) {
+			nearest, nearestDistance = segment, distance
 		}
 	}
 
-	return nil, fmt.Errorf("unable to find RoadSegment with id %s", id)
+	if nearest == nil {
+		return nil, ErrNotFound
+	}
+
+	return nearest, nil
 }
 
 func (db *myDB) GetSegmentsNearPoint(lat, lon float64, maxDistance uint64) ([]RoadSegment, error) {
@@ -626,14 +1013,15 @@ func (db *myDB) GetSegmentsNearPoint(lat, lon float64, maxDistance uint64) ([]Ro
 
 	pt := NewPoint(lat, lon)
 
-	for _, road := range db.roads {
-		if road.IsWithinDistanceFromPoint(maxDistance, pt) {
-			roadsegments, count := road.GetSegmentsWithinDistanceFromPoint(maxDistance, pt)
-			if count > 0 {
-				segments = append(segments, roadsegments...)
-			}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	db.segmentIndex.search(newRectangleAroundPoint(pt, maxDistance), func(id string) {
+		segment := db.segments[id]
+		if segment.IsWithinDistanceFromPoint(maxDistance, pt) {
+			segments = append(segments, segment)
 		}
-	}
+	})
 
 	return segments, nil
 }
@@ -643,58 +1031,140 @@ func (db *myDB) GetSegmentsWithinRect(lat0, lon0, lat1, lon1 float64) ([]RoadSeg
 
 	rect := NewRectangle(NewPoint(lat0, lon0), NewPoint(lat1, lon1))
 
-	for _, road := range db.roads {
-		if rect.Intersects(road.BoundingBox()) {
-			roadsegs, count := road.GetSegmentsWithinRect(rect)
-			if count > 0 {
-				segments = append(segments, roadsegs...)
-			}
+	db.mu.RLock()
+	db.segmentIndex.search(rect, func(id string) {
+		segment := db.segments[id]
+		if segment.BoundingBox().Intersects(rect) {
+			segments = append(segments, segment)
 		}
-	}
+	})
+	db.mu.RUnlock()
 
 	log.Infof("Found %d segments within rect (%f,%f)(%f,%f).", len(segments), rect.northWest.lat, rect.northWest.lon, rect.southEast.lat, rect.southEast.lon)
 
 	return segments, nil
 }
 
-func (db *myDB) RoadSegmentSurfaceUpdated(segmentID, surfaceType string, probability float64, timestamp time.Time) error {
+func (db *myDB) GetSegmentsMatchingGeometry(relation geometry.Relation, g geometry.Geometry) ([]RoadSegment, error) {
+	segments := []RoadSegment{}
 
-	for idx := range db.roads {
-		segment, err := db.roads[idx].GetSegment(segmentID)
-		if err == nil {
-			segment.setSurfaceType(surfaceType, probability)
-			segment.setLastModified(&timestamp)
-			db.roads[idx].setLastModified(&timestamp)
-			return nil
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	candidates := map[string]bool{}
+	db.segmentIndex.search(newRectangleFromGeometry(g), func(id string) {
+		candidates[id] = true
+	})
+
+	if relation == geometry.RelationDisjoint {
+		// Segments outside of the geometry's bounding box are disjoint by definition
+		for id, segment := range db.segments {
+			if !candidates[id] || geometry.Relates(relation, g, newLineString(segment)) {
+				segments = append(segments, segment)
+			}
+		}
+		return segments, nil
+	}
+
+	for id := range candidates {
+		segment := db.segments[id]
+		if geometry.Relates(relation, g, newLineString(segment)) {
+			segments = append(segments, segment)
 		}
 	}
 
-	return fmt.Errorf("unable to update non existing RoadSegment %s", segmentID)
+	return segments, nil
 }
 
-func (db *myDB) CreateRoadSurfaceObserved(src *diwise.RoadSurfaceObserved) (*persistence.RoadSurfaceObserved, error) {
+//RoadSegmentSurfaceUpdated replaces the distribution over surface types of a segment, unless
+//the segment already has the same or a more recent surface
+func (db *myDB) RoadSegmentSurfaceUpdated(segmentID string, update SurfaceUpdate) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	segment, ok := db.segments[segmentID]
+	if !ok {
+		return fmt.Errorf("unable to update non existing RoadSegment %s", segmentID)
+	}
+
+	if segment.isNewerThan(update) {
+		log.Debugf("Ignoring stale or duplicate surface update %d of road segment %s", update.Sequence, segmentID)
+		return nil
+	}
+
+	// Replace the segment and its road with updated copies, so that readers holding on
+	// to the old versions never see a partially applied update
+	segment = segment.withSurfaceUpdate(update)
+	db.segments[segmentID] = segment
+
+	if road, ok := db.roads[db.seg2road[segmentID]]; ok {
+		db.roads[road.ID()] = road.withUpdatedSegment(segment)
+	}
+
+	return nil
+}
 
-	err := validateSurfaceType(src.SurfaceType.Value)
+//CreateRoadSurfaceObserved stores an observation, together with a reference to the segment
+//it has been matched to, if any. The surface type is expected to have been validated
+//against the vocabulary by the caller.
+func (db *myDB) CreateRoadSurfaceObserved(src *diwise.RoadSurfaceObserved, segmentID string) (*persistence.RoadSurfaceObserved, error) {
+	rows, err := db.CreateRoadSurfacesObserved([]*diwise.RoadSurfaceObserved{src}, []string{segmentID})
 	if err != nil {
 		return nil, err
 	}
 
-	if src.SurfaceType.Probability <= 0 || src.SurfaceType.Probability > 1 {
-		return nil, fmt.Errorf("probability %f is not within acceptable range: (0, 1.0]", src.SurfaceType.Probability)
+	return &rows[0], nil
+}
+
+//CreateRoadSurfacesObserved stores a batch of observations in a single transaction, each
+//matched to the segment with the same index in segmentIDs or to no segment if that id is
+//empty. Either every observation is stored or none of them, and an ObservationExistsError
+//with the id of the first observation that already exists is returned if any of them does.
+func (db *myDB) CreateRoadSurfacesObserved(observations []*diwise.RoadSurfaceObserved, segmentIDs []string) ([]persistence.RoadSurfaceObserved, error) {
+	if len(observations) != len(segmentIDs) {
+		return nil, fmt.Errorf("expected a segment id for each of the %d observations, but got %d", len(observations), len(segmentIDs))
 	}
 
-	lon := src.Location.Value.Coordinates[0]
-	lat := src.Location.Value.Coordinates[1]
+	rows := make([]persistence.RoadSurfaceObserved, 0, len(observations))
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		for idx, src := range observations {
+			rso, err := newRoadSurfaceObservedRow(tx, src, segmentIDs[idx])
+			if err != nil {
+				return err
+			}
+
+			result := tx.Create(rso)
+			if result.Error != nil {
+				if isUniqueViolation(result.Error) {
+					return &ObservationExistsError{ID: src.ID}
+				}
+				return result.Error
+			}
 
-	if lon < 15.516210 || lon > 17.975816 {
-		return nil, fmt.Errorf("longitude %f is out of bounds: [15.516210, 17.975816]", lon)
+			rows = append(rows, *rso)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
-	if lat < 62.042301 || lat > 62.648987 {
-		return nil, fmt.Errorf("latitude %f is out of bounds: [62.042301, 62.648987]", lat)
+	return rows, nil
+}
+
+func newRoadSurfaceObservedRow(tx *gorm.DB, src *diwise.RoadSurfaceObserved, segmentID string) (*persistence.RoadSurfaceObserved, error) {
+	if src.SurfaceType.Probability <= 0 || src.SurfaceType.Probability > 1 {
+		return nil, fmt.Errorf("probability %f is not within acceptable range: (0, 1.0]", src.SurfaceType.Probability)
 	}
 
+	lon := src.Location.Value.Coordinates[0]
+	lat := src.Location.Value.Coordinates[1]
+
 	rso := &persistence.RoadSurfaceObserved{
+		SegmentID:             segmentID,
 		RoadSurfaceObservedID: src.ID,
 		SurfaceType:           src.SurfaceType.Value,
 		Probability:           src.SurfaceType.Probability,
@@ -703,14 +1173,54 @@ func (db *myDB) CreateRoadSurfaceObserved(src *diwise.RoadSurfaceObserved) (*per
 		Timestamp:             time.Now().UTC(),
 	}
 
-	result := db.impl.Create(rso)
-	if result.RowsAffected != 1 {
+	if segmentID != "" {
+		segment := &persistence.RoadSegment{}
+		result := tx.Where(&persistence.RoadSegment{SegmentID: segmentID}).Limit(1).Find(segment)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return nil, fmt.Errorf("unable to match observation to non existing RoadSegment %s", segmentID)
+		}
+
+		rso.RoadSegmentID = segment.ID
+	}
+
+	return rso, nil
+}
+
+func (db *myDB) GetRoadSurfaceObservedByID(id string) (*persistence.RoadSurfaceObserved, error) {
+	rso := &persistence.RoadSurfaceObserved{}
+	result := db.impl.Where(&persistence.RoadSurfaceObserved{RoadSurfaceObservedID: id}).Limit(1).Find(rso)
+	if result.Error != nil {
 		return nil, result.Error
 	}
 
+	if result.RowsAffected == 0 {
+		return nil, ErrNotFound
+	}
+
 	return rso, nil
 }
 
+//DeleteRoadSurfacesObserved deletes a batch of observations in a single transaction. Nothing
+//is deleted and ErrNotFound is returned if any of the observations does not exist.
+func (db *myDB) DeleteRoadSurfacesObserved(ids []string) error {
+	return db.impl.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("road_surface_observed_id IN ?", ids).Delete(&persistence.RoadSurfaceObserved{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected != int64(len(ids)) {
+			return ErrNotFound
+		}
+
+		return nil
+	})
+}
+
 func (db *myDB) GetRoadSurfacesObserved() ([]persistence.RoadSurfaceObserved, error) {
 	rso := []persistence.RoadSurfaceObserved{}
 	result := db.impl.Find(&rso)
@@ -721,65 +1231,400 @@ func (db *myDB) GetRoadSurfacesObserved() ([]persistence.RoadSurfaceObserved, er
 	return rso, nil
 }
 
-func (db *myDB) UpdateRoadSegmentSurface(segmentID, surfaceType string, probability float64, timestamp time.Time) error {
-	// Find the segment to be updated in the database
-	segment := &persistence.RoadSegment{SegmentID: segmentID}
-	result := db.impl.Where(segment).First(segment)
+//GetRoadSurfacesObservedBetween returns the observations with the supplied ids, or every
+//observation if no ids are supplied, that were made within a time span, ordered by time
+func (db *myDB) GetRoadSurfacesObservedBetween(ids []string, from, to *time.Time) ([]persistence.RoadSurfaceObserved, error) {
+	rso := []persistence.RoadSurfaceObserved{}
 
-	if result.RowsAffected == 0 {
-		log.Infof("No segment with id %s found in database. Adding it before surface can be updated.", segmentID)
+	tx := withinTimeSpan(db.impl, from, to)
+	if len(ids) > 0 {
+		tx = tx.Where("road_surface_observed_id IN ?", ids)
+	}
 
-		memRoad, err := db.GetRoadBySegmentID(segmentID)
-		if err != nil {
-			return err
+	result := tx.Order("timestamp").Find(&rso)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return rso, nil
+}
+
+//GetSurfaceTypePredictions returns the predictions for a set of segments, or for all
+//segments if no identities are supplied, ordered by time and mapped by segment id
+func (db *myDB) GetSurfaceTypePredictions(segmentIDs []string, from, to *time.Time) (map[string][]persistence.SurfaceTypePrediction, error) {
+	segments := []persistence.RoadSegment{}
+
+	tx := db.impl.Preload("SurfaceTypePredictions", func(tx *gorm.DB) *gorm.DB {
+		return withinTimeSpan(tx, from, to).Order("timestamp")
+	})
+
+	if len(segmentIDs) > 0 {
+		tx = tx.Where("segment_id IN ?", segmentIDs)
+	}
+
+	result := tx.Find(&segments)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	predictions := map[string][]persistence.SurfaceTypePrediction{}
+	for _, segment := range segments {
+		if len(segment.SurfaceTypePredictions) > 0 {
+			predictions[segment.SegmentID] = segment.SurfaceTypePredictions
 		}
+	}
 
-		dbRoad := &persistence.Road{RID: memRoad.ID()}
+	return predictions, nil
+}
 
-		for _, memSegID := range memRoad.GetSegmentIdentities() {
-			_, err := db.GetRoadSegmentByID(memSegID)
-			if err != nil {
-				return err
-			}
+//withinTimeSpan limits a query to rows with a timestamp that is equal to or after from,
+//and before to. Either bound may be nil to leave that end of the span open.
+func withinTimeSpan(tx *gorm.DB, from, to *time.Time) *gorm.DB {
+	if from != nil {
+		tx = tx.Where("timestamp >= ?", from.UTC())
+	}
+
+	if to != nil {
+		tx = tx.Where("timestamp < ?", to.UTC())
+	}
 
-			dbRoad.RoadSegments = append(dbRoad.RoadSegments, persistence.RoadSegment{SegmentID: memSegID})
+	return tx
+}
+
+//UpdateRoadSegmentSurface stores a new prediction of the surface type of a segment, and
+//fuses it with the other recent predictions of the segment. The fused distribution is
+//stored with the segment and returned, together with the time of the most recent
+//prediction and the next sequence number of the segment. The event that passes the update
+//on to every replica is stored in the outbox in the same transaction, so that it is only
+//published if the update is stored. ErrDuplicate is returned if a prediction with the same
+//message id has already been stored, and ErrRetracted if the prediction was made from an
+//observation that has since been deleted.
+func (db *myDB) UpdateRoadSegmentSurface(segmentID, messageID, observationID string, prediction fusion.Prediction, model fusion.Model) (SurfaceUpdate, error) {
+	update := SurfaceUpdate{}
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		// Find the segment to be updated in the database, and lock it until the update is stored
+		segment := &persistence.RoadSegment{}
+		result := findSegmentForUpdate(tx, segmentID, segment)
+		if result.Error != nil {
+			return result.Error
 		}
 
-		result = db.impl.Create(dbRoad)
 		if result.RowsAffected == 0 {
+			return fmt.Errorf("unable to update non existing RoadSegment %s", segmentID)
+		}
+
+		if observationID != "" {
+			var count int64
+			result = tx.Model(&persistence.RoadSurfaceObserved{}).Where("road_surface_observed_id = ?", observationID).Count(&count)
+			if result.Error != nil {
+				return result.Error
+			}
+
+			if count == 0 {
+				return fmt.Errorf("the observation %s of road segment %s has been deleted: %w", observationID, segmentID, ErrRetracted)
+			}
+		}
+
+		stp := &persistence.SurfaceTypePrediction{
+			RoadSegmentID: segment.ID,
+			SurfaceType:   prediction.SurfaceType,
+			Probability:   prediction.Probability,
+			Source:        prediction.Source,
+			MessageID:     messageID,
+			ObservationID: observationID,
+			Timestamp:     prediction.Timestamp,
+		}
+		result = tx.Create(stp)
+		if result.Error != nil {
+			if messageID != "" && isUniqueViolation(result.Error) {
+				return fmt.Errorf("the update %s of road segment %s has already been applied: %w", messageID, segmentID, ErrDuplicate)
+			}
+			return result.Error
+		}
+
+		// Predictions that are older than the window are not fused, but the window is
+		// relative to the most recent prediction which may be newer than this one
+		recent := []persistence.SurfaceTypePrediction{}
+		query := tx.Where("road_segment_id = ?", segment.ID)
+		if model.Window > 0 {
+			query = query.Where("timestamp >= ?", prediction.Timestamp.Add(-model.Window))
+		}
+
+		result = query.Find(&recent)
+		if result.Error != nil {
 			return result.Error
 		}
 
-		_ = db.impl.Where(segment).First(segment)
+		update.Distribution, update.Timestamp = model.Fuse(newPredictionsFromRows(recent))
+		update.Sequence = segment.SurfaceSequence + 1
+
+		return storeSurfaceUpdate(tx, segment, update)
+	})
+
+	if err != nil {
+		return SurfaceUpdate{}, err
 	}
 
-	stp := &persistence.SurfaceTypePrediction{
-		RoadSegmentID: segment.ID,
-		SurfaceType:   surfaceType,
-		Probability:   probability,
-		Timestamp:     timestamp,
+	return update, nil
+}
+
+//RetractRoadSegmentSurface deletes predictions of the surface type of a segment, either those
+//made from an observation or those with the given ids, and fuses the predictions that remain
+//in the window of the most recent of them. The fused distribution is stored with the segment
+//together with its event, as by UpdateRoadSegmentSurface, and returned together with whether
+//any prediction was retracted. The segment is left as it is if there was nothing to retract.
+func (db *myDB) RetractRoadSegmentSurface(segmentID, observationID string, predictionIDs []uint, model fusion.Model) (SurfaceUpdate, bool, error) {
+	update := SurfaceUpdate{}
+	retracted := false
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		segment := &persistence.RoadSegment{}
+		result := findSegmentForUpdate(tx, segmentID, segment)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("unable to retract the surface of non existing RoadSegment %s", segmentID)
+		}
+
+		if observationID == "" && len(predictionIDs) == 0 {
+			return nil
+		}
+
+		query := tx.Where("road_segment_id = ?", segment.ID)
+		if observationID != "" {
+			query = query.Where("observation_id = ?", observationID)
+		} else {
+			query = query.Where("id IN ?", predictionIDs)
+		}
+
+		result = query.Delete(&persistence.SurfaceTypePrediction{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		retracted = result.RowsAffected > 0
+		if !retracted {
+			return nil
+		}
+
+		latest := &persistence.SurfaceTypePrediction{}
+		result = tx.Where("road_segment_id = ?", segment.ID).Order("timestamp desc").Limit(1).Find(latest)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		remaining := []persistence.SurfaceTypePrediction{}
+		if result.RowsAffected > 0 {
+			query = tx.Where("road_segment_id = ?", segment.ID)
+			if model.Window > 0 {
+				query = query.Where("timestamp >= ?", latest.Timestamp.Add(-model.Window))
+			}
+
+			result = query.Find(&remaining)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		update.Distribution, update.Timestamp = model.Fuse(newPredictionsFromRows(remaining))
+		update.Sequence = segment.SurfaceSequence + 1
+
+		// A segment without any remaining predictions has no surface type, as of the
+		// time that the last of them was retracted
+		if len(remaining) == 0 {
+			update.Timestamp = time.Now().UTC()
+		}
+
+		return storeSurfaceUpdate(tx, segment, update)
+	})
+
+	if err != nil {
+		return SurfaceUpdate{}, false, err
 	}
-	result = db.impl.Create(stp)
 
-	return result.Error
+	return update, retracted, nil
 }
 
-func validateSurfaceType(surfaceType string) error {
+//ExpireRoadSegmentSurface applies the decay rules to the stored surface of a segment, and
+//stores what remains if its most likely surface type has changed. The update is returned
+//together with whether it was stored, in which case its event has been added to the outbox.
+//The segment is locked while its surface is read and written, so when replicas expire the
+//same segment at the same time, those that come later see the change that was stored first.
+func (db *myDB) ExpireRoadSegmentSurface(segmentID string, rules *decay.Rules, now time.Time) (SurfaceUpdate, bool, error) {
+	update := SurfaceUpdate{}
+	flipped := false
+
+	err := db.impl.Transaction(func(tx *gorm.DB) error {
+		segment := &persistence.RoadSegment{}
+		result := findSegmentForUpdate(tx, segmentID, segment)
+		if result.Error != nil {
+			return result.Error
+		}
 
-	knownTypes := []string{"grass", "gravel", "snow", "tarmac"}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("unable to expire the surface of non existing RoadSegment %s", segmentID)
+		}
 
-	for _, kt := range knownTypes {
-		if strings.Compare(surfaceType, kt) == 0 {
+		if segment.SurfaceModified == nil {
 			return nil
 		}
+
+		// The surface decays from when it was last confirmed, and not from when it last decayed
+		current := newSurfaceUpdateFromRow(*segment)
+
+		attributes := map[string]string{}
+		if segment.Attributes != "" {
+			if err := json.Unmarshal([]byte(segment.Attributes), &attributes); err != nil {
+				return err
+			}
+		}
+
+		update.Distribution, flipped = rules.HasFlipped(current.Distribution, current.Timestamp, current.ConfirmedAt(), attributes, now)
+		if !flipped {
+			return nil
+		}
+
+		update.Timestamp = now
+		update.Confirmed = current.ConfirmedAt()
+		update.Sequence = segment.SurfaceSequence + 1
+
+		return storeSurfaceUpdate(tx, segment, update)
+	})
+
+	if errors.Is(err, errSurfaceChanged) {
+		return SurfaceUpdate{}, false, nil
+	} else if err != nil {
+		return SurfaceUpdate{}, false, err
 	}
 
-	return fmt.Errorf("surfaceType does not match any known types")
+	return update, flipped, nil
 }
 
 type myDB struct {
 	impl *gorm.DB
 
+	// mu guards the maps and indexes below, but not the roads and segments in them
+	// since those are never modified after they have been added
+	mu sync.RWMutex
+
 	roads    map[string]Road
 	seg2road map[string]string
+	segments map[string]RoadSegment
+
+	roadIndex    *spatialIndex
+	segmentIndex *spatialIndex
+}
+
+func (db *myDB) CreateSubscription(subscription *persistence.Subscription) error {
+	result := db.impl.Create(subscription)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	return nil
+}
+
+func (db *myDB) GetSubscriptionByID(id string) (*persistence.Subscription, error) {
+	subscription := &persistence.Subscription{}
+	result := db.impl.Where(&persistence.Subscription{SubscriptionID: id}).Limit(1).Find(subscription)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, ErrNotFound
+	}
+
+	return subscription, nil
+}
+
+func (db *myDB) GetSubscriptions() ([]persistence.Subscription, error) {
+	subscriptions := []persistence.Subscription{}
+	result := db.impl.Order("id").Find(&subscriptions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return subscriptions, nil
+}
+
+func (db *myDB) UpdateSubscription(subscription *persistence.Subscription) error {
+	result := db.impl.Model(&persistence.Subscription{}).
+		Where(&persistence.Subscription{SubscriptionID: subscription.SubscriptionID}).
+		Updates(map[string]interface{}{"body": subscription.Body, "is_active": subscription.IsActive})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *myDB) DeleteSubscription(id string) error {
+	result := db.impl.Unscoped().Where(&persistence.Subscription{SubscriptionID: id}).Delete(&persistence.Subscription{})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//SubscriptionNotified records the outcome of an attempt to deliver a notification
+func (db *myDB) SubscriptionNotified(id string, success bool, timestamp time.Time) error {
+	timestamp = timestamp.UTC()
+
+	updates := map[string]interface{}{
+		"last_notification": timestamp,
+		"times_sent":        gorm.Expr("times_sent + 1"),
+	}
+
+	if success {
+		updates["last_success"] = timestamp
+	} else {
+		updates["last_failure"] = timestamp
+	}
+
+	result := db.impl.Model(&persistence.Subscription{}).
+		Where(&persistence.Subscription{SubscriptionID: id}).
+		Updates(updates)
+
+	return result.Error
+}
+
+//GetServiceAreas returns the areas that make up the stored service area, ordered by name
+func (db *myDB) GetServiceAreas() ([]persistence.ServiceArea, error) {
+	areas := []persistence.ServiceArea{}
+	result := db.impl.Order("name").Find(&areas)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return areas, nil
+}
+
+//ReplaceServiceAreas replaces the stored service area with a new set of areas
+func (db *myDB) ReplaceServiceAreas(areas []persistence.ServiceArea) error {
+	return db.impl.Transaction(func(tx *gorm.DB) error {
+		// Delete permanently, so that the unique names can be reused
+		result := tx.Unscoped().Where("1 = 1").Delete(&persistence.ServiceArea{})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if len(areas) == 0 {
+			return nil
+		}
+
+		return tx.Create(&areas).Error
+	})
 }
@@ -1,14 +1,23 @@
 package database_test
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	db "github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/decay"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fusion"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/surfacetype"
+	diwise "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/diwise"
 	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 )
 
 func TestMain(m *testing.M) {
@@ -84,11 +93,11 @@ func TestBoundingBoxCreation(t *testing.T) {
 func TestUpdateRoadSegmentSurface(t *testing.T) {
 	segmentID := "21277:153930"
 	seedData := fmt.Sprintf("%s;%s;62.389109;17.310863;62.389084;17.310852\n", segmentID, segmentID)
-	db, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
 
-	db.RoadSegmentSurfaceUpdated(segmentID, "snow", 75.0, time.Now())
+	datastore.RoadSegmentSurfaceUpdated(segmentID, db.SurfaceUpdate{Distribution: fusion.Distribution{"snow": 75.0}, Timestamp: time.Now()})
 
-	seg, _ := db.GetRoadSegmentByID(segmentID)
+	seg, _ := datastore.GetRoadSegmentByID(segmentID)
 	surfaceType, probability := seg.SurfaceType()
 
 	if surfaceType != "snow" || probability != 75.0 || seg.DateModified() == nil {
@@ -101,15 +110,534 @@ func TestConnectToSQLite(t *testing.T) {
 	seedData := fmt.Sprintf("%s;%s;62.389109;17.310863;62.389084;17.310852\n", segmentID, segmentID)
 	db, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
 
-	err := db.UpdateRoadSegmentSurface(segmentID, "snow", 75.0, time.Now())
+	_, err := db.UpdateRoadSegmentSurface(segmentID, "", "", fusion.Prediction{SurfaceType: "snow", Probability: 75.0, Timestamp: time.Now()}, fusion.DefaultModel())
 
 	if err != nil {
 		t.Errorf("Failed to update road segment surface type in database. %s", err.Error())
 	}
 
-	err = db.UpdateRoadSegmentSurface(segmentID, "tarmac", 85.0, time.Now())
+	_, err = db.UpdateRoadSegmentSurface(segmentID, "", "", fusion.Prediction{SurfaceType: "tarmac", Probability: 85.0, Timestamp: time.Now()}, fusion.DefaultModel())
 
 	if err != nil {
 		t.Errorf("Failed to update road segment surface type a second time in database. %s", err.Error())
 	}
 }
+
+func TestGetRoadSegmentsWithinRectThatSpansSeveralIndexCells(t *testing.T) {
+	seedData := "1;1:1;62.30;17.20;62.45;17.45\n" +
+		"2;2:1;62.389109;17.310863;62.389084;17.310852\n" +
+		"3;3:1;63.389109;17.310863;63.389084;17.310852\n"
+
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+
+	segments, _ := datastore.GetSegmentsWithinRect(62.38, 17.30, 62.40, 17.32)
+	if len(segments) != 2 {
+		t.Errorf("Unexpected number of segments within rect. %d != 2", len(segments))
+	}
+
+	roads, _ := datastore.GetRoadsWithinRect(62.0, 17.0, 62.5, 17.5)
+	if len(roads) != 2 {
+		t.Errorf("Unexpected number of roads within rect. %d != 2", len(roads))
+	}
+}
+
+func TestGetRoadSegmentByIDAcrossRoads(t *testing.T) {
+	seedData := "1;1:1;62.389109;17.310863;62.389084;17.310852\n" +
+		"1;1:2;62.389084;17.310852;62.389073;17.310854\n" +
+		"2;2:1;62.389109;17.320863;62.389084;17.320852\n"
+
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+
+	segment, err := datastore.GetRoadSegmentByID("2:1")
+	if err != nil || segment.RoadID() != "2" {
+		t.Error("Unable to find expected segment from id.")
+	}
+
+	road, err := datastore.GetRoadBySegmentID("1:2")
+	if err != nil || road.ID() != "1" {
+		t.Error("Unable to find expected road from segment id.")
+	}
+
+	if _, err = datastore.GetRoadSegmentByID("3:1"); err == nil {
+		t.Error("Expected an error when looking up a non existing segment.")
+	}
+}
+
+var benchmarkDatastores = map[int]db.Datastore{}
+
+//newBenchmarkDatastore seeds a datastore with a grid of short road segments, ten per road,
+//spread out over an area about the size of a county
+func newBenchmarkDatastore(b *testing.B, numberOfSegments int) db.Datastore {
+	if datastore, ok := benchmarkDatastores[numberOfSegments]; ok {
+		return datastore
+	}
+
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(log.InfoLevel)
+
+	const segmentsPerRoad = 10
+	const segmentLength = 0.0005
+
+	roadsPerRow := int(math.Sqrt(float64(numberOfSegments / segmentsPerRoad)))
+	spacing := 2.0 / float64(roadsPerRow)
+
+	sb := strings.Builder{}
+	for i := 0; i < numberOfSegments; i++ {
+		roadIdx := i / segmentsPerRoad
+		lat := 62.0 + float64(roadIdx/roadsPerRow)*spacing
+		lon := 16.0 + float64(roadIdx%roadsPerRow)*spacing + float64(i%segmentsPerRoad)*segmentLength
+
+		fmt.Fprintf(&sb, "%d;%d:%d;%f;%f;%f;%f\n", roadIdx, roadIdx, i, lat, lon, lat+segmentLength/2, lon+segmentLength)
+	}
+
+	datastore, err := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(sb.String()))
+	if err != nil {
+		b.Fatalf("Failed to seed benchmark datastore: %s", err.Error())
+	}
+
+	benchmarkDatastores[numberOfSegments] = datastore
+	b.ResetTimer()
+
+	return datastore
+}
+
+func benchmarkGetSegmentsNearPoint(b *testing.B, numberOfSegments int) {
+	datastore := newBenchmarkDatastore(b, numberOfSegments)
+
+	for i := 0; i < b.N; i++ {
+		datastore.GetSegmentsNearPoint(62.5+float64(i%100)*0.01, 16.5, 100)
+	}
+}
+
+func benchmarkGetSegmentsWithinRect(b *testing.B, numberOfSegments int) {
+	datastore := newBenchmarkDatastore(b, numberOfSegments)
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(log.InfoLevel)
+
+	for i := 0; i < b.N; i++ {
+		lat := 62.5 + float64(i%100)*0.01
+		datastore.GetSegmentsWithinRect(lat, 16.5, lat+0.01, 16.52)
+	}
+}
+
+func benchmarkGetRoadSegmentByID(b *testing.B, numberOfSegments int) {
+	datastore := newBenchmarkDatastore(b, numberOfSegments)
+
+	for i := 0; i < b.N; i++ {
+		segmentIdx := (i * 7919) % numberOfSegments
+		datastore.GetRoadSegmentByID(fmt.Sprintf("%d:%d", segmentIdx/10, segmentIdx))
+	}
+}
+
+func BenchmarkGetSegmentsNearPoint10k(b *testing.B)  { benchmarkGetSegmentsNearPoint(b, 10000) }
+func BenchmarkGetSegmentsNearPoint100k(b *testing.B) { benchmarkGetSegmentsNearPoint(b, 100000) }
+func BenchmarkGetSegmentsNearPoint1M(b *testing.B)   { benchmarkGetSegmentsNearPoint(b, 1000000) }
+
+func BenchmarkGetSegmentsWithinRect10k(b *testing.B)  { benchmarkGetSegmentsWithinRect(b, 10000) }
+func BenchmarkGetSegmentsWithinRect100k(b *testing.B) { benchmarkGetSegmentsWithinRect(b, 100000) }
+func BenchmarkGetSegmentsWithinRect1M(b *testing.B)   { benchmarkGetSegmentsWithinRect(b, 1000000) }
+
+func BenchmarkGetRoadSegmentByID10k(b *testing.B)  { benchmarkGetRoadSegmentByID(b, 10000) }
+func BenchmarkGetRoadSegmentByID100k(b *testing.B) { benchmarkGetRoadSegmentByID(b, 100000) }
+func BenchmarkGetRoadSegmentByID1M(b *testing.B)   { benchmarkGetRoadSegmentByID(b, 1000000) }
+
+func TestGetRoadSegmentNearPointIsAccurateAtHighLatitudes(t *testing.T) {
+	// A north-south segment at 62N, where 0.0005 degrees of longitude is ~26 m
+	seedData := "1;1:1;62.3880;17.3100;62.3890;17.3100\n"
+
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+
+	segments, _ := datastore.GetSegmentsNearPoint(62.3885, 17.3105, 30)
+	if len(segments) != 1 {
+		t.Error("Expected to find a segment 26 meters east of the point.")
+	}
+
+	segments, _ = datastore.GetSegmentsNearPoint(62.3885, 17.3107, 30)
+	if len(segments) != 0 {
+		t.Error("Did not expect to find a segment 37 meters east of the point.")
+	}
+
+	segments, _ = datastore.GetSegmentsNearPoint(62.3895, 17.3100, 50)
+	if len(segments) != 0 {
+		t.Error("Did not expect to find a segment 56 meters south of the point.")
+	}
+
+	segment, _ := datastore.GetRoadSegmentByID("1:1")
+	distance := segment.DistanceFromPoint(db.NewPoint(62.3885, 17.3105))
+	if math.Abs(distance-26.1) > 1.0 {
+		t.Errorf("Unexpected distance from point to segment. %f != 26.1", distance)
+	}
+}
+
+func TestConcurrentSurfaceUpdatesAndQueries(t *testing.T) {
+	seedData := "1;1:1;62.389109;17.310863;62.389084;17.310852\n" +
+		"1;1:2;62.389084;17.310852;62.389073;17.310854\n" +
+		"2;2:1;62.389109;17.320863;62.389084;17.320852\n"
+
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(log.InfoLevel)
+
+	// Every update pairs a surface type with a probability that we can verify, so that
+	// readers can detect if they ever see a half applied update
+	surfaceTypes := []string{"snow", "gravel", "tarmac", "grass"}
+	probabilityOf := func(surfaceType string) float64 {
+		for idx, st := range surfaceTypes {
+			if st == surfaceType {
+				return float64(idx+1) / 10.0
+			}
+		}
+		return 0
+	}
+
+	const iterations = 500
+	wg := sync.WaitGroup{}
+	start := time.Now()
+
+	for _, segmentID := range []string{"1:1", "1:2", "2:1"} {
+		wg.Add(1)
+		go func(segmentID string) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				st := surfaceTypes[i%len(surfaceTypes)]
+				datastore.RoadSegmentSurfaceUpdated(segmentID, db.SurfaceUpdate{Distribution: fusion.Distribution{st: probabilityOf(st)}, Timestamp: start.Add(time.Duration(i) * time.Second)})
+			}
+		}(segmentID)
+	}
+
+	errors := make(chan string, 10)
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				segments, _ := datastore.GetSegmentsWithinRect(62.38, 17.30, 62.40, 17.33)
+
+				sort.Slice(segments, func(i, j int) bool {
+					iTime, jTime := segments[i].DateModified(), segments[j].DateModified()
+					if iTime == nil || jTime == nil {
+						return iTime != nil
+					}
+					return iTime.After(*jTime)
+				})
+
+				for _, segment := range segments {
+					st, probability := segment.SurfaceType()
+					if st != "" && probability != probabilityOf(st) {
+						select {
+						case errors <- fmt.Sprintf("segment %s has surface %s with probability %f", segment.ID(), st, probability):
+						default:
+						}
+					}
+				}
+
+				road, err := datastore.GetRoadBySegmentID("1:1")
+				if err == nil {
+					road.GetSegmentsWithinRect(db.NewRectangle(db.NewPoint(62.38, 17.30), db.NewPoint(62.40, 17.33)))
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errors)
+
+	for err := range errors {
+		t.Error("Inconsistent read: " + err)
+	}
+
+	for _, segmentID := range []string{"1:1", "1:2", "2:1"} {
+		segment, _ := datastore.GetRoadSegmentByID(segmentID)
+		if !segment.DateModified().Equal(start.Add(time.Duration(iterations-1) * time.Second)) {
+			t.Errorf("Segment %s did not end up with the most recent modification time.", segmentID)
+		}
+	}
+}
+
+func TestSeedFromGeoJSON(t *testing.T) {
+	seedData := `{"type": "FeatureCollection", "features": [{
+		"type": "Feature",
+		"geometry": {"type": "LineString", "coordinates": [[17.310863, 62.389109], [17.310852, 62.389084]]},
+		"properties": {"segmentID": "153930", "roadID": "21277", "name": "Storgatan", "roadClass": "primary", "width": 7}
+	}]}`
+
+	datastore, err := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+	if err != nil {
+		t.Fatalf("Failed to seed datastore from GeoJSON: %s", err.Error())
+	}
+
+	road, err := datastore.GetRoadByID("21277")
+	if err != nil {
+		t.Fatalf("Unable to find expected road from id: %s", err.Error())
+	}
+
+	if road.Name() != "Storgatan" || road.RoadClass() != "primary" {
+		t.Errorf("Expected the road to be named after its segment, but got %s (%s)", road.Name(), road.RoadClass())
+	}
+
+	segment, _ := road.GetSegment("153930")
+	if segment == nil || segment.Attributes()["width"] != "7" {
+		t.Error("Expected the width property to be kept as an attribute of the segment.")
+	}
+}
+
+//sharedSQLiteConnector lets several datastores use the same in-memory database, the way
+//replicas of the service share one database
+func sharedSQLiteConnector(t *testing.T) db.ConnectorFunc {
+	impl, err := db.NewSQLiteConnector()()
+	if err != nil {
+		t.Fatalf("Failed to open database: %s", err.Error())
+	}
+
+	return func() (*gorm.DB, error) {
+		return impl, nil
+	}
+}
+
+func TestLoadRoadNetworkFromDatabase(t *testing.T) {
+	seedData := `{"type": "FeatureCollection", "features": [{
+		"type": "Feature",
+		"geometry": {"type": "LineString", "coordinates": [[17.310863, 62.389109], [17.310852, 62.389084], [17.310854, 62.389073]]},
+		"properties": {"segmentID": "153930", "roadID": "21277", "name": "Storgatan", "roadClass": "primary", "width": 7}
+	}, {
+		"type": "Feature",
+		"geometry": {"type": "LineString", "coordinates": [[17.310854, 62.389073], [17.310878, 62.389059]]},
+		"properties": {"segmentID": "153931", "roadID": "21277"}
+	}]}`
+
+	connector := sharedSQLiteConnector(t)
+
+	seeded, err := db.NewDatabaseConnection(connector, strings.NewReader(seedData))
+	if err != nil {
+		t.Fatalf("Failed to seed datastore: %s", err.Error())
+	}
+
+	timestamp := time.Date(2021, 2, 10, 12, 0, 0, 0, time.UTC)
+	if _, err = seeded.UpdateRoadSegmentSurface("153931", "", "", fusion.Prediction{SurfaceType: "snow", Probability: 0.8, Timestamp: timestamp}, fusion.DefaultModel()); err != nil {
+		t.Fatalf("Failed to update road segment surface: %s", err.Error())
+	}
+
+	replica, err := db.NewDatabaseConnection(connector, nil)
+	if err != nil {
+		t.Fatalf("Failed to load datastore from database: %s", err.Error())
+	}
+
+	road, err := replica.GetRoadByID("21277")
+	if err != nil {
+		t.Fatalf("Unable to find expected road from id: %s", err.Error())
+	}
+
+	if road.Name() != "Storgatan" || road.RoadClass() != "primary" || len(road.GetSegmentIdentities()) != 2 {
+		t.Errorf("Unexpected road loaded from database: %s (%s) with segments %v", road.Name(), road.RoadClass(), road.GetSegmentIdentities())
+	}
+
+	segment, _ := replica.GetRoadSegmentByID("153930")
+	if segment == nil || len(segment.Coordinates()) != 3 || segment.Coordinates()[2] != [2]float64{17.310854, 62.389073} {
+		t.Fatalf("Expected the geometry of the segment to be loaded from the database.")
+	}
+
+	if segment.Attributes()["width"] != "7" {
+		t.Error("Expected the attributes of the segment to be loaded from the database.")
+	}
+
+	segment, _ = replica.GetRoadSegmentByID("153931")
+	if surfaceType, _ := segment.SurfaceType(); surfaceType != "snow" || !segment.DateModified().Equal(timestamp) {
+		t.Errorf("Expected the loaded segment to be annotated with its most recent surface type, but got %s", surfaceType)
+	}
+}
+
+func TestReseedRemovesSegmentsFromStoredNetwork(t *testing.T) {
+	connector := sharedSQLiteConnector(t)
+
+	_, err := db.NewDatabaseConnection(connector, strings.NewReader(
+		"1;1:1;62.389109;17.310863;62.389084;17.310852\n"+
+			"2;2:1;62.389109;17.320863;62.389084;17.320852\n"))
+	if err != nil {
+		t.Fatalf("Failed to seed datastore: %s", err.Error())
+	}
+
+	_, err = db.NewDatabaseConnection(connector, strings.NewReader(
+		"1;1:1;62.389109;17.310863;62.389084;17.310852;62.389073;17.310854\n"))
+	if err != nil {
+		t.Fatalf("Failed to reseed datastore: %s", err.Error())
+	}
+
+	replica, _ := db.NewDatabaseConnection(connector, nil)
+
+	if replica.GetRoadCount() != 1 {
+		t.Errorf("Expected the removed road to be gone from the stored network, but found %d roads", replica.GetRoadCount())
+	}
+
+	segment, err := replica.GetRoadSegmentByID("1:1")
+	if err != nil || len(segment.Coordinates()) != 3 {
+		t.Error("Expected the updated geometry of the segment to be stored.")
+	}
+
+	if _, err = replica.UpdateRoadSegmentSurface("2:1", "", "", fusion.Prediction{SurfaceType: "snow", Probability: 0.8, Timestamp: time.Now()}, fusion.DefaultModel()); err == nil {
+		t.Error("Expected updating the surface of a removed segment to fail.")
+	}
+}
+
+func TestUpdateSurfaceOfUnknownSegmentFails(t *testing.T) {
+	seedData := "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n"
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+
+	_, err := datastore.UpdateRoadSegmentSurface("21277:999999", "", "", fusion.Prediction{SurfaceType: "snow", Probability: 0.8, Timestamp: time.Now()}, fusion.DefaultModel())
+	if err == nil {
+		t.Error("Expected updating the surface of an unknown segment to fail.")
+	}
+}
+
+func TestRedeliveredSurfaceUpdateIsDropped(t *testing.T) {
+	seedData := "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n"
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+
+	prediction := fusion.Prediction{SurfaceType: "snow", Probability: 0.8, Timestamp: time.Now()}
+
+	update, err := datastore.UpdateRoadSegmentSurface("21277:153930", "message-1", "", prediction, fusion.DefaultModel())
+	if err != nil || update.Sequence != 1 {
+		t.Fatalf("Expected the first update to be applied with sequence 1, but got %d (%v).", update.Sequence, err)
+	}
+
+	_, err = datastore.UpdateRoadSegmentSurface("21277:153930", "message-1", "", prediction, fusion.DefaultModel())
+	if !errors.Is(err, db.ErrDuplicate) {
+		t.Errorf("Expected a redelivered update to be reported as a duplicate, but got %v.", err)
+	}
+
+	update, err = datastore.UpdateRoadSegmentSurface("21277:153930", "message-2", "", prediction, fusion.DefaultModel())
+	if err != nil || update.Sequence != 2 {
+		t.Errorf("Expected the next update to get sequence 2, but got %d (%v).", update.Sequence, err)
+	}
+}
+
+func TestUpdatesOfSegmentSurfaceAreFused(t *testing.T) {
+	seedData := "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n"
+	connector := sharedSQLiteConnector(t)
+
+	seeded, _ := db.NewDatabaseConnection(connector, strings.NewReader(seedData))
+	model := fusion.DefaultModel()
+
+	snowstorm := time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)
+	seeded.UpdateRoadSegmentSurface("21277:153930", "", "", fusion.Prediction{SurfaceType: "snow", Probability: 0.9, Source: fusion.SourceAPI, Timestamp: snowstorm}, model)
+
+	update, err := seeded.UpdateRoadSegmentSurface(
+		"21277:153930", "", "",
+		fusion.Prediction{SurfaceType: "tarmac", Probability: 0.2, Source: fusion.SourceObservation, Timestamp: snowstorm.Add(5 * time.Minute)},
+		model,
+	)
+	if err != nil {
+		t.Fatalf("Failed to update road segment surface: %s", err.Error())
+	}
+
+	distribution := update.Distribution
+	if surfaceType, _ := distribution.MostLikely(); surfaceType != "snow" || distribution["tarmac"] == 0 || !update.Timestamp.Equal(snowstorm.Add(5*time.Minute)) {
+		t.Errorf("Expected a low confidence prediction to not override snow, but got %v at %s.", distribution, update.Timestamp)
+	}
+
+	replica, err := db.NewDatabaseConnection(connector, nil)
+	if err != nil {
+		t.Fatalf("Failed to load datastore from database: %s", err.Error())
+	}
+
+	segment, _ := replica.GetRoadSegmentByID("21277:153930")
+	surfaceType, probability := segment.SurfaceType()
+	if surfaceType != "snow" || probability != distribution["snow"] || len(segment.SurfaceTypeDistribution()) != 2 {
+		t.Errorf("Expected the fused distribution to be restored from the database, but got %s (%f).", surfaceType, probability)
+	}
+}
+
+func TestExpiredSurfaceIsStoredOnce(t *testing.T) {
+	seedData := "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n"
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+	rules, _ := decay.Default(surfacetype.Default())
+
+	snowstorm := time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)
+	datastore.UpdateRoadSegmentSurface("21277:153930", "", "", fusion.Prediction{SurfaceType: "snow", Probability: 0.8, Timestamp: snowstorm}, fusion.DefaultModel())
+
+	if _, stored, err := datastore.ExpireRoadSegmentSurface("21277:153930", rules, snowstorm.Add(time.Hour)); err != nil || stored {
+		t.Errorf("Expected recent snow to not expire (%v).", err)
+	}
+
+	update, stored, err := datastore.ExpireRoadSegmentSurface("21277:153930", rules, snowstorm.Add(72*time.Hour))
+	if surfaceType, _ := update.Distribution.MostLikely(); err != nil || !stored || surfaceType != "unknown" {
+		t.Errorf("Expected old snow to expire into unknown, but got %v (%v).", update.Distribution, err)
+	}
+
+	if _, stored, _ = datastore.ExpireRoadSegmentSurface("21277:153930", rules, snowstorm.Add(73*time.Hour)); stored {
+		t.Error("Expected an expired surface to only be stored once.")
+	}
+}
+
+func TestSurfaceThatHasFlippedExpiresFromWhenItWasConfirmed(t *testing.T) {
+	seedData := "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n"
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+	rules, _ := decay.New(surfacetype.Default(), decay.Config{
+		Fallback:       "unknown",
+		MinProbability: 0.01,
+		Rules: []decay.Rule{
+			{SurfaceType: "ice", HalfLife: time.Hour},
+			{SurfaceType: "snow", TTL: 48 * time.Hour},
+		},
+	})
+
+	snowstorm := time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)
+	datastore.UpdateRoadSegmentSurface("21277:153930", "", "", fusion.Prediction{SurfaceType: "ice", Probability: 0.6, Timestamp: snowstorm}, fusion.DefaultModel())
+	datastore.UpdateRoadSegmentSurface("21277:153930", "", "", fusion.Prediction{SurfaceType: "snow", Probability: 0.4, Timestamp: snowstorm}, fusion.DefaultModel())
+
+	update, stored, err := datastore.ExpireRoadSegmentSurface("21277:153930", rules, snowstorm.Add(90*time.Minute))
+	if surfaceType, _ := update.Distribution.MostLikely(); err != nil || !stored || surfaceType != "snow" {
+		t.Fatalf("Expected the ice to fade into snow, but got %v (%v).", update.Distribution, err)
+	}
+
+	if !update.ConfirmedAt().Equal(snowstorm) {
+		t.Errorf("Expected the faded surface to keep the time it was confirmed, but got %s.", update.ConfirmedAt())
+	}
+
+	update, stored, err = datastore.ExpireRoadSegmentSurface("21277:153930", rules, snowstorm.Add(48*time.Hour))
+	if surfaceType, _ := update.Distribution.MostLikely(); err != nil || !stored || surfaceType != "unknown" {
+		t.Errorf("Expected the snow to expire 48 hours after it was confirmed, but got %v (%v).", update.Distribution, err)
+	}
+}
+
+func TestRetractedPredictionsAreRemovedFromTheFusedSurface(t *testing.T) {
+	seedData := "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n"
+	datastore, _ := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(seedData))
+	model := fusion.DefaultModel()
+
+	observation := diwise.NewRoadSurfaceObserved("wrong", "ice", 0.9, 62.389109, 17.310863)
+	observation.ID = "wrong"
+	if _, err := datastore.CreateRoadSurfaceObserved(observation, "21277:153930"); err != nil {
+		t.Fatalf("Failed to store observation: %s", err.Error())
+	}
+
+	snowstorm := time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)
+	datastore.UpdateRoadSegmentSurface("21277:153930", "", "", fusion.Prediction{SurfaceType: "snow", Probability: 0.8, Timestamp: snowstorm}, model)
+	datastore.UpdateRoadSegmentSurface("21277:153930", "", "wrong", fusion.Prediction{SurfaceType: "ice", Probability: 0.9, Timestamp: snowstorm.Add(time.Minute)}, model)
+
+	update, retracted, err := datastore.RetractRoadSegmentSurface("21277:153930", "wrong", nil, model)
+	if err != nil || !retracted {
+		t.Fatalf("Expected the prediction from the observation to be retracted (%v).", err)
+	}
+
+	if update.Sequence != 3 || len(update.Distribution) != 1 || update.Distribution["snow"] != 0.8 || !update.Timestamp.Equal(snowstorm) {
+		t.Errorf("Expected the surface to be fused from the remaining snow with sequence 3, but got %v (%d).", update.Distribution, update.Sequence)
+	}
+
+	if _, retracted, _ = datastore.RetractRoadSegmentSurface("21277:153930", "wrong", nil, model); retracted {
+		t.Error("Expected a prediction to only be retracted once.")
+	}
+
+	datastore.DeleteRoadSurfacesObserved([]string{"wrong"})
+	_, err = datastore.UpdateRoadSegmentSurface("21277:153930", "", "wrong", fusion.Prediction{SurfaceType: "ice", Probability: 0.9, Timestamp: snowstorm}, model)
+	if !errors.Is(err, db.ErrRetracted) {
+		t.Errorf("Expected a prediction from a deleted observation to be dropped, but got %v.", err)
+	}
+
+	predictions, _ := datastore.GetSurfaceTypePredictions([]string{"21277:153930"}, nil, nil)
+	update, retracted, _ = datastore.RetractRoadSegmentSurface("21277:153930", "", []uint{predictions["21277:153930"][0].ID}, model)
+	if !retracted || len(update.Distribution) != 0 || update.Sequence != 4 {
+		t.Errorf("Expected the segment to have no surface once every prediction is retracted, but got %v.", update.Distribution)
+	}
+}
@@ -0,0 +1,354 @@
+package database_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	db "github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/decay"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fusion"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/surfacetype"
+	"gorm.io/gorm"
+)
+
+//datastoreSeedData has two roads next to each other and one further away
+const datastoreSeedData string = "A;A:1;62.3900;17.3000;62.3900;17.3010\n" +
+	"A;A:2;62.3900;17.3010;62.3900;17.3020\n" +
+	"B;B:1;62.3950;17.3000;62.3950;17.3010\n" +
+	"C;C:1;62.4100;17.3500;62.4100;17.3510\n"
+
+//forEachDatastore runs a behavioural test against every Datastore implementation.
+//SpatiaLite stands in for PostGIS and must be installed, and PostGIS itself is tested when
+//TRANSPORTATION_TEST_POSTGIS is set, using the same environment variables as the service
+//to connect.
+func forEachDatastore(t *testing.T, test func(t *testing.T, datastore db.Datastore)) {
+	t.Run("memory", func(t *testing.T) {
+		datastore, err := db.NewDatabaseConnection(db.NewSQLiteConnector(), strings.NewReader(datastoreSeedData))
+		if err != nil {
+			t.Fatalf("Failed to create datastore: %s", err.Error())
+		}
+		test(t, datastore)
+	})
+
+	t.Run("spatialite", func(t *testing.T) {
+		connector := db.NewSpatiaLiteConnector()
+		if _, err := connector(); err != nil {
+			t.Fatalf("SpatiaLite is required to test the spatial datastore, install mod_spatialite: %s", err.Error())
+		}
+
+		datastore, err := db.NewSpatialDatabaseConnection(connector, strings.NewReader(datastoreSeedData))
+		if err != nil {
+			t.Fatalf("Failed to create datastore: %s", err.Error())
+		}
+		test(t, datastore)
+	})
+
+	t.Run("postgis", func(t *testing.T) {
+		if os.Getenv("TRANSPORTATION_TEST_POSTGIS") == "" {
+			t.Skip("Set TRANSPORTATION_TEST_POSTGIS to also test against PostGIS.")
+		}
+
+		datastore, err := db.NewSpatialDatabaseConnection(db.NewPostgreSQLConnector(), strings.NewReader(datastoreSeedData))
+		if err != nil {
+			t.Fatalf("Failed to create datastore: %s", err.Error())
+		}
+		test(t, datastore)
+	})
+}
+
+func segmentIDs(segments []db.RoadSegment) string {
+	ids := []string{}
+	for _, s := range segments {
+		ids = append(ids, s.ID())
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, " ")
+}
+
+func roadIDs(roads []db.Road) string {
+	ids := []string{}
+	for _, r := range roads {
+		ids = append(ids, r.ID())
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, " ")
+}
+
+func TestDatastoreGetByID(t *testing.T) {
+	forEachDatastore(t, func(t *testing.T, datastore db.Datastore) {
+		if datastore.GetRoadCount() != 3 {
+			t.Errorf("Unexpected number of roads in datastore. %d != 3", datastore.GetRoadCount())
+		}
+
+		road, err := datastore.GetRoadByID("A")
+		if err != nil || strings.Join(road.GetSegmentIdentities(), " ") != "A:1 A:2" {
+			t.Fatalf("Unable to find road A with its segments.")
+		}
+
+		road, err = datastore.GetRoadBySegmentID("B:1")
+		if err != nil || road.ID() != "B" {
+			t.Error("Unable to find road B from its segment.")
+		}
+
+		segment, err := datastore.GetRoadSegmentByID("A:2")
+		if err != nil || segment.RoadID() != "A" || len(segment.Coordinates()) != 2 || segment.Coordinates()[1] != [2]float64{17.3020, 62.3900} {
+			t.Error("Unable to find segment A:2 with its geometry.")
+		}
+
+		if _, err = datastore.GetRoadByID("D"); err == nil {
+			t.Error("Expected an error when getting an unknown road.")
+		}
+
+		if _, err = datastore.GetRoadSegmentByID("D:1"); err == nil {
+			t.Error("Expected an error when getting an unknown segment.")
+		}
+
+		segments, _ := datastore.GetAllSegments()
+		roads, _ := datastore.GetAllRoads()
+		if segmentIDs(segments) != "A:1 A:2 B:1 C:1" || roadIDs(roads) != "A B C" {
+			t.Errorf("Unexpected contents of datastore: %s and %s", roadIDs(roads), segmentIDs(segments))
+		}
+	})
+}
+
+func TestDatastoreNearPoint(t *testing.T) {
+	forEachDatastore(t, func(t *testing.T, datastore db.Datastore) {
+		segments, _ := datastore.GetSegmentsNearPoint(62.3901, 17.3005, 20)
+		if segmentIDs(segments) != "A:1" {
+			t.Errorf("Unexpected segments near point: %s", segmentIDs(segments))
+		}
+
+		roads, _ := datastore.GetRoadsNearPoint(62.3901, 17.3005, 20)
+		if roadIDs(roads) != "A" {
+			t.Errorf("Unexpected roads near point: %s", roadIDs(roads))
+		}
+
+		segments, _ = datastore.GetSegmentsNearPoint(62.3901, 17.3005, 1000)
+		if segmentIDs(segments) != "A:1 A:2 B:1" {
+			t.Errorf("Unexpected segments within 1 km from point: %s", segmentIDs(segments))
+		}
+
+		nearest, err := datastore.GetNearestSegment(62.3901, 17.3012, 1000)
+		if err != nil || nearest.ID() != "A:2" {
+			t.Errorf("Expected A:2 to be the nearest segment.")
+		}
+
+		if _, err = datastore.GetNearestSegment(62.3901, 17.3300, 100); err != db.ErrNotFound {
+			t.Errorf("Expected no segment to be found near point.")
+		}
+	})
+}
+
+func TestDatastoreWithinRect(t *testing.T) {
+	forEachDatastore(t, func(t *testing.T, datastore db.Datastore) {
+		segments, _ := datastore.GetSegmentsWithinRect(62.3945, 17.2990, 62.3960, 17.3020)
+		if segmentIDs(segments) != "B:1" {
+			t.Errorf("Unexpected segments within rect: %s", segmentIDs(segments))
+		}
+
+		roads, _ := datastore.GetRoadsWithinRect(62.3945, 17.2990, 62.3960, 17.3020)
+		if roadIDs(roads) != "B" {
+			t.Errorf("Unexpected roads within rect: %s", roadIDs(roads))
+		}
+	})
+}
+
+func TestDatastoreMatchingGeometry(t *testing.T) {
+	// The polygon covers A:1 and B:1, and half of A:2
+	polygon := geometry.Polygon{[]geometry.Point{
+		geometry.NewPoint(62.3890, 17.2995), geometry.NewPoint(62.3960, 17.2995), geometry.NewPoint(62.3960, 17.3015),
+		geometry.NewPoint(62.3890, 17.3015), geometry.NewPoint(62.3890, 17.2995),
+	}}
+
+	expectedSegments := map[geometry.Relation]string{
+		geometry.RelationWithin:     "A:1 B:1",
+		geometry.RelationOverlaps:   "A:2",
+		geometry.RelationIntersects: "A:1 A:2 B:1",
+		geometry.RelationDisjoint:   "C:1",
+	}
+
+	expectedRoads := map[geometry.Relation]string{
+		geometry.RelationWithin:     "B",
+		geometry.RelationOverlaps:   "A",
+		geometry.RelationIntersects: "A B",
+		geometry.RelationDisjoint:   "C",
+	}
+
+	forEachDatastore(t, func(t *testing.T, datastore db.Datastore) {
+		for relation, expected := range expectedSegments {
+			segments, err := datastore.GetSegmentsMatchingGeometry(relation, polygon)
+			if err != nil || segmentIDs(segments) != expected {
+				t.Errorf("Expected segments %s to be %s the polygon, but got %s", expected, relation, segmentIDs(segments))
+			}
+		}
+
+		for relation, expected := range expectedRoads {
+			roads, err := datastore.GetRoadsMatchingGeometry(relation, polygon)
+			if err != nil || roadIDs(roads) != expected {
+				t.Errorf("Expected roads %s to be %s the polygon, but got %s", expected, relation, roadIDs(roads))
+			}
+		}
+
+		line := geometry.LineString{geometry.NewPoint(62.3800, 17.3015), geometry.NewPoint(62.4000, 17.3015)}
+		segments, _ := datastore.GetSegmentsMatchingGeometry(geometry.RelationIntersects, line)
+		if segmentIDs(segments) != "A:2" {
+			t.Errorf("Unexpected segments intersecting line: %s", segmentIDs(segments))
+		}
+	})
+}
+
+func TestDatastoreRoadSegmentSurfaceUpdated(t *testing.T) {
+	forEachDatastore(t, func(t *testing.T, datastore db.Datastore) {
+		snowstorm := time.Date(2021, 2, 10, 12, 0, 0, 0, time.UTC)
+
+		datastore.RoadSegmentSurfaceUpdated("A:1", db.SurfaceUpdate{Distribution: fusion.Distribution{"snow": 0.8}, Timestamp: snowstorm})
+		datastore.RoadSegmentSurfaceUpdated("A:1", db.SurfaceUpdate{Distribution: fusion.Distribution{"tarmac": 0.6}, Timestamp: snowstorm.Add(-time.Hour)})
+
+		segment, _ := datastore.GetRoadSegmentByID("A:1")
+		surfaceType, probability := segment.SurfaceType()
+		if surfaceType != "snow" || probability != 0.8 || !segment.DateModified().Equal(snowstorm) {
+			t.Errorf("Expected a stale update to be dropped, but got %s (%f) modified at %v", surfaceType, probability, segment.DateModified())
+		}
+
+		road, _ := datastore.GetRoadByID("A")
+		segment, _ = road.GetSegment("A:1")
+		if surfaceType, _ = segment.SurfaceType(); surfaceType != "snow" {
+			t.Errorf("Expected the segment of the road to be updated as well, but got %s", surfaceType)
+		}
+
+		datastore.RoadSegmentSurfaceUpdated("A:1", db.SurfaceUpdate{Distribution: fusion.Distribution{"ice": 0.7}, Timestamp: snowstorm.Add(-2 * time.Hour), Sequence: 3})
+		datastore.RoadSegmentSurfaceUpdated("A:1", db.SurfaceUpdate{Distribution: fusion.Distribution{"slush": 0.9}, Timestamp: snowstorm.Add(time.Hour), Sequence: 2})
+		datastore.RoadSegmentSurfaceUpdated("A:1", db.SurfaceUpdate{Distribution: fusion.Distribution{"wet": 0.5}, Timestamp: snowstorm.Add(2 * time.Hour), Sequence: 3})
+
+		segment, _ = datastore.GetRoadSegmentByID("A:1")
+		if surfaceType, _ = segment.SurfaceType(); surfaceType != "ice" {
+			t.Errorf("Expected updates to be ordered by their sequence, but got %s", surfaceType)
+		}
+
+		if err := datastore.RoadSegmentSurfaceUpdated("D:1", db.SurfaceUpdate{Distribution: fusion.Distribution{"snow": 0.8}, Timestamp: snowstorm}); err == nil {
+			t.Error("Expected an error when updating an unknown segment.")
+		}
+	})
+}
+
+func TestDatastoreConcurrentSurfaceUpdatesOfSegment(t *testing.T) {
+	forEachDatastore(t, func(t *testing.T, datastore db.Datastore) {
+		const commands = 8
+		prefix := time.Now().UTC().Format(time.RFC3339Nano)
+
+		var wg sync.WaitGroup
+		mu := sync.Mutex{}
+		sequences := []int{}
+		duplicates := 0
+
+		// Every command is delivered twice, and every delivery is handled at the same time
+		for i := 0; i < 2*commands; i++ {
+			wg.Add(1)
+			go func(messageID string) {
+				defer wg.Done()
+
+				prediction := fusion.Prediction{SurfaceType: "snow", Probability: 0.8, Timestamp: time.Now().UTC()}
+				update, err := datastore.UpdateRoadSegmentSurface("A:1", messageID, "", prediction, fusion.DefaultModel())
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if errors.Is(err, db.ErrDuplicate) {
+					duplicates++
+				} else if err != nil {
+					t.Errorf("Unexpected error when updating the surface: %s", err.Error())
+				} else {
+					sequences = append(sequences, int(update.Sequence))
+				}
+			}(fmt.Sprintf("%s-%d", prefix, i%commands))
+		}
+
+		wg.Wait()
+
+		sort.Ints(sequences)
+		if len(sequences) != commands || duplicates != commands {
+			t.Fatalf("Expected %d commands to be applied once each, but got %d updates and %d duplicates.", commands, len(sequences), duplicates)
+		}
+
+		for idx := range sequences {
+			if sequences[idx] != sequences[0]+idx {
+				t.Fatalf("Expected every update to get its own sequence, but got %v.", sequences)
+			}
+		}
+	})
+}
+
+func TestDatastoreConcurrentExpiryOfSegment(t *testing.T) {
+	forEachDatastore(t, func(t *testing.T, datastore db.Datastore) {
+		rules, _ := decay.Default(surfacetype.Default())
+		snowstorm := time.Now().UTC().Add(-72 * time.Hour)
+
+		prediction := fusion.Prediction{SurfaceType: "snow", Probability: 0.8, Timestamp: snowstorm}
+		if _, err := datastore.UpdateRoadSegmentSurface("A:2", "", "", prediction, fusion.DefaultModel()); err != nil {
+			t.Fatalf("Failed to update the surface: %s", err.Error())
+		}
+
+		var wg sync.WaitGroup
+		mu := sync.Mutex{}
+		stored := 0
+
+		// Every replica runs the expiry job at the same time
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				_, expired, err := datastore.ExpireRoadSegmentSurface("A:2", rules, time.Now().UTC())
+				if err != nil {
+					t.Errorf("Unexpected error when expiring the surface: %s", err.Error())
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if expired {
+					stored++
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		if stored != 1 {
+			t.Errorf("Expected the expired surface to be stored once, but it was stored %d times.", stored)
+		}
+	})
+}
+
+func TestSpatialDatastoreStoresMissingGeometriesAtStartup(t *testing.T) {
+	impl, err := db.NewSpatiaLiteConnector()()
+	if err != nil {
+		t.Fatalf("SpatiaLite is required to test the spatial datastore, install mod_spatialite: %s", err.Error())
+	}
+
+	connector := func() (*gorm.DB, error) {
+		return impl, nil
+	}
+
+	// The datastore that keeps the network in memory stores the segments without geometries
+	if _, err = db.NewDatabaseConnection(connector, strings.NewReader(datastoreSeedData)); err != nil {
+		t.Fatalf("Failed to seed the database: %s", err.Error())
+	}
+
+	datastore, err := db.NewSpatialDatabaseConnection(connector, nil)
+	if err != nil {
+		t.Fatalf("Failed to create datastore: %s", err.Error())
+	}
+
+	segments, _ := datastore.GetSegmentsNearPoint(62.3901, 17.3005, 20)
+	if segmentIDs(segments) != "A:1" {
+		t.Errorf("Expected the geometries of segments without any to be stored at startup, but found %s near point.", segmentIDs(segments))
+	}
+}
@@ -0,0 +1,104 @@
+package database
+
+import (
+	"time"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/persistence"
+
+	"gorm.io/gorm"
+)
+
+//CreateFailedMessage stores a message that failed to be handled
+func (db *myDB) CreateFailedMessage(message *persistence.FailedMessage) error {
+	return db.impl.Create(message).Error
+}
+
+//ClaimFailedMessages returns up to limit failed messages that are due to be retried, in the
+//order they failed. Only messages that are shared by every replica, or owned by the given
+//instance, are returned. Dead lettered messages are never returned, and each message is
+//claimed for the duration of the lease so that replicas do not retry the same message.
+func (db *myDB) ClaimFailedMessages(owner string, now time.Time, lease time.Duration, limit int) ([]persistence.FailedMessage, error) {
+	ids, err := claimDueRows(func() *gorm.DB {
+		return db.impl.Model(&persistence.FailedMessage{}).Where("dead_lettered = ? AND owner IN ?", false, []string{"", owner})
+	}, now, lease, limit)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	claimed := []persistence.FailedMessage{}
+	result := db.impl.Where("id IN ?", ids).Order("id").Find(&claimed)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return claimed, nil
+}
+
+//FailedMessageRetried records another failed attempt to handle a message, and when to try
+//again. The message is dead lettered if there is no next attempt.
+func (db *myDB) FailedMessageRetried(id uint, reason string, nextAttempt *time.Time) error {
+	updates := map[string]interface{}{
+		"attempts":      gorm.Expr("attempts + 1"),
+		"last_error":    reason,
+		"next_attempt":  nil,
+		"dead_lettered": true,
+	}
+
+	if nextAttempt != nil {
+		updates["next_attempt"] = nextAttempt.UTC()
+		updates["dead_lettered"] = false
+	}
+
+	result := db.impl.Model(&persistence.FailedMessage{}).Where("id = ?", id).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+//GetDeadLetters returns every dead lettered message that is shared by every replica or owned
+//by the given instance, in the order they failed
+func (db *myDB) GetDeadLetters(owner string) ([]persistence.FailedMessage, error) {
+	messages := []persistence.FailedMessage{}
+	result := db.impl.Where("dead_lettered = ? AND owner IN ?", true, []string{"", owner}).Order("id").Find(&messages)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return messages, nil
+}
+
+//GetDeadLetterByID returns a dead lettered message, or ErrNotFound if there is no such message
+//that is shared by every replica or owned by the given instance
+func (db *myDB) GetDeadLetterByID(owner string, id uint) (*persistence.FailedMessage, error) {
+	message := &persistence.FailedMessage{}
+	result := db.impl.Where("id = ? AND dead_lettered = ? AND owner IN ?", id, true, []string{"", owner}).Limit(1).Find(message)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, ErrNotFound
+	}
+
+	return message, nil
+}
+
+//DeleteFailedMessage removes a failed message that has been handled or discarded
+func (db *myDB) DeleteFailedMessage(id uint) error {
+	result := db.impl.Unscoped().Delete(&persistence.FailedMessage{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"math"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+)
+
+//spatialIndex is a uniform grid that keeps track of which cells the bounding box of
+//each indexed item overlaps, so that rect queries only need to visit nearby items
+type spatialIndex struct {
+	cellSize float64
+	cells    map[cellKey][]indexEntry
+}
+
+type cellKey struct {
+	x int32
+	y int32
+}
+
+type indexEntry struct {
+	id   string
+	bbox Rectangle
+}
+
+//defaultIndexCellSize is roughly 1 km north-south and 500 m east-west at our latitudes
+const defaultIndexCellSize float64 = 0.01
+
+func newSpatialIndex(cellSize float64) *spatialIndex {
+	return &spatialIndex{
+		cellSize: cellSize,
+		cells:    map[cellKey][]indexEntry{},
+	}
+}
+
+func (idx *spatialIndex) cellFor(lat, lon float64) cellKey {
+	return cellKey{
+		x: int32(math.Floor(lon / idx.cellSize)),
+		y: int32(math.Floor(lat / idx.cellSize)),
+	}
+}
+
+func (idx *spatialIndex) cellRange(bbox Rectangle) (cellKey, cellKey) {
+	min := idx.cellFor(bbox.southEast.lat, bbox.northWest.lon)
+	max := idx.cellFor(bbox.northWest.lat, bbox.southEast.lon)
+	return min, max
+}
+
+func (idx *spatialIndex) insert(id string, bbox Rectangle) {
+	min, max := idx.cellRange(bbox)
+	entry := indexEntry{id: id, bbox: bbox}
+
+	for x := min.x; x <= max.x; x++ {
+		for y := min.y; y <= max.y; y++ {
+			key := cellKey{x: x, y: y}
+			idx.cells[key] = append(idx.cells[key], entry)
+		}
+	}
+}
+
+func (idx *spatialIndex) remove(id string, bbox Rectangle) {
+	min, max := idx.cellRange(bbox)
+
+	for x := min.x; x <= max.x; x++ {
+		for y := min.y; y <= max.y; y++ {
+			key := cellKey{x: x, y: y}
+			entries := idx.cells[key]
+
+			for i := range entries {
+				if entries[i].id == id {
+					entries[i] = entries[len(entries)-1]
+					entries = entries[:len(entries)-1]
+					break
+				}
+			}
+
+			if len(entries) == 0 {
+				delete(idx.cells, key)
+			} else {
+				idx.cells[key] = entries
+			}
+		}
+	}
+}
+
+//search calls visit exactly once for every indexed item whose bounding box overlaps
+//the supplied rect. Items that span several cells are only reported from the cell
+//that contains the lower left corner of the overlap, which saves us from having to
+//keep track of visited items.
+func (idx *spatialIndex) search(rect Rectangle, visit func(id string)) {
+	min, max := idx.cellRange(rect)
+
+	report := func(key cellKey, entries []indexEntry) {
+		for _, e := range entries {
+			if !overlaps(e.bbox, rect) {
+				continue
+			}
+
+			refCell := idx.cellFor(
+				math.Max(e.bbox.southEast.lat, rect.southEast.lat),
+				math.Max(e.bbox.northWest.lon, rect.northWest.lon),
+			)
+
+			if refCell == key {
+				visit(e.id)
+			}
+		}
+	}
+
+	cellsInRect := (int64(max.x) - int64(min.x) + 1) * (int64(max.y) - int64(min.y) + 1)
+
+	if cellsInRect > int64(len(idx.cells)) {
+		// The query covers more cells than we have populated, so it is cheaper
+		// to walk the populated cells instead of every cell within the rect
+		for key, entries := range idx.cells {
+			if key.x >= min.x && key.x <= max.x && key.y >= min.y && key.y <= max.y {
+				report(key, entries)
+			}
+		}
+		return
+	}
+
+	for x := min.x; x <= max.x; x++ {
+		for y := min.y; y <= max.y; y++ {
+			key := cellKey{x: x, y: y}
+			if entries, ok := idx.cells[key]; ok {
+				report(key, entries)
+			}
+		}
+	}
+}
+
+//overlaps is an inclusive version of Rectangle.Intersects that also accepts boxes
+//that only share an edge, which is needed for degenerate (flat) bounding boxes
+func overlaps(r, other Rectangle) bool {
+	return r.northWest.lon <= other.southEast.lon && r.southEast.lon >= other.northWest.lon &&
+		r.southEast.lat <= other.northWest.lat && r.northWest.lat >= other.southEast.lat
+}
+
+//newRectangleAroundPoint returns a rect that is guaranteed to contain every point
+//that lies within distance meters from pt
+func newRectangleAroundPoint(pt Point, distance uint64) Rectangle {
+	const metersPerDegree float64 = geometry.EarthRadius * math.Pi / 180
+
+	latDelta := float64(distance) / metersPerDegree
+	lonDelta := 180.0
+
+	cosLat := math.Cos((math.Abs(pt.lat) + latDelta) * math.Pi / 180)
+	if cosLat > 0.0001 {
+		lonDelta = math.Min(latDelta/cosLat, 180.0)
+	}
+
+	return NewRectangle(
+		NewPoint(pt.lat+latDelta, pt.lon-lonDelta),
+		NewPoint(pt.lat-latDelta, pt.lon+lonDelta),
+	)
+}
+
+//newRectangleFromGeometry returns the bounding box of a geometry as a Rectangle
+func newRectangleFromGeometry(g geometry.Geometry) Rectangle {
+	sw, ne := g.BoundingBox()
+	return NewRectangle(NewPoint(sw.Lat, sw.Lon), NewPoint(ne.Lat, ne.Lon))
+}
@@ -0,0 +1,409 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fusion"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/importer"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/persistence"
+	log "github.com/sirupsen/logrus"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+//persistBatchSize limits the number of rows per insert, and the number of ids per IN
+//clause, to stay well below the maximum number of parameters of a statement in sqlite
+const persistBatchSize int = 100
+
+//newRoadsFromSegments groups segments into roads, in the order the roads first appear
+func newRoadsFromSegments(segments []importer.Segment) []Road {
+	roadSegments := make([]RoadSegment, 0, len(segments))
+	for _, s := range segments {
+		roadSegments = append(roadSegments, newRoadSegmentFromImport(s))
+	}
+
+	return groupIntoRoads(roadSegments)
+}
+
+func newRoadSegmentFromImport(s importer.Segment) RoadSegment {
+	coordinates := make([]Point, 0, len(s.Coordinates))
+	for _, pt := range s.Coordinates {
+		coordinates = append(coordinates, NewPoint(pt.Lat, pt.Lon))
+	}
+
+	segment := newRoadSegment(s.ID, s.RoadID, coordinates)
+	if impl, ok := segment.(*roadSegmentImpl); ok {
+		impl.name = s.Name
+		impl.roadClass = s.RoadClass
+		impl.attributes = s.Attributes
+	}
+
+	return segment
+}
+
+//groupIntoRoads adds segments to the roads they belong to, in the order the roads first appear
+func groupIntoRoads(segments []RoadSegment) []Road {
+	roads := map[string]Road{}
+	order := []string{}
+
+	for _, segment := range segments {
+		road, ok := roads[segment.RoadID()]
+		if !ok {
+			roads[segment.RoadID()] = newRoad(segment.RoadID(), segment)
+			order = append(order, segment.RoadID())
+		} else {
+			road.AddSegment(segment)
+		}
+	}
+
+	result := make([]Road, 0, len(order))
+	for _, id := range order {
+		result = append(result, roads[id])
+	}
+
+	return result
+}
+
+//newSegmentsFromRows returns the road segments of a set of database rows, with the surface
+//type that has been stored with them. Rows without a usable geometry are skipped, since
+//segments that were created before their geometry was stored can not be used.
+func newSegmentsFromRows(rows []persistence.RoadSegment, roadIDs map[uint]string) ([]RoadSegment, error) {
+	segments := make([]RoadSegment, 0, len(rows))
+
+	for _, row := range rows {
+		s, err := newSegmentFromRow(roadIDs[row.RoadID], row)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(s.Coordinates) < 2 {
+			log.Warnf("Ignoring road segment %s without geometry in database.", row.SegmentID)
+			continue
+		}
+
+		segment := newRoadSegmentFromImport(s)
+		if row.SurfaceModified != nil {
+			segment = segment.withSurfaceUpdate(newSurfaceUpdateFromRow(row))
+		}
+
+		segments = append(segments, segment)
+	}
+
+	return segments, nil
+}
+
+//newRoadsFromRows returns the roads of a set of database rows with their segments preloaded
+func newRoadsFromRows(rows []persistence.Road) ([]Road, error) {
+	segments := []RoadSegment{}
+
+	for _, road := range rows {
+		roadSegments, err := newSegmentsFromRows(road.RoadSegments, map[uint]string{road.ID: road.RID})
+		if err != nil {
+			return nil, err
+		}
+
+		segments = append(segments, roadSegments...)
+	}
+
+	return groupIntoRoads(segments), nil
+}
+
+//newSegmentRow returns the database representation of a road segment
+func newSegmentRow(segment RoadSegment, roadRowID uint) (persistence.RoadSegment, error) {
+	row := persistence.RoadSegment{
+		SegmentID: segment.ID(),
+		RoadID:    roadRowID,
+		Name:      segment.Name(),
+	}
+
+	if impl, ok := segment.(*roadSegmentImpl); ok {
+		row.RoadClass = impl.roadClass
+	}
+
+	coordinates, err := json.Marshal(segment.Coordinates())
+	if err != nil {
+		return row, err
+	}
+	row.Coordinates = string(coordinates)
+
+	if len(segment.Attributes()) > 0 {
+		attributes, err := json.Marshal(segment.Attributes())
+		if err != nil {
+			return row, err
+		}
+		row.Attributes = string(attributes)
+	}
+
+	return row, nil
+}
+
+//newSegmentFromRow returns an importer segment from a database row, so that a network
+//loaded from the database is built in the same way as one read from a file
+func newSegmentFromRow(roadID string, row persistence.RoadSegment) (importer.Segment, error) {
+	segment := importer.Segment{
+		ID:        row.SegmentID,
+		RoadID:    roadID,
+		Name:      row.Name,
+		RoadClass: row.RoadClass,
+	}
+
+	coordinates := [][2]float64{}
+	if err := json.Unmarshal([]byte(row.Coordinates), &coordinates); err != nil {
+		return segment, fmt.Errorf("invalid coordinates of segment %s: %s", row.SegmentID, err.Error())
+	}
+
+	for _, pos := range coordinates {
+		segment.Coordinates = append(segment.Coordinates, geometry.NewPoint(pos[1], pos[0]))
+	}
+
+	if row.Attributes != "" {
+		if err := json.Unmarshal([]byte(row.Attributes), &segment.Attributes); err != nil {
+			return segment, fmt.Errorf("invalid attributes of segment %s: %s", row.SegmentID, err.Error())
+		}
+	}
+
+	return segment, nil
+}
+
+//newDistributionFromRow returns the fused distribution that has been stored with a segment.
+//Segments that were updated before distributions were stored only have a surface type.
+func newDistributionFromRow(row persistence.RoadSegment) fusion.Distribution {
+	distribution := fusion.Distribution{}
+
+	if row.SurfaceDistribution != "" {
+		if err := json.Unmarshal([]byte(row.SurfaceDistribution), &distribution); err == nil {
+			return distribution
+		}
+		log.Warnf("Ignoring invalid surface distribution of road segment %s.", row.SegmentID)
+	}
+
+	if row.SurfaceType != "" {
+		distribution[row.SurfaceType] = row.SurfaceProbability
+	}
+
+	return distribution
+}
+
+//newSurfaceUpdateFromRow returns the surface that has been stored with a segment
+func newSurfaceUpdateFromRow(row persistence.RoadSegment) SurfaceUpdate {
+	update := SurfaceUpdate{
+		Distribution: newDistributionFromRow(row),
+		Sequence:     row.SurfaceSequence,
+	}
+
+	if row.SurfaceModified != nil {
+		update.Timestamp = *row.SurfaceModified
+	}
+
+	if row.SurfaceConfirmed != nil {
+		update.Confirmed = *row.SurfaceConfirmed
+	}
+
+	return update
+}
+
+//newSurfaceColumns returns the columns that store a surface update with a segment
+func newSurfaceColumns(update SurfaceUpdate) (map[string]interface{}, error) {
+	bytes, err := json.Marshal(update.Distribution)
+	if err != nil {
+		return nil, err
+	}
+
+	surfaceType, probability := update.Distribution.MostLikely()
+
+	return map[string]interface{}{
+		"surface_type":         surfaceType,
+		"surface_probability":  probability,
+		"surface_distribution": string(bytes),
+		"surface_modified":     update.Timestamp.UTC(),
+		"surface_confirmed":    update.ConfirmedAt().UTC(),
+		"surface_sequence":     update.Sequence,
+	}, nil
+}
+
+func newPredictionsFromRows(rows []persistence.SurfaceTypePrediction) []fusion.Prediction {
+	predictions := make([]fusion.Prediction, 0, len(rows))
+
+	for _, row := range rows {
+		predictions = append(predictions, fusion.Prediction{
+			SurfaceType: row.SurfaceType,
+			Probability: row.Probability,
+			Source:      row.Source,
+			Timestamp:   row.Timestamp,
+		})
+	}
+
+	return predictions
+}
+
+//persistRoads stores roads and their segments in the database, inserting the rows that
+//are missing and updating the ones that have changed. If replace is true the supplied
+//roads make up the whole network, and any other roads and segments are soft deleted so
+//that they are no longer loaded, while their surface type predictions are kept.
+func (db *myDB) persistRoads(roads []Road, replace bool) error {
+	// Logging every statement would flood the log when a whole network is stored
+	quiet := db.impl.Session(&gorm.Session{Logger: db.impl.Logger.LogMode(logger.Warn)})
+
+	return quiet.Transaction(func(tx *gorm.DB) error {
+		existingRoads := []persistence.Road{}
+		if result := tx.Unscoped().Find(&existingRoads); result.Error != nil {
+			return result.Error
+		}
+
+		existingSegments := []persistence.RoadSegment{}
+		if result := tx.Unscoped().Find(&existingSegments); result.Error != nil {
+			return result.Error
+		}
+
+		roadRows := map[string]*persistence.Road{}
+		for idx := range existingRoads {
+			roadRows[existingRoads[idx].RID] = &existingRoads[idx]
+		}
+
+		segmentRows := map[string]*persistence.RoadSegment{}
+		for idx := range existingSegments {
+			segmentRows[existingSegments[idx].SegmentID] = &existingSegments[idx]
+		}
+
+		keptRoads := map[uint]bool{}
+		newRoads := []*persistence.Road{}
+
+		for _, road := range roads {
+			row, ok := roadRows[road.ID()]
+			if !ok {
+				row = &persistence.Road{RID: road.ID(), Name: road.Name(), RoadClass: road.RoadClass()}
+				roadRows[road.ID()] = row
+				newRoads = append(newRoads, row)
+				continue
+			}
+
+			keptRoads[row.ID] = true
+
+			if row.DeletedAt.Valid || row.Name != road.Name() || row.RoadClass != road.RoadClass() {
+				result := tx.Unscoped().Model(&persistence.Road{}).Where("id = ?", row.ID).Updates(map[string]interface{}{
+					"name": road.Name(), "road_class": road.RoadClass(), "deleted_at": nil,
+				})
+				if result.Error != nil {
+					return result.Error
+				}
+			}
+		}
+
+		if len(newRoads) > 0 {
+			if result := tx.CreateInBatches(newRoads, persistBatchSize); result.Error != nil {
+				return result.Error
+			}
+		}
+
+		keptSegments := map[uint]bool{}
+		newSegments := []*persistence.RoadSegment{}
+
+		for _, road := range roads {
+			roadRowID := roadRows[road.ID()].ID
+
+			for _, segment := range road.allSegments() {
+				segmentRow, err := newSegmentRow(segment, roadRowID)
+				if err != nil {
+					return err
+				}
+
+				existing, ok := segmentRows[segment.ID()]
+				if !ok {
+					newSegments = append(newSegments, &segmentRow)
+					continue
+				}
+
+				keptSegments[existing.ID] = true
+
+				if existing.DeletedAt.Valid || existing.RoadID != segmentRow.RoadID || existing.Name != segmentRow.Name ||
+					existing.RoadClass != segmentRow.RoadClass || existing.Coordinates != segmentRow.Coordinates ||
+					existing.Attributes != segmentRow.Attributes {
+					result := tx.Unscoped().Model(&persistence.RoadSegment{}).Where("id = ?", existing.ID).Updates(map[string]interface{}{
+						"road_id":     segmentRow.RoadID,
+						"name":        segmentRow.Name,
+						"road_class":  segmentRow.RoadClass,
+						"coordinates": segmentRow.Coordinates,
+						"attributes":  segmentRow.Attributes,
+						"deleted_at":  nil,
+					})
+					if result.Error != nil {
+						return result.Error
+					}
+				}
+			}
+		}
+
+		if len(newSegments) > 0 {
+			if result := tx.CreateInBatches(newSegments, persistBatchSize); result.Error != nil {
+				return result.Error
+			}
+		}
+
+		if !replace {
+			return nil
+		}
+
+		removedSegments := []uint{}
+		for _, row := range existingSegments {
+			if !row.DeletedAt.Valid && !keptSegments[row.ID] {
+				removedSegments = append(removedSegments, row.ID)
+			}
+		}
+
+		removedRoads := []uint{}
+		for _, row := range existingRoads {
+			if !row.DeletedAt.Valid && !keptRoads[row.ID] {
+				removedRoads = append(removedRoads, row.ID)
+			}
+		}
+
+		if err := deleteInBatches(tx, &persistence.RoadSegment{}, removedSegments); err != nil {
+			return err
+		}
+
+		return deleteInBatches(tx, &persistence.Road{}, removedRoads)
+	})
+}
+
+func deleteInBatches(tx *gorm.DB, model interface{}, ids []uint) error {
+	for start := 0; start < len(ids); start += persistBatchSize {
+		end := start + persistBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		if result := tx.Where("id IN ?", ids[start:end]).Delete(model); result.Error != nil {
+			return result.Error
+		}
+	}
+
+	return nil
+}
+
+//loadFromDatabase builds the in memory road network from the roads and segments that
+//have been stored in the database
+func (db *myDB) loadFromDatabase() error {
+	log.Infof("Loading road network from database ...")
+
+	rows := []persistence.Road{}
+	result := db.impl.Session(&gorm.Session{Logger: db.impl.Logger.LogMode(logger.Warn)}).
+		Preload("RoadSegments", func(tx *gorm.DB) *gorm.DB { return tx.Order("id") }).
+		Order("id").Find(&rows)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	roads, err := newRoadsFromRows(rows)
+	if err != nil {
+		return err
+	}
+
+	for _, road := range roads {
+		db.addRoad(road)
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/messaging/events"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/persistence"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+//newSurfaceUpdatedMessage returns an outbox message with the event that announces a change
+//of the surface of a segment
+func newSurfaceUpdatedMessage(segmentID string, update SurfaceUpdate) (*persistence.OutboxMessage, error) {
+	surfaceType, probability := update.Distribution.MostLikely()
+
+	event := &events.RoadSegmentSurfaceUpdated{
+		MessageID:    uuid.New().String(),
+		ID:           segmentID,
+		Sequence:     update.Sequence,
+		SurfaceType:  surfaceType,
+		Probability:  probability,
+		Distribution: update.Distribution,
+		Timestamp:    update.Timestamp.UTC().Format(time.RFC3339),
+		Confirmed:    update.ConfirmedAt().UTC().Format(time.RFC3339),
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	return &persistence.OutboxMessage{
+		Topic:       event.TopicName(),
+		ContentType: event.ContentType(),
+		Body:        string(body),
+	}, nil
+}
+
+//findSegmentForUpdate reads the row of a segment and locks it until the end of the transaction,
+//so that replicas that change the surface of the same segment at the same time take turns.
+//SQLite has no row locks, but only ever runs one transaction at a time.
+func findSegmentForUpdate(tx *gorm.DB, segmentID string, segment *persistence.RoadSegment) *gorm.DB {
+	return tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where(&persistence.RoadSegment{SegmentID: segmentID}).Limit(1).Find(segment)
+}
+
+//storeSurfaceUpdate writes the surface columns of a segment row, together with the event
+//that announces the change, as part of a transaction. The row is only written if its sequence
+//is still the one that the update was based on, and errSurfaceChanged is returned otherwise.
+func storeSurfaceUpdate(tx *gorm.DB, segment *persistence.RoadSegment, update SurfaceUpdate) error {
+	surface, err := newSurfaceColumns(update)
+	if err != nil {
+		return err
+	}
+
+	result := tx.Model(&persistence.RoadSegment{}).Where("id = ? AND surface_sequence = ?", segment.ID, segment.SurfaceSequence).Updates(surface)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("unable to store the surface of road segment %s: %w", segment.SegmentID, errSurfaceChanged)
+	}
+
+	message, err := newSurfaceUpdatedMessage(segment.SegmentID, update)
+	if err != nil {
+		return err
+	}
+
+	return tx.Create(message).Error
+}
+
+//ClaimOutboxMessages returns up to limit messages that are due to be published, in the order
+//they were stored. Each message is claimed for the duration of the lease, so that replicas
+//that relay the outbox at the same time do not publish the same message.
+func (db *myDB) ClaimOutboxMessages(now time.Time, lease time.Duration, limit int) ([]persistence.OutboxMessage, error) {
+	ids, err := claimDueRows(func() *gorm.DB {
+		return db.impl.Model(&persistence.OutboxMessage{})
+	}, now, lease, limit)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	claimed := []persistence.OutboxMessage{}
+	result := db.impl.Where("id IN ?", ids).Order("id").Find(&claimed)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return claimed, nil
+}
+
+//claimDueRows claims up to limit rows of a query that are due at a point in time, by moving
+//their next attempt to the end of the lease, and returns the ids of the rows it claimed. A
+//row that is claimed by someone else in the meantime is skipped.
+func claimDueRows(query func() *gorm.DB, now time.Time, lease time.Duration, limit int) ([]uint, error) {
+	now = now.UTC()
+	until := now.Add(lease)
+	due := "next_attempt IS NULL OR next_attempt <= ?"
+
+	ids := []uint{}
+	result := query().Where(due, now).Order("id").Limit(limit).Pluck("id", &ids)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	claimed := []uint{}
+
+	for _, id := range ids {
+		result = query().Where("id = ?", id).Where(due, now).Update("next_attempt", until)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+
+		if result.RowsAffected == 1 {
+			claimed = append(claimed, id)
+		}
+	}
+
+	return claimed, nil
+}
+
+//OutboxMessagePublished removes a message that has been published from the outbox
+func (db *myDB) OutboxMessagePublished(id uint) error {
+	return db.impl.Unscoped().Delete(&persistence.OutboxMessage{}, id).Error
+}
+
+//OutboxMessageFailed records a failed attempt to publish a message, and when to try again
+func (db *myDB) OutboxMessageFailed(id uint, reason string, nextAttempt time.Time) error {
+	result := db.impl.Model(&persistence.OutboxMessage{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"attempts":     gorm.Expr("attempts + 1"),
+		"last_error":   reason,
+		"next_attempt": nextAttempt.UTC(),
+	})
+
+	return result.Error
+}
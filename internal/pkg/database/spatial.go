@@ -0,0 +1,615 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/importer"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/persistence"
+	"github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+//spatialDialect hides the differences between the spatial extensions of the databases
+//that a spatialDB can run on. Geometries are always stored with SRID 4326.
+type spatialDialect interface {
+	//setup adds the geometry column and its spatial index to the road_segments table
+	setup(tx *gorm.DB) error
+	//fromCoordinates is an expression that creates the geometry of a segment from the JSON
+	//array in its coordinates column
+	fromCoordinates() string
+
+	//fromText is an expression that creates a geometry from a WKT parameter
+	fromText() string
+	//boundingBox is a condition that takes the min lon, min lat, max lon and max lat of a
+	//box as parameters and is met by segments whose bounding box intersects it
+	boundingBox() string
+	//withinDistance is a condition that takes the lon and lat of a point and a distance in
+	//meters as parameters, and is met by segments within that distance from the point
+	withinDistance() string
+	//relates is a condition that is met when the named spatial predicate, such as
+	//Intersects or CoveredBy, is true for a segment and the other geometry
+	relates(predicate, other string) string
+}
+
+type postGISDialect struct{}
+
+func (postGISDialect) setup(tx *gorm.DB) error {
+	for _, statement := range []string{
+		"CREATE EXTENSION IF NOT EXISTS postgis",
+		"ALTER TABLE road_segments ADD COLUMN IF NOT EXISTS geom geometry(LineString, 4326)",
+		"CREATE INDEX IF NOT EXISTS road_segments_geom_idx ON road_segments USING GIST (geom)",
+	} {
+		if result := tx.Exec(statement); result.Error != nil {
+			return result.Error
+		}
+	}
+
+	return nil
+}
+
+func (postGISDialect) fromCoordinates() string {
+	return `ST_SetSRID(ST_GeomFromGeoJSON('{"type":"LineString","coordinates":' || coordinates || '}'), 4326)`
+}
+
+func (postGISDialect) fromText() string {
+	return "ST_GeomFromText(?, 4326)"
+}
+
+func (postGISDialect) boundingBox() string {
+	return "geom && ST_MakeEnvelope(?, ?, ?, ?, 4326)"
+}
+
+func (postGISDialect) withinDistance() string {
+	return "ST_DWithin(geom::geography, ST_SetSRID(ST_MakePoint(?, ?), 4326)::geography, ?)"
+}
+
+func (postGISDialect) relates(predicate, other string) string {
+	return fmt.Sprintf("ST_%s(geom, %s)", predicate, other)
+}
+
+//spatiaLiteDialect lets SQLite with the SpatiaLite extension stand in for PostGIS, which is
+//mostly useful for running tests without a database server
+type spatiaLiteDialect struct{}
+
+func (spatiaLiteDialect) setup(tx *gorm.DB) error {
+	var initialized int
+	if result := tx.Raw("SELECT CheckSpatialMetaData()").Scan(&initialized); result.Error != nil {
+		return fmt.Errorf("spatialite is not available: %s", result.Error.Error())
+	}
+
+	if initialized == 0 {
+		if result := tx.Exec("SELECT InitSpatialMetaData(1)"); result.Error != nil {
+			return result.Error
+		}
+	}
+
+	if !tx.Migrator().HasColumn(&persistence.RoadSegment{}, "geom") {
+		for _, statement := range []string{
+			"SELECT AddGeometryColumn('road_segments', 'geom', 4326, 'LINESTRING', 'XY')",
+			"SELECT CreateSpatialIndex('road_segments', 'geom')",
+		} {
+			if result := tx.Exec(statement); result.Error != nil {
+				return result.Error
+			}
+		}
+	}
+
+	return nil
+}
+
+func (spatiaLiteDialect) fromCoordinates() string {
+	return `SetSRID(GeomFromGeoJSON('{"type":"LineString","coordinates":' || coordinates || '}'), 4326)`
+}
+
+func (spatiaLiteDialect) fromText() string {
+	return "GeomFromText(?, 4326)"
+}
+
+func (spatiaLiteDialect) boundingBox() string {
+	// SpatiaLite only uses the spatial index when it is queried explicitly
+	return "ROWID IN (SELECT ROWID FROM SpatialIndex WHERE f_table_name = 'road_segments' AND f_geometry_column = 'geom' AND search_frame = BuildMbr(?, ?, ?, ?, 4326))"
+}
+
+func (spatiaLiteDialect) withinDistance() string {
+	return "ST_Distance(geom, MakePoint(?, ?, 4326), 1) <= ?"
+}
+
+func (spatiaLiteDialect) relates(predicate, other string) string {
+	// The predicates return -1 instead of failing on invalid geometries
+	return fmt.Sprintf("ST_%s(geom, %s) = 1", predicate, other)
+}
+
+//updateGeometries sets the geometry column from the coordinates of the segments with the
+//supplied ids, or of every segment if ids is nil
+func updateGeometries(tx *gorm.DB, dialect spatialDialect, ids []string) error {
+	statement := "UPDATE road_segments SET geom = " + dialect.fromCoordinates() + " WHERE deleted_at IS NULL"
+
+	if ids == nil {
+		return tx.Exec(statement).Error
+	}
+
+	for start := 0; start < len(ids); start += persistBatchSize {
+		end := start + persistBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		if result := tx.Exec(statement+" AND segment_id IN ?", ids[start:end]); result.Error != nil {
+			return result.Error
+		}
+	}
+
+	return nil
+}
+
+//updateMissingGeometries sets the geometry column of every segment that has none
+func updateMissingGeometries(tx *gorm.DB, dialect spatialDialect) error {
+	result := tx.Exec("UPDATE road_segments SET geom = " + dialect.fromCoordinates() + " WHERE deleted_at IS NULL AND geom IS NULL")
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected > 0 {
+		log.Infof("Stored the geometries of %d segments that had none.", result.RowsAffected)
+	}
+
+	return nil
+}
+
+func newSpatialDialect(name string) (spatialDialect, error) {
+	switch name {
+	case "postgres":
+		return postGISDialect{}, nil
+	case "sqlite":
+		return spatiaLiteDialect{}, nil
+	}
+
+	return nil, fmt.Errorf("no spatial datastore is available for %s databases", name)
+}
+
+const spatiaLiteDriverName string = "sqlite3_with_spatialite"
+
+var registerSpatiaLiteDriver sync.Once
+
+//NewSpatiaLiteConnector opens a connection to a local, in-memory, sqlite database with the
+//SpatiaLite extension loaded, that can be used with NewSpatialDatabaseConnection
+func NewSpatiaLiteConnector() ConnectorFunc {
+	registerSpatiaLiteDriver.Do(func() {
+		sql.Register(spatiaLiteDriverName, &sqlite3.SQLiteDriver{Extensions: []string{"mod_spatialite"}})
+	})
+
+	return func() (*gorm.DB, error) {
+		db, err := gorm.Open(sqlite.Dialector{DriverName: spatiaLiteDriverName, DSN: "file::memory:"}, &gorm.Config{
+			Logger: logger.Default.LogMode(logger.Silent),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+
+		// Every new connection would open a separate, empty, in-memory database
+		sqlDB.SetMaxOpenConns(1)
+
+		// The extension is loaded when the first connection is made
+		if err = sqlDB.Ping(); err != nil {
+			return nil, fmt.Errorf("failed to load spatialite: %s", err.Error())
+		}
+
+		return db, nil
+	}
+}
+
+//spatialDB is a Datastore that keeps the road network in a spatially enabled database and
+//lets the database answer the geospatial queries, so that no part of the network has to be
+//held in memory. Everything that is not about the road network is handled by myDB, whose
+//maps are left empty.
+type spatialDB struct {
+	*myDB
+	dialect spatialDialect
+}
+
+//NewSpatialDatabaseConnection creates a Datastore that stores segment geometries in PostGIS,
+//or in SpatiaLite when connected to sqlite, and queries them there. The datafile, if any,
+//replaces the stored road network as with NewDatabaseConnection.
+func NewSpatialDatabaseConnection(connect ConnectorFunc, datafile io.Reader, options ...importer.Option) (Datastore, error) {
+	impl, err := connect()
+	if err != nil {
+		return nil, err
+	}
+
+	dialect, err := newSpatialDialect(impl.Dialector.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	db := &spatialDB{
+		myDB: &myDB{
+			impl:         impl.Debug(),
+			roads:        map[string]Road{},
+			seg2road:     map[string]string{},
+			segments:     map[string]RoadSegment{},
+			roadIndex:    newSpatialIndex(defaultIndexCellSize),
+			segmentIndex: newSpatialIndex(defaultIndexCellSize),
+		},
+		dialect: dialect,
+	}
+
+	migrate(db.impl)
+
+	if err = dialect.setup(db.impl); err != nil {
+		return nil, err
+	}
+
+	if datafile != nil {
+		log.Infof("Seeding datastore ...")
+
+		segments, err := importer.Read(datafile, options...)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = db.persistRoads(newRoadsFromSegments(segments), true); err != nil {
+			return nil, fmt.Errorf("failed to store the road network in the database: %s", err.Error())
+		}
+
+		if err = updateGeometries(db.impl, dialect, nil); err != nil {
+			return nil, fmt.Errorf("failed to store the segment geometries: %s", err.Error())
+		}
+	}
+
+	// Segments that were stored before the geometry column was added, or by an instance that
+	// keeps the road network in memory, have no geometry and would never match a query
+	if err = updateMissingGeometries(db.impl, dialect); err != nil {
+		log.Errorf("Failed to store the geometries of segments that have none: %s", err.Error())
+	}
+
+	log.Infof("Datastore contains %d roads.", db.GetRoadCount())
+
+	annotateSurfaceTypes(db.impl, db.RoadSegmentSurfaceUpdated)
+
+	return db, nil
+}
+
+func (db *spatialDB) AddRoad(road Road) error {
+	if err := db.persistRoads([]Road{road}, false); err != nil {
+		return err
+	}
+
+	return updateGeometries(db.impl, db.dialect, road.GetSegmentIdentities())
+}
+
+//findRoads returns the roads that have at least one segment that meets the condition
+func (db *spatialDB) findRoads(condition string, args ...interface{}) ([]Road, error) {
+	return db.findRoadsWhere("id IN (SELECT road_id FROM road_segments WHERE deleted_at IS NULL AND "+condition+")", args...)
+}
+
+func (db *spatialDB) findRoadsWhere(condition string, args ...interface{}) ([]Road, error) {
+	tx := db.impl.Preload("RoadSegments", func(tx *gorm.DB) *gorm.DB { return tx.Order("id") })
+	if condition != "" {
+		tx = tx.Where(condition, args...)
+	}
+
+	rows := []persistence.Road{}
+	if result := tx.Order("id").Find(&rows); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return newRoadsFromRows(rows)
+}
+
+//findSegments returns the segments that meet the condition
+func (db *spatialDB) findSegments(condition string, args ...interface{}) ([]RoadSegment, error) {
+	tx := db.impl
+	if condition != "" {
+		tx = tx.Where(condition, args...)
+	}
+
+	rows := []persistence.RoadSegment{}
+	if result := tx.Order("id").Find(&rows); result.Error != nil {
+		return nil, result.Error
+	}
+
+	ids := []uint{}
+	roadIDs := map[uint]string{}
+	for _, row := range rows {
+		if _, ok := roadIDs[row.RoadID]; !ok {
+			roadIDs[row.RoadID] = ""
+			ids = append(ids, row.RoadID)
+		}
+	}
+
+	for start := 0; start < len(ids); start += persistBatchSize {
+		end := start + persistBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		roads := []persistence.Road{}
+		if result := db.impl.Where("id IN ?", ids[start:end]).Find(&roads); result.Error != nil {
+			return nil, result.Error
+		}
+
+		for _, road := range roads {
+			roadIDs[road.ID] = road.RID
+		}
+	}
+
+	return newSegmentsFromRows(rows, roadIDs)
+}
+
+func (db *spatialDB) GetAllRoads() ([]Road, error) {
+	return db.findRoadsWhere("")
+}
+
+func (db *spatialDB) GetRoadByID(id string) (Road, error) {
+	roads, err := db.findRoadsWhere("r_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(roads) == 0 {
+		return nil, fmt.Errorf("no road with id %s in datastore: %w", id, ErrNotFound)
+	}
+
+	return roads[0], nil
+}
+
+func (db *spatialDB) GetRoadBySegmentID(segmentID string) (Road, error) {
+	roads, err := db.findRoads("segment_id = ?", segmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(roads) == 0 {
+		return nil, fmt.Errorf("no road mapping exists from segment %s: %w", segmentID, ErrNotFound)
+	}
+
+	return roads[0], nil
+}
+
+func (db *spatialDB) GetRoadCount() int {
+	var count int64
+	if result := db.impl.Model(&persistence.Road{}).Count(&count); result.Error != nil {
+		log.Errorf("Failed to count roads: %s", result.Error.Error())
+	}
+
+	return int(count)
+}
+
+//nearPoint returns the condition and arguments that select segments within maxDistance
+//meters from a point, using the spatial index to rule out distant segments first
+func (db *spatialDB) nearPoint(lat, lon float64, maxDistance uint64) (string, []interface{}) {
+	box := newRectangleAroundPoint(NewPoint(lat, lon), maxDistance)
+
+	condition := db.dialect.boundingBox() + " AND " + db.dialect.withinDistance()
+	args := []interface{}{box.northWest.lon, box.southEast.lat, box.southEast.lon, box.northWest.lat, lon, lat, float64(maxDistance)}
+
+	return condition, args
+}
+
+func (db *spatialDB) withinRect(lat0, lon0, lat1, lon1 float64) (string, []interface{}) {
+	rect := NewRectangle(NewPoint(lat0, lon0), NewPoint(lat1, lon1))
+	return db.dialect.boundingBox(), []interface{}{rect.northWest.lon, rect.southEast.lat, rect.southEast.lon, rect.northWest.lat}
+}
+
+func (db *spatialDB) GetRoadsNearPoint(lat, lon float64, maxDistance uint64) ([]Road, error) {
+	condition, args := db.nearPoint(lat, lon, maxDistance)
+	return db.findRoads(condition, args...)
+}
+
+func (db *spatialDB) GetRoadsWithinRect(lat0, lon0, lat1, lon1 float64) ([]Road, error) {
+	condition, args := db.withinRect(lat0, lon0, lat1, lon1)
+	return db.findRoads(condition, args...)
+}
+
+//spatialRelation holds the conditions that relate segments to a query geometry
+type spatialRelation struct {
+	box        string
+	intersects string
+	coveredBy  string
+	boxArgs    []interface{}
+	wkt        string
+}
+
+func (db *spatialDB) newSpatialRelation(g geometry.Geometry) (*spatialRelation, error) {
+	text, err := toWKT(g)
+	if err != nil {
+		return nil, err
+	}
+
+	sw, ne := g.BoundingBox()
+
+	return &spatialRelation{
+		box:        db.dialect.boundingBox(),
+		intersects: db.dialect.relates("Intersects", db.dialect.fromText()),
+		coveredBy:  db.dialect.relates("CoveredBy", db.dialect.fromText()),
+		boxArgs:    []interface{}{sw.Lon, sw.Lat, ne.Lon, ne.Lat},
+		wkt:        text,
+	}, nil
+}
+
+func (db *spatialDB) GetRoadsMatchingGeometry(relation geometry.Relation, g geometry.Geometry) ([]Road, error) {
+	r, err := db.newSpatialRelation(g)
+	if err != nil {
+		return nil, err
+	}
+
+	_, isSurface := g.(geometry.Surface)
+	segmentsWhere := "(SELECT road_id FROM road_segments WHERE deleted_at IS NULL AND %s)"
+	intersecting := fmt.Sprintf(segmentsWhere, r.box+" AND "+r.intersects)
+	args := append(append([]interface{}{}, r.boxArgs...), r.wkt)
+
+	// The relations are evaluated for the segments of a road as a whole, in the same way
+	// as geometry.Relates does for the in memory datastore
+	switch relation {
+	case geometry.RelationIntersects:
+		return db.findRoadsWhere("id IN "+intersecting, args...)
+	case geometry.RelationDisjoint:
+		return db.findRoadsWhere("id NOT IN "+intersecting, args...)
+	case geometry.RelationWithin:
+		if isSurface {
+			uncovered := fmt.Sprintf(segmentsWhere, "NOT ("+r.coveredBy+")")
+			return db.findRoadsWhere("id IN "+intersecting+" AND id NOT IN "+uncovered, append(args, r.wkt)...)
+		}
+	case geometry.RelationOverlaps:
+		if isSurface {
+			uncovered := fmt.Sprintf(segmentsWhere, "NOT ("+r.coveredBy+")")
+			return db.findRoadsWhere("id IN "+intersecting+" AND id IN "+uncovered, append(args, r.wkt)...)
+		}
+	}
+
+	return []Road{}, nil
+}
+
+func (db *spatialDB) GetAllSegments() ([]RoadSegment, error) {
+	return db.findSegments("")
+}
+
+func (db *spatialDB) GetRoadSegmentByID(id string) (RoadSegment, error) {
+	segments, err := db.findSegments("segment_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("unable to find RoadSegment with id %s: %w", id, ErrNotFound)
+	}
+
+	return segments[0], nil
+}
+
+func (db *spatialDB) GetNearestSegment(lat, lon float64, maxDistance uint64) (RoadSegment, error) {
+	segments, err := db.GetSegmentsNearPoint(lat, lon, maxDistance)
+	if err != nil {
+		return nil, err
+	}
+
+	return nearestSegment(segments, NewPoint(lat, lon))
+}
+
+func (db *spatialDB) GetSegmentsNearPoint(lat, lon float64, maxDistance uint64) ([]RoadSegment, error) {
+	condition, args := db.nearPoint(lat, lon, maxDistance)
+	return db.findSegments(condition, args...)
+}
+
+func (db *spatialDB) GetSegmentsWithinRect(lat0, lon0, lat1, lon1 float64) ([]RoadSegment, error) {
+	condition, args := db.withinRect(lat0, lon0, lat1, lon1)
+	return db.findSegments(condition, args...)
+}
+
+func (db *spatialDB) GetSegmentsMatchingGeometry(relation geometry.Relation, g geometry.Geometry) ([]RoadSegment, error) {
+	r, err := db.newSpatialRelation(g)
+	if err != nil {
+		return nil, err
+	}
+
+	_, isSurface := g.(geometry.Surface)
+	args := append(append([]interface{}{}, r.boxArgs...), r.wkt)
+
+	switch relation {
+	case geometry.RelationIntersects:
+		return db.findSegments(r.box+" AND "+r.intersects, args...)
+	case geometry.RelationDisjoint:
+		return db.findSegments("NOT ("+r.intersects+")", r.wkt)
+	case geometry.RelationWithin:
+		if isSurface {
+			return db.findSegments(r.box+" AND "+r.coveredBy, args...)
+		}
+	case geometry.RelationOverlaps:
+		if isSurface {
+			return db.findSegments(r.box+" AND "+r.intersects+" AND NOT ("+r.coveredBy+")", append(args, r.wkt)...)
+		}
+	}
+
+	return []RoadSegment{}, nil
+}
+
+//RoadSegmentSurfaceUpdated stores the distribution over surface types with the segment,
+//unless the stored surface is the same or more recent. The instance that handled the
+//command has already stored the update, so replicas that share the database only store
+//updates from instances that do not.
+func (db *spatialDB) RoadSegmentSurfaceUpdated(segmentID string, update SurfaceUpdate) error {
+	surface, err := newSurfaceColumns(update)
+	if err != nil {
+		return err
+	}
+
+	query := db.impl.Model(&persistence.RoadSegment{}).Where(&persistence.RoadSegment{SegmentID: segmentID})
+	if update.Sequence > 0 {
+		query = query.Where("surface_sequence < ?", update.Sequence)
+	} else {
+		query = query.Where("surface_modified IS NULL OR surface_modified < ?", update.Timestamp.UTC())
+	}
+
+	result := query.Updates(surface)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		var count int64
+		db.impl.Model(&persistence.RoadSegment{}).Where(&persistence.RoadSegment{SegmentID: segmentID}).Count(&count)
+		if count == 0 {
+			return fmt.Errorf("unable to update non existing RoadSegment %s", segmentID)
+		}
+
+		log.Debugf("Ignoring stale or duplicate surface update %d of road segment %s", update.Sequence, segmentID)
+	}
+
+	return nil
+}
+
+//toWKT returns the well known text representation of a query geometry
+func toWKT(g geometry.Geometry) (string, error) {
+	switch shape := g.(type) {
+	case geometry.LineString:
+		return "LINESTRING" + wktPoints(shape, false), nil
+	case geometry.Polygon:
+		return "POLYGON" + wktRings(shape), nil
+	case geometry.MultiPolygon:
+		polygons := []string{}
+		for _, polygon := range shape {
+			polygons = append(polygons, wktRings(polygon))
+		}
+		return "MULTIPOLYGON(" + strings.Join(polygons, ",") + ")", nil
+	}
+
+	return "", fmt.Errorf("unable to convert geometry of type %T to WKT", g)
+}
+
+func wktRings(polygon geometry.Polygon) string {
+	rings := []string{}
+	for _, ring := range polygon {
+		rings = append(rings, wktPoints(ring, true))
+	}
+	return "(" + strings.Join(rings, ",") + ")"
+}
+
+//wktPoints returns a list of positions as lon lat pairs. Rings are closed if needed, since
+//the spatial databases do not accept open ones.
+func wktPoints(points []geometry.Point, ring bool) string {
+	if ring && len(points) > 0 && points[0] != points[len(points)-1] {
+		points = append(append([]geometry.Point{}, points...), points[0])
+	}
+
+	positions := make([]string, 0, len(points))
+	for _, pt := range points {
+		positions = append(positions, strconv.FormatFloat(pt.Lon, 'f', -1, 64)+" "+strconv.FormatFloat(pt.Lat, 'f', -1, 64))
+	}
+
+	return "(" + strings.Join(positions, ",") + ")"
+}
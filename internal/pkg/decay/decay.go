@@ -0,0 +1,251 @@
+package decay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fusion"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/surfacetype"
+)
+
+//Rule describes how the confidence in a surface type fades when it is not confirmed. The
+//probability halves every HalfLife, and the type is dropped altogether once TTL has passed.
+//A zero HalfLife or TTL means that the probability never decays or never expires.
+type Rule struct {
+	SurfaceType string
+	HalfLife    time.Duration
+	TTL         time.Duration
+}
+
+//Config is the configuration of a set of rules. Segments whose every surface type has
+//expired fall back to the surface type in their BaseAttribute, if it is a known type, or
+//to Fallback otherwise. Probabilities that decay below MinProbability expire.
+type Config struct {
+	Fallback       string
+	BaseAttribute  string
+	MinProbability float64
+	Rules          []Rule
+}
+
+//Rules applies decay and expiry to the surface types of road segments
+type Rules struct {
+	vocabulary     *surfacetype.Vocabulary
+	rules          map[string]Rule
+	fallback       string
+	baseAttribute  string
+	minProbability float64
+}
+
+//DefaultConfig returns rules that let wintry and wet surfaces fade within a day or two,
+//while surfaces such as tarmac and gravel are kept until they are updated
+func DefaultConfig() Config {
+	return Config{
+		Fallback:       "unknown",
+		BaseAttribute:  "surface",
+		MinProbability: 0.1,
+		Rules: []Rule{
+			{SurfaceType: "wet", HalfLife: 2 * time.Hour, TTL: 12 * time.Hour},
+			{SurfaceType: "slippery", HalfLife: 6 * time.Hour, TTL: 48 * time.Hour},
+			{SurfaceType: "frost", HalfLife: 2 * time.Hour, TTL: 12 * time.Hour},
+			{SurfaceType: "ice", HalfLife: 3 * time.Hour, TTL: 24 * time.Hour},
+			{SurfaceType: "slush", HalfLife: 3 * time.Hour, TTL: 24 * time.Hour},
+			{SurfaceType: "snow", HalfLife: 6 * time.Hour, TTL: 48 * time.Hour},
+			{SurfaceType: "packed_snow", HalfLife: 12 * time.Hour, TTL: 168 * time.Hour},
+		},
+	}
+}
+
+//Default returns the default rules for a vocabulary
+func Default(vocabulary *surfacetype.Vocabulary) (*Rules, error) {
+	return New(vocabulary, DefaultConfig())
+}
+
+//New returns rules for the surface types of a vocabulary. Types without a rule of their
+//own inherit the rule of their closest ancestor, so that a rule for snow also applies to
+//packed snow unless it has a rule of its own.
+func New(vocabulary *surfacetype.Vocabulary, config Config) (*Rules, error) {
+	fallback, err := vocabulary.Canonical(config.Fallback)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fallback surface type: %s", err.Error())
+	}
+
+	if config.MinProbability < 0 || config.MinProbability > 1 {
+		return nil, fmt.Errorf("the minimum probability %f is not within [0, 1]", config.MinProbability)
+	}
+
+	own := map[string]Rule{}
+
+	for _, rule := range config.Rules {
+		rule.SurfaceType, err = vocabulary.Canonical(rule.SurfaceType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid decay rule: %s", err.Error())
+		}
+
+		if rule.HalfLife < 0 || rule.TTL < 0 {
+			return nil, fmt.Errorf("the decay rule for %s may not have a negative half life or ttl", rule.SurfaceType)
+		}
+
+		if _, ok := own[rule.SurfaceType]; ok {
+			return nil, fmt.Errorf("more than one decay rule for %s", rule.SurfaceType)
+		}
+
+		own[rule.SurfaceType] = rule
+	}
+
+	parents := map[string]string{}
+	for _, t := range vocabulary.Types() {
+		parents[t.Name] = t.Parent
+	}
+
+	rules := map[string]Rule{}
+
+	for _, t := range vocabulary.Types() {
+		for ancestor := t.Name; ancestor != ""; ancestor = parents[ancestor] {
+			if rule, ok := own[ancestor]; ok {
+				rules[t.Name] = Rule{SurfaceType: t.Name, HalfLife: rule.HalfLife, TTL: rule.TTL}
+				break
+			}
+		}
+	}
+
+	return &Rules{
+		vocabulary:     vocabulary,
+		rules:          rules,
+		fallback:       fallback,
+		baseAttribute:  config.BaseAttribute,
+		minProbability: config.MinProbability,
+	}, nil
+}
+
+//Load reads rules from a JSON document such as
+//{"fallback":"unknown","baseAttribute":"surface","minProbability":0.1,
+// "rules":[{"surfaceType":"snow","halfLife":"6h","ttl":"48h"}, ...]}
+//where any setting that is left out keeps its default value
+func Load(r io.Reader, vocabulary *surfacetype.Vocabulary) (*Rules, error) {
+	defaults := DefaultConfig()
+
+	doc := struct {
+		Fallback       *string  `json:"fallback"`
+		BaseAttribute  *string  `json:"baseAttribute"`
+		MinProbability *float64 `json:"minProbability"`
+		Rules          []struct {
+			SurfaceType string `json:"surfaceType"`
+			HalfLife    string `json:"halfLife"`
+			TTL         string `json:"ttl"`
+		} `json:"rules"`
+	}{}
+
+	err := json.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse decay rules: %s", err.Error())
+	}
+
+	config := Config{Fallback: defaults.Fallback, BaseAttribute: defaults.BaseAttribute, MinProbability: defaults.MinProbability}
+
+	if doc.Fallback != nil {
+		config.Fallback = *doc.Fallback
+	}
+	if doc.BaseAttribute != nil {
+		config.BaseAttribute = *doc.BaseAttribute
+	}
+	if doc.MinProbability != nil {
+		config.MinProbability = *doc.MinProbability
+	}
+
+	for _, r := range doc.Rules {
+		rule := Rule{SurfaceType: r.SurfaceType}
+
+		if rule.HalfLife, err = parseDuration(r.HalfLife); err != nil {
+			return nil, fmt.Errorf("invalid half life of %s: %s", r.SurfaceType, err.Error())
+		}
+
+		if rule.TTL, err = parseDuration(r.TTL); err != nil {
+			return nil, fmt.Errorf("invalid ttl of %s: %s", r.SurfaceType, err.Error())
+		}
+
+		config.Rules = append(config.Rules, rule)
+	}
+
+	return New(vocabulary, config)
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+//RuleFor returns the rule that applies to a surface type, if any
+func (r *Rules) RuleFor(surfaceType string) (Rule, bool) {
+	rule, ok := r.rules[surfaceType]
+	return rule, ok
+}
+
+//Fallback returns the surface type that a segment with the supplied attributes falls back
+//to when every other surface type has expired
+func (r *Rules) Fallback(attributes map[string]string) string {
+	if base, ok := attributes[r.baseAttribute]; ok && r.baseAttribute != "" {
+		if canonical, err := r.vocabulary.Canonical(base); err == nil {
+			return canonical
+		}
+	}
+
+	return r.fallback
+}
+
+//Apply returns what remains at a point in time of a distribution that was stored at modified
+//and last confirmed at confirmed. The two differ when a distribution that has decayed is
+//stored. Every surface type decays and expires according to its own rule, and if nothing
+//remains the segment falls back to its base surface type with full probability. The time to
+//live runs from the confirmation, while probabilities halve with the time since the
+//distribution was stored, which is the same as halving the confirmed probabilities with the
+//time since they were confirmed.
+func (r *Rules) Apply(distribution fusion.Distribution, modified, confirmed time.Time, attributes map[string]string, now time.Time) fusion.Distribution {
+	age := now.Sub(modified)
+	if age <= 0 || len(distribution) == 0 {
+		return distribution
+	}
+
+	confirmedAge := now.Sub(confirmed)
+
+	remaining := fusion.Distribution{}
+
+	for surfaceType, probability := range distribution {
+		rule, ok := r.rules[surfaceType]
+		if ok {
+			if rule.TTL > 0 && confirmedAge >= rule.TTL {
+				continue
+			}
+
+			if rule.HalfLife > 0 {
+				probability *= math.Pow(0.5, float64(age)/float64(rule.HalfLife))
+				if probability < r.minProbability {
+					continue
+				}
+			}
+		}
+
+		remaining[surfaceType] = probability
+	}
+
+	if len(remaining) == 0 {
+		remaining[r.Fallback(attributes)] = 1.0
+	}
+
+	return remaining
+}
+
+//HasFlipped returns true if the most likely surface type of a distribution changes when the
+//rules are applied to it
+func (r *Rules) HasFlipped(distribution fusion.Distribution, modified, confirmed time.Time, attributes map[string]string, now time.Time) (fusion.Distribution, bool) {
+	remaining := r.Apply(distribution, modified, confirmed, attributes, now)
+
+	before, _ := distribution.MostLikely()
+	after, _ := remaining.MostLikely()
+
+	return remaining, before != after
+}
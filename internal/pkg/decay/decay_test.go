@@ -0,0 +1,81 @@
+package decay_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/decay"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fusion"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/surfacetype"
+)
+
+func TestSnowConfidenceHalvesWithoutConfirmation(t *testing.T) {
+	rules, _ := decay.Default(surfacetype.Default())
+	modified := time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)
+
+	remaining := rules.Apply(fusion.Distribution{"snow": 0.8}, modified, modified, nil, modified.Add(6*time.Hour))
+	if math.Abs(remaining["snow"]-0.4) > 1e-9 {
+		t.Errorf("Expected the snow probability to have halved, but got %v.", remaining)
+	}
+
+	remaining = rules.Apply(fusion.Distribution{"snow": 0.8}, modified, modified, nil, modified.Add(-time.Hour))
+	if remaining["snow"] != 0.8 {
+		t.Errorf("Expected a distribution from the future to be left as is, but got %v.", remaining)
+	}
+}
+
+func TestExpiredSegmentsFallBackToBaseSurface(t *testing.T) {
+	rules, _ := decay.Default(surfacetype.Default())
+	modified := time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)
+	lastMarch := modified.Add(30 * 24 * time.Hour)
+
+	remaining, flipped := rules.HasFlipped(fusion.Distribution{"snow": 0.8}, modified, modified, map[string]string{"surface": "asphalt"}, lastMarch)
+	if surfaceType, probability := remaining.MostLikely(); !flipped || surfaceType != "tarmac" || probability != 1.0 {
+		t.Errorf("Expected snow to expire into the base surface, but got %v.", remaining)
+	}
+
+	remaining = rules.Apply(fusion.Distribution{"snow": 0.8}, modified, modified, map[string]string{"surface": "lava"}, lastMarch)
+	if surfaceType, _ := remaining.MostLikely(); surfaceType != "unknown" {
+		t.Errorf("Expected snow to expire into unknown, but got %v.", remaining)
+	}
+
+	remaining = rules.Apply(fusion.Distribution{"gravel": 0.7}, modified, modified, nil, lastMarch)
+	if remaining["gravel"] != 0.7 {
+		t.Errorf("Expected surface types without rules to never expire, but got %v.", remaining)
+	}
+}
+
+func TestRulesAreInheritedAndLoaded(t *testing.T) {
+	rules, err := decay.Load(strings.NewReader(`{
+		"fallback": "dry",
+		"rules": [{"surfaceType": "slippery", "halfLife": "1h", "ttl": "3h"}, {"surfaceType": "icy", "ttl": "1h"}]
+	}`), surfacetype.Default())
+	if err != nil {
+		t.Fatalf("Failed to load decay rules: %s", err.Error())
+	}
+
+	if rule, ok := rules.RuleFor("packed_snow"); !ok || rule.HalfLife != time.Hour || rule.TTL != 3*time.Hour {
+		t.Errorf("Expected packed_snow to inherit the rule of slippery, but got %v.", rule)
+	}
+
+	if rule, ok := rules.RuleFor("ice"); !ok || rule.HalfLife != 0 || rule.TTL != time.Hour {
+		t.Errorf("Expected ice to have a rule of its own, but got %v.", rule)
+	}
+
+	if rules.Fallback(nil) != "dry" {
+		t.Errorf("Expected the configured fallback, but got %s.", rules.Fallback(nil))
+	}
+
+	for _, invalid := range []string{
+		`{"fallback": "lava"}`,
+		`{"rules": [{"surfaceType": "snow", "ttl": "two days"}]}`,
+		`{"rules": [{"surfaceType": "snow"}, {"surfaceType": "snowy"}]}`,
+		`{"minProbability": 2}`,
+	} {
+		if _, err := decay.Load(strings.NewReader(invalid), surfacetype.Default()); err == nil {
+			t.Errorf("Expected %s to be rejected.", invalid)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package context
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/persistence"
+	diwise "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/diwise"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//BatchEntity is an entity of a batch operation, with its type and id and the JSON object
+//that it was sent as
+type BatchEntity struct {
+	Type string
+	ID   string
+	Body []byte
+}
+
+//ProblemDetails describes why an entity of a batch operation failed, as in RFC 7807
+type ProblemDetails struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+//BatchEntityError is the error of a single entity of a batch operation
+type BatchEntityError struct {
+	EntityID string         `json:"entityId"`
+	Error    ProblemDetails `json:"error"`
+}
+
+//BatchOperationResult is the result of a batch operation, with the ids of the entities that
+//succeeded and the errors of those that failed. Created holds the ids of the entities that
+//were created by an upsert, rather than updated.
+type BatchOperationResult struct {
+	Success []string           `json:"success"`
+	Errors  []BatchEntityError `json:"errors"`
+	Created []string           `json:"-"`
+}
+
+//NewBatchOperationResult returns an empty result
+func NewBatchOperationResult() *BatchOperationResult {
+	return &BatchOperationResult{Success: []string{}, Errors: []BatchEntityError{}, Created: []string{}}
+}
+
+//ErrAlreadyExists is returned when an entity that already exists is created
+var ErrAlreadyExists = errors.New("already exists")
+
+//Succeed records that an entity of a batch operation succeeded
+func (r *BatchOperationResult) Succeed(entityID string) {
+	r.Success = append(r.Success, entityID)
+}
+
+//Fail records that an entity of a batch operation failed. Entities that do not exist are
+//reported as ResourceNotFound, entities that already exist as AlreadyExists, and every
+//other error as BadRequestData.
+func (r *BatchOperationResult) Fail(entityID string, err error) {
+	problem := ProblemDetails{Type: "https://uri.etsi.org/ngsi-ld/errors/BadRequestData", Title: "Bad Request Data"}
+
+	if errors.Is(err, database.ErrNotFound) {
+		problem = ProblemDetails{Type: "https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound", Title: "Resource Not Found"}
+	} else if errors.Is(err, ErrAlreadyExists) {
+		problem = ProblemDetails{Type: "https://uri.etsi.org/ngsi-ld/errors/AlreadyExists", Title: "Already Exists"}
+	}
+
+	problem.Detail = err.Error()
+	r.Errors = append(r.Errors, BatchEntityError{EntityID: entityID, Error: problem})
+}
+
+//failInternally records that an entity failed because of an error in the datastore
+func (r *BatchOperationResult) failInternally(entityID string, err error) {
+	r.Errors = append(r.Errors, BatchEntityError{
+		EntityID: entityID,
+		Error: ProblemDetails{
+			Type:   "https://uri.etsi.org/ngsi-ld/errors/InternalError",
+			Title:  "Internal Error",
+			Detail: err.Error(),
+		},
+	})
+}
+
+//Merge adds the outcome of another result to this one
+func (r *BatchOperationResult) Merge(other *BatchOperationResult) {
+	r.Success = append(r.Success, other.Success...)
+	r.Errors = append(r.Errors, other.Errors...)
+	r.Created = append(r.Created, other.Created...)
+}
+
+//CreateEntities creates a batch of RoadSurfaceObserved entities, which are stored in a single
+//transaction. Observations without an id are given one. An upsert also updates the surface
+//type of RoadSegments, and leaves observations that already exist as they are, since
+//observations can not be changed once they have been made. Observations that already exist
+//are found by the datastore as they are stored, and the rest of the batch is then stored
+//without them.
+func (cs *contextSource) CreateEntities(entities []BatchEntity, upsert bool) *BatchOperationResult {
+	result := NewBatchOperationResult()
+
+	observations := []*diwise.RoadSurfaceObserved{}
+	segmentIDs := []string{}
+	entityIDs := []string{}
+	seen := map[string]bool{}
+
+	for _, entity := range entities {
+		if entity.Type == "RoadSegment" && upsert {
+			cs.updateEntity(entity, result)
+			continue
+		}
+
+		if entity.Type != "RoadSurfaceObserved" {
+			result.Fail(entity.ID, fmt.Errorf("entities of type %s can not be created", entity.Type))
+			continue
+		}
+
+		rso, err := cs.newRoadSurfaceObserved(entity)
+		if err != nil {
+			result.Fail(entity.ID, err)
+			continue
+		}
+
+		entityID := diwise.RoadSurfaceObservedIDPrefix + rso.ID
+
+		if seen[rso.ID] {
+			result.Fail(entityID, fmt.Errorf("the entity %s occurs more than once in the batch", entityID))
+			continue
+		}
+		seen[rso.ID] = true
+
+		observations = append(observations, rso)
+		segmentIDs = append(segmentIDs, cs.matchRoadSegment(rso))
+		entityIDs = append(entityIDs, entityID)
+	}
+
+	for len(observations) > 0 {
+		stored, err := cs.db.CreateRoadSurfacesObserved(observations, segmentIDs)
+
+		exists := &database.ObservationExistsError{}
+		if errors.As(err, &exists) {
+			if idx := indexOfObservation(observations, exists.ID); idx >= 0 {
+				cs.observationExists(entityIDs[idx], exists.ID, upsert, result)
+
+				observations = append(observations[:idx], observations[idx+1:]...)
+				segmentIDs = append(segmentIDs[:idx], segmentIDs[idx+1:]...)
+				entityIDs = append(entityIDs[:idx], entityIDs[idx+1:]...)
+				continue
+			}
+		}
+
+		if err != nil {
+			log.Errorf("Failed to store a batch of %d observations: %s", len(observations), err.Error())
+			for _, entityID := range entityIDs {
+				result.failInternally(entityID, err)
+			}
+			return result
+		}
+
+		for idx := range stored {
+			cs.observationStored(&stored[idx])
+			result.Succeed(entityIDs[idx])
+			result.Created = append(result.Created, entityIDs[idx])
+		}
+
+		break
+	}
+
+	return result
+}
+
+//observationExists records the outcome for an observation of a batch that has already been
+//stored. An upsert of an observation that exists succeeds, while an observation that has been
+//deleted can not be created again since its id is not reused.
+func (cs *contextSource) observationExists(entityID, id string, upsert bool, result *BatchOperationResult) {
+	_, err := cs.db.GetRoadSurfaceObservedByID(id)
+	if err == nil {
+		if upsert {
+			result.Succeed(entityID)
+		} else {
+			result.Fail(entityID, fmt.Errorf("the entity %s %w", entityID, ErrAlreadyExists))
+		}
+	} else if errors.Is(err, database.ErrNotFound) {
+		result.Fail(entityID, fmt.Errorf("the entity %s has been deleted and its id can not be reused: %w", entityID, ErrAlreadyExists))
+	} else {
+		result.failInternally(entityID, err)
+	}
+}
+
+func indexOfObservation(observations []*diwise.RoadSurfaceObserved, id string) int {
+	for idx, rso := range observations {
+		if rso.ID == id {
+			return idx
+		}
+	}
+
+	return -1
+}
+
+//newRoadSurfaceObserved decodes and validates an observation of a batch
+func (cs *contextSource) newRoadSurfaceObserved(entity BatchEntity) (*diwise.RoadSurfaceObserved, error) {
+	rso := &diwise.RoadSurfaceObserved{}
+	err := json.Unmarshal(entity.Body, rso)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode entity: %s", err.Error())
+	}
+
+	if entity.ID == "" {
+		rso.ID = uuid.New().String()
+	} else if strings.HasPrefix(entity.ID, diwise.RoadSurfaceObservedIDPrefix) && len(entity.ID) > len(diwise.RoadSurfaceObservedIDPrefix) {
+		rso.ID = strings.TrimPrefix(entity.ID, diwise.RoadSurfaceObservedIDPrefix)
+	} else {
+		return nil, fmt.Errorf("the id of a RoadSurfaceObserved must start with %s", diwise.RoadSurfaceObservedIDPrefix)
+	}
+
+	return rso, cs.validateRoadSurfaceObserved(rso)
+}
+
+//UpdateEntities updates the surface type of a batch of RoadSegments
+func (cs *contextSource) UpdateEntities(entities []BatchEntity) *BatchOperationResult {
+	result := NewBatchOperationResult()
+
+	for _, entity := range entities {
+		if entity.Type != "RoadSegment" {
+			result.Fail(entity.ID, fmt.Errorf("entities of type %s can not be updated", entity.Type))
+			continue
+		}
+
+		cs.updateEntity(entity, result)
+	}
+
+	return result
+}
+
+func (cs *contextSource) updateEntity(entity BatchEntity, result *BatchOperationResult) {
+	if !strings.HasPrefix(entity.ID, fiware.RoadSegmentIDPrefix) {
+		result.Fail(entity.ID, fmt.Errorf("the id of a RoadSegment must start with %s", fiware.RoadSegmentIDPrefix))
+		return
+	}
+
+	updateSource := &fiware.RoadSegment{}
+	err := json.Unmarshal(entity.Body, updateSource)
+	if err != nil {
+		result.Fail(entity.ID, fmt.Errorf("unable to decode entity: %s", err.Error()))
+		return
+	}
+
+	err = cs.updateRoadSegment(strings.TrimPrefix(entity.ID, fiware.RoadSegmentIDPrefix), updateSource)
+	if err != nil {
+		result.Fail(entity.ID, err)
+		return
+	}
+
+	result.Succeed(entity.ID)
+}
+
+//DeleteEntities deletes a batch of RoadSurfaceObserved entities in a single transaction, and
+//retracts the predictions that were made from them
+func (cs *contextSource) DeleteEntities(entityIDs []string) *BatchOperationResult {
+	result := NewBatchOperationResult()
+
+	observations := []persistence.RoadSurfaceObserved{}
+	deleted := []string{}
+	seen := map[string]bool{}
+
+	for _, entityID := range entityIDs {
+		if !strings.HasPrefix(entityID, diwise.RoadSurfaceObservedIDPrefix) {
+			result.Fail(entityID, fmt.Errorf("the entity %s can not be deleted", entityID))
+			continue
+		}
+
+		id := strings.TrimPrefix(entityID, diwise.RoadSurfaceObservedIDPrefix)
+		if seen[id] {
+			result.Fail(entityID, fmt.Errorf("the entity %s occurs more than once in the batch", entityID))
+			continue
+		}
+		seen[id] = true
+
+		observation, err := cs.db.GetRoadSurfaceObservedByID(id)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				result.Fail(entityID, fmt.Errorf("the entity %s was %w", entityID, err))
+			} else {
+				result.failInternally(entityID, err)
+			}
+			continue
+		}
+
+		observations = append(observations, *observation)
+		deleted = append(deleted, entityID)
+	}
+
+	if len(observations) == 0 {
+		return result
+	}
+
+	err := cs.deleteRoadSurfacesObserved(observations)
+	if err != nil {
+		log.Errorf("Failed to delete a batch of %d observations: %s", len(observations), err.Error())
+		for _, entityID := range deleted {
+			result.failInternally(entityID, err)
+		}
+		return result
+	}
+
+	for _, entityID := range deleted {
+		result.Succeed(entityID)
+	}
+
+	return result
+}
@@ -2,14 +2,23 @@ package context
 
 import (
 	"errors"
+	"fmt"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/decay"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/format"
+	ngsiquery "github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/query"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fusion"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
 	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/messaging"
 	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/messaging/commands"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/persistence"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/servicearea"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/surfacetype"
 	diwise "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/diwise"
 	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
 	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
@@ -18,14 +27,66 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+//DefaultSnapDistance is the default maximum distance, in meters, between a road surface
+//observation and the road segment it is matched to
+const DefaultSnapDistance uint64 = 20
+
 type contextSource struct {
 	db  database.Datastore
 	msg messaging.MessagingContext
+
+	snapDistance uint64
+	serviceArea  *servicearea.ServiceArea
+	vocabulary   *surfacetype.Vocabulary
+	decayRules   *decay.Rules
+}
+
+//SourceOption is used to configure a context source
+type SourceOption func(*contextSource)
+
+//WithSnapDistance sets the maximum distance, in meters, between a road surface observation
+//and the road segment it is matched to. Observations that are further away from every
+//segment are stored without affecting any segment. Zero disables the matching.
+func WithSnapDistance(meters uint64) SourceOption {
+	return func(cs *contextSource) {
+		cs.snapDistance = meters
+	}
+}
+
+//WithServiceArea restricts observations, geo-queries and updates to the road segments
+//within a service area. No restrictions apply if no service area is set.
+func WithServiceArea(area *servicearea.ServiceArea) SourceOption {
+	return func(cs *contextSource) {
+		cs.serviceArea = area
+	}
+}
+
+//WithVocabulary sets the surface types that observations and updates may use, and that
+//q filters on surfaceType are expanded with. The default vocabulary is used otherwise.
+func WithVocabulary(vocabulary *surfacetype.Vocabulary) SourceOption {
+	return func(cs *contextSource) {
+		cs.vocabulary = vocabulary
+	}
+}
+
+//WithDecayRules makes the surface types of segments decay and expire when they are not
+//confirmed, as seen at the time of each query. Surface types are kept as they are if no
+//rules are set.
+func WithDecayRules(rules *decay.Rules) SourceOption {
+	return func(cs *contextSource) {
+		cs.decayRules = rules
+	}
 }
 
 //CreateSource instantiates and returns a Fiware ContextSource that wraps the provided db interface
-func CreateSource(db database.Datastore, msg messaging.MessagingContext) ngsi.ContextSource {
-	return &contextSource{db: db, msg: msg}
+func CreateSource(db database.Datastore, msg messaging.MessagingContext, options ...SourceOption) ngsi.ContextSource {
+	cs := &contextSource{db: db, msg: msg, snapDistance: DefaultSnapDistance, vocabulary: surfacetype.Default()}
+
+	for _, option := range options {
+		option(cs)
+	}
+
+	return cs
 }
 
 func (cs *contextSource) CreateEntity(typeName, entityID string, req ngsi.Request) error {
@@ -39,50 +100,240 @@ func (cs *contextSource) CreateEntity(typeName, entityID string, req ngsi.Reques
 			return err
 		}
 		rso.ID = uuid.New().String()
-		_, err = cs.db.CreateRoadSurfaceObserved(rso)
+
+		err = cs.validateRoadSurfaceObserved(rso)
+		if err != nil {
+			return err
+		}
+
+		segmentID := cs.matchRoadSegment(rso)
+
+		observation, err := cs.db.CreateRoadSurfaceObserved(rso, segmentID)
+		if err != nil {
+			return err
+		}
+
+		cs.observationStored(observation)
+
+		return nil
 	}
 
 	return err
 }
 
+//validateRoadSurfaceObserved checks that an observation has a known surface type, which is
+//replaced by its canonical name, a probability and a location within the service area
+func (cs *contextSource) validateRoadSurfaceObserved(rso *diwise.RoadSurfaceObserved) error {
+	var err error
+
+	rso.SurfaceType.Value, err = cs.vocabulary.Canonical(rso.SurfaceType.Value)
+	if err != nil {
+		return err
+	}
+
+	if rso.SurfaceType.Probability <= 0 || rso.SurfaceType.Probability > 1 {
+		return fmt.Errorf("probability %f is not within acceptable range: (0, 1.0]", rso.SurfaceType.Probability)
+	}
+
+	if rso.Location.Value.Type != "Point" || len(rso.Location.Value.Coordinates) < 2 {
+		return errors.New("the location of an observation must be a Point")
+	}
+
+	lon, lat := rso.Location.Value.Coordinates[0], rso.Location.Value.Coordinates[1]
+	if cs.serviceArea != nil && !cs.serviceArea.ContainsPoint(lat, lon) {
+		return fmt.Errorf("the location (%f,%f) is outside of the service area", lat, lon)
+	}
+
+	return nil
+}
+
+//observationStored updates the surface of the segment that a stored observation was matched to
+func (cs *contextSource) observationStored(observation *persistence.RoadSurfaceObserved) {
+	if observation.SegmentID == "" {
+		return
+	}
+
+	// The observation has already been stored, so a failure to update the segment
+	// is logged rather than returned
+	err := cs.updateRoadSegmentSurface(observation.SegmentID, observation.SurfaceType, observation.Probability, fusion.SourceObservation, observation.RoadSurfaceObservedID, observation.Timestamp)
+	if err != nil {
+		log.Errorf("Failed to update road segment %s from observation %s: %s", observation.SegmentID, observation.RoadSurfaceObservedID, err.Error())
+	}
+}
+
+//matchRoadSegment returns the id of the road segment nearest to an observation, or an
+//empty string if no segment is within the snap distance
+func (cs *contextSource) matchRoadSegment(rso *diwise.RoadSurfaceObserved) string {
+	if cs.snapDistance == 0 {
+		return ""
+	}
+
+	lon, lat := rso.Location.Value.Coordinates[0], rso.Location.Value.Coordinates[1]
+
+	segment, err := cs.db.GetNearestSegment(lat, lon, cs.snapDistance)
+	if err != nil {
+		if !errors.Is(err, database.ErrNotFound) {
+			log.Errorf("Failed to match observation %s to a road segment: %s", rso.ID, err.Error())
+		}
+		return ""
+	}
+
+	log.Infof("Observation %s at (%f,%f) matched to road segment %s.", rso.ID, lat, lon, segment.ID())
+
+	return segment.ID()
+}
+
+//updateRoadSegmentSurface enqueues a command to a replica of this service, to fuse a road
+//surface update with recent updates of the segment and publish the result to every replica.
+//The observation id is empty unless the update was made from an observation.
+func (cs *contextSource) updateRoadSegmentSurface(segmentID, surfaceType string, probability float64, source, observationID string, timestamp time.Time) error {
+	command := &commands.UpdateRoadSegmentSurface{
+		MessageID:     uuid.New().String(),
+		ID:            segmentID,
+		SurfaceType:   surfaceType,
+		Probability:   probability,
+		Source:        source,
+		ObservationID: observationID,
+		Timestamp:     timestamp.UTC().Format(time.RFC3339),
+	}
+
+	return cs.msg.NoteToSelf(command)
+}
+
+//filterFrom returns the q filter of a query, with any surface types that it compares with
+//replaced by their canonical names and the names of every type below them
+func (cs *contextSource) filterFrom(query ngsi.Query) (ngsiquery.Filter, error) {
+	filter, err := ngsiquery.FilterFrom(query)
+	if err != nil || filter == nil {
+		return filter, err
+	}
+
+	return ngsiquery.ExpandValues(filter, "surfaceType", cs.vocabulary.Expand)
+}
+
+//checkServiceArea returns an error if a geo-query can not match anything within the service
+//area. Disjoint queries are not checked, since a geometry outside of the service area is
+//disjoint from everything within it.
+func (cs *contextSource) checkServiceArea(geoQ *ngsiquery.GeoQuery) error {
+	if cs.serviceArea == nil || geoQ == nil {
+		return nil
+	}
+
+	var withinServiceArea bool
+
+	if geoQ.GeoRel == ngsiquery.GeoRelNear {
+		withinServiceArea = cs.serviceArea.IsWithinDistanceFromPoint(geoQ.Point.Lat, geoQ.Point.Lon, geoQ.MaxDistance)
+	} else if geoQ.IsBoundingBox() {
+		lon0, lat0, lon1, lat1 := geoQ.BoundingBox()
+		withinServiceArea = cs.serviceArea.IntersectsRect(lat0, lon0, lat1, lon1)
+	} else if geoQ.Relation() == geometry.RelationDisjoint {
+		withinServiceArea = true
+	} else {
+		withinServiceArea = cs.serviceArea.IntersectsGeometry(geoQ.Geometry)
+	}
+
+	if !withinServiceArea {
+		return ngsiquery.NewBadRequestDataError("the geo-query does not cover any part of the service area")
+	}
+
+	return nil
+}
+
+//decayedSegment reports the surface of a segment as it is at the time of a query
+type decayedSegment struct {
+	database.RoadSegment
+	distribution fusion.Distribution
+}
+
+func (s *decayedSegment) SurfaceType() (string, float64) {
+	return s.distribution.MostLikely()
+}
+
+func (s *decayedSegment) SurfaceTypeDistribution() fusion.Distribution {
+	return s.distribution
+}
+
+//withDecay applies the decay rules to the surface types of segments
+func (cs *contextSource) withDecay(segments []database.RoadSegment, now time.Time) []database.RoadSegment {
+	if cs.decayRules == nil {
+		return segments
+	}
+
+	decayed := make([]database.RoadSegment, 0, len(segments))
+
+	for _, s := range segments {
+		modified, confirmed := s.DateModified(), s.DateConfirmed()
+		if modified != nil && confirmed != nil && len(s.SurfaceTypeDistribution()) > 0 {
+			distribution := cs.decayRules.Apply(s.SurfaceTypeDistribution(), *modified, *confirmed, s.Attributes(), now)
+			s = &decayedSegment{RoadSegment: s, distribution: distribution}
+		}
+
+		decayed = append(decayed, s)
+	}
+
+	return decayed
+}
+
 func (cs *contextSource) getRoads(query ngsi.Query, callback ngsi.QueryEntitiesCallback) error {
 	var err error
 
 	roads := []database.Road{}
 
-	if query.IsGeoQuery() {
-		geoQ := query.Geo()
-		if geoQ.GeoRel == ngsi.GeoSpatialRelationNearPoint {
-			lon, lat, _ := geoQ.Point()
-			distance, _ := geoQ.Distance()
-			roads, err = cs.db.GetRoadsNearPoint(lat, lon, uint64(distance))
-		} else if geoQ.GeoRel == ngsi.GeoSpatialRelationWithinRect {
-			lon0, lat0, lon1, lat1, err := geoQ.Rectangle()
-			if err != nil {
-				return err
-			}
-			roads, _ = cs.db.GetRoadsWithinRect(lat0, lon0, lat1, lon1)
-		}
+	geoQ, err := ngsiquery.GeoQueryFrom(query)
+	if err != nil {
+		return err
+	}
+
+	err = cs.checkServiceArea(geoQ)
+	if err != nil {
+		return err
+	}
+
+	filter, err := cs.filterFrom(query)
+	if err != nil {
+		return err
 	}
 
-	numberOfRoads := uint64(len(roads))
+	pagination, err := ngsiquery.PaginationFrom(query)
+	if err != nil {
+		return err
+	}
 
-	firstIndex := query.PaginationOffset()
-	stopIndex := firstIndex + query.PaginationLimit()
+	if geoQ != nil {
+		if geoQ.GeoRel == ngsiquery.GeoRelNear {
+			roads, err = cs.db.GetRoadsNearPoint(geoQ.Point.Lat, geoQ.Point.Lon, geoQ.MaxDistance)
+		} else if geoQ.IsBoundingBox() {
+			lon0, lat0, lon1, lat1 := geoQ.BoundingBox()
+			roads, err = cs.db.GetRoadsWithinRect(lat0, lon0, lat1, lon1)
+		} else {
+			roads, err = cs.db.GetRoadsMatchingGeometry(geoQ.Relation(), geoQ.Geometry)
+		}
+	} else if filter != nil {
+		// A q filter limits the result enough to not require a geo-query
+		roads, err = cs.db.GetAllRoads()
+	}
 
-	if stopIndex > numberOfRoads {
-		stopIndex = numberOfRoads
+	if err != nil {
+		return err
 	}
 
-	if firstIndex > 0 || stopIndex != numberOfRoads {
-		log.Infof("Returning road %d to %d of %d", firstIndex, stopIndex-1, numberOfRoads)
+	if filter != nil {
+		roads = filterRoads(roads, filter)
 	}
 
-	for i := firstIndex; i < stopIndex; i++ {
-		r := roads[i]
-		fwRoad := fiware.NewRoad(r.ID(), r.ID(), "class", r.GetSegmentIdentities())
+	sort.Slice(roads, func(i, j int) bool {
+		return roads[i].ID() < roads[j].ID()
+	})
+
+	ids := make([]string, 0, len(roads))
+	for _, r := range roads {
+		ids = append(ids, fiware.RoadIDPrefix+r.ID())
+	}
+
+	firstIndex, stopIndex := page(query, pagination, ids, "road")
 
-		err = callback(fwRoad)
+	for i := firstIndex; i < stopIndex; i++ {
+		err = callback(newFiwareRoad(roads[i]))
 		if err != nil {
 			break
 		}
@@ -96,63 +347,65 @@ func (cs *contextSource) getRoadSegments(query ngsi.Query, callback ngsi.QueryEn
 
 	segments := []database.RoadSegment{}
 
-	if query.IsGeoQuery() {
-		geoQ := query.Geo()
-		if geoQ.GeoRel == ngsi.GeoSpatialRelationNearPoint {
-			lon, lat, _ := geoQ.Point()
-			distance, _ := geoQ.Distance()
-			segments, err = cs.db.GetSegmentsNearPoint(lat, lon, uint64(distance))
-		} else if geoQ.GeoRel == ngsi.GeoSpatialRelationWithinRect {
-			lon0, lat0, lon1, lat1, err := geoQ.Rectangle()
-			if err != nil {
-				return err
-			}
-			segments, _ = cs.db.GetSegmentsWithinRect(lat0, lon0, lat1, lon1)
-		}
+	geoQ, err := ngsiquery.GeoQueryFrom(query)
+	if err != nil {
+		return err
 	}
 
-	numberOfSegments := uint64(len(segments))
-
-	firstIndex := query.PaginationOffset()
-	stopIndex := firstIndex + query.PaginationLimit()
+	err = cs.checkServiceArea(geoQ)
+	if err != nil {
+		return err
+	}
 
-	if stopIndex > numberOfSegments {
-		stopIndex = numberOfSegments
+	filter, err := cs.filterFrom(query)
+	if err != nil {
+		return err
 	}
 
-	if firstIndex > 0 || stopIndex != numberOfSegments {
-		log.Infof("Returning segment %d to %d of %d", firstIndex, stopIndex-1, numberOfSegments)
+	pagination, err := ngsiquery.PaginationFrom(query)
+	if err != nil {
+		return err
 	}
 
-	sort.Slice(segments, func(i, j int) bool {
-		iTime := segments[i].DateModified()
-		jTime := segments[j].DateModified()
-
-		// Sort by time first with most recently updated at the top
-		// TODO: Remove this when we have working pagination as it breaks pageability of the data
-		if iTime != nil {
-			if jTime != nil {
-				// We want the most reent to come first, so it is less if it is after ...
-				return iTime.After(*jTime)
-			} else {
-				return true
-			}
-		} else if jTime != nil {
-			return false
+	if geoQ != nil {
+		if geoQ.GeoRel == ngsiquery.GeoRelNear {
+			segments, err = cs.db.GetSegmentsNearPoint(geoQ.Point.Lat, geoQ.Point.Lon, geoQ.MaxDistance)
+		} else if geoQ.IsBoundingBox() {
+			lon0, lat0, lon1, lat1 := geoQ.BoundingBox()
+			segments, err = cs.db.GetSegmentsWithinRect(lat0, lon0, lat1, lon1)
+		} else {
+			segments, err = cs.db.GetSegmentsMatchingGeometry(geoQ.Relation(), geoQ.Geometry)
 		}
+	} else if filter != nil {
+		// A q filter limits the result enough to not require a geo-query
+		segments, err = cs.db.GetAllSegments()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	segments = cs.withDecay(segments, time.Now())
 
-		// Neither segment have been updated. Sort by segment id
-		return strings.Compare(segments[i].ID(), segments[j].ID()) < 0
+	if filter != nil {
+		segments = filterSegments(segments, filter)
+	}
+
+	// Segments are paged in order of their ids, so that pages keep their place while
+	// segments are updated
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].ID() < segments[j].ID()
 	})
 
-	for i := firstIndex; i < stopIndex; i++ {
-		s := segments[i]
-		rs := fiware.NewRoadSegment(s.ID(), s.ID(), s.RoadID(), s.Coordinates(), s.DateModified())
+	ids := make([]string, 0, len(segments))
+	for _, s := range segments {
+		ids = append(ids, fiware.RoadSegmentIDPrefix+s.ID())
+	}
 
-		surfaceType, probability := s.SurfaceType()
-		rs = rs.WithSurfaceType(surfaceType, probability)
+	firstIndex, stopIndex := page(query, pagination, ids, "segment")
 
-		err = callback(rs)
+	for i := firstIndex; i < stopIndex; i++ {
+		err = callback(newRoadSegmentEntity(segments[i], query.EntityAttributes()))
 		if err != nil {
 			break
 		}
@@ -162,20 +415,60 @@ func (cs *contextSource) getRoadSegments(query ngsi.Query, callback ngsi.QueryEn
 }
 
 func (cs *contextSource) getRoadSurfaceObserved(query ngsi.Query, callback ngsi.QueryEntitiesCallback) error {
+	filter, err := cs.filterFrom(query)
+	if err != nil {
+		return err
+	}
+
+	pagination, err := ngsiquery.PaginationFrom(query)
+	if err != nil {
+		return err
+	}
+
 	roadSurfaces, err := cs.db.GetRoadSurfacesObserved()
 	if err != nil {
 		return err
 	}
-	for _, rso := range roadSurfaces {
-		diwiseRoadSurface := diwise.NewRoadSurfaceObserved(rso.RoadSurfaceObservedID, rso.SurfaceType, rso.Probability, rso.Latitude, rso.Longitude)
-		diwiseRoadSurface.DateObserved = ngsitypes.CreateDateTimeProperty(rso.Timestamp.Format(time.RFC3339))
-		err = callback(diwiseRoadSurface)
+
+	entities := []*diwise.RoadSurfaceObserved{}
+
+	for idx := range roadSurfaces {
+		entity := newDiwiseRoadSurfaceObserved(&roadSurfaces[idx])
+		if filter == nil || matchesEntity(filter, entity) {
+			entities = append(entities, entity)
+		}
+	}
+
+	sort.Slice(entities, func(i, j int) bool {
+		return entities[i].ID < entities[j].ID
+	})
+
+	ids := make([]string, 0, len(entities))
+	for _, e := range entities {
+		ids = append(ids, e.ID)
+	}
+
+	firstIndex, stopIndex := page(query, pagination, ids, "observation")
+
+	for i := firstIndex; i < stopIndex; i++ {
+		err = callback(entities[i])
 		if err != nil {
 			break
 		}
 	}
 
-	return nil
+	return err
+}
+
+//page returns the range of a sorted list of entity ids that a query asks for
+func page(query ngsi.Query, pagination *ngsiquery.Pagination, ids []string, kind string) (uint64, uint64) {
+	firstIndex, stopIndex := pagination.Page(ids, query.PaginationOffset(), query.PaginationLimit())
+
+	if firstIndex > 0 || stopIndex != uint64(len(ids)) {
+		log.Infof("Returning %s %d to %d of %d", kind, firstIndex, int64(stopIndex)-1, len(ids))
+	}
+
+	return firstIndex, stopIndex
 }
 
 func (cs *contextSource) GetEntities(query ngsi.Query, callback ngsi.QueryEntitiesCallback) error {
@@ -214,7 +507,119 @@ func (cs contextSource) ProvidesType(typeName string) bool {
 }
 
 func (cs contextSource) RetrieveEntity(entityID string, request ngsi.Request) (ngsi.Entity, error) {
-	return nil, nil
+	var entity ngsi.Entity
+
+	if strings.HasPrefix(entityID, fiware.RoadIDPrefix) {
+		road, err := cs.db.GetRoadByID(strings.TrimPrefix(entityID, fiware.RoadIDPrefix))
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		entity = newFiwareRoad(road)
+	} else if strings.HasPrefix(entityID, fiware.RoadSegmentIDPrefix) {
+		segment, err := cs.db.GetRoadSegmentByID(strings.TrimPrefix(entityID, fiware.RoadSegmentIDPrefix))
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		segment = cs.withDecay([]database.RoadSegment{segment}, time.Now())[0]
+		entity = newRoadSegmentEntity(segment, format.Attributes(request.Request()))
+	} else if strings.HasPrefix(entityID, diwise.RoadSurfaceObservedIDPrefix) {
+		rso, err := cs.db.GetRoadSurfaceObservedByID(strings.TrimPrefix(entityID, diwise.RoadSurfaceObservedIDPrefix))
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		entity = newDiwiseRoadSurfaceObserved(rso)
+	} else {
+		return nil, nil
+	}
+
+	return format.FromRequest(entity, request.Request())
+}
+
+func newFiwareRoad(r database.Road) *fiware.Road {
+	name := r.Name()
+	if name == "" {
+		name = r.ID()
+	}
+
+	roadClass := r.RoadClass()
+	if roadClass == "" {
+		roadClass = "class"
+	}
+
+	return fiware.NewRoad(r.ID(), name, roadClass, r.GetSegmentIdentities())
+}
+
+//segmentName returns the name of a segment, or its id if it has no name
+func segmentName(s database.RoadSegment) string {
+	if name := s.Name(); name != "" {
+		return name
+	}
+	return s.ID()
+}
+
+func newFiwareRoadSegment(s database.RoadSegment) *fiware.RoadSegment {
+	rs := fiware.NewRoadSegment(s.ID(), segmentName(s), s.RoadID(), s.Coordinates(), s.DateModified())
+
+	surfaceType, probability := s.SurfaceType()
+	return rs.WithSurfaceType(surfaceType, probability)
+}
+
+//SurfaceTypeDistributionAttribute is the name of the attribute that holds the fused
+//probabilities of every surface type of a road segment. It is only returned when asked for.
+const SurfaceTypeDistributionAttribute string = "surfaceTypeDistribution"
+
+type surfaceTypeDistributionProperty struct {
+	ngsitypes.Property
+	Value map[string]float64 `json:"value"`
+}
+
+//roadSegmentWithDistribution extends a road segment with its surface type distribution
+type roadSegmentWithDistribution struct {
+	*fiware.RoadSegment
+	SurfaceTypeDistribution *surfaceTypeDistributionProperty `json:"surfaceTypeDistribution,omitempty"`
+}
+
+//newRoadSegmentEntity returns the entity of a segment, together with its surface type
+//distribution if it is one of the requested attributes
+func newRoadSegmentEntity(s database.RoadSegment, attrs []string) ngsi.Entity {
+	rs := newFiwareRoadSegment(s)
+
+	for _, attr := range attrs {
+		if attr == SurfaceTypeDistributionAttribute {
+			entity := &roadSegmentWithDistribution{RoadSegment: rs}
+
+			if distribution := s.SurfaceTypeDistribution(); len(distribution) > 0 {
+				entity.SurfaceTypeDistribution = &surfaceTypeDistributionProperty{
+					Property: ngsitypes.Property{Type: "Property"},
+					Value:    distribution,
+				}
+			}
+
+			return entity
+		}
+	}
+
+	return rs
+}
+
+func newDiwiseRoadSurfaceObserved(rso *persistence.RoadSurfaceObserved) *diwise.RoadSurfaceObserved {
+	diwiseRoadSurface := diwise.NewRoadSurfaceObserved(rso.RoadSurfaceObservedID, rso.SurfaceType, rso.Probability, rso.Latitude, rso.Longitude)
+	diwiseRoadSurface.DateObserved = ngsitypes.CreateDateTimeProperty(rso.Timestamp.Format(time.RFC3339))
+
+	if rso.SegmentID != "" {
+		diwiseRoadSurface.WithRoadSegment(fiware.RoadSegmentIDPrefix + rso.SegmentID)
+	}
+
+	return diwiseRoadSurface
 }
 
 func (cs contextSource) UpdateEntityAttributes(entityID string, req ngsi.Request) error {
@@ -229,23 +634,32 @@ func (cs contextSource) UpdateEntityAttributes(entityID string, req ngsi.Request
 		return err
 	}
 
+	return cs.updateRoadSegment(strings.TrimPrefix(entityID, fiware.RoadSegmentIDPrefix), updateSource)
+}
+
+//updateRoadSegment validates an update of the surface type of a segment, and enqueues it
+func (cs *contextSource) updateRoadSegment(segmentID string, updateSource *fiware.RoadSegment) error {
 	if updateSource.SurfaceType == nil {
 		return errors.New("UpdateEntityAttributes only supports the surfaceType property which MUST be non null")
 	}
 
-	segment, err := cs.db.GetRoadSegmentByID(entityID[24:])
+	surfaceType, err := cs.vocabulary.Canonical(updateSource.SurfaceType.Value)
 	if err != nil {
 		return err
 	}
 
-	//Enqueue a command to a replica of this service, to persist the road surface update
-	command := &commands.UpdateRoadSegmentSurface{
-		ID:          segment.ID(),
-		SurfaceType: strings.ToLower(updateSource.SurfaceType.Value),
-		Probability: updateSource.SurfaceType.Probability,
-		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+	segment, err := cs.db.GetRoadSegmentByID(segmentID)
+	if err != nil {
+		return err
+	}
+
+	if cs.serviceArea != nil && !cs.serviceArea.IntersectsLineString(lineStringFromCoordinates(segment.Coordinates())) {
+		return fmt.Errorf("the road segment %s is outside of the service area", segment.ID())
 	}
-	err = cs.msg.NoteToSelf(command)
+
+	err = cs.updateRoadSegmentSurface(
+		segment.ID(), surfaceType, updateSource.SurfaceType.Probability, fusion.SourceAPI, "", time.Now(),
+	)
 	if err != nil {
 		log.Error(err.Error())
 		return errors.New("failed to update entity attributes")
@@ -253,3 +667,102 @@ func (cs contextSource) UpdateEntityAttributes(entityID string, req ngsi.Request
 
 	return nil
 }
+
+func lineStringFromCoordinates(coordinates [][2]float64) geometry.LineString {
+	line := make(geometry.LineString, 0, len(coordinates))
+	for _, pos := range coordinates {
+		line = append(line, geometry.NewPoint(pos[1], pos[0]))
+	}
+	return line
+}
+
+//DeleteEntity deletes a RoadSurfaceObserved, and retracts the prediction of the surface of
+//the segment that it was matched to. Roads and RoadSegments can not be deleted.
+func (cs *contextSource) DeleteEntity(entityID string) error {
+	if !strings.HasPrefix(entityID, diwise.RoadSurfaceObservedIDPrefix) {
+		return fmt.Errorf("the entity %s can not be deleted", entityID)
+	}
+
+	observation, err := cs.db.GetRoadSurfaceObservedByID(strings.TrimPrefix(entityID, diwise.RoadSurfaceObservedIDPrefix))
+	if err != nil {
+		return err
+	}
+
+	return cs.deleteRoadSurfacesObserved([]persistence.RoadSurfaceObserved{*observation})
+}
+
+//deleteRoadSurfacesObserved deletes a set of observations in a single transaction, and then
+//retracts the predictions that were made from them
+func (cs *contextSource) deleteRoadSurfacesObserved(observations []persistence.RoadSurfaceObserved) error {
+	ids := make([]string, 0, len(observations))
+	for _, observation := range observations {
+		ids = append(ids, observation.RoadSurfaceObservedID)
+	}
+
+	err := cs.db.DeleteRoadSurfacesObserved(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, observation := range observations {
+		if observation.SegmentID == "" {
+			continue
+		}
+
+		// The observation has already been deleted, so a failure to retract its
+		// prediction is logged rather than returned
+		err = cs.msg.NoteToSelf(&commands.RetractRoadSegmentSurface{ID: observation.SegmentID, ObservationID: observation.RoadSurfaceObservedID})
+		if err != nil {
+			log.Errorf("Failed to retract observation %s from road segment %s: %s", observation.RoadSurfaceObservedID, observation.SegmentID, err.Error())
+		}
+	}
+
+	return nil
+}
+
+//DeleteEntityAttribute retracts the most recent surfaceType of a RoadSegment that was set
+//through the API, or every one of them if deleteAll is set, so that a wrong update can be
+//undone. The surface of the segment is then fused anew from the predictions that remain.
+func (cs *contextSource) DeleteEntityAttribute(entityID, attribute string, deleteAll bool) error {
+	if !strings.HasPrefix(entityID, fiware.RoadSegmentIDPrefix) || attribute != "surfaceType" {
+		return fmt.Errorf("only the surfaceType of a RoadSegment can be deleted")
+	}
+
+	segmentID := strings.TrimPrefix(entityID, fiware.RoadSegmentIDPrefix)
+
+	_, err := cs.db.GetRoadSegmentByID(segmentID)
+	if err != nil {
+		return err
+	}
+
+	predictions, err := cs.db.GetSurfaceTypePredictions([]string{segmentID}, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	// Predictions are ordered by time, so the last one from the API is the most recent
+	retracted := []uint{}
+	for _, p := range predictions[segmentID] {
+		if p.Source != fusion.SourceAPI {
+			continue
+		}
+
+		if deleteAll {
+			retracted = append(retracted, p.ID)
+		} else {
+			retracted = []uint{p.ID}
+		}
+	}
+
+	if len(retracted) == 0 {
+		return fmt.Errorf("the surfaceType of road segment %s has not been set through the API: %w", segmentID, database.ErrNotFound)
+	}
+
+	err = cs.msg.NoteToSelf(&commands.RetractRoadSegmentSurface{ID: segmentID, Predictions: retracted})
+	if err != nil {
+		log.Error(err.Error())
+		return errors.New("failed to delete entity attribute")
+	}
+
+	return nil
+}
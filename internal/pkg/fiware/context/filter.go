@@ -0,0 +1,83 @@
+package context
+
+import (
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/format"
+	ngsiquery "github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/query"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//segmentTarget evaluates q filters directly against a road segment, so that the common
+//attributes can be filtered on without converting every segment into an NGSI entity
+type segmentTarget struct {
+	segment database.RoadSegment
+	entity  ngsiquery.Target
+}
+
+func (st *segmentTarget) AttributeValue(path string) (interface{}, bool) {
+	surfaceType, probability := st.segment.SurfaceType()
+
+	switch path {
+	case "id":
+		return fiware.RoadSegmentIDPrefix + st.segment.ID(), true
+	case "refRoad":
+		return fiware.RoadIDPrefix + st.segment.RoadID(), true
+	case "surfaceType":
+		return surfaceType, surfaceType != ""
+	case "surfaceType.probability":
+		return probability, surfaceType != ""
+	case "dateModified":
+		if modified := st.segment.DateModified(); modified != nil {
+			return *modified, true
+		}
+		return nil, false
+	}
+
+	// Fall back to the generic representation for anything else
+	if st.entity == nil {
+		attributes, err := format.ToMap(newFiwareRoadSegment(st.segment))
+		if err != nil {
+			return nil, false
+		}
+		st.entity = ngsiquery.NewEntityTarget(attributes)
+	}
+
+	return st.entity.AttributeValue(path)
+}
+
+func filterSegments(segments []database.RoadSegment, filter ngsiquery.Filter) []database.RoadSegment {
+	matching := []database.RoadSegment{}
+
+	for _, segment := range segments {
+		if filter.Matches(&segmentTarget{segment: segment}) {
+			matching = append(matching, segment)
+		}
+	}
+
+	return matching
+}
+
+func filterRoads(roads []database.Road, filter ngsiquery.Filter) []database.Road {
+	matching := []database.Road{}
+
+	for _, road := range roads {
+		if matchesEntity(filter, newFiwareRoad(road)) {
+			matching = append(matching, road)
+		}
+	}
+
+	return matching
+}
+
+func matchesEntity(filter ngsiquery.Filter, entity ngsi.Entity) bool {
+	attributes, err := format.ToMap(entity)
+	if err != nil {
+		log.Errorf("Failed to convert entity for filtering: %s", err.Error())
+		return false
+	}
+
+	return filter.Matches(ngsiquery.NewEntityTarget(attributes))
+}
@@ -0,0 +1,198 @@
+package context
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	ngsiquery "github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/query"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/persistence"
+	diwise "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/diwise"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
+	ngsitypes "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/types"
+)
+
+//temporalEntity is the temporal representation of an entity, where each attribute is
+//represented by a list of its values over time
+type temporalEntity struct {
+	ngsitypes.BaseEntity
+	SurfaceType []surfaceTypeInstance `json:"surfaceType,omitempty"`
+}
+
+type surfaceTypeInstance struct {
+	Type        string  `json:"type"`
+	Value       string  `json:"value"`
+	Probability float64 `json:"probability"`
+	ObservedAt  string  `json:"observedAt"`
+}
+
+func newTemporalEntity(id, typeName string) *temporalEntity {
+	return &temporalEntity{
+		BaseEntity: ngsitypes.BaseEntity{
+			ID:   id,
+			Type: typeName,
+			Context: []string{
+				"https://schema.lab.fiware.org/ld/context",
+				"https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld",
+			},
+		},
+		SurfaceType: []surfaceTypeInstance{},
+	}
+}
+
+func (te *temporalEntity) addSurfaceType(surfaceType string, probability float64, observedAt time.Time) {
+	te.SurfaceType = append(te.SurfaceType, surfaceTypeInstance{
+		Type:        "Property",
+		Value:       surfaceType,
+		Probability: probability,
+		ObservedAt:  observedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+//keepLastN drops all but the n most recent instances. Instances are added in time order.
+func (te *temporalEntity) keepLastN(n uint64) {
+	if n > 0 && uint64(len(te.SurfaceType)) > n {
+		te.SurfaceType = te.SurfaceType[uint64(len(te.SurfaceType))-n:]
+	}
+}
+
+func newTemporalRoadSegment(segmentID string, predictions []persistence.SurfaceTypePrediction, tq *ngsiquery.TemporalQuery) *temporalEntity {
+	te := newTemporalEntity(fiware.RoadSegmentIDPrefix+segmentID, "RoadSegment")
+
+	for _, p := range predictions {
+		te.addSurfaceType(p.SurfaceType, p.Probability, p.Timestamp)
+	}
+
+	te.keepLastN(tq.LastN)
+	return te
+}
+
+func newTemporalRoadSurfaceObserved(rso *persistence.RoadSurfaceObserved) *temporalEntity {
+	te := newTemporalEntity(diwise.RoadSurfaceObservedIDPrefix+rso.RoadSurfaceObservedID, "RoadSurfaceObserved")
+	te.addSurfaceType(rso.SurfaceType, rso.Probability, rso.Timestamp)
+	return te
+}
+
+//GetTemporalEntities passes the temporal representation of all entities that match the
+//temporal query to the callback. Entities only have a surface type, so nothing matches a
+//query for other attributes.
+func (cs *contextSource) GetTemporalEntities(tq *ngsiquery.TemporalQuery, callback ngsi.QueryEntitiesCallback) error {
+	from, to := tq.TimeSpan()
+
+	for _, typeName := range tq.Types {
+		if typeName == "Road" {
+			return ngsiquery.NewBadRequestDataError("temporal queries are not supported for the type Road")
+		}
+
+		if !tq.IncludesAttribute("surfaceType") {
+			continue
+		}
+
+		if typeName == "RoadSegment" {
+			segmentIDs := idsWithPrefix(tq.EntityIDs, fiware.RoadSegmentIDPrefix)
+			if len(tq.EntityIDs) > 0 && len(segmentIDs) == 0 {
+				continue
+			}
+
+			predictions, err := cs.db.GetSurfaceTypePredictions(segmentIDs, from, to)
+			if err != nil {
+				return err
+			}
+
+			// Return the segments in a stable order
+			ids := make([]string, 0, len(predictions))
+			for id := range predictions {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+
+			for _, id := range ids {
+				err = callback(newTemporalRoadSegment(id, predictions[id], tq))
+				if err != nil {
+					return err
+				}
+			}
+		} else if typeName == "RoadSurfaceObserved" {
+			observationIDs := idsWithPrefix(tq.EntityIDs, diwise.RoadSurfaceObservedIDPrefix)
+			if len(tq.EntityIDs) > 0 && len(observationIDs) == 0 {
+				continue
+			}
+
+			observations, err := cs.db.GetRoadSurfacesObservedBetween(observationIDs, from, to)
+			if err != nil {
+				return err
+			}
+
+			for idx := range observations {
+				err = callback(newTemporalRoadSurfaceObserved(&observations[idx]))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+//idsWithPrefix returns the ids, without their prefix, of the entities whose ids start with it
+func idsWithPrefix(entityIDs []string, prefix string) []string {
+	ids := []string{}
+
+	for _, id := range entityIDs {
+		if strings.HasPrefix(id, prefix) {
+			ids = append(ids, strings.TrimPrefix(id, prefix))
+		}
+	}
+
+	return ids
+}
+
+//RetrieveTemporalEntity returns the temporal representation of a single entity, or nil
+//if the entity does not exist. The entity has no attributes unless its surface type is
+//requested.
+func (cs *contextSource) RetrieveTemporalEntity(entityID string, tq *ngsiquery.TemporalQuery) (ngsi.Entity, error) {
+	from, to := tq.TimeSpan()
+
+	if strings.HasPrefix(entityID, fiware.RoadSegmentIDPrefix) {
+		segmentID := strings.TrimPrefix(entityID, fiware.RoadSegmentIDPrefix)
+
+		if _, err := cs.db.GetRoadSegmentByID(segmentID); err != nil {
+			return nil, nil
+		}
+
+		predictions, err := cs.db.GetSurfaceTypePredictions([]string{segmentID}, from, to)
+		if err != nil {
+			return nil, err
+		}
+
+		te := newTemporalRoadSegment(segmentID, predictions[segmentID], tq)
+		if !tq.IncludesAttribute("surfaceType") {
+			te.SurfaceType = nil
+		}
+
+		return te, nil
+	} else if strings.HasPrefix(entityID, diwise.RoadSurfaceObservedIDPrefix) {
+		rso, err := cs.db.GetRoadSurfaceObservedByID(strings.TrimPrefix(entityID, diwise.RoadSurfaceObservedIDPrefix))
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		te := newTemporalRoadSurfaceObserved(rso)
+		if !tq.Includes(rso.Timestamp) || !tq.IncludesAttribute("surfaceType") {
+			te.SurfaceType = nil
+		}
+
+		return te, nil
+	} else if strings.HasPrefix(entityID, fiware.RoadIDPrefix) {
+		return nil, ngsiquery.NewBadRequestDataError("temporal retrieval is not supported for the type Road")
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,135 @@
+package format
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
+)
+
+//FromRequest applies the attrs and options=keyValues parameters of a request to an
+//entity. The entity is returned as is when neither parameter is present.
+func FromRequest(entity ngsi.Entity, r *http.Request) (ngsi.Entity, error) {
+	if r == nil {
+		return entity, nil
+	}
+
+	attrs := Attributes(r)
+	keyValues := false
+
+	for _, option := range ParseListParameter(r.URL.Query().Get("options")) {
+		if option == "keyValues" {
+			keyValues = true
+		}
+	}
+
+	return Entity(entity, attrs, keyValues)
+}
+
+//Attributes returns the attributes that are named by the attrs parameter of a request
+func Attributes(r *http.Request) []string {
+	if r == nil {
+		return []string{}
+	}
+
+	return ParseListParameter(r.URL.Query().Get("attrs"))
+}
+
+//Entity limits an entity to a set of attributes, if any are supplied, and optionally
+//simplifies it to its keyValues representation
+func Entity(entity ngsi.Entity, attrs []string, keyValues bool) (ngsi.Entity, error) {
+	if len(attrs) == 0 && !keyValues {
+		return entity, nil
+	}
+
+	attributes, err := ToMap(entity)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, attribute := range attributes {
+		if isCoreMember(name) {
+			continue
+		}
+
+		if len(attrs) > 0 && !Contains(attrs, name) {
+			delete(attributes, name)
+			continue
+		}
+
+		if keyValues {
+			attributes[name] = simplifiedValue(attribute)
+		}
+	}
+
+	return attributes, nil
+}
+
+//ToMap converts an entity into a generic map of its JSON representation
+func ToMap(entity ngsi.Entity) (map[string]interface{}, error) {
+	if m, ok := entity.(map[string]interface{}); ok {
+		return m, nil
+	}
+
+	bytes, err := json.Marshal(entity)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := map[string]interface{}{}
+	err = json.Unmarshal(bytes, &attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	return attributes, nil
+}
+
+//simplifiedValue returns the value of a property or the object of a relationship
+func simplifiedValue(attribute interface{}) interface{} {
+	attr, ok := attribute.(map[string]interface{})
+	if !ok {
+		return attribute
+	}
+
+	if attr["type"] == "Relationship" {
+		return attr["object"]
+	}
+
+	if value, ok := attr["value"]; ok {
+		return value
+	}
+
+	return attribute
+}
+
+func isCoreMember(name string) bool {
+	return name == "id" || name == "type" || name == "@context"
+}
+
+//ParseListParameter splits a comma separated request parameter into its values, leaving out
+//any that are empty
+func ParseListParameter(parameter string) []string {
+	values := []string{}
+
+	for _, value := range strings.Split(parameter, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+//Contains returns true if a value is one of the values
+func Contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,113 @@
+package format
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
+)
+
+//GeoJSONContentType is the media type that clients use to ask for GeoJSON responses
+const GeoJSONContentType string = "application/geo+json"
+
+//Feature is the GeoJSON representation of an entity
+type Feature struct {
+	ID         string                 `json:"id"`
+	Type       string                 `json:"type"`
+	Geometry   interface{}            `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+//FeatureCollection is the GeoJSON representation of a list of entities
+type FeatureCollection struct {
+	Type     string     `json:"type"`
+	Features []*Feature `json:"features"`
+}
+
+//WantsGeoJSON returns true if the client prefers a GeoJSON response
+func WantsGeoJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType := strings.TrimSpace(strings.Split(mediaRange, ";")[0])
+			if mediaType == GeoJSONContentType {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//NewFeatureCollectionFromRequest converts entities into a FeatureCollection, limiting the
+//properties of each feature to the attrs parameter of the request if it is present
+func NewFeatureCollectionFromRequest(entities []ngsi.Entity, r *http.Request) (*FeatureCollection, error) {
+	attrs := ParseListParameter(r.URL.Query().Get("attrs"))
+	return NewFeatureCollection(entities, attrs)
+}
+
+//NewFeatureCollection converts entities into a FeatureCollection
+func NewFeatureCollection(entities []ngsi.Entity, attrs []string) (*FeatureCollection, error) {
+	fc := &FeatureCollection{Type: "FeatureCollection", Features: []*Feature{}}
+
+	for _, entity := range entities {
+		feature, err := NewFeature(entity, attrs)
+		if err != nil {
+			return nil, err
+		}
+		fc.Features = append(fc.Features, feature)
+	}
+
+	return fc, nil
+}
+
+//NewFeature converts an entity into a Feature, with the entity's location as geometry and
+//its other attributes as simplified properties. The probability of a surfaceType and the
+//road that a segment belongs to are flattened into the probability and roadID properties.
+func NewFeature(entity ngsi.Entity, attrs []string) (*Feature, error) {
+	attributes, err := ToMap(entity)
+	if err != nil {
+		return nil, err
+	}
+
+	feature := &Feature{Type: "Feature", Properties: map[string]interface{}{}}
+	feature.ID, _ = attributes["id"].(string)
+	feature.Properties["type"] = attributes["type"]
+
+	if location, ok := attributes["location"].(map[string]interface{}); ok {
+		feature.Geometry = location["value"]
+	}
+
+	for name, attribute := range attributes {
+		if isCoreMember(name) || (len(attrs) > 0 && !Contains(attrs, name)) {
+			continue
+		}
+
+		attr, isAttribute := attribute.(map[string]interface{})
+		if isAttribute && attr["type"] == "GeoProperty" {
+			continue
+		}
+
+		value := simplifiedValue(attribute)
+
+		if typed, ok := value.(map[string]interface{}); ok && typed["@value"] != nil {
+			value = typed["@value"]
+		}
+
+		switch name {
+		case "surfaceType":
+			if isAttribute && attr["probability"] != nil {
+				feature.Properties["probability"] = attr["probability"]
+			}
+		case "refRoad":
+			if roadID, ok := value.(string); ok {
+				feature.Properties["roadID"] = strings.TrimPrefix(roadID, fiware.RoadIDPrefix)
+				continue
+			}
+		}
+
+		feature.Properties[name] = value
+	}
+
+	return feature, nil
+}
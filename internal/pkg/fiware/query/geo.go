@@ -0,0 +1,282 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+)
+
+const (
+	//GeoRelNear describes a relation as a max distance from a Point
+	GeoRelNear string = "near"
+)
+
+//GeoQuery contains a parsed NGSI-LD geo-query
+type GeoQuery struct {
+	GeoRel       string
+	GeometryType string
+
+	//Point and MaxDistance are set for near queries
+	Point       geometry.Point
+	MaxDistance uint64
+
+	//Geometry is set for within, intersects, disjoint and overlaps queries
+	Geometry geometry.Geometry
+
+	boundingBox []geometry.Point
+}
+
+//IsBoundingBox returns true for legacy within queries that describe a rect using three
+//positions, of which the first and third are opposing corners. Such queries match
+//anything that overlaps the rect, and are kept for the benefit of older clients.
+func (gq *GeoQuery) IsBoundingBox() bool {
+	return gq.boundingBox != nil
+}
+
+//BoundingBox returns the corners of a legacy within query as lon0, lat0, lon1, lat1
+func (gq *GeoQuery) BoundingBox() (float64, float64, float64, float64) {
+	return gq.boundingBox[0].Lon, gq.boundingBox[0].Lat, gq.boundingBox[1].Lon, gq.boundingBox[1].Lat
+}
+
+//Relation returns the georel as a geometry.Relation
+func (gq *GeoQuery) Relation() geometry.Relation {
+	return geometry.Relation(gq.GeoRel)
+}
+
+//MatchesLineString returns true if a line string, such as the geometry of a road segment,
+//has the requested relation to the geometry of the query
+func (gq *GeoQuery) MatchesLineString(line geometry.LineString) bool {
+	if gq.GeoRel == GeoRelNear {
+		return geometry.DistanceToLineString(gq.Point, line) <= float64(gq.MaxDistance)
+	}
+
+	if gq.IsBoundingBox() {
+		sw, ne := line.BoundingBox()
+		lon0, lat0, lon1, lat1 := gq.BoundingBox()
+		return math.Max(sw.Lon, math.Min(lon0, lon1)) <= math.Min(ne.Lon, math.Max(lon0, lon1)) &&
+			math.Max(sw.Lat, math.Min(lat0, lat1)) <= math.Min(ne.Lat, math.Max(lat0, lat1))
+	}
+
+	if len(line) == 1 {
+		// Let a single position, such as the location of an observation, be represented by
+		// a degenerate line so that it can be tested for intersection
+		line = geometry.LineString{line[0], line[0]}
+	}
+
+	return geometry.Relates(gq.Relation(), gq.Geometry, line)
+}
+
+//NewGeoQueryFromParameters parses the georel, geometry and coordinates parameters into a
+//GeoQuery. A nil GeoQuery is returned if the parameters do not contain a geo-query.
+func NewGeoQueryFromParameters(params Parameters) (*GeoQuery, error) {
+	georel := params.Get("georel")
+	if georel == "" {
+		return nil, nil
+	}
+
+	modifiers := strings.Split(georel, ";")
+	gq := &GeoQuery{
+		GeoRel:       modifiers[0],
+		GeometryType: params.Get("geometry"),
+	}
+
+	// Older clients sometimes pass the distance modifiers as separate parameters
+	if maxDistance := params.Get("maxDistance"); maxDistance != "" {
+		modifiers = append(modifiers, "maxDistance="+maxDistance)
+	}
+
+	coordinates := params.Get("coordinates")
+	if coordinates == "" {
+		return nil, NewBadRequestDataError("a geo-query must specify the coordinates parameter")
+	}
+
+	var coords interface{}
+	err := json.Unmarshal([]byte(coordinates), &coords)
+	if err != nil {
+		return nil, NewBadRequestDataError("unable to parse coordinates %s: %s", coordinates, err.Error())
+	}
+
+	if gq.GeoRel == GeoRelNear {
+		return gq, gq.parseNear(modifiers[1:], coords)
+	}
+
+	if len(modifiers) > 1 {
+		return nil, NewBadRequestDataError("the georel %s does not accept any modifiers", gq.GeoRel)
+	}
+
+	switch gq.Relation() {
+	case geometry.RelationWithin, geometry.RelationOverlaps:
+		if gq.GeometryType != "Polygon" && gq.GeometryType != "MultiPolygon" {
+			return nil, NewBadRequestDataError("the georel %s is only supported for Polygon and MultiPolygon geometries", gq.GeoRel)
+		}
+	case geometry.RelationIntersects, geometry.RelationDisjoint:
+		if gq.GeometryType != "Polygon" && gq.GeometryType != "MultiPolygon" && gq.GeometryType != "LineString" {
+			return nil, NewBadRequestDataError("the georel %s is only supported for LineString, Polygon and MultiPolygon geometries", gq.GeoRel)
+		}
+	default:
+		return nil, NewBadRequestDataError("the georel %s is not supported", gq.GeoRel)
+	}
+
+	switch gq.GeometryType {
+	case "LineString":
+		gq.Geometry, err = parseLineString(coords)
+	case "Polygon":
+		if positions, err := parsePositions(coords); err == nil && len(positions) == 3 && gq.Relation() == geometry.RelationWithin {
+			gq.boundingBox = []geometry.Point{positions[0], positions[2]}
+			return gq, nil
+		}
+		gq.Geometry, err = parsePolygon(coords)
+	case "MultiPolygon":
+		gq.Geometry, err = parseMultiPolygon(coords)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return gq, nil
+}
+
+func (gq *GeoQuery) parseNear(modifiers []string, coords interface{}) error {
+	if gq.GeometryType != "Point" {
+		return NewBadRequestDataError("the georel near is only supported for the geometry type Point")
+	}
+
+	haveDistance := false
+
+	for _, modifier := range modifiers {
+		if strings.HasPrefix(modifier, "maxDistance==") || strings.HasPrefix(modifier, "maxDistance=") {
+			value := strings.TrimLeft(strings.TrimPrefix(modifier, "maxDistance"), "=")
+			distance, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return NewBadRequestDataError("failed to parse maxDistance %s as a non negative integer", value)
+			}
+			gq.MaxDistance = distance
+			haveDistance = true
+		} else {
+			return NewBadRequestDataError("unsupported near modifier %s", modifier)
+		}
+	}
+
+	if !haveDistance {
+		return NewBadRequestDataError("required modifier maxDistance is missing from georel near")
+	}
+
+	var err error
+	gq.Point, err = parsePosition(coords)
+	return err
+}
+
+func parsePosition(coords interface{}) (geometry.Point, error) {
+	position, ok := coords.([]interface{})
+	if !ok || len(position) < 2 {
+		return geometry.Point{}, NewBadRequestDataError("a position must be an array of at least two numbers")
+	}
+
+	lon, lonOK := position[0].(float64)
+	lat, latOK := position[1].(float64)
+
+	if !lonOK || !latOK {
+		return geometry.Point{}, NewBadRequestDataError("a position must be an array of at least two numbers")
+	}
+
+	if lon < -180 || lon > 180 || lat < -90 || lat > 90 {
+		return geometry.Point{}, NewBadRequestDataError("the position [%f,%f] is not a valid WGS84 coordinate", lon, lat)
+	}
+
+	return geometry.NewPoint(lat, lon), nil
+}
+
+func parsePositions(coords interface{}) ([]geometry.Point, error) {
+	list, ok := coords.([]interface{})
+	if !ok {
+		return nil, NewBadRequestDataError("expected an array of positions")
+	}
+
+	positions := []geometry.Point{}
+
+	for _, item := range list {
+		position, err := parsePosition(item)
+		if err != nil {
+			return nil, err
+		}
+		positions = append(positions, position)
+	}
+
+	return positions, nil
+}
+
+func parseLineString(coords interface{}) (geometry.LineString, error) {
+	positions, err := parsePositions(coords)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(positions) < 2 {
+		return nil, NewBadRequestDataError("a LineString must consist of at least two positions")
+	}
+
+	return geometry.LineString(positions), nil
+}
+
+func parsePolygon(coords interface{}) (geometry.Polygon, error) {
+	list, ok := coords.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, NewBadRequestDataError("a Polygon must be an array of one or more linear rings")
+	}
+
+	polygon := geometry.Polygon{}
+
+	for _, item := range list {
+		ring, err := parsePositions(item)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+			return nil, NewBadRequestDataError("a linear ring must consist of at least four positions, where the first and last are equal")
+		}
+
+		polygon = append(polygon, ring)
+	}
+
+	return polygon, nil
+}
+
+func parseMultiPolygon(coords interface{}) (geometry.MultiPolygon, error) {
+	list, ok := coords.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, NewBadRequestDataError("a MultiPolygon must be an array of one or more polygons")
+	}
+
+	multiPolygon := geometry.MultiPolygon{}
+
+	for _, item := range list {
+		polygon, err := parsePolygon(item)
+		if err != nil {
+			return nil, err
+		}
+		multiPolygon = append(multiPolygon, polygon)
+	}
+
+	return multiPolygon, nil
+}
+
+//BadRequestDataError is returned when a request is syntactically valid, but contains
+//data that can not be used to process it
+type BadRequestDataError struct {
+	detail string
+}
+
+//NewBadRequestDataError creates a new error with a formatted detail message
+func NewBadRequestDataError(format string, args ...interface{}) error {
+	return &BadRequestDataError{detail: fmt.Sprintf(format, args...)}
+}
+
+func (e *BadRequestDataError) Error() string {
+	return e.detail
+}
@@ -0,0 +1,125 @@
+package query
+
+import (
+	"encoding/base64"
+	"net/url"
+	"sort"
+	"strings"
+
+	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
+)
+
+//Pagination holds the cursor of a query, and collects what a response needs to let clients
+//page through the results. Results are paged in order of their entity ids, so that a page
+//keeps its place while entities are updated.
+type Pagination struct {
+	//After is the id of the last entity of the previous page, if the query has a cursor
+	After string
+	//Count is true if the client asked for the total number of results
+	Count bool
+
+	resultsCount uint64
+	next         string
+}
+
+//NewPaginationFromParameters parses the cursor and count parameters of a query
+func NewPaginationFromParameters(params Parameters) (*Pagination, error) {
+	p := &Pagination{}
+
+	if cursor := params.Get("cursor"); cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || len(after) == 0 {
+			return nil, NewBadRequestDataError("invalid cursor %s", cursor)
+		}
+		p.After = string(after)
+	}
+
+	if count := params.Get("count"); count != "" {
+		if count != "true" && count != "false" {
+			return nil, NewBadRequestDataError("count must be either true or false")
+		}
+		p.Count = (count == "true")
+	}
+
+	return p, nil
+}
+
+//PaginationFrom returns the pagination of an ngsi.Query. Queries that were not created by
+//this package are parsed again from their request.
+func PaginationFrom(q ngsi.Query) (*Pagination, error) {
+	if query, ok := q.(*Query); ok {
+		return query.Pagination(), nil
+	}
+
+	if q.Request() == nil {
+		return &Pagination{}, nil
+	}
+
+	return NewPaginationFromParameters(ParseParameters(q.Request().URL.RawQuery))
+}
+
+//Page returns the range of indices into a sorted list of entity ids that make up the
+//requested page. The page starts after the cursor, if any, and then skips offset ids. The
+//total number of ids, and the cursor of the next page if there is one, are kept for the
+//response.
+func (p *Pagination) Page(ids []string, offset, limit uint64) (first, stop uint64) {
+	total := uint64(len(ids))
+	p.resultsCount = total
+
+	if p.After != "" {
+		first = uint64(sort.SearchStrings(ids, p.After))
+		if first < total && ids[first] == p.After {
+			first++
+		}
+	}
+
+	first += offset
+	if first > total {
+		first = total
+	}
+
+	stop = first + limit
+	if stop > total {
+		stop = total
+	}
+
+	p.next = ""
+	if stop > first && stop < total {
+		p.next = ids[stop-1]
+	}
+
+	return first, stop
+}
+
+//ResultsCount returns the total number of results, regardless of pagination
+func (p *Pagination) ResultsCount() uint64 {
+	return p.resultsCount
+}
+
+//HasNext returns true if there are results after the current page
+func (p *Pagination) HasNext() bool {
+	return p.next != ""
+}
+
+//NextURL returns the url of the next page of a request, which keeps every parameter of
+//the request except its cursor and offset
+func (p *Pagination) NextURL(u *url.URL) string {
+	parts := []string{}
+
+	for _, part := range strings.Split(u.RawQuery, "&") {
+		key := part
+		if idx := strings.Index(part, "="); idx >= 0 {
+			key = part[:idx]
+		}
+
+		if part == "" || key == "cursor" || key == "offset" {
+			continue
+		}
+
+		parts = append(parts, part)
+	}
+
+	parts = append(parts, "cursor="+base64.RawURLEncoding.EncodeToString([]byte(p.next)))
+
+	return u.Path + "?" + strings.Join(parts, "&")
+}
@@ -0,0 +1,581 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Target is implemented by anything that a q filter can be evaluated against. Paths are
+//attribute names, optionally followed by a dot and the name of a sub attribute, such as
+//surfaceType.probability. Values are returned as strings, float64s, bools or time.Times.
+type Target interface {
+	AttributeValue(path string) (interface{}, bool)
+}
+
+//Filter is a parsed NGSI-LD q expression
+type Filter interface {
+	Matches(target Target) bool
+	String() string
+}
+
+//NewFilter parses an expression in the NGSI-LD query language, such as
+//surfaceType=="snow";surfaceType.probability>0.7. Terms are combined with ; (and) or
+//| (or) and may be grouped with parentheses, where and takes precedence over or.
+func NewFilter(q string) (Filter, error) {
+	p := &qParser{q: q}
+
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.done() {
+		return nil, p.errorf("unexpected character %q", p.q[p.pos])
+	}
+
+	return filter, nil
+}
+
+//ValueExpander returns the values that a value in a q expression stands for, such as the
+//canonical name of an alias, or a category followed by everything within it
+type ValueExpander func(value string) ([]string, error)
+
+//ExpandValues returns a copy of a filter, where every string that the attribute is tested
+//for equality or inequality with is replaced by the values that it expands to. The
+//attribute is then equal to a value if it is equal to any of its expansions.
+func ExpandValues(f Filter, attribute string, expand ValueExpander) (Filter, error) {
+	switch filter := f.(type) {
+	case andFilter:
+		expanded := andFilter{}
+		for _, term := range filter {
+			e, err := ExpandValues(term, attribute, expand)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, e)
+		}
+		return expanded, nil
+	case orFilter:
+		expanded := orFilter{}
+		for _, term := range filter {
+			e, err := ExpandValues(term, attribute, expand)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, e)
+		}
+		return expanded, nil
+	case *qTerm:
+		if filter.attribute != attribute || filter.isRange || (filter.op != opEqual && filter.op != opUnequal) {
+			return filter, nil
+		}
+
+		expanded := *filter
+		expanded.values = []qValue{}
+
+		for _, v := range filter.values {
+			if !v.isString {
+				expanded.values = append(expanded.values, v)
+				continue
+			}
+
+			values, err := expand(v.text)
+			if err != nil {
+				return nil, NewBadRequestDataError("invalid value of %s in q expression: %s", attribute, err.Error())
+			}
+
+			for _, value := range values {
+				expanded.values = append(expanded.values, newQValue(value, true))
+			}
+		}
+
+		return &expanded, nil
+	}
+
+	return f, nil
+}
+
+type andFilter []Filter
+
+func (f andFilter) Matches(target Target) bool {
+	for _, term := range f {
+		if !term.Matches(target) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f andFilter) String() string {
+	return joinFilters(f, ";")
+}
+
+type orFilter []Filter
+
+func (f orFilter) Matches(target Target) bool {
+	for _, term := range f {
+		if term.Matches(target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f orFilter) String() string {
+	return "(" + joinFilters(f, "|") + ")"
+}
+
+func joinFilters(filters []Filter, separator string) string {
+	terms := []string{}
+	for _, f := range filters {
+		terms = append(terms, f.String())
+	}
+	return strings.Join(terms, separator)
+}
+
+const (
+	opExists     string = ""
+	opEqual      string = "=="
+	opUnequal    string = "!="
+	opGreater    string = ">"
+	opGreaterEq  string = ">="
+	opLess       string = "<"
+	opLessEq     string = "<="
+	opPattern    string = "~="
+	opNotPattern string = "!~="
+)
+
+//operators are ordered so that no operator is preceded by one of its own prefixes
+var operators = []string{opNotPattern, opEqual, opUnequal, opGreaterEq, opLessEq, opPattern, opGreater, opLess}
+
+//qTerm compares an attribute with one or more values. A term with several values matches
+//if the attribute is equal to any of them, or is within the range if isRange is set.
+type qTerm struct {
+	attribute string
+	op        string
+	values    []qValue
+	isRange   bool
+	pattern   *regexp.Regexp
+	raw       string
+}
+
+func (t *qTerm) String() string {
+	return t.attribute + t.op + t.raw
+}
+
+func (t *qTerm) Matches(target Target) bool {
+	actual, ok := target.AttributeValue(t.attribute)
+	if !ok || actual == nil {
+		// Every kind of term, including the negated ones, requires the attribute to exist
+		return false
+	}
+
+	switch t.op {
+	case opExists:
+		return true
+	case opPattern, opNotPattern:
+		s, isString := actual.(string)
+		return isString && t.pattern.MatchString(s) == (t.op == opPattern)
+	}
+
+	if t.isRange {
+		lower, lok := t.values[0].compare(actual)
+		upper, uok := t.values[1].compare(actual)
+		inRange := lok && uok && lower >= 0 && upper <= 0
+		return inRange == (t.op == opEqual)
+	}
+
+	if t.op == opEqual || t.op == opUnequal {
+		for _, v := range t.values {
+			if c, ok := v.compare(actual); ok && c == 0 {
+				return t.op == opEqual
+			}
+		}
+		return t.op == opUnequal
+	}
+
+	c, ok := t.values[0].compare(actual)
+	if !ok {
+		return false
+	}
+
+	switch t.op {
+	case opGreater:
+		return c > 0
+	case opGreaterEq:
+		return c >= 0
+	case opLess:
+		return c < 0
+	case opLessEq:
+		return c <= 0
+	}
+
+	return false
+}
+
+//qValue is a literal from a q expression, parsed into every representation that it
+//could possibly be compared as
+type qValue struct {
+	text     string
+	quoted   bool
+	number   *float64
+	time     *time.Time
+	boolean  *bool
+	isString bool
+}
+
+func newQValue(text string, quoted bool) qValue {
+	v := qValue{text: text, quoted: quoted}
+
+	if t, err := parseDateTime(text); err == nil {
+		v.time = &t
+	}
+
+	if quoted {
+		v.isString = true
+		return v
+	}
+
+	if n, err := strconv.ParseFloat(text, 64); err == nil {
+		v.number = &n
+	} else if text == "true" || text == "false" {
+		b := text == "true"
+		v.boolean = &b
+	} else {
+		// Unquoted text, such as a URI, is compared as a string
+		v.isString = true
+	}
+
+	return v
+}
+
+//compare returns a negative number, zero or a positive number depending on if the
+//actual value is less than, equal to or greater than this value. The second return
+//value is false if the two values can not be compared.
+func (v qValue) compare(actual interface{}) (int, bool) {
+	switch a := actual.(type) {
+	case float64:
+		if v.number != nil {
+			return compareFloats(a, *v.number), true
+		}
+	case int:
+		if v.number != nil {
+			return compareFloats(float64(a), *v.number), true
+		}
+	case bool:
+		if v.boolean != nil && a == *v.boolean {
+			return 0, true
+		} else if v.boolean != nil {
+			return 1, true
+		}
+	case time.Time:
+		if v.time != nil {
+			return compareTimes(a, *v.time), true
+		}
+	case string:
+		if v.time != nil {
+			if t, err := parseDateTime(a); err == nil {
+				return compareTimes(t, *v.time), true
+			}
+		}
+		if v.isString {
+			return strings.Compare(a, v.text), true
+		}
+	}
+
+	return 0, false
+}
+
+func compareFloats(a, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func compareTimes(a, b time.Time) int {
+	if a.Before(b) {
+		return -1
+	} else if a.After(b) {
+		return 1
+	}
+	return 0
+}
+
+func parseDateTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+type qParser struct {
+	q   string
+	pos int
+}
+
+func (p *qParser) done() bool {
+	return p.pos >= len(p.q)
+}
+
+func (p *qParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.q[p.pos]
+}
+
+func (p *qParser) errorf(format string, args ...interface{}) error {
+	return NewBadRequestDataError("invalid q expression %s at position %d: %s", p.q, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *qParser) parseOr() (Filter, error) {
+	terms := orFilter{}
+
+	for {
+		term, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+
+		if p.peek() != '|' {
+			break
+		}
+		p.pos++
+	}
+
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+
+	return terms, nil
+}
+
+func (p *qParser) parseAnd() (Filter, error) {
+	terms := andFilter{}
+
+	for {
+		term, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+
+		if p.peek() != ';' {
+			break
+		}
+		p.pos++
+	}
+
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+
+	return terms, nil
+}
+
+func (p *qParser) parseTerm() (Filter, error) {
+	if p.peek() == '(' {
+		p.pos++
+
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.peek() != ')' {
+			return nil, p.errorf("missing closing parenthesis")
+		}
+		p.pos++
+
+		return filter, nil
+	}
+
+	start := p.pos
+	for !p.done() && isAttributeChar(p.peek()) {
+		p.pos++
+	}
+
+	term := &qTerm{attribute: p.q[start:p.pos], op: opExists}
+	if term.attribute == "" {
+		return nil, p.errorf("expected an attribute name")
+	}
+
+	rest := p.q[p.pos:]
+	for _, op := range operators {
+		if strings.HasPrefix(rest, op) {
+			term.op = op
+			p.pos += len(op)
+			break
+		}
+	}
+
+	if term.op == opExists {
+		return term, nil
+	}
+
+	start = p.pos
+	err := p.parseValues(term)
+	if err != nil {
+		return nil, err
+	}
+	term.raw = p.q[start:p.pos]
+
+	return term, nil
+}
+
+//parseValues parses a single value, a comma separated list of values or a range
+func (p *qParser) parseValues(term *qTerm) error {
+	if term.op == opPattern || term.op == opNotPattern {
+		value, _, err := p.parseValue()
+		if err != nil {
+			return err
+		}
+
+		term.pattern, err = regexp.Compile(value)
+		if err != nil {
+			return p.errorf("invalid pattern %s", value)
+		}
+
+		return nil
+	}
+
+	for {
+		text, quoted, err := p.parseValue()
+		if err != nil {
+			return err
+		}
+		term.values = append(term.values, newQValue(text, quoted))
+
+		if strings.HasPrefix(p.q[p.pos:], "..") {
+			if term.isRange || len(term.values) > 1 {
+				return p.errorf("unexpected range")
+			}
+			term.isRange = true
+			p.pos += 2
+			continue
+		}
+
+		if p.peek() != ',' {
+			break
+		}
+
+		if term.isRange {
+			return p.errorf("a range can not be combined with a list")
+		}
+		p.pos++
+	}
+
+	if len(term.values) > 1 && term.op != opEqual && term.op != opUnequal {
+		return p.errorf("lists and ranges can only be compared with == or !=")
+	}
+
+	return nil
+}
+
+func (p *qParser) parseValue() (string, bool, error) {
+	if p.peek() == '"' {
+		p.pos++
+
+		var sb strings.Builder
+		for !p.done() && p.peek() != '"' {
+			if p.peek() == '\\' && p.pos+1 < len(p.q) {
+				p.pos++
+			}
+			sb.WriteByte(p.q[p.pos])
+			p.pos++
+		}
+
+		if p.done() {
+			return "", false, p.errorf("unterminated string")
+		}
+		p.pos++
+
+		return sb.String(), true, nil
+	}
+
+	start := p.pos
+	for !p.done() {
+		c := p.peek()
+		if c == ';' || c == '|' || c == ')' || c == ',' || strings.HasPrefix(p.q[p.pos:], "..") {
+			break
+		}
+		p.pos++
+	}
+
+	if start == p.pos {
+		return "", false, p.errorf("expected a value")
+	}
+
+	return p.q[start:p.pos], false, nil
+}
+
+func isAttributeChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+		c == '_' || c == '.' || c == ':' || c == '@' || c == '[' || c == ']'
+}
+
+//entityTarget evaluates q filters against the generic JSON representation of an entity
+type entityTarget map[string]interface{}
+
+//NewEntityTarget returns a Target for an entity in the form of a map of its JSON
+//representation. The value of a property is its value member, the value of a
+//relationship is its object and sub attributes are looked up as members of the
+//attribute, such as the probability of a surfaceType.
+func NewEntityTarget(attributes map[string]interface{}) Target {
+	return entityTarget(attributes)
+}
+
+func (e entityTarget) AttributeValue(path string) (interface{}, bool) {
+	names := strings.SplitN(path, ".", 2)
+
+	attribute, ok := e[names[0]]
+	if !ok {
+		return nil, false
+	}
+
+	if len(names) == 2 {
+		attr, ok := attribute.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		attribute, ok = attr[names[1]]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return attributeValue(attribute), true
+}
+
+func attributeValue(attribute interface{}) interface{} {
+	attr, ok := attribute.(map[string]interface{})
+	if !ok {
+		return attribute
+	}
+
+	if attr["type"] == "Relationship" {
+		return attr["object"]
+	}
+
+	value, ok := attr["value"]
+	if !ok {
+		return attribute
+	}
+
+	// Date times are represented as typed values, i.e. {"@type":"DateTime","@value":"..."}
+	if typed, ok := value.(map[string]interface{}); ok {
+		if v, ok := typed["@value"]; ok {
+			return v
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,115 @@
+package query_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/query"
+)
+
+var snowySegment = query.NewEntityTarget(map[string]interface{}{
+	"id":   "urn:ngsi-ld:RoadSegment:21277:153930",
+	"type": "RoadSegment",
+	"surfaceType": map[string]interface{}{
+		"type": "Property", "value": "snow", "probability": 0.8,
+	},
+	"refRoad": map[string]interface{}{
+		"type": "Relationship", "object": "urn:ngsi-ld:Road:21277",
+	},
+	"dateModified": map[string]interface{}{
+		"type": "Property", "value": map[string]interface{}{"@type": "DateTime", "@value": "2021-02-10T06:00:00Z"},
+	},
+})
+
+func TestFilterMatches(t *testing.T) {
+	for q, expected := range map[string]bool{
+		`surfaceType=="snow"`:                                true,
+		`surfaceType=="ice"`:                                 false,
+		`surfaceType!="ice"`:                                 true,
+		`surfaceType=="ice","snow"`:                          true,
+		`surfaceType=="snow";surfaceType.probability>0.7`:    true,
+		`surfaceType=="snow";surfaceType.probability>0.9`:    false,
+		`surfaceType=="ice"|surfaceType.probability>=0.8`:    true,
+		`(surfaceType=="ice"|surfaceType=="snow");refRoad`:   true,
+		`surfaceType.probability==0.5..0.9`:                  true,
+		`surfaceType.probability!=0.5..0.9`:                  false,
+		`surfaceType~=sn.w`:                                  true,
+		`surfaceType!~=^s`:                                   false,
+		`refRoad=="urn:ngsi-ld:Road:21277"`:                  true,
+		`dateModified>2021-01-01T00:00:00Z`:                  true,
+		`dateModified<2021-02-10T06:00:00Z`:                  false,
+		`dateModified>=2021-02-10`:                           true,
+		`name`:                                               false,
+		`name!="E4"`:                                         false,
+		`surfaceType.probability<"0.9"`:                      false,
+		`surfaceType=="ice";surfaceType=="snow"|refRoad`:     true,
+		`surfaceType=="ice";(surfaceType=="snow"|refRoad)`:   false,
+		`surfaceType=="snow"|surfaceType.probability<0.1;id`: true,
+	} {
+		filter, err := query.NewFilter(q)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %s", q, err.Error())
+			continue
+		}
+
+		if filter.Matches(snowySegment) != expected {
+			t.Errorf("Expected %s to evaluate to %v.", q, expected)
+		}
+	}
+}
+
+func TestInvalidFiltersAreRejected(t *testing.T) {
+	for _, q := range []string{
+		``,
+		`surfaceType==`,
+		`surfaceType=="snow`,
+		`(surfaceType=="snow"`,
+		`surfaceType=="snow")`,
+		`surfaceType>1,2`,
+		`surfaceType~=[`,
+		`surfaceType=="snow";`,
+	} {
+		if _, err := query.NewFilter(q); err == nil {
+			t.Errorf("Expected %s to be rejected.", q)
+		}
+	}
+}
+
+func TestExpandedFilterMatches(t *testing.T) {
+	expand := func(value string) ([]string, error) {
+		if value == "slippery" {
+			return []string{"slippery", "ice", "snow"}, nil
+		} else if value == "lava" {
+			return nil, fmt.Errorf("unknown surface type %s", value)
+		}
+		return []string{value}, nil
+	}
+
+	for q, expected := range map[string]bool{
+		`surfaceType=="slippery"`:                             true,
+		`surfaceType!="slippery"`:                             false,
+		`surfaceType=="tarmac","slippery"`:                    true,
+		`surfaceType=="slippery";surfaceType.probability>0.9`: false,
+		`(surfaceType=="tarmac"|surfaceType=="slippery");id`:  true,
+		`surfaceType~="slippery"`:                             false,
+	} {
+		filter, err := query.NewFilter(q)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %s", q, err.Error())
+		}
+
+		filter, err = query.ExpandValues(filter, "surfaceType", expand)
+		if err != nil {
+			t.Fatalf("Failed to expand %s: %s", q, err.Error())
+		}
+
+		if filter.Matches(snowySegment) != expected {
+			t.Errorf("Expected expanded filter %s to return %v.", q, expected)
+		}
+	}
+
+	filter, _ := query.NewFilter(`surfaceType=="lava"`)
+	if _, err := query.ExpandValues(filter, "surfaceType", expand); err == nil {
+		t.Error("Expected expansion of an unknown value to fail.")
+	}
+}
@@ -0,0 +1,242 @@
+package query
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
+)
+
+//Parameters holds the query parameters of a request
+type Parameters map[string][]string
+
+//Get returns the first value of a parameter, or an empty string if it is not present
+func (p Parameters) Get(key string) string {
+	if values, ok := p[key]; ok && len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+//ParseParameters splits a raw query string into parameters. Unlike url.ParseQuery it only
+//treats & as a separator, since NGSI-LD uses semicolons within georel and q values.
+func ParseParameters(rawQuery string) Parameters {
+	params := Parameters{}
+
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+
+		key, value := part, ""
+		if idx := strings.Index(part, "="); idx >= 0 {
+			key, value = part[:idx], part[idx+1:]
+		}
+
+		key, err := url.QueryUnescape(key)
+		if err != nil {
+			continue
+		}
+
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			continue
+		}
+
+		params[key] = append(params[key], value)
+	}
+
+	return params
+}
+
+//Query implements ngsi.Query and adds the parts of the NGSI-LD query language that the
+//ngsi-ld library does not handle
+type Query struct {
+	request *http.Request
+	params  Parameters
+
+	types      []string
+	attributes []string
+	device     *string
+
+	limit      uint64
+	hasLimit   bool
+	offset     uint64
+	pagination *Pagination
+
+	geoQuery *GeoQuery
+	filter   Filter
+}
+
+//NewQueryFromRequest parses the parameters of a GET request for entities
+func NewQueryFromRequest(r *http.Request) (*Query, error) {
+	params := ParseParameters(r.URL.RawQuery)
+
+	q := &Query{
+		request:    r,
+		params:     params,
+		types:      strings.Split(params.Get("type"), ","),
+		attributes: strings.Split(params.Get("attrs"), ","),
+	}
+
+	if limitparam := params.Get("limit"); limitparam != "" {
+		limit, err := strconv.ParseUint(limitparam, 10, 64)
+		if err != nil {
+			return nil, NewBadRequestDataError("unable to parse limit parameter %s into a non negative int value", limitparam)
+		}
+		q.limit = limit
+		q.hasLimit = true
+	}
+
+	if offsetparam := params.Get("offset"); offsetparam != "" {
+		offset, err := strconv.ParseUint(offsetparam, 10, 64)
+		if err != nil {
+			return nil, NewBadRequestDataError("unable to parse offset parameter %s into a non negative int value", offsetparam)
+		}
+		q.offset = offset
+	}
+
+	var err error
+	q.pagination, err = NewPaginationFromParameters(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// A limit of zero only makes sense when asking for the number of results
+	if q.hasLimit && q.limit == 0 && !q.pagination.Count {
+		return nil, NewBadRequestDataError("limit may only be 0 when count is true")
+	}
+
+	const refDevicePrefix string = "refDevice==\""
+
+	if qparam := params.Get("q"); strings.HasPrefix(qparam, refDevicePrefix) {
+		device := strings.Split(qparam, "\"")[1]
+		q.device = &device
+	}
+
+	q.geoQuery, err = NewGeoQueryFromParameters(params)
+	if err != nil {
+		return nil, err
+	}
+
+	q.filter, err = newFilterFromParameters(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+//GeoQueryFrom returns the geo-query of an ngsi.Query. Queries that were not created by
+//this package are parsed again from their request, to get all the supported geometries.
+func GeoQueryFrom(q ngsi.Query) (*GeoQuery, error) {
+	if query, ok := q.(*Query); ok {
+		return query.GeoQuery(), nil
+	}
+
+	if q.Request() == nil {
+		return nil, nil
+	}
+
+	return NewGeoQueryFromParameters(ParseParameters(q.Request().URL.RawQuery))
+}
+
+//FilterFrom returns the q filter of an ngsi.Query, or nil if the query does not have one
+func FilterFrom(q ngsi.Query) (Filter, error) {
+	if query, ok := q.(*Query); ok {
+		return query.Filter(), nil
+	}
+
+	if q.Request() == nil {
+		return nil, nil
+	}
+
+	return newFilterFromParameters(ParseParameters(q.Request().URL.RawQuery))
+}
+
+func newFilterFromParameters(params Parameters) (Filter, error) {
+	if qparam := params.Get("q"); qparam != "" {
+		return NewFilter(qparam)
+	}
+
+	return nil, nil
+}
+
+//Filter returns the parsed q parameter, or nil if the query does not have one
+func (q *Query) Filter() Filter {
+	return q.filter
+}
+
+//GeoQuery returns the parsed geo-query, or nil if this is not a geo-query
+func (q *Query) GeoQuery() *GeoQuery {
+	return q.geoQuery
+}
+
+//Parameters returns all the query parameters of the request
+func (q *Query) Parameters() Parameters {
+	return q.params
+}
+
+//HasDeviceReference returns true if the query contains a q=refDevice=="..." filter
+func (q *Query) HasDeviceReference() bool {
+	return q.device != nil
+}
+
+//Device returns the referenced device
+func (q *Query) Device() string {
+	return *q.device
+}
+
+//PaginationLimit returns the requested limit or the default limit
+func (q *Query) PaginationLimit() uint64 {
+	if q.hasLimit {
+		return q.limit
+	}
+
+	return ngsi.QueryDefaultPaginationLimit
+}
+
+//PaginationOffset returns the requested offset
+func (q *Query) PaginationOffset() uint64 {
+	return q.offset
+}
+
+//Pagination returns the cursor of the query and the pagination of its results
+func (q *Query) Pagination() *Pagination {
+	return q.pagination
+}
+
+//IsGeoQuery returns true if the query contains a geo-query
+func (q *Query) IsGeoQuery() bool {
+	return q.geoQuery != nil
+}
+
+//Geo returns the geo-query in the form used by the ngsi-ld library. The library can not
+//represent distances or nested coordinates, so use GeoQuery() instead whenever possible.
+func (q *Query) Geo() *ngsi.GeoQuery {
+	if q.geoQuery == nil {
+		return nil
+	}
+
+	return &ngsi.GeoQuery{
+		Geometry: q.geoQuery.GeometryType,
+		GeoRel:   q.geoQuery.GeoRel,
+	}
+}
+
+//EntityAttributes returns the requested attributes
+func (q *Query) EntityAttributes() []string {
+	return q.attributes
+}
+
+//EntityTypes returns the requested entity types
+func (q *Query) EntityTypes() []string {
+	return q.types
+}
+
+//Request returns the http request that this query was parsed from
+func (q *Query) Request() *http.Request {
+	return q.request
+}
@@ -0,0 +1,132 @@
+package query
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/format"
+)
+
+const (
+	//TimeRelBefore matches instances observed before timeAt
+	TimeRelBefore string = "before"
+	//TimeRelAfter matches instances observed at or after timeAt
+	TimeRelAfter string = "after"
+	//TimeRelBetween matches instances observed at or after timeAt, but before endTimeAt
+	TimeRelBetween string = "between"
+)
+
+//TemporalQuery contains the parameters of a request for the temporal evolution of entities
+type TemporalQuery struct {
+	EntityIDs  []string
+	Types      []string
+	Attributes []string
+
+	TimeRel   string
+	TimeAt    *time.Time
+	EndTimeAt *time.Time
+
+	//LastN limits the number of instances per attribute to the N most recent ones, if > 0
+	LastN uint64
+	Limit uint64
+}
+
+//NewTemporalQueryFromRequest parses the parameters of a temporal GET request. A time
+//relation is mandatory when querying for multiple entities, but optional when retrieving
+//the history of a single entity.
+func NewTemporalQueryFromRequest(r *http.Request, requireTimeRel bool) (*TemporalQuery, error) {
+	params := ParseParameters(r.URL.RawQuery)
+
+	tq := &TemporalQuery{
+		EntityIDs:  format.ParseListParameter(params.Get("id")),
+		Types:      format.ParseListParameter(params.Get("type")),
+		Attributes: format.ParseListParameter(params.Get("attrs")),
+		TimeRel:    params.Get("timerel"),
+	}
+
+	if tq.TimeRel == "" {
+		if requireTimeRel {
+			return nil, NewBadRequestDataError("a temporal query must specify the timerel parameter")
+		}
+	} else {
+		if tq.TimeRel != TimeRelBefore && tq.TimeRel != TimeRelAfter && tq.TimeRel != TimeRelBetween {
+			return nil, NewBadRequestDataError("timerel must be one of before, after or between")
+		}
+
+		timeAt, err := parseTime(params, "timeAt")
+		if err != nil {
+			return nil, err
+		}
+		tq.TimeAt = timeAt
+
+		if tq.TimeRel == TimeRelBetween {
+			tq.EndTimeAt, err = parseTime(params, "endTimeAt")
+			if err != nil {
+				return nil, err
+			}
+
+			if !tq.EndTimeAt.After(*tq.TimeAt) {
+				return nil, NewBadRequestDataError("endTimeAt must be after timeAt")
+			}
+		}
+	}
+
+	for _, name := range []string{"lastN", "limit"} {
+		if value := params.Get(name); value != "" {
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || n == 0 {
+				return nil, NewBadRequestDataError("%s must be a positive integer", name)
+			}
+
+			if name == "lastN" {
+				tq.LastN = n
+			} else {
+				tq.Limit = n
+			}
+		}
+	}
+
+	return tq, nil
+}
+
+//TimeSpan returns the time relation as a span, where from is inclusive and to is exclusive.
+//Either end of the span is nil if it is open.
+func (tq *TemporalQuery) TimeSpan() (from *time.Time, to *time.Time) {
+	switch tq.TimeRel {
+	case TimeRelBefore:
+		return nil, tq.TimeAt
+	case TimeRelAfter:
+		return tq.TimeAt, nil
+	case TimeRelBetween:
+		return tq.TimeAt, tq.EndTimeAt
+	}
+
+	return nil, nil
+}
+
+//Includes returns true if a point in time is within the time relation
+func (tq *TemporalQuery) Includes(t time.Time) bool {
+	from, to := tq.TimeSpan()
+	return (from == nil || !t.Before(*from)) && (to == nil || t.Before(*to))
+}
+
+//IncludesAttribute returns true if an attribute is requested, which every attribute is when
+//no attributes are named
+func (tq *TemporalQuery) IncludesAttribute(name string) bool {
+	return len(tq.Attributes) == 0 || format.Contains(tq.Attributes, name)
+}
+
+func parseTime(params Parameters, name string) (*time.Time, error) {
+	value := params.Get(name)
+	if value == "" {
+		return nil, NewBadRequestDataError("the parameter %s is required by timerel", name)
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, NewBadRequestDataError("unable to parse %s as an RFC3339 date time: %s", name, value)
+	}
+
+	return &t, nil
+}
@@ -0,0 +1,157 @@
+package fusion
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//SourceObservation is the source of predictions made from road surface observations
+	SourceObservation string = "observation"
+	//SourceAPI is the source of predictions that are PATCHed through the API
+	SourceAPI string = "api"
+)
+
+//Prediction is a single estimate of the surface type of a road segment
+type Prediction struct {
+	SurfaceType string
+	Probability float64
+	Source      string
+	Timestamp   time.Time
+}
+
+//Distribution maps surface types to their fused probabilities. The probabilities add up
+//to at most one, and whatever remains is the uncertainty of the estimate.
+type Distribution map[string]float64
+
+//MostLikely returns the surface type with the highest probability, or an empty string if
+//the distribution is empty. Ties are broken by name, so that every replica agrees.
+func (d Distribution) MostLikely() (string, float64) {
+	surfaceType := ""
+	probability := 0.0
+
+	for t, p := range d {
+		if surfaceType == "" || p > probability || (p == probability && t < surfaceType) {
+			surfaceType, probability = t, p
+		}
+	}
+
+	return surfaceType, probability
+}
+
+//Model combines recent predictions of a road segment into a distribution over surface
+//types. Every prediction contributes its probability to its surface type, weighted by
+//the trust in its source and by its age relative to the most recent prediction.
+type Model struct {
+	//Window is how far back from the most recent prediction that predictions are fused
+	Window time.Duration
+	//HalfLife is the age at which a prediction carries half the weight of a new one
+	HalfLife time.Duration
+	//Trust weights predictions by their source. Unknown sources get DefaultTrust.
+	Trust        map[string]float64
+	DefaultTrust float64
+}
+
+const (
+	//DefaultWindow is the default Window of a Model
+	DefaultWindow time.Duration = 6 * time.Hour
+	//DefaultHalfLife is the default HalfLife of a Model
+	DefaultHalfLife time.Duration = time.Hour
+)
+
+//DefaultModel returns a model that trusts every source equally
+func DefaultModel() Model {
+	return Model{
+		Window:       DefaultWindow,
+		HalfLife:     DefaultHalfLife,
+		Trust:        map[string]float64{},
+		DefaultTrust: 1.0,
+	}
+}
+
+//TrustIn returns the weight of predictions from a source
+func (m Model) TrustIn(source string) float64 {
+	if trust, ok := m.Trust[source]; ok {
+		return trust
+	}
+	return m.DefaultTrust
+}
+
+//Fuse returns the distribution over surface types of a set of predictions, together with
+//the time of the most recent one. Predictions outside of the window, or from sources
+//that are not trusted at all, are ignored.
+func (m Model) Fuse(predictions []Prediction) (Distribution, time.Time) {
+	distribution := Distribution{}
+
+	if len(predictions) == 0 {
+		return distribution, time.Time{}
+	}
+
+	latest := predictions[0].Timestamp
+	for _, p := range predictions[1:] {
+		if p.Timestamp.After(latest) {
+			latest = p.Timestamp
+		}
+	}
+
+	totalWeight := 0.0
+
+	for _, p := range predictions {
+		age := latest.Sub(p.Timestamp)
+		if m.Window > 0 && age > m.Window {
+			continue
+		}
+
+		weight := m.TrustIn(p.Source)
+		if m.HalfLife > 0 {
+			weight *= math.Pow(0.5, float64(age)/float64(m.HalfLife))
+		}
+
+		if weight <= 0 {
+			continue
+		}
+
+		distribution[p.SurfaceType] += weight * p.Probability
+		totalWeight += weight
+	}
+
+	if totalWeight == 0 {
+		return Distribution{}, latest
+	}
+
+	for t := range distribution {
+		distribution[t] /= totalWeight
+	}
+
+	return distribution, latest
+}
+
+//ParseTrust parses a comma separated list of source=trust pairs, such as
+//observation=0.5,api=1
+func ParseTrust(s string) (map[string]float64, error) {
+	trust := map[string]float64{}
+
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("expected source=trust, but got %s", pair)
+		}
+
+		value, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("the trust in %s must be a non negative number", parts[0])
+		}
+
+		trust[strings.TrimSpace(parts[0])] = value
+	}
+
+	return trust, nil
+}
@@ -0,0 +1,93 @@
+package fusion_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fusion"
+)
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestFuseSinglePrediction(t *testing.T) {
+	now := time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)
+
+	d, latest := fusion.DefaultModel().Fuse([]fusion.Prediction{
+		{SurfaceType: "snow", Probability: 0.8, Timestamp: now},
+	})
+
+	surfaceType, probability := d.MostLikely()
+	if surfaceType != "snow" || !almostEqual(probability, 0.8) || !latest.Equal(now) {
+		t.Errorf("Expected a single prediction to be returned as is, but got %s (%f) at %s.", surfaceType, probability, latest)
+	}
+}
+
+func TestLowConfidencePredictionDoesNotOverrideHighConfidence(t *testing.T) {
+	now := time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)
+
+	d, _ := fusion.DefaultModel().Fuse([]fusion.Prediction{
+		{SurfaceType: "snow", Probability: 0.9, Timestamp: now.Add(-10 * time.Minute)},
+		{SurfaceType: "tarmac", Probability: 0.3, Timestamp: now},
+	})
+
+	surfaceType, _ := d.MostLikely()
+	if surfaceType != "snow" {
+		t.Errorf("Expected snow to remain the most likely surface type, but got %s (%v).", surfaceType, d)
+	}
+}
+
+func TestPredictionsDecayWithAge(t *testing.T) {
+	now := time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)
+	model := fusion.DefaultModel()
+
+	d, _ := model.Fuse([]fusion.Prediction{
+		{SurfaceType: "snow", Probability: 0.9, Timestamp: now.Add(-3 * model.HalfLife)},
+		{SurfaceType: "tarmac", Probability: 0.6, Timestamp: now},
+	})
+
+	// The snow prediction carries an eighth of the weight of the tarmac prediction
+	if surfaceType, probability := d.MostLikely(); surfaceType != "tarmac" || !almostEqual(probability, 0.6/1.125) {
+		t.Errorf("Expected the old prediction to have decayed, but got %s (%f).", surfaceType, probability)
+	}
+
+	d, _ = model.Fuse([]fusion.Prediction{
+		{SurfaceType: "snow", Probability: 0.9, Timestamp: now.Add(-model.Window - time.Minute)},
+		{SurfaceType: "tarmac", Probability: 0.6, Timestamp: now},
+	})
+
+	if len(d) != 1 || !almostEqual(d["tarmac"], 0.6) {
+		t.Errorf("Expected predictions outside of the window to be ignored, but got %v.", d)
+	}
+}
+
+func TestPredictionsAreWeightedByTrust(t *testing.T) {
+	now := time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)
+
+	model := fusion.DefaultModel()
+	model.Trust = map[string]float64{fusion.SourceObservation: 0.25, fusion.SourceAPI: 1}
+
+	d, _ := model.Fuse([]fusion.Prediction{
+		{SurfaceType: "ice", Probability: 0.9, Source: fusion.SourceObservation, Timestamp: now},
+		{SurfaceType: "wet", Probability: 0.7, Source: fusion.SourceAPI, Timestamp: now},
+	})
+
+	if surfaceType, _ := d.MostLikely(); surfaceType != "wet" || !almostEqual(d["ice"], 0.9*0.25/1.25) {
+		t.Errorf("Expected the trusted source to win, but got %v.", d)
+	}
+}
+
+func TestParseTrust(t *testing.T) {
+	trust, err := fusion.ParseTrust("observation=0.5, api=1")
+	if err != nil || trust["observation"] != 0.5 || trust["api"] != 1 {
+		t.Errorf("Unexpected trust %v (%v).", trust, err)
+	}
+
+	for _, invalid := range []string{"observation", "=1", "api=high", "api=-1"} {
+		if _, err := fusion.ParseTrust(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected.", invalid)
+		}
+	}
+}
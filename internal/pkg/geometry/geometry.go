@@ -0,0 +1,91 @@
+package geometry
+
+import (
+	"math"
+)
+
+//EarthRadius is the mean radius of the earth in meters
+const EarthRadius float64 = 6371008.8
+
+//Point encapsulates a WGS84 coordinate
+type Point struct {
+	Lat float64
+	Lon float64
+}
+
+//NewPoint creates a new point instance to encapsulate the provided coordinate
+func NewPoint(lat, lon float64) Point {
+	return Point{Lat: lat, Lon: lon}
+}
+
+func toRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+//Distance returns the great circle distance in meters between two points using
+//the haversine formula
+func Distance(p1, p2 Point) float64 {
+	lat1 := toRadians(p1.Lat)
+	lat2 := toRadians(p2.Lat)
+	dLat := lat2 - lat1
+	dLon := toRadians(p2.Lon - p1.Lon)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+//ClosestPointOnLine returns the point on the line between start and end that is
+//closest to pt. The search is done in a local tangent plane around pt, where the
+//longitude is scaled with the cosine of the latitude, which is accurate to well below
+//a meter for the line lengths we store in road segments.
+func ClosestPointOnLine(pt, start, end Point) Point {
+	cosLat := math.Cos(toRadians(pt.Lat))
+
+	// Project the line end points onto a plane with pt at the origin
+	ax, ay := (start.Lon-pt.Lon)*cosLat, start.Lat-pt.Lat
+	bx, by := (end.Lon-pt.Lon)*cosLat, end.Lat-pt.Lat
+
+	dx, dy := bx-ax, by-ay
+	lengthSquared := dx*dx + dy*dy
+
+	if lengthSquared == 0 {
+		return start
+	}
+
+	// Find the fraction along the line where the projection of the origin ends up
+	t := -(ax*dx + ay*dy) / lengthSquared
+	t = math.Max(0, math.Min(1, t))
+
+	return Point{
+		Lat: start.Lat + t*(end.Lat-start.Lat),
+		Lon: start.Lon + t*(end.Lon-start.Lon),
+	}
+}
+
+//DistanceToLine returns the shortest distance in meters between a point and a
+//straight line between two other points
+func DistanceToLine(pt, start, end Point) float64 {
+	return Distance(pt, ClosestPointOnLine(pt, start, end))
+}
+
+//DistanceToLineString returns the shortest distance in meters between a point and
+//a polyline. An empty line string is considered to be infinitely far away.
+func DistanceToLineString(pt Point, line []Point) float64 {
+	if len(line) == 0 {
+		return math.Inf(1)
+	}
+
+	if len(line) == 1 {
+		return Distance(pt, line[0])
+	}
+
+	distance := math.Inf(1)
+
+	for i := 0; i < len(line)-1; i++ {
+		distance = math.Min(distance, DistanceToLine(pt, line[i], line[i+1]))
+	}
+
+	return distance
+}
@@ -0,0 +1,51 @@
+package geometry_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+)
+
+func expectDistance(t *testing.T, what string, actual, expected, tolerance float64) {
+	if math.Abs(actual-expected) > tolerance {
+		t.Errorf("Unexpected distance %s. %f != %f (+/- %f)", what, actual, expected, tolerance)
+	}
+}
+
+func TestDistanceBetweenPoints(t *testing.T) {
+	// One degree of latitude is ~111.2 km regardless of where we are ...
+	d := geometry.Distance(geometry.NewPoint(62, 17), geometry.NewPoint(63, 17))
+	expectDistance(t, "along a meridian", d, 111195, 10)
+
+	// ... but one degree of longitude shrinks with the cosine of the latitude
+	d = geometry.Distance(geometry.NewPoint(62, 17), geometry.NewPoint(62, 18))
+	expectDistance(t, "along a parallel at 62N", d, 52202, 10)
+}
+
+func TestDistanceToLineIsMeasuredToTheClosestPointOnTheLine(t *testing.T) {
+	start := geometry.NewPoint(62.0, 17.3)
+	end := geometry.NewPoint(62.001, 17.3)
+
+	// A point 0.0005 degrees east of the middle of a north-south line at 62N is ~26 m away
+	pt := geometry.NewPoint(62.0005, 17.3005)
+	expectDistance(t, "perpendicular to the line", geometry.DistanceToLine(pt, start, end), 26.1, 0.5)
+
+	// Beyond the end of the line, the distance should be measured to the end point
+	pt = geometry.NewPoint(62.002, 17.3)
+	expectDistance(t, "past the end of the line", geometry.DistanceToLine(pt, start, end), 111.2, 0.5)
+}
+
+func TestDistanceToLineString(t *testing.T) {
+	line := []geometry.Point{
+		geometry.NewPoint(62.389109, 17.310863),
+		geometry.NewPoint(62.389084, 17.310852),
+		geometry.NewPoint(62.389052, 17.310940),
+	}
+
+	d := geometry.DistanceToLineString(line[1], line)
+	expectDistance(t, "to a vertex on the line string", d, 0, 0.001)
+
+	d = geometry.DistanceToLineString(geometry.NewPoint(62.389077, 17.310243), line)
+	expectDistance(t, "to a line string west of the point", d, 32.1, 1)
+}
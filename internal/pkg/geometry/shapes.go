@@ -0,0 +1,243 @@
+package geometry
+
+import (
+	"math"
+)
+
+//Relation is a geospatial relationship between a query geometry and an entity
+type Relation string
+
+const (
+	//RelationWithin matches entities that lie completely within the query geometry
+	RelationWithin Relation = "within"
+	//RelationIntersects matches entities that share at least one point with the query geometry
+	RelationIntersects Relation = "intersects"
+	//RelationDisjoint matches entities that do not share any point with the query geometry
+	RelationDisjoint Relation = "disjoint"
+	//RelationOverlaps matches entities that lie partly, but not completely, within the query geometry
+	RelationOverlaps Relation = "overlaps"
+)
+
+//Geometry is implemented by the shapes that road segments can be related to
+type Geometry interface {
+	//BoundingBox returns the south west and north east corners of the geometry
+	BoundingBox() (Point, Point)
+	//IntersectsLineString returns true if the line string shares any point with the geometry
+	IntersectsLineString(line LineString) bool
+}
+
+//Surface is a geometry that has an interior, and can thus contain other geometries
+type Surface interface {
+	Geometry
+	//ContainsLineString returns true if no part of the line string lies outside the surface
+	ContainsLineString(line LineString) bool
+}
+
+//Relates returns true if the supplied lines, as a whole, have the requested relation
+//to the geometry. The relations within and overlaps are only defined for surfaces.
+func Relates(relation Relation, g Geometry, lines ...LineString) bool {
+	intersecting := 0
+	contained := 0
+
+	for _, line := range lines {
+		if !g.IntersectsLineString(line) {
+			continue
+		}
+
+		intersecting++
+
+		if surface, ok := g.(Surface); ok && surface.ContainsLineString(line) {
+			contained++
+		}
+	}
+
+	_, isSurface := g.(Surface)
+
+	switch relation {
+	case RelationIntersects:
+		return intersecting > 0
+	case RelationDisjoint:
+		return intersecting == 0
+	case RelationWithin:
+		return isSurface && len(lines) > 0 && contained == len(lines)
+	case RelationOverlaps:
+		return isSurface && intersecting > 0 && contained < len(lines)
+	}
+
+	return false
+}
+
+//LineString is a polyline made up of two or more points
+type LineString []Point
+
+//BoundingBox returns the south west and north east corners of the line string
+func (ls LineString) BoundingBox() (Point, Point) {
+	return boundingBox(ls)
+}
+
+//IntersectsLineString returns true if the two line strings cross or touch each other
+func (ls LineString) IntersectsLineString(line LineString) bool {
+	for i := 0; i < len(ls)-1; i++ {
+		for j := 0; j < len(line)-1; j++ {
+			if linesIntersect(ls[i], ls[i+1], line[j], line[j+1]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//Polygon is a list of linear rings, where the first ring is the exterior of the polygon
+//and any following rings are holes within it
+type Polygon [][]Point
+
+//BoundingBox returns the south west and north east corners of the polygon's exterior ring
+func (p Polygon) BoundingBox() (Point, Point) {
+	if len(p) == 0 {
+		return boundingBox(nil)
+	}
+	return boundingBox(p[0])
+}
+
+//ContainsPoint returns true if the point lies within the exterior ring, but outside
+//of any holes
+func (p Polygon) ContainsPoint(pt Point) bool {
+	if len(p) == 0 || !ringContainsPoint(p[0], pt) {
+		return false
+	}
+
+	for _, hole := range p[1:] {
+		if ringContainsPoint(hole, pt) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p Polygon) crossesLineString(line LineString) bool {
+	for _, ring := range p {
+		if LineString(ring).IntersectsLineString(line) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//ContainsLineString returns true if every point of the line string lies within the
+//polygon, and the line string does not cross the boundary anywhere in between
+func (p Polygon) ContainsLineString(line LineString) bool {
+	for _, pt := range line {
+		if !p.ContainsPoint(pt) {
+			return false
+		}
+	}
+
+	return len(line) > 0 && !p.crossesLineString(line)
+}
+
+//IntersectsLineString returns true if any part of the line string lies within the
+//polygon or crosses its boundary
+func (p Polygon) IntersectsLineString(line LineString) bool {
+	for _, pt := range line {
+		if p.ContainsPoint(pt) {
+			return true
+		}
+	}
+
+	return p.crossesLineString(line)
+}
+
+//MultiPolygon is a collection of polygons
+type MultiPolygon []Polygon
+
+//BoundingBox returns the south west and north east corners of all the polygons
+func (mp MultiPolygon) BoundingBox() (Point, Point) {
+	points := []Point{}
+	for _, p := range mp {
+		sw, ne := p.BoundingBox()
+		points = append(points, sw, ne)
+	}
+	return boundingBox(points)
+}
+
+//ContainsLineString returns true if any single polygon contains the line string
+func (mp MultiPolygon) ContainsLineString(line LineString) bool {
+	for _, p := range mp {
+		if p.ContainsLineString(line) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//IntersectsLineString returns true if any of the polygons intersects the line string
+func (mp MultiPolygon) IntersectsLineString(line LineString) bool {
+	for _, p := range mp {
+		if p.IntersectsLineString(line) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func boundingBox(points []Point) (Point, Point) {
+	sw := Point{Lat: math.Inf(1), Lon: math.Inf(1)}
+	ne := Point{Lat: math.Inf(-1), Lon: math.Inf(-1)}
+
+	for _, pt := range points {
+		sw.Lat = math.Min(sw.Lat, pt.Lat)
+		sw.Lon = math.Min(sw.Lon, pt.Lon)
+		ne.Lat = math.Max(ne.Lat, pt.Lat)
+		ne.Lon = math.Max(ne.Lon, pt.Lon)
+	}
+
+	return sw, ne
+}
+
+//ringContainsPoint uses the even-odd rule to test if a point lies within a closed ring
+func ringContainsPoint(ring []Point, pt Point) bool {
+	inside := false
+
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+
+		if (a.Lat > pt.Lat) != (b.Lat > pt.Lat) &&
+			pt.Lon < (b.Lon-a.Lon)*(pt.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+//orientation returns a positive value if c lies to the left of the line from a to b,
+//a negative value if it lies to the right and zero if the three points are collinear
+func orientation(a, b, c Point) float64 {
+	return (b.Lon-a.Lon)*(c.Lat-a.Lat) - (b.Lat-a.Lat)*(c.Lon-a.Lon)
+}
+
+func onLine(a, b, pt Point) bool {
+	return math.Min(a.Lon, b.Lon) <= pt.Lon && pt.Lon <= math.Max(a.Lon, b.Lon) &&
+		math.Min(a.Lat, b.Lat) <= pt.Lat && pt.Lat <= math.Max(a.Lat, b.Lat)
+}
+
+//linesIntersect returns true if the line from p1 to p2 and the line from q1 to q2
+//share at least one point
+func linesIntersect(p1, p2, q1, q2 Point) bool {
+	o1 := orientation(p1, p2, q1)
+	o2 := orientation(p1, p2, q2)
+	o3 := orientation(q1, q2, p1)
+	o4 := orientation(q1, q2, p2)
+
+	if ((o1 > 0 && o2 < 0) || (o1 < 0 && o2 > 0)) && ((o3 > 0 && o4 < 0) || (o3 < 0 && o4 > 0)) {
+		return true
+	}
+
+	return (o1 == 0 && onLine(p1, p2, q1)) || (o2 == 0 && onLine(p1, p2, q2)) ||
+		(o3 == 0 && onLine(q1, q2, p1)) || (o4 == 0 && onLine(q1, q2, p2))
+}
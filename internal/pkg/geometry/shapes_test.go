@@ -0,0 +1,91 @@
+package geometry_test
+
+import (
+	"testing"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+)
+
+func pt(lon, lat float64) geometry.Point {
+	return geometry.NewPoint(lat, lon)
+}
+
+// A U-shaped polygon with the opening towards the north, and a hole in its western leg
+var uShape = geometry.Polygon{
+	{pt(0, 0), pt(3, 0), pt(3, 3), pt(2, 3), pt(2, 1), pt(1, 1), pt(1, 3), pt(0, 3), pt(0, 0)},
+	{pt(0.2, 1.5), pt(0.8, 1.5), pt(0.8, 2.5), pt(0.2, 2.5), pt(0.2, 1.5)},
+}
+
+func TestPolygonContainsPoint(t *testing.T) {
+	if !uShape.ContainsPoint(pt(0.5, 0.5)) {
+		t.Error("Expected point in the bottom of the U to be contained.")
+	}
+
+	if uShape.ContainsPoint(pt(1.5, 2)) {
+		t.Error("Did not expect point in the opening of the U to be contained.")
+	}
+
+	if uShape.ContainsPoint(pt(0.5, 2)) {
+		t.Error("Did not expect point in the hole to be contained.")
+	}
+}
+
+func TestRelationsBetweenPolygonAndLineStrings(t *testing.T) {
+	inside := geometry.LineString{pt(0.5, 0.5), pt(2.5, 0.5)}
+	acrossTheOpening := geometry.LineString{pt(0.5, 2.8), pt(2.5, 2.8)}
+	partlyOutside := geometry.LineString{pt(2.5, 0.5), pt(4, 0.5)}
+	outside := geometry.LineString{pt(1.2, 1.5), pt(1.8, 2.5)}
+
+	testCases := []struct {
+		line     geometry.LineString
+		relation geometry.Relation
+		expected bool
+	}{
+		{inside, geometry.RelationWithin, true},
+		{inside, geometry.RelationIntersects, true},
+		{inside, geometry.RelationOverlaps, false},
+		{acrossTheOpening, geometry.RelationWithin, false},
+		{acrossTheOpening, geometry.RelationOverlaps, true},
+		{partlyOutside, geometry.RelationWithin, false},
+		{partlyOutside, geometry.RelationOverlaps, true},
+		{outside, geometry.RelationIntersects, false},
+		{outside, geometry.RelationDisjoint, true},
+	}
+
+	for idx, tc := range testCases {
+		if geometry.Relates(tc.relation, uShape, tc.line) != tc.expected {
+			t.Errorf("Test case %d: expected %s to be %v.", idx, tc.relation, tc.expected)
+		}
+	}
+}
+
+func TestLineStringsIntersect(t *testing.T) {
+	line := geometry.LineString{pt(0, 0), pt(1, 1), pt(2, 0)}
+
+	if !line.IntersectsLineString(geometry.LineString{pt(1.5, 0), pt(1.5, 2)}) {
+		t.Error("Expected crossing line strings to intersect.")
+	}
+
+	if line.IntersectsLineString(geometry.LineString{pt(0.5, 0), pt(1, 0.5), pt(1.5, 0)}) {
+		t.Error("Did not expect line strings to intersect.")
+	}
+
+	if geometry.Relates(geometry.RelationWithin, line, line) {
+		t.Error("The within relation should not be defined for line strings.")
+	}
+}
+
+func TestMultiPolygonRelations(t *testing.T) {
+	mp := geometry.MultiPolygon{
+		{{pt(0, 0), pt(1, 0), pt(1, 1), pt(0, 1), pt(0, 0)}},
+		{{pt(2, 0), pt(3, 0), pt(3, 1), pt(2, 1), pt(2, 0)}},
+	}
+
+	if !geometry.Relates(geometry.RelationWithin, mp, geometry.LineString{pt(2.1, 0.1), pt(2.9, 0.9)}) {
+		t.Error("Expected line string to be within the second polygon.")
+	}
+
+	if geometry.Relates(geometry.RelationIntersects, mp, geometry.LineString{pt(1.5, 0), pt(1.5, 1)}) {
+		t.Error("Did not expect a line string between the polygons to intersect.")
+	}
+}
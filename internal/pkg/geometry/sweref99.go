@@ -0,0 +1,120 @@
+package geometry
+
+import (
+	"math"
+)
+
+//SWEREF99TM is the EPSG code of SWEREF 99 TM, the national projected reference system of
+//Sweden that Trafikverket and Lantmäteriet deliver their data in
+const SWEREF99TM int64 = 3006
+
+//The parameters of SWEREF 99 TM, a transverse mercator projection of the GRS 80 ellipsoid
+const (
+	grs80SemiMajorAxis float64 = 6378137.0
+	grs80Flattening    float64 = 1.0 / 298.257222101
+
+	sweref99CentralMeridian float64 = 15.0
+	sweref99ScaleFactor     float64 = 0.9996
+	sweref99FalseNorthing   float64 = 0.0
+	sweref99FalseEasting    float64 = 500000.0
+)
+
+//gaussKruger holds the series coefficients of the Gauss-Krüger formulas that convert
+//between geodetic and grid coordinates, as published by Lantmäteriet
+type gaussKruger struct {
+	aRoof float64
+
+	a, b, c, d float64
+	beta       [4]float64
+
+	aStar, bStar, cStar, dStar float64
+	delta                      [4]float64
+}
+
+var sweref99 = newGaussKruger(grs80SemiMajorAxis, grs80Flattening)
+
+func newGaussKruger(axis, flattening float64) gaussKruger {
+	e2 := flattening * (2 - flattening)
+	n := flattening / (2 - flattening)
+	n2, n3, n4 := n*n, n*n*n, n*n*n*n
+
+	return gaussKruger{
+		aRoof: axis / (1 + n) * (1 + n2/4 + n4/64),
+
+		a: e2,
+		b: (5*e2*e2 - e2*e2*e2) / 6,
+		c: (104*e2*e2*e2 - 45*e2*e2*e2*e2) / 120,
+		d: (1237 * e2 * e2 * e2 * e2) / 1260,
+		beta: [4]float64{
+			n/2 - 2*n2/3 + 5*n3/16 + 41*n4/180,
+			13*n2/48 - 3*n3/5 + 557*n4/1440,
+			61*n3/240 - 103*n4/140,
+			49561 * n4 / 161280,
+		},
+
+		aStar: e2 + e2*e2 + e2*e2*e2 + e2*e2*e2*e2,
+		bStar: -(7*e2*e2 + 17*e2*e2*e2 + 30*e2*e2*e2*e2) / 6,
+		cStar: (224*e2*e2*e2 + 889*e2*e2*e2*e2) / 120,
+		dStar: -(4279 * e2 * e2 * e2 * e2) / 1260,
+		delta: [4]float64{
+			n/2 - 2*n2/3 + 37*n3/96 - n4/360,
+			n2/48 + n3/15 - 437*n4/1440,
+			17*n3/480 - 37*n4/840,
+			4397 * n4 / 161280,
+		},
+	}
+}
+
+//FromSWEREF99TM converts a SWEREF 99 TM grid coordinate into a WGS84 point
+func FromSWEREF99TM(northing, easting float64) Point {
+	gk := sweref99
+
+	xi := (northing - sweref99FalseNorthing) / (sweref99ScaleFactor * gk.aRoof)
+	eta := (easting - sweref99FalseEasting) / (sweref99ScaleFactor * gk.aRoof)
+
+	xiPrim, etaPrim := xi, eta
+	for i, delta := range gk.delta {
+		k := float64(2 * (i + 1))
+		xiPrim -= delta * math.Sin(k*xi) * math.Cosh(k*eta)
+		etaPrim -= delta * math.Cos(k*xi) * math.Sinh(k*eta)
+	}
+
+	phiStar := math.Asin(math.Sin(xiPrim) / math.Cosh(etaPrim))
+	deltaLambda := math.Atan(math.Sinh(etaPrim) / math.Cos(xiPrim))
+
+	sinPhi := math.Sin(phiStar)
+	sin2 := sinPhi * sinPhi
+
+	phi := phiStar + sinPhi*math.Cos(phiStar)*
+		(gk.aStar+gk.bStar*sin2+gk.cStar*sin2*sin2+gk.dStar*sin2*sin2*sin2)
+
+	return NewPoint(phi*180/math.Pi, sweref99CentralMeridian+deltaLambda*180/math.Pi)
+}
+
+//ToSWEREF99TM converts a WGS84 point into a SWEREF 99 TM grid coordinate
+func ToSWEREF99TM(pt Point) (northing, easting float64) {
+	gk := sweref99
+
+	phi := toRadians(pt.Lat)
+	deltaLambda := toRadians(pt.Lon - sweref99CentralMeridian)
+
+	sinPhi := math.Sin(phi)
+	sin2 := sinPhi * sinPhi
+
+	phiStar := phi - sinPhi*math.Cos(phi)*(gk.a+gk.b*sin2+gk.c*sin2*sin2+gk.d*sin2*sin2*sin2)
+
+	xiPrim := math.Atan(math.Tan(phiStar) / math.Cos(deltaLambda))
+	etaPrim := math.Atanh(math.Cos(phiStar) * math.Sin(deltaLambda))
+
+	xi, eta := xiPrim, etaPrim
+	for i, beta := range gk.beta {
+		k := float64(2 * (i + 1))
+		xi += beta * math.Sin(k*xiPrim) * math.Cosh(k*etaPrim)
+		eta += beta * math.Cos(k*xiPrim) * math.Sinh(k*etaPrim)
+	}
+
+	northing = sweref99ScaleFactor*gk.aRoof*xi + sweref99FalseNorthing
+	easting = sweref99ScaleFactor*gk.aRoof*eta + sweref99FalseEasting
+
+	return
+}
@@ -0,0 +1,29 @@
+package geometry_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+)
+
+func TestSWEREF99TMCentralMeridianAndFalseEasting(t *testing.T) {
+	// The central meridian of the projection is 15E and is given the easting 500 000 m
+	northing, easting := geometry.ToSWEREF99TM(geometry.NewPoint(0, 15))
+	expectDistance(t, "to the false origin", math.Hypot(northing, easting-500000), 0, 0.001)
+
+	pt := geometry.FromSWEREF99TM(6900000, 500000)
+	if math.Abs(pt.Lon-15) > 1e-9 {
+		t.Errorf("Expected a point with easting 500000 to be on the central meridian, but got %f", pt.Lon)
+	}
+}
+
+func TestSWEREF99TMRoundTripAcrossSweden(t *testing.T) {
+	for lat := 55.0; lat <= 69.0; lat += 1.0 {
+		for lon := 11.0; lon <= 24.0; lon += 1.0 {
+			pt := geometry.NewPoint(lat, lon)
+			converted := geometry.FromSWEREF99TM(geometry.ToSWEREF99TM(pt))
+			expectDistance(t, "after a round trip", geometry.Distance(pt, converted), 0, 0.001)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package importer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+	log "github.com/sirupsen/logrus"
+)
+
+type geoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	ID         interface{}            `json:"id"`
+	Type       string                 `json:"type"`
+	Geometry   *geoJSONGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONObject struct {
+	geoJSONFeature
+	Features []geoJSONFeature `json:"features"`
+}
+
+//readGeoJSON reads a FeatureCollection, or a single Feature, with LineString or
+//MultiLineString geometries. Features with any other geometry are skipped.
+func readGeoJSON(r io.Reader, opts *Options) ([]Segment, error) {
+	object := &geoJSONObject{}
+
+	err := json.NewDecoder(r).Decode(object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse GeoJSON: %s", err.Error())
+	}
+
+	features := object.Features
+	if object.Type == "Feature" {
+		features = []geoJSONFeature{object.geoJSONFeature}
+	} else if object.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("expected a GeoJSON FeatureCollection or Feature, but got %s", object.Type)
+	}
+
+	segments := []Segment{}
+
+	for idx, feature := range features {
+		if feature.Geometry == nil {
+			continue
+		}
+
+		fallbackID := propertyString(feature.ID)
+		if fallbackID == "" {
+			fallbackID = strconv.Itoa(idx + 1)
+		}
+
+		if feature.Properties == nil {
+			feature.Properties = map[string]interface{}{}
+		}
+
+		segment := newSegmentFromProperties(feature.Properties, fallbackID, opts)
+
+		var parts [][]geometry.Point
+
+		switch feature.Geometry.Type {
+		case "LineString":
+			var line [][]float64
+			err = json.Unmarshal(feature.Geometry.Coordinates, &line)
+			parts = append(parts, geoJSONPositions(line))
+		case "MultiLineString":
+			var lines [][][]float64
+			err = json.Unmarshal(feature.Geometry.Coordinates, &lines)
+			for _, line := range lines {
+				parts = append(parts, geoJSONPositions(line))
+			}
+		default:
+			log.Infof("Skipping feature %s with unsupported geometry type %s.", segment.ID, feature.Geometry.Type)
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the coordinates of feature %s: %s", segment.ID, err.Error())
+		}
+
+		segments = append(segments, splitParts(segment, parts)...)
+	}
+
+	return segments, nil
+}
+
+func geoJSONPositions(positions [][]float64) []geometry.Point {
+	points := []geometry.Point{}
+
+	for _, position := range positions {
+		if len(position) >= 2 {
+			points = append(points, geometry.NewPoint(position[1], position[0]))
+		}
+	}
+
+	return points
+}
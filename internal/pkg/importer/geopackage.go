@@ -0,0 +1,432 @@
+package importer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+	log "github.com/sirupsen/logrus"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+//geometryTable describes a table with a geometry column in a GeoPackage or SpatiaLite file
+type geometryTable struct {
+	Name   string `gorm:"column:name"`
+	Column string `gorm:"column:column"`
+	SRID   int64  `gorm:"column:srid"`
+}
+
+//readGeoPackage reads the line geometries of every feature table in a GeoPackage file, or
+//every geometry table in a SpatiaLite file
+func readGeoPackage(r io.Reader, opts *Options) ([]Segment, error) {
+	path, cleanup, err := fileFromReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	db, err := gorm.Open(sqlite.Open("file:"+path+"?mode=ro"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %s", path, err.Error())
+	}
+
+	if sqlDB, err := db.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+
+	tables := []geometryTable{}
+	isGeoPackage := true
+
+	result := db.Raw("SELECT table_name AS name, column_name AS \"column\", srs_id AS srid FROM gpkg_geometry_columns").Scan(&tables)
+	if result.Error != nil {
+		isGeoPackage = false
+		result = db.Raw("SELECT f_table_name AS name, f_geometry_column AS \"column\", srid FROM geometry_columns").Scan(&tables)
+		if result.Error != nil {
+			return nil, errors.New("the file is neither a GeoPackage nor a SpatiaLite database")
+		}
+	}
+
+	segments := []Segment{}
+
+	for _, table := range tables {
+		transform, err := newTransformation(table.SRID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read table %s: %s", table.Name, err.Error())
+		}
+
+		tableSegments, err := readGeometryTable(db, table, isGeoPackage, transform, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		segments = append(segments, tableSegments...)
+	}
+
+	return segments, nil
+}
+
+func readGeometryTable(db *gorm.DB, table geometryTable, isGeoPackage bool, transform transformation, opts *Options) ([]Segment, error) {
+	rows, err := db.Raw(fmt.Sprintf("SELECT * FROM %s", quoteIdentifier(table.Name))).Rows()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table %s: %s", table.Name, err.Error())
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []Segment{}
+	rowNumber := 0
+
+	for rows.Next() {
+		rowNumber++
+
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for idx := range values {
+			pointers[idx] = &values[idx]
+		}
+
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return nil, err
+		}
+
+		properties := map[string]interface{}{}
+		var blob []byte
+
+		for idx, column := range columns {
+			if strings.EqualFold(column, table.Column) {
+				blob, _ = values[idx].([]byte)
+			} else {
+				properties[column] = values[idx]
+			}
+		}
+
+		if blob == nil {
+			continue
+		}
+
+		var parts [][]geometry.Point
+		if isGeoPackage {
+			parts, err = decodeGeoPackageGeometry(blob)
+		} else {
+			parts, err = decodeSpatiaLiteGeometry(blob)
+		}
+
+		if err != nil {
+			log.Infof("Skipping row %d of %s: %s", rowNumber, table.Name, err.Error())
+			continue
+		}
+
+		fallbackID := fmt.Sprintf("%s:%d", table.Name, rowNumber)
+		for _, key := range []string{"fid", "ogc_fid", "PK_UID", "id"} {
+			if id := propertyString(properties[key]); id != "" {
+				fallbackID = id
+				delete(properties, key)
+				break
+			}
+		}
+
+		segment := newSegmentFromProperties(properties, fallbackID, opts)
+		segments = append(segments, splitParts(segment, transformParts(parts, transform))...)
+	}
+
+	return segments, rows.Err()
+}
+
+//fileFromReader returns the path of the file behind a reader, or writes the contents of
+//the reader to a temporary file if it is not backed by one
+func fileFromReader(r io.Reader) (string, func(), error) {
+	if f, ok := r.(namedReader); ok {
+		return f.Name(), func() {}, nil
+	}
+
+	tmp, err := ioutil.TempFile("", "roadnetwork-*.sqlite")
+	if err != nil {
+		return "", nil, err
+	}
+
+	_, err = io.Copy(tmp, r)
+	tmp.Close()
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, err
+	}
+
+	return tmp.Name(), func() { os.Remove(tmp.Name()) }, nil
+}
+
+func quoteIdentifier(name string) string {
+	return "\"" + strings.ReplaceAll(name, "\"", "\"\"") + "\""
+}
+
+const (
+	wkbLineString      uint32 = 2
+	wkbMultiLineString uint32 = 5
+)
+
+//decodeGeoPackageGeometry decodes a GeoPackage binary geometry, which is a header followed
+//by a standard WKB geometry
+func decodeGeoPackageGeometry(blob []byte) ([][]geometry.Point, error) {
+	if len(blob) < 8 || blob[0] != 'G' || blob[1] != 'P' {
+		return nil, errors.New("invalid GeoPackage geometry header")
+	}
+
+	flags := blob[3]
+	if flags&0x10 != 0 {
+		return nil, errors.New("empty geometry")
+	}
+
+	envelopeSizes := []int{0, 32, 48, 48, 64}
+	envelope := int(flags>>1) & 0x07
+	if envelope >= len(envelopeSizes) {
+		return nil, errors.New("invalid GeoPackage envelope indicator")
+	}
+
+	offset := 8 + envelopeSizes[envelope]
+	if len(blob) < offset {
+		return nil, errors.New("truncated GeoPackage geometry")
+	}
+
+	wkb := &wkbReader{data: blob[offset:]}
+	return wkb.readLines()
+}
+
+type wkbReader struct {
+	data  []byte
+	pos   int
+	order binary.ByteOrder
+	err   error
+}
+
+func (r *wkbReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if r.pos+n > len(r.data) {
+		r.err = errors.New("unexpected end of geometry")
+		return nil
+	}
+
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *wkbReader) byte() byte {
+	if b := r.read(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *wkbReader) uint32() uint32 {
+	if b := r.read(4); b != nil {
+		return r.order.Uint32(b)
+	}
+	return 0
+}
+
+func (r *wkbReader) float64() float64 {
+	if b := r.read(8); b != nil {
+		return math.Float64frombits(r.order.Uint64(b))
+	}
+	return 0
+}
+
+func (r *wkbReader) float32() float64 {
+	if b := r.read(4); b != nil {
+		return float64(math.Float32frombits(r.order.Uint32(b)))
+	}
+	return 0
+}
+
+func (r *wkbReader) byteOrder() {
+	if r.byte() == 0 {
+		r.order = binary.BigEndian
+	} else {
+		r.order = binary.LittleEndian
+	}
+}
+
+//header reads the byte order and type of a WKB geometry, and returns the base type and
+//the number of ordinates per position. Both ISO and EWKB style dimensions are handled.
+func (r *wkbReader) header() (uint32, int) {
+	r.byteOrder()
+	t := r.uint32()
+
+	dims := 2
+	if t&0x80000000 != 0 {
+		dims++
+	}
+	if t&0x40000000 != 0 {
+		dims++
+	}
+	if t&0x20000000 != 0 {
+		r.uint32() // Skip the embedded SRID
+	}
+
+	t &= 0x0fffffff
+
+	switch t / 1000 {
+	case 1, 2:
+		dims = 3
+	case 3:
+		dims = 4
+	}
+
+	return t % 1000, dims
+}
+
+func (r *wkbReader) positions(dims int) []geometry.Point {
+	count := int(r.uint32())
+	if r.err != nil || count*dims*8 > len(r.data)-r.pos {
+		r.err = errors.New("invalid number of positions")
+		return nil
+	}
+
+	points := make([]geometry.Point, 0, count)
+
+	for i := 0; i < count; i++ {
+		lon := r.float64()
+		lat := r.float64()
+		for d := 2; d < dims; d++ {
+			r.float64()
+		}
+		points = append(points, geometry.NewPoint(lat, lon))
+	}
+
+	return points
+}
+
+func (r *wkbReader) readLines() ([][]geometry.Point, error) {
+	t, dims := r.header()
+	parts := [][]geometry.Point{}
+
+	switch t {
+	case wkbLineString:
+		parts = append(parts, r.positions(dims))
+	case wkbMultiLineString:
+		count := int(r.uint32())
+		for i := 0; i < count && r.err == nil; i++ {
+			lineType, lineDims := r.header()
+			if lineType != wkbLineString {
+				return nil, fmt.Errorf("unexpected geometry type %d in MultiLineString", lineType)
+			}
+			parts = append(parts, r.positions(lineDims))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported geometry type %d", t)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return parts, nil
+}
+
+//decodeSpatiaLiteGeometry decodes SpatiaLite's own geometry format, that starts with a
+//header of its own and uses a WKB like body with markers between the entities
+func decodeSpatiaLiteGeometry(blob []byte) ([][]geometry.Point, error) {
+	if len(blob) < 44 || blob[0] != 0x00 || blob[38] != 0x7C || blob[len(blob)-1] != 0xFE {
+		return nil, errors.New("invalid SpatiaLite geometry")
+	}
+
+	r := &wkbReader{data: blob[:len(blob)-1], pos: 1}
+	r.byteOrder()
+	r.pos = 39
+
+	parts := [][]geometry.Point{}
+
+	t := r.uint32()
+	switch t % 1000 {
+	case wkbLineString:
+		parts = append(parts, r.spatiaLitePositions(t))
+	case wkbMultiLineString:
+		count := int(r.uint32())
+		for i := 0; i < count && r.err == nil; i++ {
+			if r.byte() != 0x69 {
+				return nil, errors.New("missing SpatiaLite entity marker")
+			}
+
+			lineType := r.uint32()
+			if lineType%1000 != wkbLineString {
+				return nil, fmt.Errorf("unexpected geometry type %d in MultiLineString", lineType)
+			}
+			parts = append(parts, r.spatiaLitePositions(lineType))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported geometry type %d", t)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return parts, nil
+}
+
+//spatiaLitePositions reads the positions of a SpatiaLite LineString. Compressed lines
+//store the first and last position in full, and every other position as float32 offsets
+//from the previous one.
+func (r *wkbReader) spatiaLitePositions(t uint32) []geometry.Point {
+	compressed := t >= 1000000
+	t %= 1000000
+
+	dims := 2
+	switch t / 1000 {
+	case 1, 2:
+		dims = 3
+	case 3:
+		dims = 4
+	}
+
+	if !compressed {
+		return r.positions(dims)
+	}
+
+	count := int(r.uint32())
+	if r.err != nil || count < 2 || count*dims*4 > len(r.data)-r.pos {
+		r.err = errors.New("invalid number of positions")
+		return nil
+	}
+
+	points := make([]geometry.Point, 0, count)
+	var lon, lat float64
+
+	for i := 0; i < count; i++ {
+		if i == 0 || i == count-1 {
+			lon = r.float64()
+			lat = r.float64()
+			for d := 2; d < dims; d++ {
+				r.float64()
+			}
+		} else {
+			lon += r.float32()
+			lat += r.float32()
+			for d := 2; d < dims; d++ {
+				r.float32()
+			}
+		}
+		points = append(points, geometry.NewPoint(lat, lon))
+	}
+
+	return points
+}
@@ -0,0 +1,245 @@
+package importer
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+)
+
+//gmlElement keeps track of an open element while a GML document is read
+type gmlElement struct {
+	name        string
+	srsName     string
+	srsDim      int
+	hasChildren bool
+}
+
+//readGMLFeatures reads the features of a GML document, such as a WFS response or a GML
+//delivery from NVDB. Every child of a featureMember, featureMembers or member element is
+//a feature, where the leaf elements are properties and the line geometries are converted
+//to WGS84 according to their srsName. Nested properties are named by their path, joined
+//with underscores.
+func readGMLFeatures(r io.Reader) ([]feature, error) {
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = charsetReader
+
+	features := []feature{}
+	stack := []gmlElement{}
+
+	var current *feature
+	featureDepth, geometryDepth, memberDepth := -1, -1, -1
+	text := strings.Builder{}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse GML: %s", err.Error())
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			element := gmlElement{name: t.Name.Local, srsDim: 2}
+			if len(stack) > 0 {
+				parent := &stack[len(stack)-1]
+				parent.hasChildren = true
+				element.srsName, element.srsDim = parent.srsName, parent.srsDim
+			}
+
+			for _, attr := range t.Attr {
+				switch attr.Name.Local {
+				case "srsName":
+					element.srsName = attr.Value
+				case "srsDimension", "dimension":
+					if dim, err := strconv.Atoi(attr.Value); err == nil && dim >= 2 {
+						element.srsDim = dim
+					}
+				}
+			}
+
+			stack = append(stack, element)
+			depth := len(stack)
+			text.Reset()
+
+			switch {
+			case current == nil && isGMLMember(t.Name.Local):
+				memberDepth = depth
+			case current == nil && depth == memberDepth+1:
+				current = &feature{layer: t.Name.Local, properties: map[string]string{}}
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "id" || attr.Name.Local == "fid" {
+						current.id = attr.Value
+					}
+				}
+				featureDepth = depth
+			case current != nil && geometryDepth < 0 && strings.Contains(t.Name.Space, "opengis.net/gml"):
+				geometryDepth = depth
+			}
+
+			if current != nil && geometryDepth > 0 && (t.Name.Local == "LineString" || t.Name.Local == "Curve") {
+				current.parts = append(current.parts, []geometry.Point{})
+			}
+
+		case xml.CharData:
+			text.Write(t)
+
+		case xml.EndElement:
+			depth := len(stack)
+			if depth == 0 {
+				return nil, fmt.Errorf("unbalanced GML document")
+			}
+
+			element := stack[depth-1]
+
+			if current != nil {
+				if geometryDepth > 0 {
+					switch element.name {
+					case "posList", "pos", "coordinates":
+						positions, err := parseGMLPositions(text.String(), element)
+						if err != nil {
+							return nil, err
+						}
+
+						if len(current.parts) == 0 {
+							current.parts = append(current.parts, []geometry.Point{})
+						}
+
+						last := len(current.parts) - 1
+						current.parts[last] = append(current.parts[last], positions...)
+					}
+				} else if depth > featureDepth && !element.hasChildren {
+					if value := strings.TrimSpace(text.String()); value != "" {
+						current.properties[propertyPath(stack[featureDepth:])] = value
+					}
+				}
+
+				if depth == geometryDepth {
+					geometryDepth = -1
+				}
+
+				if depth == featureDepth {
+					features = append(features, *current)
+					current = nil
+					featureDepth = -1
+				}
+			}
+
+			if depth == memberDepth && current == nil {
+				memberDepth = -1
+			}
+
+			stack = stack[:depth-1]
+			text.Reset()
+		}
+	}
+
+	return features, nil
+}
+
+func isGMLMember(name string) bool {
+	return name == "featureMember" || name == "featureMembers" || name == "member"
+}
+
+func propertyPath(elements []gmlElement) string {
+	names := make([]string, 0, len(elements))
+	for _, e := range elements {
+		names = append(names, e.name)
+	}
+	return strings.Join(names, "_")
+}
+
+//parseGMLPositions parses the contents of a posList, pos or coordinates element and
+//converts the positions to WGS84
+func parseGMLPositions(contents string, element gmlElement) ([]geometry.Point, error) {
+	values := []float64{}
+	dims := element.srsDim
+
+	fields := strings.Fields(contents)
+	if element.name == "coordinates" {
+		// The coordinates element separates the ordinates of a tuple with commas
+		dims = 0
+		for idx, tuple := range fields {
+			ordinates := strings.Split(tuple, ",")
+			if idx == 0 {
+				dims = len(ordinates)
+			}
+			values = append(values, parseFloats(ordinates)...)
+		}
+	} else {
+		values = parseFloats(fields)
+	}
+
+	if dims < 2 || len(values)%dims != 0 {
+		return nil, fmt.Errorf("invalid GML positions %q", contents)
+	}
+
+	toWGS84, err := newGMLTransformation(element.srsName, values[0], values[1])
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]geometry.Point, 0, len(values)/dims)
+	for i := 0; i+1 < len(values); i += dims {
+		points = append(points, toWGS84(values[i], values[i+1]))
+	}
+
+	return points, nil
+}
+
+func parseFloats(fields []string) []float64 {
+	values := make([]float64, 0, len(fields))
+	for _, f := range fields {
+		if v, err := strconv.ParseFloat(strings.TrimSpace(f), 64); err == nil {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+//sridFromName extracts the EPSG code from the common forms of srsName, such as
+//EPSG:3006, urn:ogc:def:crs:EPSG::3006 and http://www.opengis.net/def/crs/EPSG/0/3006
+func sridFromName(srsName string) (int64, bool) {
+	idx := strings.LastIndexAny(srsName, ":/#")
+	srid, err := strconv.ParseInt(srsName[idx+1:], 10, 64)
+	return srid, err == nil
+}
+
+//newGMLTransformation returns a function that converts the first two ordinates of a GML
+//position into WGS84. The axis order of EPSG:4326 is latitude first in the urn and http
+//forms of srsName, but longitude first in the older EPSG:4326 form. Since northings are
+//always larger than eastings in SWEREF 99 TM, the axis order is detected from the first
+//position. Positions without an srsName are assumed to be SWEREF 99 TM if they are out
+//of range for degrees.
+func newGMLTransformation(srsName string, first, second float64) (func(a, b float64) geometry.Point, error) {
+	srid, ok := sridFromName(srsName)
+	if !ok {
+		if srsName != "" {
+			return nil, fmt.Errorf("unsupported srsName %s", srsName)
+		}
+
+		srid = 4326
+		if first > 180 || first < -180 || second > 180 || second < -180 {
+			srid = geometry.SWEREF99TM
+		}
+	}
+
+	switch srid {
+	case 4326:
+		if strings.HasPrefix(srsName, "urn:") || strings.HasPrefix(srsName, "http://www.opengis.net/def/") {
+			return func(a, b float64) geometry.Point { return geometry.NewPoint(a, b) }, nil
+		}
+		return func(a, b float64) geometry.Point { return geometry.NewPoint(b, a) }, nil
+	case geometry.SWEREF99TM:
+		if first > second {
+			return func(a, b float64) geometry.Point { return geometry.FromSWEREF99TM(a, b) }, nil
+		}
+		return func(a, b float64) geometry.Point { return geometry.FromSWEREF99TM(b, a) }, nil
+	}
+
+	return nil, fmt.Errorf("the spatial reference system %d is not supported", srid)
+}
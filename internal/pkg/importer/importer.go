@@ -0,0 +1,304 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+)
+
+//Segment is a road segment read from a road network file, in a form that does not depend
+//on the format of the file
+type Segment struct {
+	ID          string
+	RoadID      string
+	Name        string
+	RoadClass   string
+	Coordinates []geometry.Point
+
+	//Attributes holds any additional information about the segment, such as a speed limit
+	Attributes map[string]string
+}
+
+const (
+	//FormatAuto detects the format of a file from its contents
+	FormatAuto string = "auto"
+	//FormatText is the semicolon separated roadID;segmentID;lat;lon;lat;lon... format
+	FormatText string = "text"
+	//FormatGeoJSON is a GeoJSON FeatureCollection of LineStrings and MultiLineStrings
+	FormatGeoJSON string = "geojson"
+	//FormatGeoPackage is a GeoPackage or SpatiaLite database file
+	FormatGeoPackage string = "gpkg"
+	//FormatNVDB is an export from Trafikverket's NVDB, as GML or as zipped Shape files
+	FormatNVDB string = "nvdb"
+	//FormatOSM is an OpenStreetMap extract in XML or PBF format
+	FormatOSM string = "osm"
+)
+
+//PropertyNames tells the importers which feature properties contain what information
+type PropertyNames struct {
+	RoadID    string
+	SegmentID string
+	Name      string
+	RoadClass string
+}
+
+//Options controls how a road network file is read
+type Options struct {
+	Format     string
+	Properties PropertyNames
+
+	//TagFilter selects the OSM ways to import, see NewTagFilter
+	TagFilter string
+}
+
+//Option is a function that modifies the Options of an import
+type Option func(*Options)
+
+//WithFormat forces the import to use a specific format instead of detecting it
+func WithFormat(format string) Option {
+	return func(o *Options) {
+		if format != "" {
+			o.Format = format
+		}
+	}
+}
+
+//WithPropertyNames overrides the names of the properties that the road ID, segment ID,
+//name and road class are read from. Empty names keep their defaults.
+func WithPropertyNames(names PropertyNames) Option {
+	return func(o *Options) {
+		if names.RoadID != "" {
+			o.Properties.RoadID = names.RoadID
+		}
+		if names.SegmentID != "" {
+			o.Properties.SegmentID = names.SegmentID
+		}
+		if names.Name != "" {
+			o.Properties.Name = names.Name
+		}
+		if names.RoadClass != "" {
+			o.Properties.RoadClass = names.RoadClass
+		}
+	}
+}
+
+//WithTagFilter sets the filter that decides which ways of an OSM extract are imported
+func WithTagFilter(filter string) Option {
+	return func(o *Options) {
+		o.TagFilter = filter
+	}
+}
+
+func newOptions(options []Option) *Options {
+	opts := &Options{
+		Format: FormatAuto,
+		Properties: PropertyNames{
+			RoadID:    "roadID",
+			SegmentID: "segmentID",
+			Name:      "name",
+			RoadClass: "roadClass",
+		},
+	}
+
+	for _, option := range options {
+		option(opts)
+	}
+
+	return opts
+}
+
+//readerFunc reads all the segments from a road network file of a specific format
+type readerFunc func(r io.Reader, opts *Options) ([]Segment, error)
+
+var readers = map[string]readerFunc{
+	FormatText:       readText,
+	FormatGeoJSON:    readGeoJSON,
+	FormatGeoPackage: readGeoPackage,
+	"spatialite":     readGeoPackage,
+	FormatNVDB:       readNVDB,
+	FormatOSM:        readOSM,
+	"pbf":            readOSM,
+}
+
+//Read reads all the road segments from a road network file. Segments with less than two
+//positions are skipped, since they can not describe a part of a road.
+func Read(r io.Reader, options ...Option) ([]Segment, error) {
+	opts := newOptions(options)
+
+	br := bufio.NewReaderSize(r, 4096)
+
+	format := strings.ToLower(opts.Format)
+	if format == FormatAuto {
+		var err error
+		format, err = sniff(br)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	read, ok := readers[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported road network format %s", format)
+	}
+
+	var input io.Reader = br
+	if f, ok := r.(namedReader); ok {
+		// Formats that need random access reopen the file by name, so pass it on
+		input = &bufferedFile{Reader: br, name: f.Name()}
+	}
+
+	segments, err := read(input, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	valid := segments[:0]
+	for _, segment := range segments {
+		if len(segment.Coordinates) >= 2 && segment.ID != "" && segment.RoadID != "" {
+			valid = append(valid, segment)
+		}
+	}
+
+	return valid, nil
+}
+
+//namedReader is implemented by *os.File
+type namedReader interface {
+	io.Reader
+	Name() string
+}
+
+//bufferedFile keeps the name of a file available to the format readers, after its first
+//bytes have been consumed by the content sniffing
+type bufferedFile struct {
+	*bufio.Reader
+	name string
+}
+
+func (f *bufferedFile) Name() string {
+	return f.name
+}
+
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+//sniff detects the format of a file by looking at its first bytes
+func sniff(br *bufio.Reader) (string, error) {
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", err
+	}
+
+	if bytes.HasPrefix(head, sqliteHeader) {
+		return FormatGeoPackage, nil
+	}
+
+	if bytes.HasPrefix(head, zipMagic) || isShapefile(head) {
+		return FormatNVDB, nil
+	}
+
+	if isOSMPBF(head) {
+		return FormatOSM, nil
+	}
+
+	trimmed := bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n")
+
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		return FormatGeoJSON, nil
+	}
+
+	if bytes.HasPrefix(trimmed, []byte("<")) {
+		if bytes.Contains(head, []byte("<osm")) {
+			return FormatOSM, nil
+		}
+		if bytes.Contains(head, []byte("opengis.net/gml")) {
+			return FormatNVDB, nil
+		}
+		return "", fmt.Errorf("unable to detect the format of an XML road network file")
+	}
+
+	return FormatText, nil
+}
+
+//propertyString converts a property value of any of the types found in GeoJSON or
+//database columns into a string
+func propertyString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+//newSegmentFromProperties creates a segment and reads its identities, name and road class
+//from a feature's properties, using fallbackID as the segment ID if it has none. Any other
+//properties are kept as attributes. Segments without a road ID make up a road of their own.
+func newSegmentFromProperties(properties map[string]interface{}, fallbackID string, opts *Options) Segment {
+	segment := Segment{
+		ID:         propertyString(properties[opts.Properties.SegmentID]),
+		RoadID:     propertyString(properties[opts.Properties.RoadID]),
+		Name:       propertyString(properties[opts.Properties.Name]),
+		RoadClass:  propertyString(properties[opts.Properties.RoadClass]),
+		Attributes: map[string]string{},
+	}
+
+	if segment.ID == "" {
+		segment.ID = fallbackID
+	}
+
+	if segment.RoadID == "" {
+		segment.RoadID = segment.ID
+	}
+
+	for key, value := range properties {
+		if key == opts.Properties.SegmentID || key == opts.Properties.RoadID ||
+			key == opts.Properties.Name || key == opts.Properties.RoadClass {
+			continue
+		}
+
+		if s := propertyString(value); s != "" {
+			segment.Attributes[key] = s
+		}
+	}
+
+	return segment
+}
+
+//splitParts turns a segment with a geometry made up of several lines into one segment
+//per line, where the parts are numbered with a suffix to keep their identities unique
+func splitParts(segment Segment, parts [][]geometry.Point) []Segment {
+	if len(parts) == 1 {
+		segment.Coordinates = parts[0]
+		return []Segment{segment}
+	}
+
+	segments := []Segment{}
+
+	for idx, part := range parts {
+		s := segment
+		s.ID = fmt.Sprintf("%s:%d", segment.ID, idx+1)
+		s.Coordinates = part
+		segments = append(segments, s)
+	}
+
+	return segments
+}
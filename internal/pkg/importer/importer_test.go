@@ -0,0 +1,233 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const geoJSONNetwork string = `{
+	"type": "FeatureCollection",
+	"features": [
+		{
+			"type": "Feature",
+			"id": 17,
+			"geometry": {"type": "LineString", "coordinates": [[17.310863, 62.389109], [17.310852, 62.389084]]},
+			"properties": {"vagnr": "E4", "namn": "Europaväg 4", "klass": "1", "maxspeed": 110}
+		},
+		{
+			"type": "Feature",
+			"geometry": {"type": "MultiLineString", "coordinates": [
+				[[17.3, 62.3], [17.4, 62.4]],
+				[[17.4, 62.4], [17.5, 62.5]]
+			]},
+			"properties": {"vagnr": "E14", "segmentID": "e14"}
+		},
+		{
+			"type": "Feature",
+			"geometry": {"type": "Point", "coordinates": [17.3, 62.3]},
+			"properties": {}
+		}
+	]
+}`
+
+func TestReadGeoJSONWithCustomPropertyNames(t *testing.T) {
+	segments, err := Read(strings.NewReader(geoJSONNetwork), WithPropertyNames(PropertyNames{
+		RoadID: "vagnr", Name: "namn", RoadClass: "klass",
+	}))
+	if err != nil {
+		t.Fatalf("Failed to read GeoJSON: %s", err.Error())
+	}
+
+	if len(segments) != 3 {
+		t.Fatalf("Expected 3 segments, but got %d", len(segments))
+	}
+
+	first := segments[0]
+	if first.ID != "17" || first.RoadID != "E4" || first.Name != "Europaväg 4" || first.RoadClass != "1" {
+		t.Errorf("Unexpected first segment %+v", first)
+	}
+
+	if first.Attributes["maxspeed"] != "110" {
+		t.Errorf("Expected the maxspeed property to be kept as an attribute, but got %v", first.Attributes)
+	}
+
+	if first.Coordinates[0].Lat != 62.389109 || first.Coordinates[0].Lon != 17.310863 {
+		t.Errorf("Coordinates were not read as lon,lat: %+v", first.Coordinates[0])
+	}
+
+	if segments[1].ID != "e14:1" || segments[2].ID != "e14:2" || segments[2].RoadID != "E14" {
+		t.Errorf("Expected the MultiLineString to be split into numbered parts, but got %s and %s", segments[1].ID, segments[2].ID)
+	}
+}
+
+func TestReadTextFormat(t *testing.T) {
+	text := "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\r\n" +
+		"21277:153931;21277:153931;62.389109;17.310863\n"
+
+	segments, err := Read(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Failed to read text: %s", err.Error())
+	}
+
+	if len(segments) != 1 || segments[0].ID != "21277:153930" || len(segments[0].Coordinates) != 2 {
+		t.Errorf("Unexpected segments %+v", segments)
+	}
+}
+
+func TestSniff(t *testing.T) {
+	sniffs := map[string]string{
+		"SQLite format 3\x00...":    FormatGeoPackage,
+		"\xef\xbb\xbf\n  {\"type\"": FormatGeoJSON,
+		"1;2;62.3;17.3;62.4;17.4":   FormatText,
+		"PK\x03\x04":                FormatNVDB,
+		"<gml:FeatureCollection xmlns:gml=\"http://www.opengis.net/gml\">": FormatNVDB,
+	}
+
+	for contents, expected := range sniffs {
+		format, _ := sniff(bufio.NewReader(strings.NewReader(contents)))
+		if format != expected {
+			t.Errorf("Expected %q to be detected as %s, but got %s", contents, expected, format)
+		}
+	}
+}
+
+func TestReadGeoPackage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "network.gpkg")
+	db := openTestDatabase(t, path)
+
+	db.Exec("CREATE TABLE gpkg_geometry_columns (table_name TEXT, column_name TEXT, geometry_type_name TEXT, srs_id INTEGER, z INTEGER, m INTEGER)")
+	db.Exec("INSERT INTO gpkg_geometry_columns VALUES ('roads', 'geom', 'LINESTRING', 4326, 0, 0)")
+	db.Exec("CREATE TABLE roads (fid INTEGER PRIMARY KEY, geom BLOB, name TEXT, road_number TEXT)")
+	db.Exec("INSERT INTO roads VALUES (?, ?, ?, ?)", 7, geoPackageLine([][2]float64{{17.3, 62.3}, {17.4, 62.4}}), "Storgatan", "562")
+	closeTestDatabase(db)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open the GeoPackage: %s", err.Error())
+	}
+	defer f.Close()
+
+	segments, err := Read(f, WithPropertyNames(PropertyNames{RoadID: "road_number"}))
+	if err != nil {
+		t.Fatalf("Failed to read the GeoPackage: %s", err.Error())
+	}
+
+	if len(segments) != 1 {
+		t.Fatalf("Expected one segment, but got %d", len(segments))
+	}
+
+	segment := segments[0]
+	if segment.ID != "7" || segment.RoadID != "562" || segment.Name != "Storgatan" {
+		t.Errorf("Unexpected segment %+v", segment)
+	}
+
+	if len(segment.Coordinates) != 2 || segment.Coordinates[1].Lat != 62.4 || segment.Coordinates[1].Lon != 17.4 {
+		t.Errorf("Unexpected coordinates %+v", segment.Coordinates)
+	}
+}
+
+func TestReadSpatiaLiteFromNonFileReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "network.sqlite")
+	db := openTestDatabase(t, path)
+
+	db.Exec("CREATE TABLE geometry_columns (f_table_name TEXT, f_geometry_column TEXT, geometry_type INTEGER, coord_dimension INTEGER, srid INTEGER, spatial_index_enabled INTEGER)")
+	db.Exec("INSERT INTO geometry_columns VALUES ('links', 'geometry', 2, 2, 4326, 0)")
+	db.Exec("CREATE TABLE links (PK_UID INTEGER PRIMARY KEY, geometry BLOB)")
+	db.Exec("INSERT INTO links VALUES (?, ?)", 3, spatiaLiteLine([][2]float64{{17.3, 62.3}, {17.35, 62.35}, {17.4, 62.4}}))
+	closeTestDatabase(db)
+
+	contents, _ := ioutil.ReadFile(path)
+
+	segments, err := Read(bytes.NewReader(contents))
+	if err != nil {
+		t.Fatalf("Failed to read the SpatiaLite file: %s", err.Error())
+	}
+
+	if len(segments) != 1 || segments[0].ID != "3" || len(segments[0].Coordinates) != 3 {
+		t.Errorf("Unexpected segments %+v", segments)
+	}
+}
+
+func TestReadGeoPackageRejectsOtherReferenceSystems(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "network.gpkg")
+	db := openTestDatabase(t, path)
+
+	db.Exec("CREATE TABLE gpkg_geometry_columns (table_name TEXT, column_name TEXT, geometry_type_name TEXT, srs_id INTEGER, z INTEGER, m INTEGER)")
+	db.Exec("INSERT INTO gpkg_geometry_columns VALUES ('roads', 'geom', 'LINESTRING', 32633, 0, 0)")
+	db.Exec("CREATE TABLE roads (fid INTEGER PRIMARY KEY, geom BLOB)")
+	closeTestDatabase(db)
+
+	f, _ := os.Open(path)
+	defer f.Close()
+
+	_, err := Read(f, WithFormat(FormatGeoPackage))
+	if err == nil {
+		t.Error("Expected an unsupported reference system to be an error")
+	}
+}
+
+func openTestDatabase(t *testing.T, path string) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("Failed to create test database: %s", err.Error())
+	}
+	return db
+}
+
+func closeTestDatabase(db *gorm.DB) {
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+}
+
+func wkbPositions(buf *bytes.Buffer, positions [][2]float64) {
+	binary.Write(buf, binary.LittleEndian, uint32(len(positions)))
+	for _, pos := range positions {
+		binary.Write(buf, binary.LittleEndian, math.Float64bits(pos[0]))
+		binary.Write(buf, binary.LittleEndian, math.Float64bits(pos[1]))
+	}
+}
+
+//geoPackageLine encodes a LineString as a GeoPackage geometry with an xy envelope
+func geoPackageLine(positions [][2]float64) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{'G', 'P', 0, 0x03})
+	binary.Write(buf, binary.LittleEndian, int32(4326))
+	for i := 0; i < 4; i++ {
+		binary.Write(buf, binary.LittleEndian, float64(0))
+	}
+
+	buf.WriteByte(1)
+	binary.Write(buf, binary.LittleEndian, wkbLineString)
+	wkbPositions(buf, positions)
+
+	return buf.Bytes()
+}
+
+//spatiaLiteLine encodes a LineString as a SpatiaLite geometry blob
+func spatiaLiteLine(positions [][2]float64) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{0x00, 0x01})
+	binary.Write(buf, binary.LittleEndian, int32(4326))
+	for i := 0; i < 4; i++ {
+		binary.Write(buf, binary.LittleEndian, float64(0))
+	}
+
+	buf.WriteByte(0x7C)
+	binary.Write(buf, binary.LittleEndian, wkbLineString)
+	wkbPositions(buf, positions)
+	buf.WriteByte(0xFE)
+
+	return buf.Bytes()
+}
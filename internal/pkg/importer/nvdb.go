@@ -0,0 +1,323 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+)
+
+//feature is a line feature with its properties, as read from a GML document or a layer of
+//a Shape delivery
+type feature struct {
+	layer      string
+	id         string
+	properties map[string]string
+	parts      [][]geometry.Point
+}
+
+//readNVDB reads an export from Trafikverket's national road database, NVDB, delivered as
+//GML or as Shape files in a zip archive. See nvdbSegments for how the features are mapped
+//to road segments.
+func readNVDB(r io.Reader, opts *Options) ([]Segment, error) {
+	peeker, ok := r.(interface{ Peek(int) ([]byte, error) })
+	if !ok {
+		br := bufio.NewReader(r)
+		peeker, r = br, br
+	}
+
+	head, _ := peeker.Peek(4)
+
+	var features []feature
+	var err error
+
+	if bytes.HasPrefix(head, zipMagic) || isShapefile(head) {
+		features, err = readShapefiles(r)
+	} else {
+		features, err = readGMLFeatures(r)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nvdbSegments(features), nil
+}
+
+//nvdbLink identifies the part of an NVDB reference link that a feature describes
+type nvdbLink struct {
+	elementID   string
+	from, to    float64
+	hasMeasures bool
+}
+
+func (l nvdbLink) overlap(other nvdbLink) float64 {
+	if !l.hasMeasures || !other.hasMeasures {
+		return 1
+	}
+	return math.Min(l.to, other.to) - math.Max(l.from, other.from)
+}
+
+func newNVDBLink(f feature) nvdbLink {
+	link := nvdbLink{elementID: f.id}
+
+	if id, ok := findProperty(f.properties, isElementIDProperty); ok {
+		link.elementID = id
+	}
+
+	from, fromOK := findProperty(f.properties, func(key string) bool {
+		return strings.HasPrefix(key, "frommeas") || key == "fromm"
+	})
+	to, toOK := findProperty(f.properties, func(key string) bool {
+		return strings.HasPrefix(key, "tomeas") || key == "tom"
+	})
+
+	if fromOK && toOK {
+		var fromErr, toErr error
+		link.from, fromErr = strconv.ParseFloat(from, 64)
+		link.to, toErr = strconv.ParseFloat(to, 64)
+		link.hasMeasures = fromErr == nil && toErr == nil
+	}
+
+	return link
+}
+
+//nvdbSegments maps NVDB features to road segments. The segments get their IDs from the
+//element ID of the reference link they are part of, followed by the measures of the part
+//if the link is split into several features. Segments belong to the road with their road
+//number, or to a road of their own if they have none.
+//
+//A delivery may contain several layers, one per NVDB data product. The layer with the
+//most features is then used for the geometries, and the attributes of the other layers
+//are joined on element ID, using the feature that overlaps each segment the most.
+func nvdbSegments(features []feature) []Segment {
+	layers := map[string][]feature{}
+	order := []string{}
+
+	for _, f := range features {
+		if _, ok := layers[f.layer]; !ok {
+			order = append(order, f.layer)
+		}
+		layers[f.layer] = append(layers[f.layer], f)
+	}
+
+	base := ""
+	for _, name := range order {
+		if base == "" || len(layers[name]) > len(layers[base]) {
+			base = name
+		}
+	}
+
+	attributeLayers := map[string]map[string][]feature{}
+	for _, name := range order {
+		if name == base {
+			continue
+		}
+
+		byElement := map[string][]feature{}
+		for _, f := range layers[name] {
+			link := newNVDBLink(f)
+			byElement[link.elementID] = append(byElement[link.elementID], f)
+		}
+		attributeLayers[name] = byElement
+	}
+
+	partsPerElement := map[string]int{}
+	for _, f := range layers[base] {
+		partsPerElement[newNVDBLink(f).elementID]++
+	}
+
+	segments := []Segment{}
+
+	for _, f := range layers[base] {
+		link := newNVDBLink(f)
+
+		properties := map[string]string{}
+		for key, value := range f.properties {
+			properties[key] = value
+		}
+
+		for _, name := range order {
+			if match, ok := bestOverlap(link, attributeLayers[name][link.elementID]); ok {
+				for key, value := range match.properties {
+					if !isLinkProperty(normalizePropertyName(key)) {
+						properties[name+"_"+key] = value
+					}
+				}
+			}
+		}
+
+		segment := newNVDBSegment(link, properties)
+
+		if partsPerElement[link.elementID] > 1 {
+			if link.hasMeasures {
+				segment.ID = fmt.Sprintf("%s:%s-%s", segment.ID, strconv.FormatFloat(link.from, 'f', -1, 64), strconv.FormatFloat(link.to, 'f', -1, 64))
+			} else {
+				segment.ID = fmt.Sprintf("%s:%s", segment.ID, f.id)
+			}
+		}
+
+		if segment.RoadID == "" {
+			segment.RoadID = segment.ID
+		}
+
+		segments = append(segments, splitParts(segment, f.parts)...)
+	}
+
+	return segments
+}
+
+func bestOverlap(link nvdbLink, candidates []feature) (feature, bool) {
+	best, bestOverlap := feature{}, 0.0
+
+	for _, candidate := range candidates {
+		if overlap := link.overlap(newNVDBLink(candidate)); overlap > bestOverlap {
+			best, bestOverlap = candidate, overlap
+		}
+	}
+
+	return best, bestOverlap > 0
+}
+
+//newNVDBSegment carries over the road number, functional road class, speed limit, width
+//and name of a part of a reference link
+func newNVDBSegment(link nvdbLink, properties map[string]string) Segment {
+	segment := Segment{
+		ID:         link.elementID,
+		Attributes: map[string]string{"elementID": link.elementID},
+	}
+
+	if number, ok := findProperty(properties, func(key string) bool {
+		return strings.Contains(key, "huvudnummer") || strings.Contains(key, "huvudnr") ||
+			key == "vagnummer" || key == "vagnr" || key == "roadnumber"
+	}); ok {
+		number = formatNumber(number)
+
+		european, _ := findProperty(properties, func(key string) bool {
+			return strings.Contains(key, "europavag")
+		})
+
+		if european == "-1" || european == "1" || strings.EqualFold(european, "true") {
+			number = "E" + number
+		}
+
+		segment.RoadID = number
+		segment.Attributes["roadNumber"] = number
+	}
+
+	if class, ok := findProperty(properties, func(key string) bool {
+		return strings.Contains(key, "funk")
+	}); ok {
+		segment.RoadClass = formatNumber(class)
+		segment.Attributes["functionalRoadClass"] = segment.RoadClass
+	}
+
+	if speed, ok := findProperty(properties, func(key string) bool {
+		return strings.Contains(key, "hastighet") || strings.Contains(key, "hogstatillatna") ||
+			strings.Contains(key, "hastgr") || key == "speedlimit"
+	}); ok {
+		segment.Attributes["speedLimit"] = formatNumber(speed)
+	}
+
+	if width, ok := findProperty(properties, func(key string) bool {
+		return strings.Contains(key, "bredd") || key == "width"
+	}); ok {
+		segment.Attributes["width"] = formatNumber(width)
+	}
+
+	if name, ok := findProperty(properties, func(key string) bool {
+		return strings.Contains(key, "namn") || key == "name"
+	}); ok {
+		segment.Name = name
+	}
+
+	return segment
+}
+
+//isLinkProperty returns true for properties that describe where on a reference link a
+//feature is, or that are bookkeeping, rather than attributes of the road itself
+func isLinkProperty(key string) bool {
+	if isElementIDProperty(key) || strings.HasPrefix(key, "frommeas") || strings.HasPrefix(key, "tomeas") ||
+		key == "fromm" || key == "tom" {
+		return true
+	}
+
+	for _, bookkeeping := range []string{"objectid", "shape", "oid", "fid", "riktning", "direction", "giltig", "datum", "date", "version"} {
+		if strings.Contains(key, bookkeeping) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isElementIDProperty(key string) bool {
+	return strings.HasSuffix(key, "elementid") || key == "rlid" || key == "routeid" || key == "linkid"
+}
+
+//findProperty returns the value of the first property, in name order, whose normalized
+//name is accepted by match. The names of NVDB attributes vary between deliveries and are
+//truncated in Shape files, so they are compared in lower case without diacritics or
+//separators. Properties that describe the direction of travel against the link, with
+//names ending in B, are only used if there is no other match.
+func findProperty(properties map[string]string, match func(key string) bool) (string, bool) {
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fallback, found := "", false
+
+	for _, key := range keys {
+		normalized := normalizePropertyName(key)
+		if !match(normalized) {
+			continue
+		}
+
+		if strings.HasSuffix(normalized, "b") && !strings.HasSuffix(normalized, "nvdb") {
+			if !found {
+				fallback, found = properties[key], true
+			}
+			continue
+		}
+
+		return properties[key], true
+	}
+
+	return fallback, found
+}
+
+func normalizePropertyName(name string) string {
+	sb := strings.Builder{}
+
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			sb.WriteRune(r)
+		case r == 'å' || r == 'ä':
+			sb.WriteRune('a')
+		case r == 'ö':
+			sb.WriteRune('o')
+		case r == 'é':
+			sb.WriteRune('e')
+		}
+	}
+
+	return sb.String()
+}
+
+//formatNumber removes trailing decimals from numbers such as 70.000, which is how
+//integers are often stored in Shape files
+func formatNumber(value string) string {
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return value
+}
@@ -0,0 +1,248 @@
+package importer
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+)
+
+const nvdbGML string = `<?xml version="1.0" encoding="ISO-8859-1"?>
+<gml:FeatureCollection xmlns:gml="http://www.opengis.net/gml" xmlns:nvdb="http://nvdb.trafikverket.se">
+	<gml:featureMember>
+		<nvdb:Vaglank gml:id="f1">
+			<nvdb:ELEMENT_ID>1001</nvdb:ELEMENT_ID>
+			<nvdb:FROM_MEASURE>0</nvdb:FROM_MEASURE>
+			<nvdb:TO_MEASURE>0.5</nvdb:TO_MEASURE>
+			<nvdb:Vagnummer>
+				<nvdb:Huvudnummer>4</nvdb:Huvudnummer>
+				<nvdb:Europavag>-1</nvdb:Europavag>
+			</nvdb:Vagnummer>
+			<nvdb:FunkVagklass_Klass>1</nvdb:FunkVagklass_Klass>
+			<nvdb:Hastighetsgrans_Hogsta_tillatna_hastighet_B>80</nvdb:Hastighetsgrans_Hogsta_tillatna_hastighet_B>
+			<nvdb:Hastighetsgrans_Hogsta_tillatna_hastighet_F>110</nvdb:Hastighetsgrans_Hogsta_tillatna_hastighet_F>
+			<nvdb:Vagbredd_Bredd>13.50</nvdb:Vagbredd_Bredd>
+			<nvdb:Gatunamn_Namn>Nordv` + "\xe4" + `gen</nvdb:Gatunamn_Namn>
+			<nvdb:geometry>
+				<gml:LineString srsName="EPSG:3006">
+					<gml:posList>6919664 619472 6919700 619500</gml:posList>
+				</gml:LineString>
+			</nvdb:geometry>
+		</nvdb:Vaglank>
+	</gml:featureMember>
+	<gml:featureMember>
+		<nvdb:Vaglank gml:id="f2">
+			<nvdb:ELEMENT_ID>1001</nvdb:ELEMENT_ID>
+			<nvdb:FROM_MEASURE>0.5</nvdb:FROM_MEASURE>
+			<nvdb:TO_MEASURE>1</nvdb:TO_MEASURE>
+			<nvdb:geometry>
+				<gml:LineString srsName="urn:ogc:def:crs:EPSG::3006">
+					<gml:posList>6919700 619500 6919750 619520</gml:posList>
+				</gml:LineString>
+			</nvdb:geometry>
+		</nvdb:Vaglank>
+	</gml:featureMember>
+</gml:FeatureCollection>`
+
+func expectNear(t *testing.T, actual, expected geometry.Point) {
+	if d := geometry.Distance(actual, expected); d > 0.01 {
+		t.Errorf("Expected (%f,%f) to be at (%f,%f), but it was %f m away", actual.Lat, actual.Lon, expected.Lat, expected.Lon, d)
+	}
+}
+
+func TestReadNVDBFromGML(t *testing.T) {
+	segments, err := Read(strings.NewReader(nvdbGML))
+	if err != nil {
+		t.Fatalf("Failed to read NVDB GML: %s", err.Error())
+	}
+
+	if len(segments) != 2 {
+		t.Fatalf("Expected 2 segments, but got %d", len(segments))
+	}
+
+	first := segments[0]
+	if first.ID != "1001:0-0.5" || first.RoadID != "E4" || first.RoadClass != "1" || first.Name != "Nordvägen" {
+		t.Errorf("Unexpected first segment %+v", first)
+	}
+
+	expected := map[string]string{"roadNumber": "E4", "functionalRoadClass": "1", "speedLimit": "110", "width": "13.5", "elementID": "1001"}
+	for key, value := range expected {
+		if first.Attributes[key] != value {
+			t.Errorf("Expected the attribute %s to be %s, but got %s", key, value, first.Attributes[key])
+		}
+	}
+
+	expectNear(t, first.Coordinates[0], geometry.FromSWEREF99TM(6919664, 619472))
+	expectNear(t, first.Coordinates[1], geometry.FromSWEREF99TM(6919700, 619500))
+
+	second := segments[1]
+	if second.ID != "1001:0.5-1" || second.RoadID != second.ID {
+		t.Errorf("Expected a segment without road number to make up a road of its own, but got %+v", second)
+	}
+}
+
+func TestReadNVDBFromZippedShapefiles(t *testing.T) {
+	archive := &bytes.Buffer{}
+	zw := zip.NewWriter(archive)
+
+	addToZip(t, zw, "nvdb/Vaglank.shp", shpPolyLines([][][2]float64{
+		{{619472, 6919664}, {619500, 6919700}},
+		{{619500, 6919700}, {619520, 6919750}},
+		{{619520, 6919750}, {619530, 6919800}},
+	}))
+	addToZip(t, zw, "nvdb/Vaglank.dbf", dbfRecords([]map[string]string{
+		{"ELEMENT_ID": "1001", "FROM_MEASU": "0.000", "TO_MEASURE": "1.000", "HUVUDNR": "562.000"},
+		{"ELEMENT_ID": "1002", "FROM_MEASU": "0.000", "TO_MEASURE": "1.000", "HUVUDNR": "562.000"},
+		{"ELEMENT_ID": "1003", "FROM_MEASU": "0.000", "TO_MEASURE": "1.000", "HUVUDNR": "562.000"},
+	}))
+	addToZip(t, zw, "nvdb/Vaglank.prj", []byte(`PROJCS["SWEREF99_TM",GEOGCS["GCS_SWEREF99"]]`))
+
+	addToZip(t, zw, "nvdb/Hastighetsgrans.shp", shpPolyLines([][][2]float64{
+		{{619472, 6919664}, {619490, 6919690}},
+		{{619490, 6919690}, {619500, 6919700}},
+	}))
+	addToZip(t, zw, "nvdb/Hastighetsgrans.dbf", dbfRecords([]map[string]string{
+		{"ELEMENT_ID": "1001", "FROM_MEASU": "0.000", "TO_MEASURE": "0.200", "HTHAST_F": "50"},
+		{"ELEMENT_ID": "1001", "FROM_MEASU": "0.200", "TO_MEASURE": "1.000", "HTHAST_F": "70"},
+	}))
+	addToZip(t, zw, "nvdb/Hastighetsgrans.prj", []byte(`PROJCS["SWEREF99_TM",GEOGCS["GCS_SWEREF99"]]`))
+
+	zw.Close()
+
+	// The layer with the most features is used for the geometries
+	segments, err := Read(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to read zipped Shape files: %s", err.Error())
+	}
+
+	if len(segments) != 3 {
+		t.Fatalf("Expected 3 segments, but got %d", len(segments))
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].ID < segments[j].ID })
+
+	if segments[0].ID != "1001" || segments[0].RoadID != "562" {
+		t.Errorf("Unexpected segment %+v", segments[0])
+	}
+
+	if segments[0].Attributes["speedLimit"] != "70" {
+		t.Errorf("Expected the speed limit that covers most of the segment to be joined, but got %q", segments[0].Attributes["speedLimit"])
+	}
+
+	if _, ok := segments[1].Attributes["speedLimit"]; ok {
+		t.Error("Did not expect a speed limit on a link without one")
+	}
+
+	expectNear(t, segments[1].Coordinates[1], geometry.FromSWEREF99TM(6919750, 619520))
+}
+
+func TestReadGeoPackageInSWEREF99TM(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "network.gpkg")
+	db := openTestDatabase(t, path)
+
+	db.Exec("CREATE TABLE gpkg_geometry_columns (table_name TEXT, column_name TEXT, geometry_type_name TEXT, srs_id INTEGER, z INTEGER, m INTEGER)")
+	db.Exec("INSERT INTO gpkg_geometry_columns VALUES ('roads', 'geom', 'LINESTRING', 3006, 0, 0)")
+	db.Exec("CREATE TABLE roads (fid INTEGER PRIMARY KEY, geom BLOB)")
+	db.Exec("INSERT INTO roads VALUES (?, ?)", 1, geoPackageLine([][2]float64{{619472, 6919664}, {619500, 6919700}}))
+	closeTestDatabase(db)
+
+	f, _ := os.Open(path)
+	defer f.Close()
+
+	segments, err := Read(f)
+	if err != nil {
+		t.Fatalf("Failed to read the GeoPackage: %s", err.Error())
+	}
+
+	if len(segments) != 1 {
+		t.Fatalf("Expected one segment, but got %d", len(segments))
+	}
+
+	expectNear(t, segments[0].Coordinates[0], geometry.FromSWEREF99TM(6919664, 619472))
+}
+
+func addToZip(t *testing.T, zw *zip.Writer, name string, contents []byte) {
+	w, err := zw.Create(name)
+	if err != nil {
+		t.Fatalf("Failed to add %s to zip: %s", name, err.Error())
+	}
+	w.Write(contents)
+}
+
+//shpPolyLines encodes single part PolyLine records as a .shp file
+func shpPolyLines(lines [][][2]float64) []byte {
+	records := &bytes.Buffer{}
+
+	for idx, line := range lines {
+		content := &bytes.Buffer{}
+		binary.Write(content, binary.LittleEndian, int32(shapePolyLine))
+		for i := 0; i < 4; i++ {
+			binary.Write(content, binary.LittleEndian, float64(0))
+		}
+		binary.Write(content, binary.LittleEndian, int32(1))
+		binary.Write(content, binary.LittleEndian, int32(len(line)))
+		binary.Write(content, binary.LittleEndian, int32(0))
+		for _, pos := range line {
+			binary.Write(content, binary.LittleEndian, math.Float64bits(pos[0]))
+			binary.Write(content, binary.LittleEndian, math.Float64bits(pos[1]))
+		}
+
+		binary.Write(records, binary.BigEndian, int32(idx+1))
+		binary.Write(records, binary.BigEndian, int32(content.Len()/2))
+		records.Write(content.Bytes())
+	}
+
+	header := make([]byte, 100)
+	copy(header, shapefileMagic)
+	binary.BigEndian.PutUint32(header[24:], uint32((100+records.Len())/2))
+	binary.LittleEndian.PutUint32(header[28:], 1000)
+	binary.LittleEndian.PutUint32(header[32:], uint32(shapePolyLine))
+
+	return append(header, records.Bytes()...)
+}
+
+//dbfRecords encodes records as a .dbf file with 16 character wide text fields
+func dbfRecords(records []map[string]string) []byte {
+	names := []string{}
+	for name := range records[0] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const width = 16
+	headerLength := 32 + 32*len(names) + 1
+	recordLength := 1 + width*len(names)
+
+	buf := &bytes.Buffer{}
+	header := make([]byte, 32)
+	header[0] = 0x03
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(records)))
+	binary.LittleEndian.PutUint16(header[8:], uint16(headerLength))
+	binary.LittleEndian.PutUint16(header[10:], uint16(recordLength))
+	buf.Write(header)
+
+	for _, name := range names {
+		descriptor := make([]byte, 32)
+		copy(descriptor, name)
+		descriptor[11] = 'C'
+		descriptor[16] = width
+		buf.Write(descriptor)
+	}
+	buf.WriteByte(0x0d)
+
+	for _, record := range records {
+		buf.WriteByte(' ')
+		for _, name := range names {
+			buf.WriteString(record[name] + strings.Repeat(" ", width-len(record[name])))
+		}
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,290 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+)
+
+//DefaultOSMTagFilter imports every way that has a highway tag
+const DefaultOSMTagFilter string = "highway"
+
+//osmAttributeTags are the tags that are kept as attributes of the imported segments
+var osmAttributeTags = []string{
+	"highway", "surface", "name", "width", "incline", "wheelchair", "lit",
+	"smoothness", "tactile_paving", "sidewalk", "footway", "cycleway", "maxspeed", "ref",
+}
+
+//osmWay is a way that has passed the tag filter
+type osmWay struct {
+	id   int64
+	refs []int64
+	tags map[string]string
+}
+
+//osmData holds the nodes and the matching ways of an OSM extract
+type osmData struct {
+	filter *TagFilter
+	nodes  map[int64]geometry.Point
+	ways   []osmWay
+}
+
+func newOSMData(filter *TagFilter) *osmData {
+	return &osmData{filter: filter, nodes: map[int64]geometry.Point{}}
+}
+
+func (d *osmData) addNode(id int64, lat, lon float64) {
+	d.nodes[id] = geometry.NewPoint(lat, lon)
+}
+
+func (d *osmData) addWay(id int64, refs []int64, tags map[string]string) {
+	if d.filter.Matches(tags) {
+		d.ways = append(d.ways, osmWay{id: id, refs: refs, tags: tags})
+	}
+}
+
+//readOSM reads an OpenStreetMap extract in XML or PBF format. Every way that matches the
+//tag filter becomes a road, which is split into segments at the nodes it shares with other
+//matching ways, so that every intersection starts a new segment.
+func readOSM(r io.Reader, opts *Options) ([]Segment, error) {
+	filter, err := NewTagFilter(opts.TagFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	br, ok := r.(interface {
+		io.Reader
+		Peek(int) ([]byte, error)
+	})
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	data := newOSMData(filter)
+
+	head, _ := br.Peek(64)
+	if isOSMPBF(head) {
+		err = readOSMPBF(br, data)
+	} else {
+		err = readOSMXML(br, data)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data.segments(), nil
+}
+
+func readOSMXML(r io.Reader, data *osmData) error {
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = charsetReader
+
+	var way *osmWay
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to parse OSM XML: %s", err.Error())
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			attrs := map[string]string{}
+			for _, attr := range t.Attr {
+				attrs[attr.Name.Local] = attr.Value
+			}
+
+			switch t.Name.Local {
+			case "node":
+				id, idErr := strconv.ParseInt(attrs["id"], 10, 64)
+				lat, latErr := strconv.ParseFloat(attrs["lat"], 64)
+				lon, lonErr := strconv.ParseFloat(attrs["lon"], 64)
+				if idErr == nil && latErr == nil && lonErr == nil {
+					data.addNode(id, lat, lon)
+				}
+			case "way":
+				id, err := strconv.ParseInt(attrs["id"], 10, 64)
+				if err == nil {
+					way = &osmWay{id: id, tags: map[string]string{}}
+				}
+			case "nd":
+				if ref, err := strconv.ParseInt(attrs["ref"], 10, 64); err == nil && way != nil {
+					way.refs = append(way.refs, ref)
+				}
+			case "tag":
+				if way != nil {
+					way.tags[attrs["k"]] = attrs["v"]
+				}
+			}
+
+		case xml.EndElement:
+			if t.Name.Local == "way" && way != nil {
+				data.addWay(way.id, way.refs, way.tags)
+				way = nil
+			}
+		}
+	}
+
+	return nil
+}
+
+//segments splits the matching ways at the nodes they share with each other
+func (d *osmData) segments() []Segment {
+	usage := map[int64]int{}
+	for _, way := range d.ways {
+		for _, ref := range way.refs {
+			usage[ref]++
+		}
+	}
+
+	segments := []Segment{}
+
+	for _, way := range d.ways {
+		roadID := strconv.FormatInt(way.id, 10)
+
+		template := Segment{
+			RoadID:     roadID,
+			Name:       way.tags["name"],
+			RoadClass:  way.tags["highway"],
+			Attributes: map[string]string{},
+		}
+
+		for _, tag := range osmAttributeTags {
+			if value, ok := way.tags[tag]; ok {
+				template.Attributes[tag] = value
+			}
+		}
+
+		parts := [][]geometry.Point{}
+		part := []geometry.Point{}
+
+		for idx, ref := range way.refs {
+			pt, ok := d.nodes[ref]
+			if !ok {
+				// The way continues outside of the extract
+				if len(part) > 1 {
+					parts = append(parts, part)
+				}
+				part = []geometry.Point{}
+				continue
+			}
+
+			part = append(part, pt)
+
+			if usage[ref] > 1 && idx > 0 && idx < len(way.refs)-1 && len(part) > 1 {
+				parts = append(parts, part)
+				part = []geometry.Point{pt}
+			}
+		}
+
+		if len(part) > 1 {
+			parts = append(parts, part)
+		}
+
+		if len(parts) == 0 {
+			continue
+		}
+
+		template.ID = roadID
+		segments = append(segments, splitParts(template, parts)...)
+	}
+
+	return segments
+}
+
+//TagFilter decides which OSM ways are imported, based on their tags
+type TagFilter struct {
+	conditions []tagCondition
+}
+
+type tagCondition struct {
+	key    string
+	values []string
+	negate bool
+}
+
+//NewTagFilter parses a tag filter, which is a list of conditions separated by semicolons
+//that all have to be met. A condition is either a key that must be present, a key that
+//must be absent when prefixed with !, key=a,b to require one of the listed values or
+//key!=a,b to exclude them. An empty filter is the same as DefaultOSMTagFilter.
+//
+//	highway=footway,cycleway,path;access!=private
+func NewTagFilter(filter string) (*TagFilter, error) {
+	if strings.TrimSpace(filter) == "" {
+		filter = DefaultOSMTagFilter
+	}
+
+	tf := &TagFilter{}
+
+	for _, condition := range strings.Split(filter, ";") {
+		condition = strings.TrimSpace(condition)
+		if condition == "" {
+			continue
+		}
+
+		c := tagCondition{}
+
+		if idx := strings.Index(condition, "!="); idx >= 0 {
+			c.key, c.negate = condition[:idx], true
+			c.values = splitTagValues(condition[idx+2:])
+		} else if idx := strings.Index(condition, "="); idx >= 0 {
+			c.key = condition[:idx]
+			c.values = splitTagValues(condition[idx+1:])
+		} else if strings.HasPrefix(condition, "!") {
+			c.key, c.negate = condition[1:], true
+		} else {
+			c.key = condition
+		}
+
+		c.key = strings.TrimSpace(c.key)
+		if c.key == "" {
+			return nil, fmt.Errorf("invalid condition %q in tag filter", condition)
+		}
+
+		tf.conditions = append(tf.conditions, c)
+	}
+
+	return tf, nil
+}
+
+func splitTagValues(values string) []string {
+	result := []string{}
+	for _, v := range strings.Split(values, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+//Matches returns true if the tags meet every condition of the filter
+func (tf *TagFilter) Matches(tags map[string]string) bool {
+	for _, c := range tf.conditions {
+		value, present := tags[c.key]
+
+		matches := present
+		if present && len(c.values) > 0 {
+			matches = false
+			for _, v := range c.values {
+				if v == value {
+					matches = true
+					break
+				}
+			}
+		}
+
+		if matches == c.negate {
+			return false
+		}
+	}
+
+	return true
+}
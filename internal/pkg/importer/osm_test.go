@@ -0,0 +1,228 @@
+package importer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+)
+
+const osmXML string = `<?xml version="1.0" encoding="UTF-8"?>
+<osm version="0.6" generator="test">
+	<node id="1" lat="62.3900" lon="17.3000"/>
+	<node id="2" lat="62.3905" lon="17.3005"/>
+	<node id="3" lat="62.3910" lon="17.3010"/>
+	<node id="4" lat="62.3905" lon="17.2995"/>
+	<node id="5" lat="62.3905" lon="17.3015"/>
+	<node id="6" lat="62.3920" lon="17.3020"/>
+	<way id="100">
+		<nd ref="1"/><nd ref="2"/><nd ref="3"/>
+		<tag k="highway" v="footway"/>
+		<tag k="surface" v="asphalt"/>
+		<tag k="wheelchair" v="yes"/>
+		<tag k="lit" v="yes"/>
+		<tag k="name" v="Strandpromenaden"/>
+		<tag k="note" v="not kept"/>
+	</way>
+	<way id="200">
+		<nd ref="4"/><nd ref="2"/><nd ref="5"/>
+		<tag k="highway" v="cycleway"/>
+		<tag k="access" v="private"/>
+	</way>
+	<way id="300">
+		<nd ref="3"/><nd ref="6"/>
+		<tag k="building" v="yes"/>
+	</way>
+</osm>`
+
+func TestReadOSMXMLSplitsWaysAtIntersections(t *testing.T) {
+	segments, err := Read(strings.NewReader(osmXML))
+	if err != nil {
+		t.Fatalf("Failed to read OSM XML: %s", err.Error())
+	}
+
+	ids := []string{}
+	for _, s := range segments {
+		ids = append(ids, s.ID)
+	}
+
+	if strings.Join(ids, " ") != "100:1 100:2 200:1 200:2" {
+		t.Fatalf("Expected both highways to be split at their shared node, but got %v", ids)
+	}
+
+	footway := segments[0]
+	if footway.RoadID != "100" || footway.Name != "Strandpromenaden" || footway.RoadClass != "footway" {
+		t.Errorf("Unexpected segment %+v", footway)
+	}
+
+	expected := map[string]string{"highway": "footway", "surface": "asphalt", "wheelchair": "yes", "lit": "yes", "name": "Strandpromenaden"}
+	for key, value := range expected {
+		if footway.Attributes[key] != value {
+			t.Errorf("Expected the tag %s to be kept as %s, but got %q", key, value, footway.Attributes[key])
+		}
+	}
+
+	if _, ok := footway.Attributes["note"]; ok {
+		t.Error("Did not expect the note tag to be kept")
+	}
+
+	if len(footway.Coordinates) != 2 || footway.Coordinates[1].Lat != 62.3905 || footway.Coordinates[1].Lon != 17.3005 {
+		t.Errorf("Expected the first part to end at the intersection, but got %+v", footway.Coordinates)
+	}
+}
+
+func TestReadOSMWithTagFilter(t *testing.T) {
+	segments, err := Read(strings.NewReader(osmXML), WithTagFilter("highway=footway,cycleway;access!=private"))
+	if err != nil {
+		t.Fatalf("Failed to read OSM XML: %s", err.Error())
+	}
+
+	// Without the private cycleway, the footway has no intersections left
+	if len(segments) != 1 || segments[0].ID != "100" || len(segments[0].Coordinates) != 3 {
+		t.Errorf("Unexpected segments %+v", segments)
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	tags := map[string]string{"highway": "path", "surface": "gravel"}
+
+	filters := map[string]bool{
+		"":                             true,
+		"highway":                      true,
+		"!highway":                     false,
+		"highway=footway,path":         true,
+		"highway=footway;surface":      false,
+		"highway;surface!=asphalt":     true,
+		"highway;surface!=gravel,dirt": false,
+		"highway;!access":              true,
+	}
+
+	for filter, expected := range filters {
+		tf, err := NewTagFilter(filter)
+		if err != nil {
+			t.Fatalf("Failed to parse the tag filter %q: %s", filter, err.Error())
+		}
+
+		if tf.Matches(tags) != expected {
+			t.Errorf("Expected the tag filter %q to return %v", filter, expected)
+		}
+	}
+}
+
+func TestReadOSMPBF(t *testing.T) {
+	pbf := &bytes.Buffer{}
+
+	header := &pbfWriter{}
+	header.bytes(4, []byte("OsmSchema-V0.6"))
+	header.bytes(4, []byte("DenseNodes"))
+	writePBFBlob(pbf, "OSMHeader", header.buf.Bytes())
+
+	strtable := &pbfWriter{}
+	for _, s := range []string{"", "highway", "footway", "surface", "gravel"} {
+		strtable.bytes(1, []byte(s))
+	}
+
+	toGranularity := func(degrees float64) int64 { return int64(math.Round(degrees * 1e7)) }
+
+	dense := &pbfWriter{}
+	dense.packedSigned(1, []int64{1, 1, 1})
+	dense.packedSigned(8, []int64{toGranularity(62.39), toGranularity(0.0005), toGranularity(0.0005)})
+	dense.packedSigned(9, []int64{toGranularity(17.30), toGranularity(0.0005), toGranularity(0.0005)})
+
+	way := &pbfWriter{}
+	way.varint(1, 100)
+	way.packed(2, []uint64{1, 3})
+	way.packed(3, []uint64{2, 4})
+	way.packedSigned(8, []int64{1, 1, 1})
+
+	group := &pbfWriter{}
+	group.bytes(2, dense.buf.Bytes())
+	group.bytes(3, way.buf.Bytes())
+
+	block := &pbfWriter{}
+	block.bytes(1, strtable.buf.Bytes())
+	block.bytes(2, group.buf.Bytes())
+	writePBFBlob(pbf, "OSMData", block.buf.Bytes())
+
+	segments, err := Read(bytes.NewReader(pbf.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to read OSM PBF: %s", err.Error())
+	}
+
+	if len(segments) != 1 {
+		t.Fatalf("Expected one segment, but got %d", len(segments))
+	}
+
+	segment := segments[0]
+	if segment.ID != "100" || segment.Attributes["surface"] != "gravel" || len(segment.Coordinates) != 3 {
+		t.Errorf("Unexpected segment %+v", segment)
+	}
+
+	last := segment.Coordinates[2]
+	if math.Abs(last.Lat-62.391) > 1e-9 || math.Abs(last.Lon-17.301) > 1e-9 {
+		t.Errorf("Unexpected delta decoded coordinate %+v", last)
+	}
+}
+
+type pbfWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *pbfWriter) key(field, wireType int) {
+	w.rawVarint(uint64(field<<3 | wireType))
+}
+
+func (w *pbfWriter) rawVarint(v uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	w.buf.Write(b[:binary.PutUvarint(b, v)])
+}
+
+func (w *pbfWriter) varint(field int, v uint64) {
+	w.key(field, 0)
+	w.rawVarint(v)
+}
+
+func (w *pbfWriter) bytes(field int, b []byte) {
+	w.key(field, 2)
+	w.rawVarint(uint64(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *pbfWriter) packed(field int, values []uint64) {
+	p := &pbfWriter{}
+	for _, v := range values {
+		p.rawVarint(v)
+	}
+	w.bytes(field, p.buf.Bytes())
+}
+
+func (w *pbfWriter) packedSigned(field int, values []int64) {
+	encoded := []uint64{}
+	for _, v := range values {
+		encoded = append(encoded, uint64((v<<1)^(v>>63)))
+	}
+	w.packed(field, encoded)
+}
+
+func writePBFBlob(out *bytes.Buffer, blobType string, contents []byte) {
+	compressed := &bytes.Buffer{}
+	zw := zlib.NewWriter(compressed)
+	zw.Write(contents)
+	zw.Close()
+
+	blob := &pbfWriter{}
+	blob.varint(2, uint64(len(contents)))
+	blob.bytes(3, compressed.Bytes())
+
+	header := &pbfWriter{}
+	header.bytes(1, []byte(blobType))
+	header.varint(3, uint64(blob.buf.Len()))
+
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(header.buf.Len()))
+	out.Write(size)
+	out.Write(header.buf.Bytes())
+	out.Write(blob.buf.Bytes())
+}
@@ -0,0 +1,386 @@
+package importer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+//isOSMPBF recognizes the first BlobHeader of a PBF file, which is an OSMHeader
+func isOSMPBF(head []byte) bool {
+	return len(head) > 4 && bytes.Contains(head[4:], []byte("OSMHeader"))
+}
+
+//readOSMPBF reads the nodes and ways of an OSM PBF file, which is a sequence of blobs that
+//each contain a protocol buffers encoded block. Only the parts of the format that are
+//needed to build a road network are decoded.
+func readOSMPBF(r io.Reader, data *osmData) error {
+	sizeBuffer := make([]byte, 4)
+
+	for {
+		_, err := io.ReadFull(r, sizeBuffer)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read PBF blob header size: %s", err.Error())
+		}
+
+		header := make([]byte, binary.BigEndian.Uint32(sizeBuffer))
+		if _, err = io.ReadFull(r, header); err != nil {
+			return fmt.Errorf("failed to read PBF blob header: %s", err.Error())
+		}
+
+		blobType, blobSize, err := decodeBlobHeader(header)
+		if err != nil {
+			return err
+		}
+
+		blob := make([]byte, blobSize)
+		if _, err = io.ReadFull(r, blob); err != nil {
+			return fmt.Errorf("failed to read PBF blob: %s", err.Error())
+		}
+
+		contents, err := decodeBlob(blob)
+		if err != nil {
+			return err
+		}
+
+		switch blobType {
+		case "OSMHeader":
+			err = checkRequiredFeatures(contents)
+		case "OSMData":
+			err = decodePrimitiveBlock(contents, data)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func decodeBlobHeader(header []byte) (string, int, error) {
+	blobType, blobSize := "", 0
+
+	msg := pbfMessage{data: header}
+	for msg.next() {
+		switch msg.field {
+		case 1:
+			blobType = string(msg.bytes)
+		case 3:
+			blobSize = int(msg.value)
+		}
+	}
+
+	if msg.err != nil {
+		return "", 0, msg.err
+	}
+
+	return blobType, blobSize, nil
+}
+
+func decodeBlob(blob []byte) ([]byte, error) {
+	msg := pbfMessage{data: blob}
+	for msg.next() {
+		switch msg.field {
+		case 1:
+			return msg.bytes, nil
+		case 3:
+			zr, err := zlib.NewReader(bytes.NewReader(msg.bytes))
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			return ioutil.ReadAll(zr)
+		case 4, 6, 7:
+			return nil, errors.New("PBF blobs compressed with lzma, lz4 or zstd are not supported")
+		}
+	}
+
+	if msg.err != nil {
+		return nil, msg.err
+	}
+
+	return nil, errors.New("empty PBF blob")
+}
+
+func checkRequiredFeatures(headerBlock []byte) error {
+	msg := pbfMessage{data: headerBlock}
+	for msg.next() {
+		if msg.field == 4 {
+			feature := string(msg.bytes)
+			if feature != "OsmSchema-V0.6" && feature != "DenseNodes" {
+				return fmt.Errorf("the PBF file requires the unsupported feature %s", feature)
+			}
+		}
+	}
+
+	return msg.err
+}
+
+//primitiveBlock holds what is needed to decode the groups of a PrimitiveBlock
+type primitiveBlock struct {
+	strings     []string
+	granularity int64
+	latOffset   int64
+	lonOffset   int64
+}
+
+func (b *primitiveBlock) coordinate(offset, value int64) float64 {
+	return 1e-9 * float64(offset+b.granularity*value)
+}
+
+func (b *primitiveBlock) string(idx uint64) string {
+	if idx < uint64(len(b.strings)) {
+		return b.strings[idx]
+	}
+	return ""
+}
+
+func decodePrimitiveBlock(contents []byte, data *osmData) error {
+	block := &primitiveBlock{granularity: 100}
+	groups := [][]byte{}
+
+	msg := pbfMessage{data: contents}
+	for msg.next() {
+		switch msg.field {
+		case 1:
+			table := pbfMessage{data: msg.bytes}
+			for table.next() {
+				if table.field == 1 {
+					block.strings = append(block.strings, string(table.bytes))
+				}
+			}
+		case 2:
+			groups = append(groups, msg.bytes)
+		case 17:
+			block.granularity = int64(msg.value)
+		case 19:
+			block.latOffset = int64(msg.value)
+		case 20:
+			block.lonOffset = int64(msg.value)
+		}
+	}
+
+	if msg.err != nil {
+		return msg.err
+	}
+
+	for _, group := range groups {
+		msg := pbfMessage{data: group}
+		for msg.next() {
+			var err error
+
+			switch msg.field {
+			case 1:
+				err = block.decodeNode(msg.bytes, data)
+			case 2:
+				err = block.decodeDenseNodes(msg.bytes, data)
+			case 3:
+				err = block.decodeWay(msg.bytes, data)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if msg.err != nil {
+			return msg.err
+		}
+	}
+
+	return nil
+}
+
+func (b *primitiveBlock) decodeNode(node []byte, data *osmData) error {
+	var id, lat, lon int64
+
+	msg := pbfMessage{data: node}
+	for msg.next() {
+		switch msg.field {
+		case 1:
+			id = zigzag(msg.value)
+		case 8:
+			lat = zigzag(msg.value)
+		case 9:
+			lon = zigzag(msg.value)
+		}
+	}
+
+	if msg.err != nil {
+		return msg.err
+	}
+
+	data.addNode(id, b.coordinate(b.latOffset, lat), b.coordinate(b.lonOffset, lon))
+	return nil
+}
+
+func (b *primitiveBlock) decodeDenseNodes(dense []byte, data *osmData) error {
+	var ids, lats, lons []uint64
+
+	msg := pbfMessage{data: dense}
+	for msg.next() {
+		switch msg.field {
+		case 1:
+			ids = msg.packed(ids)
+		case 8:
+			lats = msg.packed(lats)
+		case 9:
+			lons = msg.packed(lons)
+		}
+	}
+
+	if msg.err != nil {
+		return msg.err
+	}
+
+	if len(lats) != len(ids) || len(lons) != len(ids) {
+		return errors.New("invalid PBF dense nodes")
+	}
+
+	// The ids and coordinates of dense nodes are delta encoded
+	var id, lat, lon int64
+	for i := range ids {
+		id += zigzag(ids[i])
+		lat += zigzag(lats[i])
+		lon += zigzag(lons[i])
+		data.addNode(id, b.coordinate(b.latOffset, lat), b.coordinate(b.lonOffset, lon))
+	}
+
+	return nil
+}
+
+func (b *primitiveBlock) decodeWay(way []byte, data *osmData) error {
+	var id int64
+	var keys, values, refs []uint64
+
+	msg := pbfMessage{data: way}
+	for msg.next() {
+		switch msg.field {
+		case 1:
+			id = int64(msg.value)
+		case 2:
+			keys = msg.packed(keys)
+		case 3:
+			values = msg.packed(values)
+		case 8:
+			refs = msg.packed(refs)
+		}
+	}
+
+	if msg.err != nil {
+		return msg.err
+	}
+
+	if len(keys) != len(values) {
+		return errors.New("invalid PBF way tags")
+	}
+
+	tags := make(map[string]string, len(keys))
+	for i := range keys {
+		tags[b.string(keys[i])] = b.string(values[i])
+	}
+
+	nodeRefs := make([]int64, len(refs))
+	var ref int64
+	for i := range refs {
+		ref += zigzag(refs[i])
+		nodeRefs[i] = ref
+	}
+
+	data.addWay(id, nodeRefs, tags)
+	return nil
+}
+
+func zigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+//pbfMessage iterates over the fields of a protocol buffers message
+type pbfMessage struct {
+	data []byte
+	pos  int
+	err  error
+
+	field    int
+	wireType int
+	value    uint64
+	bytes    []byte
+}
+
+func (m *pbfMessage) varint() uint64 {
+	v, n := binary.Uvarint(m.data[m.pos:])
+	if n <= 0 {
+		m.err = errors.New("invalid varint in PBF message")
+		return 0
+	}
+	m.pos += n
+	return v
+}
+
+//next moves to the next field of the message and returns false at the end of it or if
+//the message is invalid
+func (m *pbfMessage) next() bool {
+	if m.err != nil || m.pos >= len(m.data) {
+		return false
+	}
+
+	key := m.varint()
+	m.field, m.wireType = int(key>>3), int(key&7)
+	m.bytes = nil
+
+	switch m.wireType {
+	case 0:
+		m.value = m.varint()
+	case 1:
+		if m.pos+8 > len(m.data) {
+			m.err = errors.New("truncated PBF message")
+			return false
+		}
+		m.value = binary.LittleEndian.Uint64(m.data[m.pos:])
+		m.pos += 8
+	case 2:
+		length := m.varint()
+		if m.err != nil || length > uint64(len(m.data)-m.pos) {
+			m.err = errors.New("truncated PBF message")
+			return false
+		}
+		m.bytes = m.data[m.pos : m.pos+int(length)]
+		m.pos += int(length)
+	case 5:
+		if m.pos+4 > len(m.data) {
+			m.err = errors.New("truncated PBF message")
+			return false
+		}
+		m.value = uint64(binary.LittleEndian.Uint32(m.data[m.pos:]))
+		m.pos += 4
+	default:
+		m.err = fmt.Errorf("unsupported wire type %d in PBF message", m.wireType)
+		return false
+	}
+
+	return m.err == nil
+}
+
+//packed appends the values of a repeated varint field, that may be packed or not
+func (m *pbfMessage) packed(values []uint64) []uint64 {
+	if m.wireType == 0 {
+		return append(values, m.value)
+	}
+
+	for pos := 0; pos < len(m.bytes); {
+		v, n := binary.Uvarint(m.bytes[pos:])
+		if n <= 0 {
+			m.err = errors.New("invalid packed field in PBF message")
+			return values
+		}
+		values = append(values, v)
+		pos += n
+	}
+
+	return values
+}
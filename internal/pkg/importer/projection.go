@@ -0,0 +1,41 @@
+package importer
+
+import (
+	"fmt"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+)
+
+//transformation converts a position, with x in Lon and y in Lat, into WGS84
+type transformation func(pt geometry.Point) geometry.Point
+
+func fromWGS84(pt geometry.Point) geometry.Point {
+	return pt
+}
+
+func fromSWEREF99TM(pt geometry.Point) geometry.Point {
+	return geometry.FromSWEREF99TM(pt.Lat, pt.Lon)
+}
+
+//newTransformation returns the transformation into WGS84 for a spatial reference system.
+//The undefined reference systems 0 and -1 are assumed to contain WGS84 coordinates.
+func newTransformation(srid int64) (transformation, error) {
+	switch srid {
+	case 4326, 0, -1:
+		return fromWGS84, nil
+	case geometry.SWEREF99TM:
+		return fromSWEREF99TM, nil
+	}
+
+	return nil, fmt.Errorf("the spatial reference system %d is not supported", srid)
+}
+
+func transformParts(parts [][]geometry.Point, transform transformation) [][]geometry.Point {
+	for _, part := range parts {
+		for idx := range part {
+			part[idx] = transform(part[idx])
+		}
+	}
+
+	return parts
+}
@@ -0,0 +1,369 @@
+package importer
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+)
+
+var (
+	shapefileMagic = []byte{0x00, 0x00, 0x27, 0x0a}
+	zipMagic       = []byte("PK\x03\x04")
+)
+
+//shapefile holds the contents of the files that make up one layer of a Shape delivery
+type shapefile struct {
+	name string
+	shp  []byte
+	dbf  []byte
+	prj  []byte
+	cpg  []byte
+}
+
+//readShapefiles reads the layers of a Shape delivery, either from a zip archive with one
+//or more layers, or from a single .shp file whose .dbf, .prj and .cpg siblings are read
+//from the same directory
+func readShapefiles(r io.Reader) ([]feature, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	layers := []shapefile{}
+
+	if bytes.HasPrefix(contents, zipMagic) {
+		layers, err = shapefilesFromZip(contents)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		f, ok := r.(namedReader)
+		if !ok {
+			return nil, errors.New("a .shp file can only be read from disk, since its attributes are stored in a separate .dbf file")
+		}
+
+		base := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		layer := shapefile{name: filepath.Base(base), shp: contents}
+		layer.dbf, _ = ioutil.ReadFile(base + ".dbf")
+		layer.prj, _ = ioutil.ReadFile(base + ".prj")
+		layer.cpg, _ = ioutil.ReadFile(base + ".cpg")
+		layers = append(layers, layer)
+	}
+
+	features := []feature{}
+
+	for _, layer := range layers {
+		layerFeatures, err := layer.features()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the layer %s: %s", layer.name, err.Error())
+		}
+		features = append(features, layerFeatures...)
+	}
+
+	return features, nil
+}
+
+func shapefilesFromZip(contents []byte) ([]shapefile, error) {
+	archive, err := zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{}
+	names := []string{}
+
+	for _, file := range archive.File {
+		ext := strings.ToLower(path.Ext(file.Name))
+		if ext != ".shp" && ext != ".dbf" && ext != ".prj" && ext != ".cpg" {
+			continue
+		}
+
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		base := strings.TrimSuffix(file.Name, path.Ext(file.Name))
+		files[base+ext] = data
+		if ext == ".shp" {
+			names = append(names, base)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, errors.New("the zip archive does not contain any .shp files")
+	}
+
+	sort.Strings(names)
+
+	layers := []shapefile{}
+	for _, base := range names {
+		layers = append(layers, shapefile{
+			name: path.Base(base),
+			shp:  files[base+".shp"],
+			dbf:  files[base+".dbf"],
+			prj:  files[base+".prj"],
+			cpg:  files[base+".cpg"],
+		})
+	}
+
+	return layers, nil
+}
+
+//features reads the polylines of a layer together with their attributes. Positions are
+//converted to WGS84 from the reference system described by the .prj file, which is
+//assumed to be SWEREF 99 TM if it is missing and the positions are out of range for
+//degrees.
+func (s shapefile) features() ([]feature, error) {
+	if len(s.shp) < 100 || !bytes.HasPrefix(s.shp, shapefileMagic) {
+		return nil, errors.New("invalid .shp file")
+	}
+
+	records, err := readDBF(s.dbf, isUTF8(s.cpg))
+	if err != nil {
+		return nil, err
+	}
+
+	features := []feature{}
+	transform := transformation(nil)
+
+	pos := 100
+	for idx := 0; pos+8 <= len(s.shp); idx++ {
+		length := int(binary.BigEndian.Uint32(s.shp[pos+4:])) * 2
+		pos += 8
+
+		if pos+length > len(s.shp) {
+			return nil, errors.New("truncated .shp file")
+		}
+
+		parts, err := readPolyLine(s.shp[pos : pos+length])
+		pos += length
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(parts) == 0 || len(parts[0]) == 0 {
+			continue
+		}
+
+		if transform == nil {
+			transform, err = s.transformation(parts[0][0])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		f := feature{layer: s.name, id: strconv.Itoa(idx + 1), properties: map[string]string{}}
+		if idx < len(records) {
+			f.properties = records[idx]
+		}
+		f.parts = transformParts(parts, transform)
+
+		features = append(features, f)
+	}
+
+	return features, nil
+}
+
+func (s shapefile) transformation(first geometry.Point) (transformation, error) {
+	prj := strings.ToUpper(string(s.prj))
+
+	switch {
+	case strings.Contains(prj, "SWEREF") && strings.Contains(prj, "TM"):
+		return newTransformation(geometry.SWEREF99TM)
+	case strings.HasPrefix(prj, "GEOGCS") && strings.Contains(prj, "WGS"):
+		return newTransformation(4326)
+	case prj != "":
+		return nil, fmt.Errorf("unsupported projection %s", string(s.prj))
+	case math.Abs(first.Lon) > 180 || math.Abs(first.Lat) > 90:
+		return newTransformation(geometry.SWEREF99TM)
+	}
+
+	return newTransformation(4326)
+}
+
+const (
+	shapeNull      int32 = 0
+	shapePolyLine  int32 = 3
+	shapePolyLineZ int32 = 13
+	shapePolyLineM int32 = 23
+)
+
+//readPolyLine reads the parts of a PolyLine record, with x in Lon and y in Lat. Any z
+//and m values follow the x and y values of a record and are ignored.
+func readPolyLine(record []byte) ([][]geometry.Point, error) {
+	if len(record) < 4 {
+		return nil, errors.New("invalid .shp record")
+	}
+
+	shapeType := int32(binary.LittleEndian.Uint32(record))
+
+	switch shapeType {
+	case shapeNull:
+		return nil, nil
+	case shapePolyLine, shapePolyLineZ, shapePolyLineM:
+	default:
+		return nil, fmt.Errorf("unsupported shape type %d", shapeType)
+	}
+
+	if len(record) < 44 {
+		return nil, errors.New("invalid .shp record")
+	}
+
+	numParts := int(binary.LittleEndian.Uint32(record[36:]))
+	numPoints := int(binary.LittleEndian.Uint32(record[40:]))
+	pointsStart := 44 + 4*numParts
+
+	if numParts < 0 || numPoints < 0 || pointsStart+16*numPoints > len(record) {
+		return nil, errors.New("invalid .shp record")
+	}
+
+	parts := [][]geometry.Point{}
+
+	for p := 0; p < numParts; p++ {
+		start := int(binary.LittleEndian.Uint32(record[44+4*p:]))
+		end := numPoints
+		if p+1 < numParts {
+			end = int(binary.LittleEndian.Uint32(record[44+4*(p+1):]))
+		}
+
+		if start < 0 || end > numPoints || start > end {
+			return nil, errors.New("invalid part in .shp record")
+		}
+
+		part := make([]geometry.Point, 0, end-start)
+		for i := start; i < end; i++ {
+			offset := pointsStart + 16*i
+			x := math.Float64frombits(binary.LittleEndian.Uint64(record[offset:]))
+			y := math.Float64frombits(binary.LittleEndian.Uint64(record[offset+8:]))
+			part = append(part, geometry.NewPoint(y, x))
+		}
+
+		parts = append(parts, part)
+	}
+
+	return parts, nil
+}
+
+//readDBF reads the records of a dBASE file. The values are decoded as UTF-8 if the .cpg
+//file says so or if they are valid UTF-8, and as Latin-1 otherwise.
+func readDBF(dbf []byte, utf8Encoded bool) ([]map[string]string, error) {
+	if len(dbf) == 0 {
+		return []map[string]string{}, nil
+	}
+
+	if len(dbf) < 32 {
+		return nil, errors.New("invalid .dbf file")
+	}
+
+	numRecords := int(binary.LittleEndian.Uint32(dbf[4:]))
+	headerLength := int(binary.LittleEndian.Uint16(dbf[8:]))
+	recordLength := int(binary.LittleEndian.Uint16(dbf[10:]))
+
+	type field struct {
+		name   string
+		length int
+	}
+
+	fields := []field{}
+	for pos := 32; pos+32 <= headerLength && pos < len(dbf) && dbf[pos] != 0x0d; pos += 32 {
+		name := dbf[pos : pos+11]
+		if end := bytes.IndexByte(name, 0); end >= 0 {
+			name = name[:end]
+		}
+		fields = append(fields, field{name: decodeText(name, utf8Encoded), length: int(dbf[pos+16])})
+	}
+
+	fieldsLength := 1
+	for _, f := range fields {
+		fieldsLength += f.length
+	}
+
+	if fieldsLength > recordLength {
+		return nil, errors.New("invalid .dbf field descriptors")
+	}
+
+	records := make([]map[string]string, 0, numRecords)
+
+	for r := 0; r < numRecords; r++ {
+		pos := headerLength + r*recordLength
+		if pos+recordLength > len(dbf) {
+			return nil, errors.New("truncated .dbf file")
+		}
+
+		record := map[string]string{}
+		offset := pos + 1 // Skip the deletion flag
+
+		for _, f := range fields {
+			value := strings.TrimSpace(decodeText(dbf[offset:offset+f.length], utf8Encoded))
+			if value != "" {
+				record[f.name] = value
+			}
+			offset += f.length
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func isUTF8(cpg []byte) bool {
+	encoding := strings.ToUpper(strings.TrimSpace(string(cpg)))
+	return encoding == "UTF-8" || encoding == "UTF8" || encoding == "65001"
+}
+
+func decodeText(b []byte, utf8Encoded bool) string {
+	if utf8Encoded || utf8.Valid(b) {
+		return string(b)
+	}
+	return latin1ToString(b)
+}
+
+func latin1ToString(b []byte) string {
+	runes := make([]rune, len(b))
+	for idx, c := range b {
+		runes[idx] = rune(c)
+	}
+	return string(runes)
+}
+
+//charsetReader lets the XML decoder read documents in Latin-1, which older NVDB
+//deliveries use
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "iso8859-1", "latin1", "windows-1252":
+		contents, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		return strings.NewReader(latin1ToString(contents)), nil
+	}
+
+	return nil, fmt.Errorf("unsupported charset %s", charset)
+}
+
+//isShapefile is used by the sniffing to tell a .shp file from other binary formats
+func isShapefile(head []byte) bool {
+	return bytes.HasPrefix(head, shapefileMagic)
+}
@@ -0,0 +1,56 @@
+package importer
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+	log "github.com/sirupsen/logrus"
+)
+
+//readText reads the original roadID;segmentID;lat;lon;lat;lon... format, with one
+//segment per line
+func readText(r io.Reader, opts *Options) ([]Segment, error) {
+	reader := bufio.NewReader(r)
+	segments := []Segment{}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		parts := strings.Split(strings.TrimRight(line, "\r\n"), ";")
+		numberOfParts := len(parts)
+
+		if numberOfParts >= 6 {
+			coordinates := []geometry.Point{}
+
+			for i := 2; i+1 < numberOfParts; i += 2 {
+				lat, laterr := strconv.ParseFloat(parts[i], 64)
+				lon, lonerr := strconv.ParseFloat(parts[i+1], 64)
+
+				if laterr != nil || lonerr != nil {
+					log.Errorf("Failed to parse (%s,%s) as a coordinate. Skipping record.", parts[i], parts[i+1])
+					continue
+				}
+
+				coordinates = append(coordinates, geometry.NewPoint(lat, lon))
+			}
+
+			segments = append(segments, Segment{
+				ID:          parts[1],
+				RoadID:      parts[0],
+				Coordinates: coordinates,
+			})
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return segments, nil
+}
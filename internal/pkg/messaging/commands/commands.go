@@ -3,17 +3,40 @@ package commands
 const (
 	//UpdateRoadSegmentSurfaceContentType is the content type for ...
 	UpdateRoadSegmentSurfaceContentType = "application/vnd-diwise-updateroadsegmentsurface+json"
+	//RetractRoadSegmentSurfaceContentType is the content type for RetractRoadSegmentSurface commands
+	RetractRoadSegmentSurfaceContentType = "application/vnd-diwise-retractroadsegmentsurface+json"
 )
 
-//UpdateRoadSegmentSurface is a command that takes info about a road surface update and enqueues it for persistence
+//UpdateRoadSegmentSurface is a command that takes info about a road surface update and enqueues it for persistence.
+//Source tells where the update came from, so that it can be weighted by trust when it is fused, and
+//MessageID identifies the command so that it is only applied once if it is delivered more than once.
+//ObservationID is set when the update was made from an observation, so that it can be retracted.
 type UpdateRoadSegmentSurface struct {
-	ID          string  `json:"id"`
-	SurfaceType string  `json:"surfaceType"`
-	Probability float64 `json:"probability"`
-	Timestamp   string  `json:"timestamp"`
+	MessageID     string  `json:"messageId,omitempty"`
+	ID            string  `json:"id"`
+	SurfaceType   string  `json:"surfaceType"`
+	Probability   float64 `json:"probability"`
+	Source        string  `json:"source,omitempty"`
+	ObservationID string  `json:"observationId,omitempty"`
+	Timestamp     string  `json:"timestamp"`
 }
 
 //ContentType returns the content type that this event will be sent as
 func (rssu *UpdateRoadSegmentSurface) ContentType() string {
 	return UpdateRoadSegmentSurfaceContentType
 }
+
+//RetractRoadSegmentSurface is a command that retracts erroneous predictions of the surface type of a
+//road segment, which is then fused anew from the predictions that remain. The predictions to retract
+//are those made from the observation with ObservationID, or the stored predictions with the ids in
+//Predictions. Retracting predictions that have already been retracted changes nothing.
+type RetractRoadSegmentSurface struct {
+	ID            string `json:"id"`
+	ObservationID string `json:"observationId,omitempty"`
+	Predictions   []uint `json:"predictions,omitempty"`
+}
+
+//ContentType returns the content type that this command will be sent as
+func (rrss *RetractRoadSegmentSurface) ContentType() string {
+	return RetractRoadSegmentSurfaceContentType
+}
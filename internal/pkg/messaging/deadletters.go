@@ -0,0 +1,282 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/persistence"
+)
+
+//RetryPolicy decides how a message that failed to be handled is retried. The first retry
+//is made after Delay, which doubles with every attempt up to MaxDelay, and the message is
+//dead lettered once it has been attempted MaxAttempts times.
+type RetryPolicy struct {
+	MaxAttempts int
+	Delay       time.Duration
+	MaxDelay    time.Duration
+}
+
+//DefaultRetryPolicy returns a policy that retries a message four times within a few minutes
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 5,
+		Delay:       10 * time.Second,
+		MaxDelay:    10 * time.Minute,
+	}
+}
+
+//DelayAfter returns the delay before the next attempt to handle a message that has failed
+//a number of times
+func (p RetryPolicy) DelayAfter(attempts int) time.Duration {
+	delay := p.Delay
+	for i := 1; i < attempts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	return delay
+}
+
+//rejectedError is returned for messages that can never be handled, such as messages that
+//can not be parsed, which are dead lettered without being retried
+type rejectedError struct {
+	err error
+}
+
+func (e *rejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *rejectedError) Unwrap() error {
+	return e.err
+}
+
+func reject(format string, args ...interface{}) error {
+	return &rejectedError{err: fmt.Errorf(format, args...)}
+}
+
+func isRejected(err error) bool {
+	rejected := &rejectedError{}
+	return errors.As(err, &rejected)
+}
+
+const (
+	failedMessagesBatchSize int           = 100
+	failedMessagesLease     time.Duration = time.Minute
+)
+
+//registration is the handler of a kind of message, and whether the messages of that kind
+//are local to the instance that received them
+type registration struct {
+	handler func(body []byte) error
+	local   bool
+}
+
+//DeadLetters keeps the commands and events that failed to be handled. A failed message is
+//retried according to the retry policy, and dead lettered once it has failed too many times
+//or can never be handled. Dead lettered messages are kept until they are replayed or discarded.
+//
+//Commands are handled by whichever replica receives them, so failed commands are shared by
+//every replica. Events are delivered to every replica and update the state of the replica
+//that received them, so failed events are owned by that instance and are only retried,
+//listed, replayed or discarded by it. The instance id must therefore stay the same when the
+//instance is restarted, or its failed events are left in the database.
+type DeadLetters struct {
+	db       database.Datastore
+	policy   RetryPolicy
+	instance string
+	handlers map[string]registration
+
+	mu sync.Mutex
+}
+
+//NewDeadLetters returns dead letters that are kept in a datastore, where the failed events of
+//the instance are owned by its id
+func NewDeadLetters(db database.Datastore, instance string, policy RetryPolicy) *DeadLetters {
+	return &DeadLetters{
+		db:       db,
+		policy:   policy,
+		instance: instance,
+		handlers: map[string]registration{},
+	}
+}
+
+//register makes a handler available for retries and replays of a kind of message that may be
+//handled by any replica. Dead letters may be nil, in which case failed messages are only logged.
+func (d *DeadLetters) register(kind string, handler func(body []byte) error) {
+	d.add(kind, registration{handler: handler})
+}
+
+//registerLocal makes a handler available for retries and replays of a kind of message that
+//must be handled by the instance that received it
+func (d *DeadLetters) registerLocal(kind string, handler func(body []byte) error) {
+	d.add(kind, registration{handler: handler, local: true})
+}
+
+func (d *DeadLetters) add(kind string, r registration) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.handlers[kind] = r
+}
+
+func (d *DeadLetters) registrationFor(kind string) (registration, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	r, ok := d.handlers[kind]
+	return r, ok
+}
+
+//handle passes a message to its handler, and keeps it to be retried if the handler fails. An
+//error is only returned if the message could not be kept.
+func (d *DeadLetters) handle(kind string, body []byte, handler func(body []byte) error) error {
+	err := handler(body)
+	if err == nil {
+		return nil
+	}
+
+	if d == nil {
+		log.Errorf("Failed to handle %s: %s", kind, err.Error())
+		return err
+	}
+
+	message := &persistence.FailedMessage{
+		Kind:      kind,
+		Owner:     d.ownerOf(kind),
+		Body:      string(body),
+		Attempts:  1,
+		LastError: err.Error(),
+	}
+
+	if isRejected(err) || d.policy.MaxAttempts <= 1 {
+		log.Errorf("Dead lettering %s: %s", kind, err.Error())
+		message.DeadLettered = true
+	} else {
+		nextAttempt := time.Now().UTC().Add(d.policy.DelayAfter(1))
+		log.Warnf("Failed to handle %s, retrying at %s: %s", kind, nextAttempt.Format(time.RFC3339), err.Error())
+		message.NextAttempt = &nextAttempt
+	}
+
+	storeErr := d.db.CreateFailedMessage(message)
+	if storeErr != nil {
+		log.Errorf("Failed to store failed %s: %s", kind, storeErr.Error())
+		return err
+	}
+
+	return nil
+}
+
+//ownerOf returns the instance that owns the failed messages of a kind, or an empty string if
+//they are shared by every replica
+func (d *DeadLetters) ownerOf(kind string) string {
+	if r, ok := d.registrationFor(kind); ok && r.local {
+		return d.instance
+	}
+
+	return ""
+}
+
+//Retry is a job that retries the shared failed messages and those owned by this instance that
+//are due, and dead letters those that fail for the last time
+func (d *DeadLetters) Retry(now time.Time) {
+	for {
+		messages, err := d.db.ClaimFailedMessages(d.instance, now, failedMessagesLease, failedMessagesBatchSize)
+		if err != nil {
+			log.Errorf("Failed to read the messages to retry: %s", err.Error())
+			return
+		}
+
+		for _, m := range messages {
+			err = d.run(m)
+			if err == nil {
+				log.Infof("Handled %s %d after %d failed attempts.", m.Kind, m.ID, m.Attempts)
+				continue
+			}
+
+			var nextAttempt *time.Time
+			if !isRejected(err) && m.Attempts+1 < d.policy.MaxAttempts {
+				next := now.Add(d.policy.DelayAfter(m.Attempts + 1))
+				nextAttempt = &next
+			} else {
+				log.Errorf("Dead lettering %s %d after %d attempts: %s", m.Kind, m.ID, m.Attempts+1, err.Error())
+			}
+
+			err = d.db.FailedMessageRetried(m.ID, err.Error(), nextAttempt)
+			if err != nil {
+				log.Errorf("Failed to record the failure to handle %s %d: %s", m.Kind, m.ID, err.Error())
+			}
+		}
+
+		if len(messages) < failedMessagesBatchSize {
+			return
+		}
+	}
+}
+
+//run handles a failed message once more, and removes it if it succeeds
+func (d *DeadLetters) run(m persistence.FailedMessage) error {
+	r, ok := d.registrationFor(m.Kind)
+	if !ok {
+		return reject("no handler for messages of kind %s", m.Kind)
+	}
+
+	err := r.handler([]byte(m.Body))
+	if err != nil {
+		return err
+	}
+
+	return d.db.DeleteFailedMessage(m.ID)
+}
+
+//List returns every dead lettered message that is shared or owned by this instance
+func (d *DeadLetters) List() ([]persistence.FailedMessage, error) {
+	return d.db.GetDeadLetters(d.instance)
+}
+
+//Get returns a dead lettered message, or database.ErrNotFound if there is no such message
+//or it is owned by another instance
+func (d *DeadLetters) Get(id uint) (*persistence.FailedMessage, error) {
+	return d.db.GetDeadLetterByID(d.instance, id)
+}
+
+//Replay handles a dead lettered message once more. The message is removed if it is handled,
+//and is otherwise kept with the reason that it failed again.
+func (d *DeadLetters) Replay(id uint) error {
+	m, err := d.db.GetDeadLetterByID(d.instance, id)
+	if err != nil {
+		return err
+	}
+
+	err = d.run(*m)
+	if err != nil {
+		if recordErr := d.db.FailedMessageRetried(m.ID, err.Error(), nil); recordErr != nil {
+			log.Errorf("Failed to record the failure to replay %s %d: %s", m.Kind, m.ID, recordErr.Error())
+		}
+		return err
+	}
+
+	log.Infof("Replayed dead lettered %s %d.", m.Kind, m.ID)
+	return nil
+}
+
+//Discard removes a dead lettered message without handling it
+func (d *DeadLetters) Discard(id uint) error {
+	if _, err := d.db.GetDeadLetterByID(d.instance, id); err != nil {
+		return err
+	}
+
+	return d.db.DeleteFailedMessage(id)
+}
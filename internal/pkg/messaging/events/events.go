@@ -1,11 +1,19 @@
 package events
 
-//RoadSegmentSurfaceUpdated is an event that notifies that a road surface type has changed
+//RoadSegmentSurfaceUpdated is an event that notifies that a road surface type has changed.
+//SurfaceType and Probability are the most likely type of the fused Distribution. Sequence
+//increases with every change of a segment's surface, so that receivers can drop events
+//that are redelivered or arrive out of order. Confirmed is when the distribution was last
+//confirmed by a prediction, which is earlier than Timestamp if it has decayed since.
 type RoadSegmentSurfaceUpdated struct {
-	ID          string  `json:"id"`
-	SurfaceType string  `json:"surfaceType"`
-	Probability float64 `json:"probability"`
-	Timestamp   string  `json:"timestamp"`
+	MessageID    string             `json:"messageId,omitempty"`
+	ID           string             `json:"id"`
+	Sequence     uint64             `json:"sequence,omitempty"`
+	SurfaceType  string             `json:"surfaceType"`
+	Probability  float64            `json:"probability"`
+	Distribution map[string]float64 `json:"distribution,omitempty"`
+	Timestamp    string             `json:"timestamp"`
+	Confirmed    string             `json:"confirmed,omitempty"`
 }
 
 //TopicName returns the name of the topic that this event should be posted to
@@ -2,14 +2,22 @@ package messaging
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/decay"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fusion"
 	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/messaging/commands"
 	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/messaging/events"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/persistence"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/subscriptions"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/surfacetype"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
 	"github.com/iot-for-tillgenglighet/messaging-golang/pkg/messaging"
 	"github.com/streadway/amqp"
 )
@@ -20,50 +28,329 @@ type MessagingContext interface {
 	NoteToSelf(message messaging.CommandMessage) error
 }
 
-//CreateRoadSegmentSurfaceUpdatedReceiver is a closure that take a datastore and handles incoming events
-func CreateRoadSegmentSurfaceUpdatedReceiver(db database.Datastore) messaging.TopicMessageHandler {
-	return func(msg amqp.Delivery) {
-		log.Info("Message received from topic: " + string(msg.Body))
+//CreateRoadSegmentSurfaceUpdatedReceiver is a closure that take a datastore and handles incoming events.
+//Events that are older than, or the same as, the segment's current surface are dropped by the datastore.
+//Events that fail to be applied are kept by the dead letters, which may be nil, to be retried
+//by this instance only, since every replica applies the event to its own state.
+func CreateRoadSegmentSurfaceUpdatedReceiver(db database.Datastore, deadLetters *DeadLetters) messaging.TopicMessageHandler {
+	kind := (&events.RoadSegmentSurfaceUpdated{}).TopicName()
 
+	handle := func(body []byte) error {
 		evt := &events.RoadSegmentSurfaceUpdated{}
-		err := json.Unmarshal(msg.Body, evt)
-
+		err := json.Unmarshal(body, evt)
 		if err != nil {
-			log.Error("Failed to unmarshal message")
-			return
+			return reject("failed to unmarshal event: %s", err.Error())
 		}
 
 		ts, err := time.Parse(time.RFC3339, evt.Timestamp)
-		err = db.RoadSegmentSurfaceUpdated(evt.ID, evt.SurfaceType, evt.Probability, ts)
-
 		if err != nil {
-			log.Error(err.Error())
-			return
+			return reject("surface update of road segment %s has an invalid timestamp %s", evt.ID, evt.Timestamp)
+		}
+
+		update := database.SurfaceUpdate{
+			Distribution: fusion.Distribution(evt.Distribution),
+			Timestamp:    ts,
+			Sequence:     evt.Sequence,
+		}
+
+		// Events from instances that do not keep the confirmation time were confirmed when they were made
+		if evt.Confirmed != "" {
+			update.Confirmed, err = time.Parse(time.RFC3339, evt.Confirmed)
+			if err != nil {
+				return reject("surface update of road segment %s has an invalid confirmation time %s", evt.ID, evt.Confirmed)
+			}
 		}
+
+		// Events from instances that do not fuse predictions carry no distribution, while
+		// events without a surface type clear the surface of a segment
+		if len(update.Distribution) == 0 && evt.SurfaceType != "" {
+			update.Distribution = fusion.Distribution{evt.SurfaceType: evt.Probability}
+		}
+
+		return db.RoadSegmentSurfaceUpdated(evt.ID, update)
+	}
+
+	deadLetters.registerLocal(kind, handle)
+
+	return func(msg amqp.Delivery) {
+		log.Info("Message received from topic: " + string(msg.Body))
+		deadLetters.handle(kind, msg.Body, handle)
 	}
 }
 
-//CreateUpdateRoadSegmentSurfaceCommandHandler returns a handler for commands
-func CreateUpdateRoadSegmentSurfaceCommandHandler(db database.Datastore, msg MessagingContext) messaging.CommandHandler {
-	return func(wrapper messaging.CommandMessageWrapper) error {
+//CreateUpdateRoadSegmentSurfaceCommandHandler returns a handler for commands. Commands with
+//a surface type that is not part of the vocabulary are rejected, and aliases are replaced
+//by their canonical names. Each command is fused with the recent predictions of the segment
+//according to the model, and the resulting distribution is stored together with the event
+//that announces it. The event is published by the relay, and only once the update has been
+//stored. Commands that are delivered more than once are only applied once, and commands
+//that fail to be applied are kept by the dead letters, which may be nil, to be retried.
+func CreateUpdateRoadSegmentSurfaceCommandHandler(db database.Datastore, vocabulary *surfacetype.Vocabulary, model fusion.Model, relay func(now time.Time), deadLetters *DeadLetters) messaging.CommandHandler {
+	kind := commands.UpdateRoadSegmentSurfaceContentType
+
+	handle := func(body []byte) error {
 		cmd := &commands.UpdateRoadSegmentSurface{}
-		err := json.Unmarshal(wrapper.Body(), cmd)
+		err := json.Unmarshal(body, cmd)
 		if err != nil {
-			return fmt.Errorf("Failed to unmarshal command! %s", err.Error())
+			return reject("failed to unmarshal command: %s", err.Error())
 		}
 
-		ts, err := time.Parse(time.RFC3339, cmd.Timestamp)
-		err = db.UpdateRoadSegmentSurface(cmd.ID, cmd.SurfaceType, cmd.Probability, ts)
+		cmd.SurfaceType, err = vocabulary.Canonical(cmd.SurfaceType)
+		if err != nil {
+			return reject("rejecting update of road segment %s: %s", cmd.ID, err.Error())
+		}
+
+		ts := time.Now().UTC()
+		if cmd.Timestamp != "" {
+			ts, err = time.Parse(time.RFC3339, cmd.Timestamp)
+			if err != nil {
+				return reject("update of road segment %s has an invalid timestamp %s", cmd.ID, cmd.Timestamp)
+			}
+		}
 
-		//Post an event stating that a roadsegment's surface has been updated
-		event := &events.RoadSegmentSurfaceUpdated{
-			ID:          cmd.ID,
+		prediction := fusion.Prediction{
 			SurfaceType: cmd.SurfaceType,
 			Probability: cmd.Probability,
-			Timestamp:   time.Now().UTC().Format(time.RFC3339),
+			Source:      cmd.Source,
+			Timestamp:   ts,
+		}
+
+		update, err := db.UpdateRoadSegmentSurface(cmd.ID, cmd.MessageID, cmd.ObservationID, prediction, model)
+		if err != nil {
+			if errors.Is(err, database.ErrDuplicate) {
+				log.Infof("Dropping redelivered command: %s", err.Error())
+				return nil
+			} else if errors.Is(err, database.ErrRetracted) {
+				log.Infof("Dropping retracted command: %s", err.Error())
+				return nil
+			}
+			return fmt.Errorf("failed to update surface of road segment %s: %s", cmd.ID, err.Error())
 		}
-		msg.PublishOnTopic(event)
+
+		surfaceStored(db, cmd.ID, update, relay)
 
 		return nil
 	}
+
+	deadLetters.register(kind, handle)
+
+	return func(wrapper messaging.CommandMessageWrapper) error {
+		return deadLetters.handle(kind, wrapper.Body(), handle)
+	}
+}
+
+//CreateRetractRoadSegmentSurfaceCommandHandler returns a handler for commands that retract
+//erroneous predictions of the surface of a segment. The predictions that remain are fused
+//according to the model, and the result is stored and published as by the handler of
+//update commands. Commands that retract nothing, such as redelivered commands, are dropped.
+func CreateRetractRoadSegmentSurfaceCommandHandler(db database.Datastore, model fusion.Model, relay func(now time.Time), deadLetters *DeadLetters) messaging.CommandHandler {
+	kind := commands.RetractRoadSegmentSurfaceContentType
+
+	handle := func(body []byte) error {
+		cmd := &commands.RetractRoadSegmentSurface{}
+		err := json.Unmarshal(body, cmd)
+		if err != nil {
+			return reject("failed to unmarshal command: %s", err.Error())
+		}
+
+		update, retracted, err := db.RetractRoadSegmentSurface(cmd.ID, cmd.ObservationID, cmd.Predictions, model)
+		if err != nil {
+			return fmt.Errorf("failed to retract surface of road segment %s: %s", cmd.ID, err.Error())
+		}
+
+		if !retracted {
+			log.Infof("Nothing left to retract from road segment %s.", cmd.ID)
+			return nil
+		}
+
+		surfaceType, probability := update.Distribution.MostLikely()
+		log.Infof("Retracted predictions of road segment %s, which is now %s (%f).", cmd.ID, surfaceType, probability)
+
+		surfaceStored(db, cmd.ID, update, relay)
+
+		return nil
+	}
+
+	deadLetters.register(kind, handle)
+
+	return func(wrapper messaging.CommandMessageWrapper) error {
+		return deadLetters.handle(kind, wrapper.Body(), handle)
+	}
+}
+
+//surfaceStored applies a stored update right away, so that this instance does not have to
+//wait for the event to come back from the broker, and relays the event to the other instances
+func surfaceStored(db database.Datastore, segmentID string, update database.SurfaceUpdate, relay func(now time.Time)) {
+	err := db.RoadSegmentSurfaceUpdated(segmentID, update)
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	if relay != nil {
+		relay(time.Now().UTC())
+	}
+}
+
+//CreateSurfaceExpiryJob returns a job that applies the decay rules to the surface of every
+//segment, and stores an update for each segment whose most likely surface type has changed.
+//Every instance may run the job, since the datastore locks each segment while it is expired
+//and only one of them stores each change.
+func CreateSurfaceExpiryJob(db database.Datastore, rules *decay.Rules, relay func(now time.Time)) func(now time.Time) {
+	return func(now time.Time) {
+		segments, err := db.GetAllSegments()
+		if err != nil {
+			log.Errorf("Failed to get road segments to expire: %s", err.Error())
+			return
+		}
+
+		expired := 0
+
+		for _, segment := range segments {
+			modified, confirmed := segment.DateModified(), segment.DateConfirmed()
+			if modified == nil || confirmed == nil {
+				continue
+			}
+
+			if _, flipped := rules.HasFlipped(segment.SurfaceTypeDistribution(), *modified, *confirmed, segment.Attributes(), now); !flipped {
+				continue
+			}
+
+			update, stored, err := db.ExpireRoadSegmentSurface(segment.ID(), rules, now)
+			if err != nil {
+				log.Errorf("Failed to expire the surface of road segment %s: %s", segment.ID(), err.Error())
+				continue
+			}
+
+			if !stored {
+				continue
+			}
+
+			surfaceType, probability := update.Distribution.MostLikely()
+			log.Infof("The surface of road segment %s has expired and is now %s with probability %f.", segment.ID(), surfaceType, probability)
+
+			err = db.RoadSegmentSurfaceUpdated(segment.ID(), update)
+			if err != nil {
+				log.Error(err.Error())
+			}
+
+			expired++
+		}
+
+		if expired > 0 && relay != nil {
+			relay(now)
+		}
+	}
+}
+
+const (
+	//DefaultOutboxRetryDelay is the default delay before a message that failed to be published
+	//is retried. The delay doubles with every failed attempt, up to MaxOutboxRetryDelay.
+	DefaultOutboxRetryDelay time.Duration = 5 * time.Second
+	//MaxOutboxRetryDelay is the longest delay between two attempts to publish a message
+	MaxOutboxRetryDelay time.Duration = 10 * time.Minute
+
+	outboxBatchSize int           = 100
+	outboxLease     time.Duration = time.Minute
+)
+
+//outboxMessage publishes a stored message with its stored topic, content type and body
+type outboxMessage struct {
+	row persistence.OutboxMessage
+}
+
+func (m *outboxMessage) TopicName() string {
+	return m.row.Topic
+}
+
+func (m *outboxMessage) ContentType() string {
+	return m.row.ContentType
+}
+
+func (m *outboxMessage) MarshalJSON() ([]byte, error) {
+	return []byte(m.row.Body), nil
+}
+
+//CreateOutboxRelay returns a job that publishes the messages of the outbox in the order they
+//were stored. A message that fails to be published is retried after a delay that doubles with
+//every attempt, and the job stops at the first failure so that the rest of the outbox is left
+//for the next run. Subscribers are notified of surface updates once they have been published.
+func CreateOutboxRelay(db database.Datastore, msg MessagingContext, notifier subscriptions.Notifier, retryDelay time.Duration) func(now time.Time) {
+	policy := RetryPolicy{Delay: retryDelay, MaxDelay: MaxOutboxRetryDelay}
+	mu := sync.Mutex{}
+
+	return func(now time.Time) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for {
+			messages, err := db.ClaimOutboxMessages(now, outboxLease, outboxBatchSize)
+			if err != nil {
+				log.Errorf("Failed to read the outbox: %s", err.Error())
+				return
+			}
+
+			for _, m := range messages {
+				err = msg.PublishOnTopic(&outboxMessage{row: m})
+				if err != nil {
+					delay := policy.DelayAfter(m.Attempts + 1)
+					log.Errorf("Failed to publish message %d on %s, retrying in %s: %s", m.ID, m.Topic, delay, err.Error())
+
+					err = db.OutboxMessageFailed(m.ID, err.Error(), now.Add(delay))
+					if err != nil {
+						log.Errorf("Failed to record the failure to publish message %d: %s", m.ID, err.Error())
+					}
+					return
+				}
+
+				err = db.OutboxMessagePublished(m.ID)
+				if err != nil {
+					log.Errorf("Failed to remove published message %d from the outbox: %s", m.ID, err.Error())
+				}
+
+				if notifier != nil && m.Topic == (&events.RoadSegmentSurfaceUpdated{}).TopicName() {
+					notifyPublishedSurfaceUpdate(db, notifier, m)
+				}
+			}
+
+			if len(messages) < outboxBatchSize {
+				return
+			}
+		}
+	}
+}
+
+func notifyPublishedSurfaceUpdate(db database.Datastore, notifier subscriptions.Notifier, m persistence.OutboxMessage) {
+	evt := &events.RoadSegmentSurfaceUpdated{}
+	err := json.Unmarshal([]byte(m.Body), evt)
+	if err != nil {
+		log.Errorf("Failed to unmarshal published message %d: %s", m.ID, err.Error())
+		return
+	}
+
+	ts, err := time.Parse(time.RFC3339, evt.Timestamp)
+	if err != nil {
+		log.Errorf("Published message %d has an invalid timestamp %s", m.ID, evt.Timestamp)
+		return
+	}
+
+	notifySurfaceUpdated(db, notifier, evt.ID, evt.SurfaceType, evt.Probability, ts)
+}
+
+func notifySurfaceUpdated(db database.Datastore, notifier subscriptions.Notifier, segmentID, surfaceType string, probability float64, timestamp time.Time) {
+	segment, err := db.GetRoadSegmentByID(segmentID)
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+
+	name := segment.Name()
+	if name == "" {
+		name = segment.ID()
+	}
+
+	entity := fiware.NewRoadSegment(
+		segment.ID(), name, segment.RoadID(), segment.Coordinates(), &timestamp,
+	).WithSurfaceType(surfaceType, probability)
+
+	notifier.EntityChanged(entity, []string{"surfaceType"})
 }
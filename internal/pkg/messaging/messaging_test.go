@@ -0,0 +1,401 @@
+package messaging_test
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/decay"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fusion"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/messaging"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/messaging/commands"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/messaging/events"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/surfacetype"
+	messaginggolang "github.com/iot-for-tillgenglighet/messaging-golang/pkg/messaging"
+	diwise "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/diwise"
+	"github.com/streadway/amqp"
+)
+
+type messengerMock struct {
+	commands []messaginggolang.CommandMessage
+	messages []messaginggolang.TopicMessage
+	failures int
+}
+
+func (m *messengerMock) PublishOnTopic(message messaginggolang.TopicMessage) error {
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("the broker is unreachable")
+	}
+
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+func (m *messengerMock) NoteToSelf(command messaginggolang.CommandMessage) error {
+	m.commands = append(m.commands, command)
+	return nil
+}
+
+type commandWrapperMock struct {
+	body []byte
+}
+
+func (w *commandWrapperMock) Body() []byte {
+	return w.body
+}
+
+func (w *commandWrapperMock) RespondWith(messaginggolang.CommandMessage) error {
+	return nil
+}
+
+const testSeedData string = "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852\n"
+
+func newTestDatastore(t *testing.T) database.Datastore {
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(testSeedData))
+	if err != nil {
+		t.Fatalf("Failed to create test datastore: %s", err.Error())
+	}
+	return db
+}
+
+func deliver(t *testing.T, handler messaginggolang.TopicMessageHandler, evt *events.RoadSegmentSurfaceUpdated) {
+	body, err := json.Marshal(evt)
+	if err != nil {
+		t.Fatalf("Failed to marshal event: %s", err.Error())
+	}
+	handler(amqp.Delivery{Body: body})
+}
+
+func TestReorderedAndRedeliveredEventsAreDropped(t *testing.T) {
+	db := newTestDatastore(t)
+	receiver := messaging.CreateRoadSegmentSurfaceUpdatedReceiver(db, nil)
+
+	snowstorm := time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)
+	newer := &events.RoadSegmentSurfaceUpdated{
+		MessageID: "b", ID: "21277:153930", Sequence: 2, SurfaceType: "snow", Probability: 0.8,
+		Timestamp: snowstorm.Format(time.RFC3339),
+	}
+	older := &events.RoadSegmentSurfaceUpdated{
+		MessageID: "a", ID: "21277:153930", Sequence: 1, SurfaceType: "tarmac", Probability: 0.9,
+		Timestamp: snowstorm.Add(-time.Hour).Format(time.RFC3339),
+	}
+
+	deliver(t, receiver, newer)
+	deliver(t, receiver, older)
+
+	redelivered := *newer
+	redelivered.SurfaceType = "ice"
+	deliver(t, receiver, &redelivered)
+
+	segment, _ := db.GetRoadSegmentByID("21277:153930")
+	if surfaceType, probability := segment.SurfaceType(); surfaceType != "snow" || probability != 0.8 || !segment.DateModified().Equal(snowstorm) {
+		t.Errorf("Expected the event with the highest sequence to win, but got %s (%f).", surfaceType, probability)
+	}
+}
+
+func publishedEvents(t *testing.T, messenger *messengerMock) []events.RoadSegmentSurfaceUpdated {
+	published := []events.RoadSegmentSurfaceUpdated{}
+
+	for _, m := range messenger.messages {
+		body, err := json.Marshal(m)
+		if err != nil {
+			t.Fatalf("Failed to marshal published message: %s", err.Error())
+		}
+
+		evt := events.RoadSegmentSurfaceUpdated{}
+		json.Unmarshal(body, &evt)
+		published = append(published, evt)
+	}
+
+	return published
+}
+
+func newUpdateCommand(segmentID, messageID string) []byte {
+	body, _ := json.Marshal(&commands.UpdateRoadSegmentSurface{
+		MessageID:   messageID,
+		ID:          segmentID,
+		SurfaceType: "snow",
+		Probability: 0.8,
+		Timestamp:   time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC).Format(time.RFC3339),
+	})
+	return body
+}
+
+func TestRedeliveredCommandIsOnlyAppliedOnce(t *testing.T) {
+	db := newTestDatastore(t)
+	messenger := &messengerMock{}
+	relay := messaging.CreateOutboxRelay(db, messenger, nil, messaging.DefaultOutboxRetryDelay)
+	handler := messaging.CreateUpdateRoadSegmentSurfaceCommandHandler(db, surfacetype.Default(), fusion.DefaultModel(), relay, nil)
+
+	body := newUpdateCommand("21277:153930", "8a5c7f1e-4b1d-4f5e-9c1a-2b7e0c3d9f10")
+
+	for i := 0; i < 2; i++ {
+		if err := handler(&commandWrapperMock{body: body}); err != nil {
+			t.Fatalf("Unexpected error when handling command: %s", err.Error())
+		}
+	}
+
+	published := publishedEvents(t, messenger)
+	if len(published) != 1 {
+		t.Fatalf("Expected a single event to be published, but got %d.", len(published))
+	}
+
+	if published[0].Sequence != 1 || published[0].MessageID == "" || published[0].SurfaceType != "snow" {
+		t.Errorf("Expected the event to carry a message id and the first sequence number, but got %+v.", published[0])
+	}
+}
+
+func TestFailedUpdateIsNotPublished(t *testing.T) {
+	db := newTestDatastore(t)
+	messenger := &messengerMock{}
+	relay := messaging.CreateOutboxRelay(db, messenger, nil, messaging.DefaultOutboxRetryDelay)
+	handler := messaging.CreateUpdateRoadSegmentSurfaceCommandHandler(db, surfacetype.Default(), fusion.DefaultModel(), relay, nil)
+
+	if err := handler(&commandWrapperMock{body: newUpdateCommand("21277:999999", "")}); err == nil {
+		t.Error("Expected an error when updating the surface of an unknown segment.")
+	}
+
+	if len(messenger.messages) != 0 {
+		t.Errorf("Expected no event to be published for a failed update, but got %d.", len(messenger.messages))
+	}
+}
+
+func TestOutboxIsRetriedUntilPublished(t *testing.T) {
+	db := newTestDatastore(t)
+	messenger := &messengerMock{failures: 2}
+	relay := messaging.CreateOutboxRelay(db, messenger, nil, time.Minute)
+	handler := messaging.CreateUpdateRoadSegmentSurfaceCommandHandler(db, surfacetype.Default(), fusion.DefaultModel(), relay, nil)
+
+	if err := handler(&commandWrapperMock{body: newUpdateCommand("21277:153930", "")}); err != nil {
+		t.Fatalf("Unexpected error when handling command: %s", err.Error())
+	}
+
+	segment, _ := db.GetRoadSegmentByID("21277:153930")
+	if surfaceType, _ := segment.SurfaceType(); surfaceType != "snow" {
+		t.Errorf("Expected the stored update to be applied while its event is pending, but got %s.", surfaceType)
+	}
+
+	now := time.Now().UTC()
+
+	relay(now.Add(30 * time.Second))
+	if messenger.failures != 1 {
+		t.Fatal("Expected the relay to wait before retrying a failed event.")
+	}
+
+	relay(now.Add(61 * time.Second))
+	relay(now.Add(2 * time.Minute))
+	if len(messenger.messages) != 0 {
+		t.Fatal("Expected the delay to double after the second failure.")
+	}
+
+	relay(now.Add(4 * time.Minute))
+	relay(now.Add(5 * time.Minute))
+
+	if published := publishedEvents(t, messenger); len(published) != 1 || published[0].ID != "21277:153930" {
+		t.Errorf("Expected the event to be published exactly once after it has been retried, but got %d.", len(published))
+	}
+}
+
+//flakyDatastore fails to apply surface updates a number of times before it succeeds
+type flakyDatastore struct {
+	database.Datastore
+	failures int
+}
+
+func (db *flakyDatastore) RoadSegmentSurfaceUpdated(segmentID string, update database.SurfaceUpdate) error {
+	if db.failures > 0 {
+		db.failures--
+		return errors.New("the database is unreachable")
+	}
+
+	return db.Datastore.RoadSegmentSurfaceUpdated(segmentID, update)
+}
+
+func TestUnparseableEventIsDeadLettered(t *testing.T) {
+	db := newTestDatastore(t)
+	deadLetters := messaging.NewDeadLetters(db, "replica-0", messaging.DefaultRetryPolicy())
+	receiver := messaging.CreateRoadSegmentSurfaceUpdatedReceiver(db, deadLetters)
+
+	receiver(amqp.Delivery{Body: []byte(`{"id":"21277:153930","timestamp":"yesterday"}`)})
+
+	dead, _ := deadLetters.List()
+	if len(dead) != 1 || dead[0].Kind != (&events.RoadSegmentSurfaceUpdated{}).TopicName() || dead[0].Attempts != 1 {
+		t.Fatalf("Expected an event with an invalid timestamp to be dead lettered without retries, but got %v.", dead)
+	}
+
+	if err := deadLetters.Discard(dead[0].ID); err != nil {
+		t.Errorf("Failed to discard dead letter: %s", err.Error())
+	}
+
+	if dead, _ = deadLetters.List(); len(dead) != 0 {
+		t.Error("Expected the discarded message to be removed.")
+	}
+}
+
+func TestFailedEventIsRetriedThenDeadLetteredAndReplayed(t *testing.T) {
+	db := &flakyDatastore{Datastore: newTestDatastore(t), failures: 3}
+	deadLetters := messaging.NewDeadLetters(db, "replica-0", messaging.RetryPolicy{MaxAttempts: 3, Delay: time.Minute, MaxDelay: time.Hour})
+	receiver := messaging.CreateRoadSegmentSurfaceUpdatedReceiver(db, deadLetters)
+
+	deliver(t, receiver, &events.RoadSegmentSurfaceUpdated{
+		ID: "21277:153930", Sequence: 1, SurfaceType: "snow", Probability: 0.8,
+		Timestamp: time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC).Format(time.RFC3339),
+	})
+
+	now := time.Now().UTC()
+
+	deadLetters.Retry(now.Add(2 * time.Minute))
+	if dead, _ := deadLetters.List(); len(dead) != 0 || db.failures != 1 {
+		t.Fatalf("Expected the event to be retried before it is dead lettered (%d failures left).", db.failures)
+	}
+
+	deadLetters.Retry(now.Add(5 * time.Minute))
+	dead, _ := deadLetters.List()
+	if len(dead) != 1 || dead[0].Attempts != 3 || dead[0].LastError == "" {
+		t.Fatalf("Expected the event to be dead lettered after three attempts, but got %v.", dead)
+	}
+
+	if err := deadLetters.Replay(dead[0].ID); err != nil {
+		t.Fatalf("Expected the replayed event to be handled, but got %s.", err.Error())
+	}
+
+	segment, _ := db.GetRoadSegmentByID("21277:153930")
+	if surfaceType, _ := segment.SurfaceType(); surfaceType != "snow" {
+		t.Errorf("Expected the replayed event to be applied, but got %s.", surfaceType)
+	}
+
+	if dead, _ = deadLetters.List(); len(dead) != 0 {
+		t.Error("Expected the replayed message to be removed.")
+	}
+}
+
+func TestFailedEventsAreOnlyRetriedByTheReplicaThatReceivedThem(t *testing.T) {
+	db := &flakyDatastore{Datastore: newTestDatastore(t), failures: 2}
+	policy := messaging.RetryPolicy{MaxAttempts: 3, Delay: time.Minute, MaxDelay: time.Hour}
+	owner := messaging.NewDeadLetters(db, "replica-0", policy)
+	other := messaging.NewDeadLetters(db, "replica-1", policy)
+	messaging.CreateRoadSegmentSurfaceUpdatedReceiver(db, other)
+	messaging.CreateUpdateRoadSegmentSurfaceCommandHandler(db, surfacetype.Default(), fusion.DefaultModel(), nil, other)
+
+	deliver(t, messaging.CreateRoadSegmentSurfaceUpdatedReceiver(db, owner), &events.RoadSegmentSurfaceUpdated{
+		ID: "21277:153930", Sequence: 1, SurfaceType: "snow", Probability: 0.8,
+		Timestamp: time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC).Format(time.RFC3339),
+	})
+
+	command := messaging.CreateUpdateRoadSegmentSurfaceCommandHandler(db, surfacetype.Default(), fusion.DefaultModel(), nil, owner)
+	command(&commandWrapperMock{body: []byte("not json")})
+
+	other.Retry(time.Now().UTC().Add(2 * time.Minute))
+	if db.failures != 1 {
+		t.Fatalf("Expected the failed event to be left to the replica that received it (%d failures left).", db.failures)
+	}
+
+	dead, _ := other.List()
+	if len(dead) != 1 || dead[0].Kind != commands.UpdateRoadSegmentSurfaceContentType {
+		t.Fatalf("Expected only the dead lettered command to be shared with other replicas, but got %v.", dead)
+	}
+
+	owner.Retry(time.Now().UTC().Add(2 * time.Minute))
+	if db.failures != 0 {
+		t.Errorf("Expected the failed event to be retried by the replica that received it (%d failures left).", db.failures)
+	}
+}
+
+func TestFailedEventsAreRetriedAfterTheReplicaRestarts(t *testing.T) {
+	db := &flakyDatastore{Datastore: newTestDatastore(t), failures: 2}
+	policy := messaging.RetryPolicy{MaxAttempts: 3, Delay: time.Minute, MaxDelay: time.Hour}
+
+	deliver(t, messaging.CreateRoadSegmentSurfaceUpdatedReceiver(db, messaging.NewDeadLetters(db, "replica-0", policy)), &events.RoadSegmentSurfaceUpdated{
+		ID: "21277:153930", Sequence: 1, SurfaceType: "snow", Probability: 0.8,
+		Timestamp: time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC).Format(time.RFC3339),
+	})
+
+	restarted := messaging.NewDeadLetters(db, "replica-0", policy)
+	messaging.CreateRoadSegmentSurfaceUpdatedReceiver(db, restarted)
+
+	restarted.Retry(time.Now().UTC().Add(2 * time.Minute))
+	if db.failures != 0 {
+		t.Errorf("Expected the failed event to be retried by the restarted replica (%d failures left).", db.failures)
+	}
+}
+
+func TestExpiredSurfaceKeepsItsConfirmationOnEveryReplica(t *testing.T) {
+	db := newTestDatastore(t)
+	messenger := &messengerMock{}
+	relay := messaging.CreateOutboxRelay(db, messenger, nil, messaging.DefaultOutboxRetryDelay)
+	handler := messaging.CreateUpdateRoadSegmentSurfaceCommandHandler(db, surfacetype.Default(), fusion.DefaultModel(), relay, nil)
+	rules, _ := decay.Default(surfacetype.Default())
+
+	handler(&commandWrapperMock{body: newUpdateCommand("21277:153930", "")})
+
+	snowstorm := time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)
+	messaging.CreateSurfaceExpiryJob(db, rules, relay)(snowstorm.Add(72 * time.Hour))
+
+	published := publishedEvents(t, messenger)
+	if len(published) != 2 || published[1].SurfaceType != "unknown" || published[1].Confirmed != snowstorm.Format(time.RFC3339) {
+		t.Fatalf("Expected an event with the expired surface and the time it was confirmed, but got %+v.", published)
+	}
+
+	replica := newTestDatastore(t)
+	receiver := messaging.CreateRoadSegmentSurfaceUpdatedReceiver(replica, nil)
+	for idx := range published {
+		deliver(t, receiver, &published[idx])
+	}
+
+	segment, _ := replica.GetRoadSegmentByID("21277:153930")
+	if confirmed := segment.DateConfirmed(); confirmed == nil || !confirmed.Equal(snowstorm) || !segment.DateModified().After(snowstorm) {
+		t.Errorf("Expected other replicas to keep the time that the surface was confirmed, but got %v.", confirmed)
+	}
+}
+
+func TestRetractedObservationIsRemovedFromEveryReplica(t *testing.T) {
+	db := newTestDatastore(t)
+	messenger := &messengerMock{}
+	relay := messaging.CreateOutboxRelay(db, messenger, nil, messaging.DefaultOutboxRetryDelay)
+	update := messaging.CreateUpdateRoadSegmentSurfaceCommandHandler(db, surfacetype.Default(), fusion.DefaultModel(), relay, nil)
+	retract := messaging.CreateRetractRoadSegmentSurfaceCommandHandler(db, fusion.DefaultModel(), relay, nil)
+
+	observation := diwise.NewRoadSurfaceObserved("wrong", "snow", 0.8, 62.389109, 17.310863)
+	observation.ID = "wrong"
+	db.CreateRoadSurfaceObserved(observation, "21277:153930")
+
+	body, _ := json.Marshal(&commands.UpdateRoadSegmentSurface{
+		ID: "21277:153930", SurfaceType: "snow", Probability: 0.8, ObservationID: "wrong",
+		Timestamp: time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC).Format(time.RFC3339),
+	})
+	update(&commandWrapperMock{body: body})
+
+	db.DeleteRoadSurfacesObserved([]string{"wrong"})
+	body, _ = json.Marshal(&commands.RetractRoadSegmentSurface{ID: "21277:153930", ObservationID: "wrong"})
+
+	for i := 0; i < 2; i++ {
+		if err := retract(&commandWrapperMock{body: body}); err != nil {
+			t.Fatalf("Unexpected error when handling retraction: %s", err.Error())
+		}
+	}
+
+	published := publishedEvents(t, messenger)
+	if len(published) != 2 || published[1].Sequence != 2 || published[1].SurfaceType != "" {
+		t.Fatalf("Expected a single event that clears the surface of the segment, but got %+v.", published)
+	}
+
+	segment, _ := db.GetRoadSegmentByID("21277:153930")
+	if surfaceType, _ := segment.SurfaceType(); surfaceType != "" || len(segment.SurfaceTypeDistribution()) != 0 {
+		t.Errorf("Expected the retraction to be applied locally, but the surface is %s.", surfaceType)
+	}
+
+	replica := newTestDatastore(t)
+	receiver := messaging.CreateRoadSegmentSurfaceUpdatedReceiver(replica, nil)
+	for idx := range published {
+		deliver(t, receiver, &published[idx])
+	}
+
+	segment, _ = replica.GetRoadSegmentByID("21277:153930")
+	if surfaceType, _ := segment.SurfaceType(); surfaceType != "" || len(segment.SurfaceTypeDistribution()) != 0 {
+		t.Errorf("Expected the retraction to be applied by other replicas, but the surface is %s.", surfaceType)
+	}
+}
@@ -6,38 +6,119 @@ import (
 	"gorm.io/gorm"
 )
 
-//Road persists the bare minimum we need to store about a road
+//Road persists a road of the road network
 type Road struct {
 	gorm.Model
 	RID          string `gorm:"unique"`
+	Name         string
+	RoadClass    string
 	RoadSegments []RoadSegment
 }
 
-//RoadSegment persists the bare minimum we need to store in a database about a road segment
+//RoadSegment persists a road segment together with its geometry, so that the road network
+//can be loaded from the database. Coordinates holds the segment's positions as a JSON array
+//of [lon, lat] pairs and Attributes holds any additional attributes as a JSON object.
+//The current fused surface type is kept with the segment, where SurfaceDistribution holds
+//the probabilities of every surface type as a JSON object. SurfaceModified is when the surface
+//was last changed and SurfaceConfirmed when it was last confirmed by a prediction, which is
+//earlier if it has decayed since. SurfaceSequence is incremented with every change of the
+//surface, so that replicas can tell stale updates from new ones.
 type RoadSegment struct {
 	gorm.Model
 	SegmentID              string `gorm:"unique"`
 	RoadID                 uint
+	Name                   string
+	RoadClass              string
+	Coordinates            string `gorm:"type:text"`
+	Attributes             string `gorm:"type:text"`
+	SurfaceType            string
+	SurfaceProbability     float64
+	SurfaceDistribution    string `gorm:"type:text"`
+	SurfaceModified        *time.Time
+	SurfaceConfirmed       *time.Time
+	SurfaceSequence        uint64
 	SurfaceTypePredictions []SurfaceTypePrediction
 }
 
-//SurfaceTypePrediction is a model for a temporary table until a better schema is designed
+//SurfaceTypePrediction is a model for a temporary table until a better schema is designed.
+//Source tells where the prediction came from, so that it can be weighted by trust, and
+//MessageID is the id of the command that it came from, so that redelivered commands are
+//only applied once. Message ids are unique, except for predictions that were not made from a
+//command and have none. ObservationID is the id of the observation that the prediction was
+//made from, if any, so that it can be retracted when the observation is deleted.
 type SurfaceTypePrediction struct {
 	gorm.Model
 	RoadSegmentID uint
 	SurfaceType   string
 	Probability   float64
+	Source        string
+	MessageID     string `gorm:"uniqueIndex:idx_surface_type_predictions_unique_message_id,where:message_id <> ''"`
+	ObservationID string `gorm:"index"`
 	Timestamp     time.Time
 }
 
-//RoadSurfaceObserved is a model for a temporary table until a better schema is designed
+//RoadSurfaceObserved is a model for a temporary table until a better schema is designed.
+//Observations are matched to the nearest road segment, whose row and id are kept in
+//RoadSegmentID and SegmentID. Both are empty if no segment was close enough. The ids of
+//observations are unique, and are not reused once an observation has been deleted.
 type RoadSurfaceObserved struct {
 	gorm.Model
 	RoadSegmentID         uint
-	RoadSurfaceObservedID string
+	SegmentID             string
+	RoadSurfaceObservedID string `gorm:"uniqueIndex"`
 	SurfaceType           string
 	Probability           float64
 	Latitude              float64
 	Longitude             float64
 	Timestamp             time.Time
 }
+
+//OutboxMessage is an event that has been stored together with the change that it describes,
+//but that has not yet been published. Attempts, LastError and NextAttempt keep track of
+//failed attempts to publish it, and rows are removed once they have been published.
+type OutboxMessage struct {
+	gorm.Model
+	Topic       string
+	ContentType string
+	Body        string `gorm:"type:text"`
+	Attempts    int
+	LastError   string
+	NextAttempt *time.Time `gorm:"index"`
+}
+
+//FailedMessage is a command or an event that failed to be handled. Kind is the content type
+//of a command or the topic of an event, and Body is the message as it was received. The
+//message is retried at NextAttempt until it is dead lettered, after which it is kept until
+//it is replayed or discarded. Owner is the instance that must handle the message, or empty
+//if any replica may handle it.
+type FailedMessage struct {
+	gorm.Model
+	Kind         string
+	Owner        string `gorm:"index;not null;default:''"`
+	Body         string `gorm:"type:text"`
+	Attempts     int
+	LastError    string     `gorm:"type:text"`
+	NextAttempt  *time.Time `gorm:"index"`
+	DeadLettered bool       `gorm:"index"`
+}
+
+//Subscription persists an NGSI-LD subscription as its JSON representation, together with
+//the delivery status of its notifications
+type Subscription struct {
+	gorm.Model
+	SubscriptionID   string `gorm:"unique"`
+	Body             string
+	IsActive         bool
+	TimesSent        uint64
+	LastNotification *time.Time
+	LastSuccess      *time.Time
+	LastFailure      *time.Time
+}
+
+//ServiceArea persists a named part of the service area. Geometry holds the area as a
+//GeoJSON Polygon or MultiPolygon.
+type ServiceArea struct {
+	gorm.Model
+	Name     string `gorm:"unique"`
+	Geometry string `gorm:"type:text"`
+}
@@ -0,0 +1,359 @@
+package servicearea
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/persistence"
+)
+
+//Area is a named part of the service area, such as a municipality
+type Area struct {
+	Name     string
+	Geometry geometry.MultiPolygon
+}
+
+//ServiceArea is made up of one or more areas within which observations are accepted and
+//the road network can be queried
+type ServiceArea struct {
+	areas []Area
+}
+
+//New returns a service area made up of the supplied areas
+func New(areas ...Area) *ServiceArea {
+	return &ServiceArea{areas: areas}
+}
+
+//Default returns the service area that was used before service areas could be configured,
+//which is a box around the municipality of Sundsvall
+func Default() *ServiceArea {
+	sw := geometry.NewPoint(62.042301, 15.516210)
+	ne := geometry.NewPoint(62.648987, 17.975816)
+
+	box := geometry.Polygon{[]geometry.Point{
+		sw, {Lat: sw.Lat, Lon: ne.Lon}, ne, {Lat: ne.Lat, Lon: sw.Lon}, sw,
+	}}
+
+	return New(Area{Name: "Sundsvall", Geometry: geometry.MultiPolygon{box}})
+}
+
+//Areas returns the areas that make up the service area
+func (sa *ServiceArea) Areas() []Area {
+	return sa.areas
+}
+
+//ContainsPoint returns true if the position lies within any of the areas
+func (sa *ServiceArea) ContainsPoint(lat, lon float64) bool {
+	pt := geometry.NewPoint(lat, lon)
+
+	for _, area := range sa.areas {
+		for _, polygon := range area.Geometry {
+			if polygon.ContainsPoint(pt) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//IsWithinDistanceFromPoint returns true if any part of the service area lies within
+//maxDistance meters from the position
+func (sa *ServiceArea) IsWithinDistanceFromPoint(lat, lon float64, maxDistance uint64) bool {
+	if sa.ContainsPoint(lat, lon) {
+		return true
+	}
+
+	pt := geometry.NewPoint(lat, lon)
+
+	for _, area := range sa.areas {
+		for _, polygon := range area.Geometry {
+			for _, ring := range polygon {
+				if geometry.DistanceToLineString(pt, ring) <= float64(maxDistance) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+//IntersectsLineString returns true if any part of the line string lies within the service area
+func (sa *ServiceArea) IntersectsLineString(line geometry.LineString) bool {
+	if len(line) == 1 {
+		return sa.ContainsPoint(line[0].Lat, line[0].Lon)
+	}
+
+	for _, area := range sa.areas {
+		if area.Geometry.IntersectsLineString(line) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//IntersectsGeometry returns true if the geometry shares any point with the service area
+func (sa *ServiceArea) IntersectsGeometry(g geometry.Geometry) bool {
+	switch shape := g.(type) {
+	case geometry.LineString:
+		return sa.IntersectsLineString(shape)
+	case geometry.Polygon:
+		return sa.intersectsPolygon(shape)
+	case geometry.MultiPolygon:
+		for _, polygon := range shape {
+			if sa.intersectsPolygon(polygon) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+//IntersectsRect returns true if the rect with the supplied corners overlaps the service area
+func (sa *ServiceArea) IntersectsRect(lat0, lon0, lat1, lon1 float64) bool {
+	return sa.intersectsPolygon(geometry.Polygon{[]geometry.Point{
+		{Lat: lat0, Lon: lon0}, {Lat: lat0, Lon: lon1}, {Lat: lat1, Lon: lon1}, {Lat: lat1, Lon: lon0}, {Lat: lat0, Lon: lon0},
+	}})
+}
+
+func (sa *ServiceArea) intersectsPolygon(polygon geometry.Polygon) bool {
+	if len(polygon) == 0 {
+		return false
+	}
+
+	// Either the exterior of the polygon lies within, or crosses, an area, or an area
+	// lies completely within the polygon
+	if sa.IntersectsLineString(polygon[0]) {
+		return true
+	}
+
+	for _, area := range sa.areas {
+		for _, p := range area.Geometry {
+			if len(p) > 0 && len(p[0]) > 0 && polygon.ContainsPoint(p[0][0]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type geoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   *geoJSONGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONObject struct {
+	geoJSONFeature
+	Coordinates json.RawMessage  `json:"coordinates"`
+	Features    []geoJSONFeature `json:"features"`
+}
+
+//Load reads a service area from a GeoJSON FeatureCollection or Feature, or from a bare
+//Polygon or MultiPolygon geometry. Each feature becomes an area, named by its name
+//property, and features with any other geometry are rejected.
+func Load(r io.Reader) (*ServiceArea, error) {
+	object := &geoJSONObject{}
+
+	err := json.NewDecoder(r).Decode(object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse GeoJSON: %s", err.Error())
+	}
+
+	features := object.Features
+
+	switch object.Type {
+	case "FeatureCollection":
+	case "Feature":
+		features = []geoJSONFeature{object.geoJSONFeature}
+	case "Polygon", "MultiPolygon":
+		features = []geoJSONFeature{{
+			Type:     "Feature",
+			Geometry: &geoJSONGeometry{Type: object.Type, Coordinates: object.Coordinates},
+		}}
+	default:
+		return nil, fmt.Errorf("expected a GeoJSON FeatureCollection, Feature, Polygon or MultiPolygon, but got %s", object.Type)
+	}
+
+	areas := []Area{}
+	names := map[string]bool{}
+
+	for idx, feature := range features {
+		name, _ := feature.Properties["name"].(string)
+		if name == "" {
+			name = strconv.Itoa(idx + 1)
+		}
+
+		if names[name] {
+			return nil, fmt.Errorf("more than one service area is named %s", name)
+		}
+		names[name] = true
+
+		if feature.Geometry == nil {
+			return nil, fmt.Errorf("service area %s has no geometry", name)
+		}
+
+		multiPolygon, err := parseGeometry(feature.Geometry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid geometry of service area %s: %s", name, err.Error())
+		}
+
+		areas = append(areas, Area{Name: name, Geometry: multiPolygon})
+	}
+
+	if len(areas) == 0 {
+		return nil, fmt.Errorf("a service area must consist of at least one polygon")
+	}
+
+	return New(areas...), nil
+}
+
+func parseGeometry(g *geoJSONGeometry) (geometry.MultiPolygon, error) {
+	var polygons [][][][]float64
+
+	switch g.Type {
+	case "Polygon":
+		var polygon [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &polygon); err != nil {
+			return nil, err
+		}
+		polygons = append(polygons, polygon)
+	case "MultiPolygon":
+		if err := json.Unmarshal(g.Coordinates, &polygons); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("expected a Polygon or MultiPolygon, but got %s", g.Type)
+	}
+
+	multiPolygon := geometry.MultiPolygon{}
+
+	for _, rings := range polygons {
+		polygon := geometry.Polygon{}
+
+		for _, ring := range rings {
+			points := make([]geometry.Point, 0, len(ring))
+			for _, pos := range ring {
+				if len(pos) < 2 {
+					return nil, fmt.Errorf("a position must consist of at least two numbers")
+				}
+				points = append(points, geometry.NewPoint(pos[1], pos[0]))
+			}
+
+			if len(points) < 4 || points[0] != points[len(points)-1] {
+				return nil, fmt.Errorf("a linear ring must consist of at least four positions, where the first and last are equal")
+			}
+
+			polygon = append(polygon, points)
+		}
+
+		if len(polygon) == 0 {
+			return nil, fmt.Errorf("a polygon must consist of at least one linear ring")
+		}
+
+		multiPolygon = append(multiPolygon, polygon)
+	}
+
+	return multiPolygon, nil
+}
+
+func newGeoJSONGeometry(mp geometry.MultiPolygon) (*geoJSONGeometry, error) {
+	polygons := make([][][][2]float64, 0, len(mp))
+
+	for _, polygon := range mp {
+		rings := make([][][2]float64, 0, len(polygon))
+		for _, ring := range polygon {
+			positions := make([][2]float64, 0, len(ring))
+			for _, pt := range ring {
+				positions = append(positions, [2]float64{pt.Lon, pt.Lat})
+			}
+			rings = append(rings, positions)
+		}
+		polygons = append(polygons, rings)
+	}
+
+	coordinates, err := json.Marshal(polygons)
+	if err != nil {
+		return nil, err
+	}
+
+	return &geoJSONGeometry{Type: "MultiPolygon", Coordinates: coordinates}, nil
+}
+
+//MarshalJSON returns the service area as a GeoJSON FeatureCollection, with one
+//MultiPolygon feature per area
+func (sa *ServiceArea) MarshalJSON() ([]byte, error) {
+	features := make([]geoJSONFeature, 0, len(sa.areas))
+
+	for _, area := range sa.areas {
+		g, err := newGeoJSONGeometry(area.Geometry)
+		if err != nil {
+			return nil, err
+		}
+
+		features = append(features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   g,
+			Properties: map[string]interface{}{"name": area.Name},
+		})
+	}
+
+	return json.Marshal(struct {
+		Type     string           `json:"type"`
+		Features []geoJSONFeature `json:"features"`
+	}{Type: "FeatureCollection", Features: features})
+}
+
+//NewFromRows returns the service area that has been stored in the database
+func NewFromRows(rows []persistence.ServiceArea) (*ServiceArea, error) {
+	areas := make([]Area, 0, len(rows))
+
+	for _, row := range rows {
+		g := &geoJSONGeometry{}
+		if err := json.Unmarshal([]byte(row.Geometry), g); err != nil {
+			return nil, fmt.Errorf("invalid geometry of service area %s: %s", row.Name, err.Error())
+		}
+
+		multiPolygon, err := parseGeometry(g)
+		if err != nil {
+			return nil, fmt.Errorf("invalid geometry of service area %s: %s", row.Name, err.Error())
+		}
+
+		areas = append(areas, Area{Name: row.Name, Geometry: multiPolygon})
+	}
+
+	return New(areas...), nil
+}
+
+//Rows returns the database representation of the areas that make up the service area
+func (sa *ServiceArea) Rows() ([]persistence.ServiceArea, error) {
+	rows := make([]persistence.ServiceArea, 0, len(sa.areas))
+
+	for _, area := range sa.areas {
+		g, err := newGeoJSONGeometry(area.Geometry)
+		if err != nil {
+			return nil, err
+		}
+
+		bytes, err := json.Marshal(g)
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, persistence.ServiceArea{Name: area.Name, Geometry: string(bytes)})
+	}
+
+	return rows, nil
+}
@@ -0,0 +1,136 @@
+package servicearea_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/servicearea"
+)
+
+// Two municipalities, where the first has a lake in the middle
+const twoAreas string = `{"type":"FeatureCollection","features":[
+	{"type":"Feature","properties":{"name":"West"},"geometry":{"type":"Polygon","coordinates":[
+		[[0,0],[3,0],[3,3],[0,3],[0,0]],
+		[[1,1],[2,1],[2,2],[1,2],[1,1]]]}},
+	{"type":"Feature","properties":{"name":"East"},"geometry":{"type":"MultiPolygon","coordinates":[
+		[[[10,0],[11,0],[11,1],[10,1],[10,0]]]]}}
+]}`
+
+func loadTwoAreas(t *testing.T) *servicearea.ServiceArea {
+	area, err := servicearea.Load(strings.NewReader(twoAreas))
+	if err != nil {
+		t.Fatalf("Failed to load service area: %s", err.Error())
+	}
+	return area
+}
+
+func TestLoadServiceArea(t *testing.T) {
+	area := loadTwoAreas(t)
+
+	areas := area.Areas()
+	if len(areas) != 2 || areas[0].Name != "West" || areas[1].Name != "East" {
+		t.Fatalf("Unexpected areas loaded: %v", areas)
+	}
+
+	if len(areas[0].Geometry) != 1 || len(areas[0].Geometry[0]) != 2 {
+		t.Errorf("Expected the first area to be a single polygon with a hole.")
+	}
+}
+
+func TestLoadBarePolygon(t *testing.T) {
+	area, err := servicearea.Load(strings.NewReader(`{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}`))
+	if err != nil {
+		t.Fatalf("Failed to load service area: %s", err.Error())
+	}
+
+	if !area.ContainsPoint(0.2, 0.8) {
+		t.Error("Expected the polygon to contain the point.")
+	}
+}
+
+func TestLoadInvalidServiceAreasFails(t *testing.T) {
+	for _, src := range []string{
+		`{"type":"LineString","coordinates":[[0,0],[1,1]]}`,
+		`{"type":"FeatureCollection","features":[]}`,
+		`{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1]]]}`,
+		`{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1]]]}`,
+		`{"type":"FeatureCollection","features":[
+			{"type":"Feature","properties":{"name":"A"},"geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}},
+			{"type":"Feature","properties":{"name":"A"},"geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}}]}`,
+	} {
+		if _, err := servicearea.Load(strings.NewReader(src)); err == nil {
+			t.Errorf("Expected loading %s to fail.", src)
+		}
+	}
+}
+
+func TestServiceAreaContainsPoint(t *testing.T) {
+	area := loadTwoAreas(t)
+
+	for _, tc := range []struct {
+		lat, lon float64
+		expected bool
+	}{
+		{0.5, 0.5, true},
+		{1.5, 1.5, false},
+		{0.5, 10.5, true},
+		{0.5, 5, false},
+	} {
+		if area.ContainsPoint(tc.lat, tc.lon) != tc.expected {
+			t.Errorf("Expected ContainsPoint(%f, %f) to be %v.", tc.lat, tc.lon, tc.expected)
+		}
+	}
+}
+
+func TestServiceAreaIntersections(t *testing.T) {
+	area := loadTwoAreas(t)
+
+	if !area.IsWithinDistanceFromPoint(0.5, 3.0001, 50) || area.IsWithinDistanceFromPoint(0.5, 5, 1000) {
+		t.Error("Unexpected result of distance checks against the service area.")
+	}
+
+	if !area.IntersectsRect(-1, -1, 4, 4) || !area.IntersectsRect(0.5, 10.5, 0.6, 10.6) || area.IntersectsRect(0, 5, 1, 6) {
+		t.Error("Unexpected result of rect checks against the service area.")
+	}
+
+	if !area.IntersectsGeometry(geometry.LineString{geometry.NewPoint(0.5, 5), geometry.NewPoint(0.5, 10.5)}) {
+		t.Error("Expected a line into the eastern area to intersect the service area.")
+	}
+
+	if area.IntersectsGeometry(geometry.LineString{geometry.NewPoint(1.4, 1.4), geometry.NewPoint(1.6, 1.6)}) {
+		t.Error("Expected a line within the lake to not intersect the service area.")
+	}
+}
+
+func TestServiceAreaRoundTrip(t *testing.T) {
+	area := loadTwoAreas(t)
+
+	rows, err := area.Rows()
+	if err != nil {
+		t.Fatalf("Failed to convert service area to rows: %s", err.Error())
+	}
+
+	restored, err := servicearea.NewFromRows(rows)
+	if err != nil {
+		t.Fatalf("Failed to restore service area from rows: %s", err.Error())
+	}
+
+	if len(restored.Areas()) != 2 || !restored.ContainsPoint(0.5, 10.5) || restored.ContainsPoint(1.5, 1.5) {
+		t.Errorf("Service area was not restored correctly: %v", restored.Areas())
+	}
+
+	bytes, _ := json.Marshal(restored)
+	fc := struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}{}
+	json.Unmarshal(bytes, &fc)
+
+	if fc.Type != "FeatureCollection" || len(fc.Features) != 2 || fc.Features[1].Properties["name"] != "East" {
+		t.Errorf("Unexpected GeoJSON representation of the service area: %s", string(bytes))
+	}
+}
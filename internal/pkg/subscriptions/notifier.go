@@ -0,0 +1,296 @@
+package subscriptions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/format"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/surfacetype"
+	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
+)
+
+//Notifier delivers notifications about changed entities to the endpoints of all
+//matching subscriptions
+type Notifier interface {
+	EntityChanged(entity ngsi.Entity, changedAttributes []string)
+}
+
+const (
+	defaultWorkerCount int           = 4
+	defaultQueueSize   int           = 1000
+	defaultMaxAttempts int           = 5
+	defaultRetryDelay  time.Duration = 2 * time.Second
+)
+
+type notifier struct {
+	db     database.Datastore
+	client *http.Client
+	queue  chan *notification
+
+	//vocabulary expands the surface types in the q filters of subscriptions
+	vocabulary *surfacetype.Vocabulary
+
+	//maxAttempts is the number of times that a notification is posted before giving up,
+	//with retryDelay before the first retry and twice as long before every following one
+	maxAttempts int
+	retryDelay  time.Duration
+
+	mu           sync.Mutex
+	lastNotified map[string]time.Time
+}
+
+type notification struct {
+	subscriptionID string
+	endpoint       Endpoint
+	body           []byte
+}
+
+//notificationBody is the NGSI-LD representation of a notification
+type notificationBody struct {
+	ID             string        `json:"id"`
+	Type           string        `json:"type"`
+	SubscriptionID string        `json:"subscriptionId"`
+	NotifiedAt     string        `json:"notifiedAt"`
+	Data           []ngsi.Entity `json:"data"`
+}
+
+//NewNotifier creates a notifier and starts the workers that deliver its notifications
+func NewNotifier(db database.Datastore, vocabulary *surfacetype.Vocabulary) Notifier {
+	return newNotifier(db, vocabulary, defaultWorkerCount, defaultMaxAttempts, defaultRetryDelay)
+}
+
+func newNotifier(db database.Datastore, vocabulary *surfacetype.Vocabulary, workers, maxAttempts int, retryDelay time.Duration) *notifier {
+	n := &notifier{
+		db:           db,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		queue:        make(chan *notification, defaultQueueSize),
+		vocabulary:   vocabulary,
+		maxAttempts:  maxAttempts,
+		retryDelay:   retryDelay,
+		lastNotified: map[string]time.Time{},
+	}
+
+	for i := 0; i < workers; i++ {
+		go n.deliverNotifications()
+	}
+
+	return n
+}
+
+//EntityChanged matches a changed entity against all active subscriptions and queues a
+//notification for each match. Notifications are delivered in the background, so a slow
+//or unreachable subscriber never holds up the caller.
+func (n *notifier) EntityChanged(entity ngsi.Entity, changedAttributes []string) {
+	attributes, err := format.ToMap(entity)
+	if err != nil {
+		log.Errorf("Failed to convert changed entity for notification: %s", err.Error())
+		return
+	}
+
+	id, _ := attributes["id"].(string)
+	typeName, _ := attributes["type"].(string)
+	location := entityLocation(attributes)
+
+	stored, err := n.db.GetSubscriptions()
+	if err != nil {
+		log.Errorf("Failed to load subscriptions: %s", err.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+
+	for idx := range stored {
+		subscription, err := FromPersistence(&stored[idx])
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+
+		if subscription.status(now) != "active" {
+			continue
+		}
+
+		m, err := newMatcher(subscription, n.vocabulary)
+		if err != nil {
+			log.Errorf("Ignoring invalid subscription %s: %s", subscription.ID, err.Error())
+			continue
+		}
+
+		if !m.matches(id, typeName, attributes, changedAttributes, location) {
+			continue
+		}
+
+		if !n.allowNotification(subscription, stored[idx].LastNotification, now) {
+			log.Infof("Throttling notification of %s to subscription %s.", id, subscription.ID)
+			continue
+		}
+
+		err = n.enqueue(subscription, entity, now)
+		if err != nil {
+			log.Errorf("Failed to queue notification to subscription %s: %s", subscription.ID, err.Error())
+		}
+	}
+}
+
+//allowNotification implements throttling by only allowing a notification if enough time
+//has passed since the previous one to the same subscription
+func (n *notifier) allowNotification(s *Subscription, lastNotification *time.Time, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	last, ok := n.lastNotified[s.ID]
+	if lastNotification != nil && (!ok || lastNotification.After(last)) {
+		last, ok = *lastNotification, true
+	}
+
+	throttling := time.Duration(s.Throttling * float64(time.Second))
+	if ok && throttling > 0 && now.Sub(last) < throttling {
+		return false
+	}
+
+	n.lastNotified[s.ID] = now
+	return true
+}
+
+func (n *notifier) enqueue(s *Subscription, entity ngsi.Entity, now time.Time) error {
+	keyValues := s.Notification.Format == formatKeyValues
+
+	data, err := format.Entity(entity, s.Notification.Attributes, keyValues)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(&notificationBody{
+		ID:             "urn:ngsi-ld:Notification:" + uuid.New().String(),
+		Type:           "Notification",
+		SubscriptionID: s.ID,
+		NotifiedAt:     now.Format(time.RFC3339),
+		Data:           []ngsi.Entity{data},
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case n.queue <- &notification{subscriptionID: s.ID, endpoint: s.Notification.Endpoint, body: body}:
+		return nil
+	default:
+		return fmt.Errorf("notification queue is full")
+	}
+}
+
+func (n *notifier) deliverNotifications() {
+	for notification := range n.queue {
+		success := n.deliver(notification)
+
+		err := n.db.SubscriptionNotified(notification.subscriptionID, success, time.Now())
+		if err != nil {
+			log.Errorf("Failed to store notification status of subscription %s: %s", notification.subscriptionID, err.Error())
+		}
+	}
+}
+
+//deliver posts a notification to its endpoint, retrying with an exponential backoff
+//for as long as the failure might be temporary
+func (n *notifier) deliver(notification *notification) bool {
+	delay := n.retryDelay
+
+	for attempt := 1; attempt <= n.maxAttempts; attempt++ {
+		retry, err := n.post(notification)
+		if err == nil {
+			return true
+		}
+
+		log.Warnf("Attempt %d to notify subscription %s failed: %s", attempt, notification.subscriptionID, err.Error())
+
+		if !retry || attempt == n.maxAttempts {
+			break
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	log.Errorf("Giving up on notification to subscription %s.", notification.subscriptionID)
+	return false
+}
+
+//post sends a notification once and returns an error if it was not accepted, together
+//with a flag telling if it is worth trying again
+func (n *notifier) post(notification *notification) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, notification.endpoint.URI, bytes.NewReader(notification.body))
+	if err != nil {
+		return false, err
+	}
+
+	contentType := notification.endpoint.Accept
+	if contentType == "" {
+		contentType = acceptJSON
+	}
+	req.Header.Add("Content-Type", contentType)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	// Server errors and rate limiting are usually temporary, anything else is not
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("endpoint %s responded with status code %d", notification.endpoint.URI, resp.StatusCode)
+}
+
+//entityLocation returns the location of an entity as a line string, where a Point is
+//represented by a single position
+func entityLocation(attributes map[string]interface{}) geometry.LineString {
+	location, ok := attributes["location"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	value, ok := location["value"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	positions := []interface{}{}
+
+	switch value["type"] {
+	case "Point":
+		positions = append(positions, value["coordinates"])
+	case "LineString":
+		positions, _ = value["coordinates"].([]interface{})
+	}
+
+	line := geometry.LineString{}
+
+	for _, p := range positions {
+		position, ok := p.([]interface{})
+		if !ok || len(position) < 2 {
+			return nil
+		}
+
+		lon, lonOK := position[0].(float64)
+		lat, latOK := position[1].(float64)
+		if !lonOK || !latOK {
+			return nil
+		}
+
+		line = append(line, geometry.NewPoint(lat, lon))
+	}
+
+	return line
+}
@@ -0,0 +1,154 @@
+package subscriptions
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/surfacetype"
+	"github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/datamodels/fiware"
+)
+
+const testSeedData string = "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852;62.389073;17.310854\n"
+
+//recorder is a subscriber endpoint that fails a configurable number of requests before
+//accepting any notifications
+type recorder struct {
+	mu            sync.Mutex
+	failuresLeft  int
+	notifications []map[string]interface{}
+	received      chan bool
+}
+
+func (rec *recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.failuresLeft > 0 {
+		rec.failuresLeft--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	n := map[string]interface{}{}
+	json.Unmarshal(body, &n)
+	rec.notifications = append(rec.notifications, n)
+
+	w.WriteHeader(http.StatusNoContent)
+	rec.received <- true
+}
+
+func (rec *recorder) count() int {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return len(rec.notifications)
+}
+
+func newTestNotifier(t *testing.T, failures int, subscription string) (*notifier, *recorder, database.Datastore, func()) {
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(testSeedData))
+	if err != nil {
+		t.Fatalf("Failed to create test datastore: %s", err.Error())
+	}
+
+	rec := &recorder{failuresLeft: failures, received: make(chan bool, 10)}
+	server := httptest.NewServer(rec)
+
+	s, err := NewSubscription([]byte(strings.ReplaceAll(subscription, "ENDPOINT", server.URL)))
+	if err != nil {
+		t.Fatalf("Failed to create subscription: %s", err.Error())
+	}
+
+	stored, _ := s.ToPersistence()
+	db.CreateSubscription(stored)
+
+	return newNotifier(db, surfacetype.Default(), 1, 3, 10*time.Millisecond), rec, db, server.Close
+}
+
+func snowySegment(db database.Datastore) *fiware.RoadSegment {
+	ts := time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)
+	rs, _ := db.GetRoadSegmentByID("21277:153930")
+	return fiware.NewRoadSegment(rs.ID(), rs.ID(), rs.RoadID(), rs.Coordinates(), &ts).WithSurfaceType("snow", 0.8)
+}
+
+func waitForNotification(t *testing.T, rec *recorder) {
+	select {
+	case <-rec.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a notification.")
+	}
+}
+
+func TestNotificationIsRetriedUntilDelivered(t *testing.T) {
+	n, rec, db, done := newTestNotifier(t, 2, `{
+		"type": "Subscription",
+		"entities": [{"type": "RoadSegment"}],
+		"watchedAttributes": ["surfaceType"],
+		"q": "surfaceType==\"snow\";surfaceType.probability>0.7",
+		"geoQ": {"georel": "near;maxDistance==100", "geometry": "Point", "coordinates": [17.310863,62.389109]},
+		"notification": {"attributes": ["surfaceType"], "format": "keyValues", "endpoint": {"uri": "ENDPOINT"}}
+	}`)
+	defer done()
+
+	n.EntityChanged(snowySegment(db), []string{"surfaceType"})
+	waitForNotification(t, rec)
+
+	rec.mu.Lock()
+	data := rec.notifications[0]["data"].([]interface{})[0].(map[string]interface{})
+	rec.mu.Unlock()
+
+	if data["surfaceType"] != "snow" || data["location"] != nil {
+		t.Errorf("Unexpected notification data: %v", data)
+	}
+
+	// The status is stored after the notification has been delivered
+	time.Sleep(100 * time.Millisecond)
+
+	subscriptions, _ := db.GetSubscriptions()
+	if subscriptions[0].TimesSent != 1 || subscriptions[0].LastSuccess == nil {
+		t.Errorf("Expected the successful notification to be recorded: %v", subscriptions[0])
+	}
+}
+
+func TestNotificationsAreFiltered(t *testing.T) {
+	n, rec, db, done := newTestNotifier(t, 0, `{
+		"type": "Subscription",
+		"entities": [{"type": "RoadSegment", "idPattern": ".*:21277:.*"}],
+		"q": "surfaceType==\"ice\"",
+		"notification": {"endpoint": {"uri": "ENDPOINT"}}
+	}`)
+	defer done()
+
+	n.EntityChanged(snowySegment(db), []string{"surfaceType"})
+	time.Sleep(100 * time.Millisecond)
+
+	if rec.count() != 0 {
+		t.Error("Expected no notification for a segment that does not match the q filter.")
+	}
+}
+
+func TestNotificationsAreThrottled(t *testing.T) {
+	n, rec, db, done := newTestNotifier(t, 0, `{
+		"type": "Subscription",
+		"entities": [{"type": "RoadSegment"}],
+		"throttling": 60,
+		"notification": {"endpoint": {"uri": "ENDPOINT"}}
+	}`)
+	defer done()
+
+	n.EntityChanged(snowySegment(db), []string{"surfaceType"})
+	waitForNotification(t, rec)
+
+	n.EntityChanged(snowySegment(db), []string{"surfaceType"})
+	time.Sleep(100 * time.Millisecond)
+
+	if rec.count() != 1 {
+		t.Errorf("Expected the second notification to be throttled, but got %d notifications.", rec.count())
+	}
+}
@@ -0,0 +1,369 @@
+package subscriptions
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/query"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/geometry"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/persistence"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/surfacetype"
+)
+
+//SubscriptionIDPrefix is the prefix of the identities of all subscriptions
+const SubscriptionIDPrefix string = "urn:ngsi-ld:Subscription:"
+
+//Subscription is the NGSI-LD representation of a subscription to changes of entities
+type Subscription struct {
+	ID                string        `json:"id"`
+	Type              string        `json:"type"`
+	Name              string        `json:"subscriptionName,omitempty"`
+	Description       string        `json:"description,omitempty"`
+	Entities          []EntityInfo  `json:"entities,omitempty"`
+	WatchedAttributes []string      `json:"watchedAttributes,omitempty"`
+	Q                 string        `json:"q,omitempty"`
+	GeoQ              *GeoQuery     `json:"geoQ,omitempty"`
+	IsActive          *bool         `json:"isActive,omitempty"`
+	Notification      Notification  `json:"notification"`
+	ExpiresAt         string        `json:"expiresAt,omitempty"`
+	Throttling        float64       `json:"throttling,omitempty"`
+	Status            string        `json:"status,omitempty"`
+	Context           []interface{} `json:"@context,omitempty"`
+}
+
+//EntityInfo selects the entities that a subscription is interested in, by type and
+//optionally by id or id pattern
+type EntityInfo struct {
+	ID        string `json:"id,omitempty"`
+	IDPattern string `json:"idPattern,omitempty"`
+	Type      string `json:"type"`
+}
+
+//GeoQuery limits a subscription to entities with a location that matches the query.
+//Coordinates may be given either as a JSON array or as a string containing one.
+type GeoQuery struct {
+	Geometry    string          `json:"geometry"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	GeoRel      string          `json:"georel"`
+}
+
+//Notification describes what to notify and where to send it
+type Notification struct {
+	Attributes []string `json:"attributes,omitempty"`
+	Format     string   `json:"format,omitempty"`
+	Endpoint   Endpoint `json:"endpoint"`
+
+	//The following members are maintained by the broker and ignored in requests
+	Status           string `json:"status,omitempty"`
+	TimesSent        uint64 `json:"timesSent,omitempty"`
+	LastNotification string `json:"lastNotification,omitempty"`
+	LastFailure      string `json:"lastFailure,omitempty"`
+	LastSuccess      string `json:"lastSuccess,omitempty"`
+}
+
+//Endpoint is the HTTP endpoint that notifications are posted to
+type Endpoint struct {
+	URI    string `json:"uri"`
+	Accept string `json:"accept,omitempty"`
+}
+
+const (
+	formatNormalized string = "normalized"
+	formatKeyValues  string = "keyValues"
+
+	acceptJSON   string = "application/json"
+	acceptJSONLD string = "application/ld+json"
+)
+
+//NewSubscription parses and validates the body of a request to create a subscription.
+//An identity is generated for the subscription unless the request supplies one.
+func NewSubscription(body []byte) (*Subscription, error) {
+	s := &Subscription{}
+
+	err := json.Unmarshal(body, s)
+	if err != nil {
+		return nil, query.NewBadRequestDataError("unable to parse subscription: %s", err.Error())
+	}
+
+	if s.ID == "" {
+		s.ID = SubscriptionIDPrefix + uuid.New().String()
+	}
+
+	err = s.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+//FromPersistence restores a subscription and its notification status from the database
+func FromPersistence(p *persistence.Subscription) (*Subscription, error) {
+	s := &Subscription{}
+
+	err := json.Unmarshal([]byte(p.Body), s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal stored subscription %s: %s", p.SubscriptionID, err.Error())
+	}
+
+	active := p.IsActive
+	s.IsActive = &active
+	s.Status = s.status(time.Now())
+
+	s.Notification.TimesSent = p.TimesSent
+	s.Notification.LastNotification = formatTime(p.LastNotification)
+	s.Notification.LastSuccess = formatTime(p.LastSuccess)
+	s.Notification.LastFailure = formatTime(p.LastFailure)
+
+	if p.TimesSent > 0 {
+		s.Notification.Status = "ok"
+		if p.LastFailure != nil && (p.LastSuccess == nil || p.LastFailure.After(*p.LastSuccess)) {
+			s.Notification.Status = "failed"
+		}
+	}
+
+	return s, nil
+}
+
+//ToPersistence returns the database model of a subscription, without any status members
+func (s *Subscription) ToPersistence() (*persistence.Subscription, error) {
+	stored := *s
+	stored.Status = ""
+	stored.Notification.Status = ""
+	stored.Notification.TimesSent = 0
+	stored.Notification.LastNotification = ""
+	stored.Notification.LastSuccess = ""
+	stored.Notification.LastFailure = ""
+
+	body, err := json.Marshal(&stored)
+	if err != nil {
+		return nil, err
+	}
+
+	return &persistence.Subscription{
+		SubscriptionID: s.ID,
+		Body:           string(body),
+		IsActive:       s.Active(),
+	}, nil
+}
+
+//Patch applies the members of a partial subscription to this one and validates the result.
+//The identity of a subscription can not be changed.
+func (s *Subscription) Patch(body []byte) error {
+	patched := *s
+
+	err := json.Unmarshal(body, &patched)
+	if err != nil {
+		return query.NewBadRequestDataError("unable to parse subscription fragment: %s", err.Error())
+	}
+
+	if patched.ID != s.ID {
+		return query.NewBadRequestDataError("the id of a subscription can not be changed")
+	}
+
+	err = patched.Validate()
+	if err != nil {
+		return err
+	}
+
+	*s = patched
+	return nil
+}
+
+//Active returns true unless the subscription has been paused
+func (s *Subscription) Active() bool {
+	return s.IsActive == nil || *s.IsActive
+}
+
+func (s *Subscription) status(now time.Time) string {
+	if !s.Active() {
+		return "paused"
+	}
+
+	if expires, err := time.Parse(time.RFC3339, s.ExpiresAt); err == nil && !now.Before(expires) {
+		return "expired"
+	}
+
+	return "active"
+}
+
+//Validate returns an error if the subscription is incomplete or contains a filter
+//that can not be parsed
+func (s *Subscription) Validate() error {
+	if s.Type != "Subscription" {
+		return query.NewBadRequestDataError("the type of a subscription must be Subscription")
+	}
+
+	if !strings.HasPrefix(s.ID, "urn:") {
+		return query.NewBadRequestDataError("the id of a subscription must be a URN")
+	}
+
+	if len(s.Entities) == 0 && len(s.WatchedAttributes) == 0 {
+		return query.NewBadRequestDataError("a subscription must specify entities, watchedAttributes or both")
+	}
+
+	if s.ExpiresAt != "" {
+		if _, err := time.Parse(time.RFC3339, s.ExpiresAt); err != nil {
+			return query.NewBadRequestDataError("unable to parse expiresAt %s as an RFC3339 date time", s.ExpiresAt)
+		}
+	}
+
+	if s.Throttling < 0 {
+		return query.NewBadRequestDataError("throttling must be a non negative number of seconds")
+	}
+
+	endpoint, err := url.Parse(s.Notification.Endpoint.URI)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return query.NewBadRequestDataError("the notification endpoint must be an absolute http or https URI")
+	}
+
+	if accept := s.Notification.Endpoint.Accept; accept != "" && accept != acceptJSON && accept != acceptJSONLD {
+		return query.NewBadRequestDataError("the notification endpoint must accept %s or %s", acceptJSON, acceptJSONLD)
+	}
+
+	if f := s.Notification.Format; f != "" && f != formatNormalized && f != formatKeyValues {
+		return query.NewBadRequestDataError("the notification format must be %s or %s", formatNormalized, formatKeyValues)
+	}
+
+	_, err = newMatcher(s, nil)
+	return err
+}
+
+//matcher is a subscription with its filters parsed and ready for use
+type matcher struct {
+	subscription *Subscription
+	idPatterns   []*regexp.Regexp
+	filter       query.Filter
+	geoQuery     *query.GeoQuery
+}
+
+//newMatcher parses the filters of a subscription. Surface types in the q filter are
+//expanded with the vocabulary, unless it is nil.
+func newMatcher(s *Subscription, vocabulary *surfacetype.Vocabulary) (*matcher, error) {
+	m := &matcher{subscription: s}
+
+	for _, info := range s.Entities {
+		if info.Type == "" {
+			return nil, query.NewBadRequestDataError("every entity selector must specify a type")
+		}
+
+		var pattern *regexp.Regexp
+		if info.IDPattern != "" {
+			var err error
+			pattern, err = regexp.Compile(info.IDPattern)
+			if err != nil {
+				return nil, query.NewBadRequestDataError("invalid idPattern %s", info.IDPattern)
+			}
+		}
+		m.idPatterns = append(m.idPatterns, pattern)
+	}
+
+	if s.Q != "" {
+		var err error
+		m.filter, err = query.NewFilter(s.Q)
+		if err != nil {
+			return nil, err
+		}
+
+		if vocabulary != nil {
+			m.filter, err = query.ExpandValues(m.filter, "surfaceType", vocabulary.Expand)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if s.GeoQ != nil {
+		coordinates := string(s.GeoQ.Coordinates)
+
+		var quoted string
+		if json.Unmarshal(s.GeoQ.Coordinates, &quoted) == nil {
+			coordinates = quoted
+		}
+
+		var err error
+		m.geoQuery, err = query.NewGeoQueryFromParameters(query.Parameters{
+			"georel":      {s.GeoQ.GeoRel},
+			"geometry":    {s.GeoQ.Geometry},
+			"coordinates": {coordinates},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if m.geoQuery == nil {
+			return nil, query.NewBadRequestDataError("a geoQ must specify a georel")
+		}
+	}
+
+	return m, nil
+}
+
+//matches returns true if a change of an entity should be notified to the subscriber
+func (m *matcher) matches(id, typeName string, attributes map[string]interface{}, changedAttributes []string, location geometry.LineString) bool {
+	s := m.subscription
+
+	if len(s.Entities) > 0 {
+		selected := false
+
+		for idx, info := range s.Entities {
+			if info.Type != typeName {
+				continue
+			}
+
+			if info.ID != "" && info.ID != id {
+				continue
+			}
+
+			if m.idPatterns[idx] != nil && !m.idPatterns[idx].MatchString(id) {
+				continue
+			}
+
+			selected = true
+			break
+		}
+
+		if !selected {
+			return false
+		}
+	}
+
+	if len(s.WatchedAttributes) > 0 && !containsAny(s.WatchedAttributes, changedAttributes) {
+		return false
+	}
+
+	if m.filter != nil && !m.filter.Matches(query.NewEntityTarget(attributes)) {
+		return false
+	}
+
+	if m.geoQuery != nil && (len(location) == 0 || !m.geoQuery.MatchesLineString(location)) {
+		return false
+	}
+
+	return true
+}
+
+func containsAny(values []string, candidates []string) bool {
+	for _, v := range values {
+		for _, c := range candidates {
+			if v == c {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,188 @@
+package surfacetype
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+//Type is a surface type of the vocabulary, with the other names that it is known by and
+//the broader type that it belongs to, if any
+type Type struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases,omitempty"`
+	Parent  string   `json:"parent,omitempty"`
+}
+
+//Vocabulary is the set of surface types that observations and updates may use. Every
+//type has a canonical name, which is what is stored and returned, and may have aliases
+//that are accepted in its place. Types may be grouped under broader types, such that a
+//query for slippery surfaces also matches ice and snow.
+type Vocabulary struct {
+	types     []Type
+	canonical map[string]string
+	children  map[string][]string
+}
+
+//defaultTypes are the types that are used unless a vocabulary is configured
+var defaultTypes = []Type{
+	{Name: "dry"},
+	{Name: "wet"},
+	{Name: "tarmac", Aliases: []string{"asphalt"}},
+	{Name: "cobblestone", Aliases: []string{"cobblestones", "sett"}},
+	{Name: "gravel"},
+	{Name: "grass"},
+	{Name: "slippery"},
+	{Name: "ice", Aliases: []string{"icy", "black_ice"}, Parent: "slippery"},
+	{Name: "frost", Parent: "slippery"},
+	{Name: "slush", Parent: "slippery"},
+	{Name: "snow", Aliases: []string{"snowy"}, Parent: "slippery"},
+	{Name: "packed_snow", Aliases: []string{"snow_packed"}, Parent: "snow"},
+	{Name: "unknown"},
+}
+
+//Default returns the built in vocabulary
+func Default() *Vocabulary {
+	v, err := New(defaultTypes...)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+//New returns a vocabulary made up of the supplied types. An error is returned if a name
+//or alias is used more than once, or if a parent is unknown or part of a cycle.
+func New(types ...Type) (*Vocabulary, error) {
+	v := &Vocabulary{
+		canonical: map[string]string{},
+		children:  map[string][]string{},
+	}
+
+	for _, t := range types {
+		t.Name = normalize(t.Name)
+		t.Parent = normalize(t.Parent)
+
+		if t.Name == "" {
+			return nil, fmt.Errorf("every surface type must have a name")
+		}
+
+		for _, name := range append([]string{t.Name}, t.Aliases...) {
+			name = normalize(name)
+			if existing, ok := v.canonical[name]; ok {
+				return nil, fmt.Errorf("the name %s is used by both %s and %s", name, existing, t.Name)
+			}
+			v.canonical[name] = t.Name
+		}
+
+		v.types = append(v.types, t)
+	}
+
+	parents := map[string]string{}
+
+	for _, t := range v.types {
+		if t.Parent == "" {
+			continue
+		}
+
+		parent, ok := v.canonical[t.Parent]
+		if !ok || parent != t.Parent {
+			return nil, fmt.Errorf("the parent %s of surface type %s is not a known surface type", t.Parent, t.Name)
+		}
+
+		parents[t.Name] = parent
+		v.children[parent] = append(v.children[parent], t.Name)
+	}
+
+	for _, t := range v.types {
+		seen := map[string]bool{t.Name: true}
+		for p := parents[t.Name]; p != ""; p = parents[p] {
+			if seen[p] {
+				return nil, fmt.Errorf("the surface type %s is part of a cycle of parents", t.Name)
+			}
+			seen[p] = true
+		}
+	}
+
+	return v, nil
+}
+
+//Load reads a vocabulary from a JSON document such as
+//{"surfaceTypes":[{"name":"ice","aliases":["black_ice"],"parent":"slippery"}, ...]}
+func Load(r io.Reader) (*Vocabulary, error) {
+	doc := struct {
+		SurfaceTypes []Type `json:"surfaceTypes"`
+	}{}
+
+	err := json.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse surface types: %s", err.Error())
+	}
+
+	if len(doc.SurfaceTypes) == 0 {
+		return nil, fmt.Errorf("a vocabulary must contain at least one surface type")
+	}
+
+	return New(doc.SurfaceTypes...)
+}
+
+//normalize makes names case insensitive and lets spaces and dashes stand in for underscores
+func normalize(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+}
+
+//Types returns the types of the vocabulary in the order they were defined
+func (v *Vocabulary) Types() []Type {
+	return v.types
+}
+
+//Canonical returns the canonical name of a surface type or any of its aliases
+func (v *Vocabulary) Canonical(name string) (string, error) {
+	canonical, ok := v.canonical[normalize(name)]
+	if !ok {
+		return "", fmt.Errorf("%q is not a known surface type", name)
+	}
+
+	return canonical, nil
+}
+
+//Expand returns the canonical name of a surface type, followed by the names of every
+//type below it in the hierarchy
+func (v *Vocabulary) Expand(name string) ([]string, error) {
+	canonical, err := v.Canonical(name)
+	if err != nil {
+		return nil, err
+	}
+
+	expanded := []string{canonical}
+	for idx := 0; idx < len(expanded); idx++ {
+		children := append([]string{}, v.children[expanded[idx]]...)
+		sort.Strings(children)
+		expanded = append(expanded, children...)
+	}
+
+	return expanded, nil
+}
+
+//IsA returns true if a surface type is the same as, or lies below, another type
+func (v *Vocabulary) IsA(name, other string) bool {
+	canonical, err := v.Canonical(name)
+	if err != nil {
+		return false
+	}
+
+	expanded, err := v.Expand(other)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range expanded {
+		if t == canonical {
+			return true
+		}
+	}
+
+	return false
+}
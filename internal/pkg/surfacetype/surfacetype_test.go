@@ -0,0 +1,71 @@
+package surfacetype_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/surfacetype"
+)
+
+func TestCanonicalNames(t *testing.T) {
+	v := surfacetype.Default()
+
+	for name, expected := range map[string]string{
+		"snow":        "snow",
+		"Asphalt":     "tarmac",
+		"snow_packed": "packed_snow",
+		"Snow-Packed": "packed_snow",
+		" black ice ": "ice",
+	} {
+		canonical, err := v.Canonical(name)
+		if err != nil || canonical != expected {
+			t.Errorf("Expected %q to be known as %s, but got %q (%v).", name, expected, canonical, err)
+		}
+	}
+
+	if _, err := v.Canonical("lava"); err == nil {
+		t.Error("Expected an unknown surface type to be rejected.")
+	}
+}
+
+func TestHierarchy(t *testing.T) {
+	v := surfacetype.Default()
+
+	expanded, err := v.Expand("slippery")
+	if err != nil || strings.Join(expanded, ",") != "slippery,frost,ice,slush,snow,packed_snow" {
+		t.Errorf("Unexpected expansion of slippery: %v (%v)", expanded, err)
+	}
+
+	if !v.IsA("snow_packed", "slippery") || !v.IsA("icy", "ice") || v.IsA("tarmac", "slippery") || v.IsA("slippery", "ice") {
+		t.Error("Unexpected result of hierarchy checks.")
+	}
+}
+
+func TestLoadVocabulary(t *testing.T) {
+	v, err := surfacetype.Load(strings.NewReader(`{"surfaceTypes":[
+		{"name":"paved"},
+		{"name":"concrete","parent":"paved"},
+		{"name":"asphalt","aliases":["tarmac"],"parent":"paved"}]}`))
+	if err != nil {
+		t.Fatalf("Failed to load vocabulary: %s", err.Error())
+	}
+
+	if canonical, _ := v.Canonical("tarmac"); canonical != "asphalt" || !v.IsA("concrete", "paved") || len(v.Types()) != 3 {
+		t.Error("The loaded vocabulary did not behave as expected.")
+	}
+}
+
+func TestInvalidVocabulariesAreRejected(t *testing.T) {
+	for _, src := range []string{
+		`{"surfaceTypes":[]}`,
+		`{"surfaceTypes":[{"name":""}]}`,
+		`{"surfaceTypes":[{"name":"ice"},{"name":"snow","aliases":["ice"]}]}`,
+		`{"surfaceTypes":[{"name":"ice","parent":"slippery"}]}`,
+		`{"surfaceTypes":[{"name":"ice","aliases":["black_ice"]},{"name":"snow","parent":"black_ice"}]}`,
+		`{"surfaceTypes":[{"name":"a","parent":"b"},{"name":"b","parent":"a"}]}`,
+	} {
+		if _, err := surfacetype.Load(strings.NewReader(src)); err == nil {
+			t.Errorf("Expected loading %s to fail.", src)
+		}
+	}
+}
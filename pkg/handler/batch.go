@@ -0,0 +1,216 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	fiwarecontext "github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/context"
+	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
+	ngsierrors "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+//BatchContextSource is an interface that context sources can implement to support batch
+//operations on their entities
+type BatchContextSource interface {
+	CreateEntities(entities []fiwarecontext.BatchEntity, upsert bool) *fiwarecontext.BatchOperationResult
+	UpdateEntities(entities []fiwarecontext.BatchEntity) *fiwarecontext.BatchOperationResult
+	DeleteEntities(entityIDs []string) *fiwarecontext.BatchOperationResult
+}
+
+func (router *RequestRouter) addBatchHandlers(contextRegistry ngsi.ContextRegistry) {
+	router.Post("/ngsi-ld/v1/entityOperations/create", newBatchCreateHandler(contextRegistry, false))
+	router.Post("/ngsi-ld/v1/entityOperations/upsert", newBatchCreateHandler(contextRegistry, true))
+	router.Post("/ngsi-ld/v1/entityOperations/update", newBatchUpdateHandler(contextRegistry))
+	router.Post("/ngsi-ld/v1/entityOperations/delete", newBatchDeleteHandler(contextRegistry))
+}
+
+//newBatchCreateHandler handles POST requests to create, or upsert, a batch of entities. The
+//ids of the created entities are returned if every entity succeeds, and a result with the
+//errors of each entity that failed otherwise.
+func newBatchCreateHandler(ctxReg ngsi.ContextRegistry, upsert bool) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entities, err := decodeBatchEntities(r)
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		result := forEachBatchSource(ctxReg, entities, func(source BatchContextSource, entities []fiwarecontext.BatchEntity) *fiwarecontext.BatchOperationResult {
+			return source.CreateEntities(entities, upsert)
+		})
+
+		if len(result.Errors) > 0 {
+			writeBatchOperationResult(w, result)
+			return
+		}
+
+		if upsert && len(result.Created) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		created := result.Success
+		if upsert {
+			created = result.Created
+		}
+
+		bytes, err := json.MarshalIndent(created, "", "  ")
+		if err != nil {
+			ngsierrors.ReportNewInternalError(w, "Failed to encode response.")
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json;charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(bytes)
+	})
+}
+
+//newBatchUpdateHandler handles POST requests to update the attributes of a batch of entities
+func newBatchUpdateHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entities, err := decodeBatchEntities(r)
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		result := forEachBatchSource(ctxReg, entities, func(source BatchContextSource, entities []fiwarecontext.BatchEntity) *fiwarecontext.BatchOperationResult {
+			return source.UpdateEntities(entities)
+		})
+
+		writeBatchOperationResult(w, result)
+	})
+}
+
+//newBatchDeleteHandler handles POST requests to delete a batch of entities by their ids
+func newBatchDeleteHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, "Failed to read request body.")
+			return
+		}
+
+		entityIDs := []string{}
+		err = json.Unmarshal(body, &entityIDs)
+		if err != nil || len(entityIDs) == 0 {
+			ngsierrors.ReportNewBadRequestData(w, "The request body MUST be a non empty array of entity ids.")
+			return
+		}
+
+		result := fiwarecontext.NewBatchOperationResult()
+		batches := map[BatchContextSource][]string{}
+		sources := []BatchContextSource{}
+
+		for _, entityID := range entityIDs {
+			source := batchSourceFor(ctxReg.GetContextSourcesForEntity(entityID))
+			if source == nil {
+				result.Fail(entityID, fmt.Errorf("no context source provides the entity %s", entityID))
+				continue
+			}
+
+			if _, ok := batches[source]; !ok {
+				sources = append(sources, source)
+			}
+			batches[source] = append(batches[source], entityID)
+		}
+
+		for _, source := range sources {
+			result.Merge(source.DeleteEntities(batches[source]))
+		}
+
+		writeBatchOperationResult(w, result)
+	})
+}
+
+//decodeBatchEntities reads the entities of a batch operation, which MUST be a non empty array
+//of objects that each have a type
+func decodeBatchEntities(r *http.Request) ([]fiwarecontext.BatchEntity, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body")
+	}
+
+	objects := []json.RawMessage{}
+	err = json.Unmarshal(body, &objects)
+	if err != nil || len(objects) == 0 {
+		return nil, fmt.Errorf("the request body MUST be a non empty array of entities")
+	}
+
+	entities := make([]fiwarecontext.BatchEntity, 0, len(objects))
+
+	for idx, object := range objects {
+		header := struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		}{}
+
+		err = json.Unmarshal(object, &header)
+		if err != nil || header.Type == "" {
+			return nil, fmt.Errorf("the entity at index %d MUST be an object with a type", idx)
+		}
+
+		entities = append(entities, fiwarecontext.BatchEntity{Type: header.Type, ID: header.ID, Body: object})
+	}
+
+	return entities, nil
+}
+
+//forEachBatchSource groups the entities of a batch by the context source that provides their
+//type, passes each group to its source and merges the results
+func forEachBatchSource(ctxReg ngsi.ContextRegistry, entities []fiwarecontext.BatchEntity, operation func(BatchContextSource, []fiwarecontext.BatchEntity) *fiwarecontext.BatchOperationResult) *fiwarecontext.BatchOperationResult {
+	result := fiwarecontext.NewBatchOperationResult()
+	batches := map[BatchContextSource][]fiwarecontext.BatchEntity{}
+	sources := []BatchContextSource{}
+
+	for _, entity := range entities {
+		source := batchSourceFor(ctxReg.GetContextSourcesForEntityType(entity.Type))
+		if source == nil {
+			result.Fail(entity.ID, fmt.Errorf("no context source provides entities of type %s", entity.Type))
+			continue
+		}
+
+		if _, ok := batches[source]; !ok {
+			sources = append(sources, source)
+		}
+		batches[source] = append(batches[source], entity)
+	}
+
+	for _, source := range sources {
+		result.Merge(operation(source, batches[source]))
+	}
+
+	return result
+}
+
+func batchSourceFor(contextSources []ngsi.ContextSource) BatchContextSource {
+	for _, source := range contextSources {
+		if batchSource, ok := source.(BatchContextSource); ok {
+			return batchSource
+		}
+	}
+
+	return nil
+}
+
+//writeBatchOperationResult responds with 204 No Content if every entity of a batch succeeded,
+//and with 207 Multi-Status and the result of each entity if any of them failed
+func writeBatchOperationResult(w http.ResponseWriter, result *fiwarecontext.BatchOperationResult) {
+	if len(result.Errors) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	bytes, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		ngsierrors.ReportNewInternalError(w, "Failed to encode response.")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write(bytes)
+}
@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/persistence"
+	ngsierrors "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+//DeadLetterQueue is an interface that allows the admin endpoints to inspect, replay and
+//discard the messages that failed to be handled
+type DeadLetterQueue interface {
+	List() ([]persistence.FailedMessage, error)
+	Get(id uint) (*persistence.FailedMessage, error)
+	Replay(id uint) error
+	Discard(id uint) error
+}
+
+func (router *RequestRouter) addDeadLetterHandlers(deadLetters DeadLetterQueue) {
+	router.Get("/admin/deadletters", newQueryDeadLettersHandler(deadLetters))
+	router.Get("/admin/deadletters/{message}", newRetrieveDeadLetterHandler(deadLetters))
+	router.Post("/admin/deadletters/{message}/replay", newReplayDeadLetterHandler(deadLetters))
+	router.Delete("/admin/deadletters/{message}", newDiscardDeadLetterHandler(deadLetters))
+}
+
+//deadLetter is the representation of a dead lettered message. The body is included as is if
+//it is valid JSON, and as a string otherwise.
+type deadLetter struct {
+	ID        uint            `json:"id"`
+	Kind      string          `json:"kind"`
+	Body      json.RawMessage `json:"body"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"lastError"`
+	FailedAt  string          `json:"failedAt"`
+}
+
+func newDeadLetter(m *persistence.FailedMessage) *deadLetter {
+	body := json.RawMessage(m.Body)
+	if !json.Valid(body) {
+		body, _ = json.Marshal(m.Body)
+	}
+
+	return &deadLetter{
+		ID:        m.ID,
+		Kind:      m.Kind,
+		Body:      body,
+		Attempts:  m.Attempts,
+		LastError: m.LastError,
+		FailedAt:  m.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+//newQueryDeadLettersHandler handles GET requests for all dead lettered messages
+func newQueryDeadLettersHandler(deadLetters DeadLetterQueue) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		messages, err := deadLetters.List()
+		if err != nil {
+			ngsierrors.ReportNewInternalError(w, "Failed to load dead letters.")
+			return
+		}
+
+		result := []*deadLetter{}
+		for idx := range messages {
+			result = append(result, newDeadLetter(&messages[idx]))
+		}
+
+		writeDeadLetterResponse(w, result)
+	})
+}
+
+//newRetrieveDeadLetterHandler handles GET requests for a single dead lettered message
+func newRetrieveDeadLetterHandler(deadLetters DeadLetterQueue) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := deadLetterID(r)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		message, err := deadLetters.Get(id)
+		if err != nil {
+			reportDeadLetterError(w, err)
+			return
+		}
+
+		writeDeadLetterResponse(w, newDeadLetter(message))
+	})
+}
+
+//newReplayDeadLetterHandler handles POST requests to handle a dead lettered message once more
+func newReplayDeadLetterHandler(deadLetters DeadLetterQueue) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := deadLetterID(r)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		err = deadLetters.Replay(id)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			ngsierrors.ReportNewInternalError(w, "The message failed again: "+err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+//newDiscardDeadLetterHandler handles DELETE requests for dead lettered messages
+func newDiscardDeadLetterHandler(deadLetters DeadLetterQueue) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := deadLetterID(r)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		err = deadLetters.Discard(id)
+		if err != nil {
+			reportDeadLetterError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func deadLetterID(r *http.Request) (uint, error) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "message"), 10, 64)
+	return uint(id), err
+}
+
+func reportDeadLetterError(w http.ResponseWriter, err error) {
+	if errors.Is(err, database.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ngsierrors.ReportNewInternalError(w, "An internal error was encountered when accessing the dead letters.")
+}
+
+func writeDeadLetterResponse(w http.ResponseWriter, response interface{}) {
+	bytes, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		ngsierrors.ReportNewInternalError(w, "Failed to encode response.")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json;charset=utf-8")
+	w.Write(bytes)
+}
@@ -0,0 +1,276 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/format"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/query"
+	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
+	ngsierrors "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+//newQueryEntitiesHandler handles GET requests for NGSI entities. It replaces the handler in
+//the ngsi-ld library, since that one only supports near and rect shaped within queries.
+func newQueryEntitiesHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, err := query.NewQueryFromRequest(r)
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		if q.Parameters().Get("type") == "" && q.Parameters().Get("attrs") == "" {
+			ngsierrors.ReportNewBadRequestData(
+				w,
+				"A request for entities MUST specify at least one of type or attrs.",
+			)
+			return
+		}
+
+		contextSources := ctxReg.GetContextSourcesForQuery(q)
+
+		var entities = []ngsi.Entity{}
+		var entityCount = uint64(0)
+		var entityMaxCount = q.PaginationLimit()
+
+		for _, source := range contextSources {
+			err = source.GetEntities(q, func(entity ngsi.Entity) error {
+				if entityCount < entityMaxCount {
+					entities = append(entities, entity)
+					entityCount++
+				}
+				return nil
+			})
+			if err != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			reportQueryError(w, err)
+			return
+		}
+
+		geoJSON := format.WantsGeoJSON(r)
+
+		mediaType := "application/ld+json"
+		if geoJSON {
+			mediaType = format.GeoJSONContentType
+		}
+
+		addPaginationHeaders(w, r, q.Pagination(), mediaType)
+
+		if geoJSON {
+			writeGeoJSONResponse(w, r, entities)
+			return
+		}
+
+		bytes, err := json.MarshalIndent(entities, "", "  ")
+		if err != nil {
+			ngsierrors.ReportNewInternalError(w, "Failed to encode response.")
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json;charset=utf-8")
+		w.Write(bytes)
+	})
+}
+
+//addPaginationHeaders tells the client where the next page of results is, in the same media
+//type as the current page, and the total number of results if it asked for it
+func addPaginationHeaders(w http.ResponseWriter, r *http.Request, pagination *query.Pagination, mediaType string) {
+	if pagination.Count {
+		w.Header().Add("NGSILD-Results-Count", strconv.FormatUint(pagination.ResultsCount(), 10))
+	}
+
+	if pagination.HasNext() {
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"next\"; type=\"%s\"", pagination.NextURL(r.URL), mediaType))
+	}
+}
+
+//newRetrieveEntityHandler handles GET requests for a single entity. It replaces the handler
+//in the ngsi-ld library, so that the entity can be returned as GeoJSON.
+func newRetrieveEntityHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entityID := chi.URLParam(r, "entity")
+		geoJSON := format.WantsGeoJSON(r)
+
+		request := r
+		if geoJSON {
+			// Retrieve the complete entity and leave attrs to the GeoJSON conversion
+			request = r.Clone(r.Context())
+			request.URL.RawQuery = ""
+		}
+
+		var entity ngsi.Entity
+		var err error
+
+		for _, source := range ctxReg.GetContextSourcesForEntity(entityID) {
+			entity, err = source.RetrieveEntity(entityID, &requestWrapper{request: request})
+			if err != nil {
+				reportQueryError(w, err)
+				return
+			}
+			break
+		}
+
+		if entity == nil {
+			reportResourceNotFound(w, fmt.Sprintf("The entity %s was not found.", entityID))
+			return
+		}
+
+		if geoJSON {
+			writeGeoJSONResponse(w, r, []ngsi.Entity{entity})
+			return
+		}
+
+		bytes, err := json.Marshal(entity)
+		if err != nil {
+			ngsierrors.ReportNewInternalError(w, "Failed to encode response.")
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json;charset=utf-8")
+		w.Write(bytes)
+	})
+}
+
+func writeGeoJSONResponse(w http.ResponseWriter, r *http.Request, entities []ngsi.Entity) {
+	fc, err := format.NewFeatureCollectionFromRequest(entities, r)
+	if err != nil {
+		ngsierrors.ReportNewInternalError(w, "Failed to convert entities to GeoJSON.")
+		return
+	}
+
+	bytes, err := json.MarshalIndent(fc, "", "  ")
+	if err != nil {
+		ngsierrors.ReportNewInternalError(w, "Failed to encode response.")
+		return
+	}
+
+	w.Header().Add("Content-Type", format.GeoJSONContentType+";charset=utf-8")
+	w.Write(bytes)
+}
+
+//DeletionContextSource is an interface that context sources can implement to allow their
+//entities, or attributes of them, to be deleted
+type DeletionContextSource interface {
+	DeleteEntity(entityID string) error
+	DeleteEntityAttribute(entityID, attribute string, deleteAll bool) error
+}
+
+//newDeleteEntityHandler handles DELETE requests for NGSI entities
+func newDeleteEntityHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entityID := chi.URLParam(r, "entity")
+
+		withDeletionSource(w, ctxReg, entityID, func(source DeletionContextSource) error {
+			return source.DeleteEntity(entityID)
+		})
+	})
+}
+
+//newDeleteEntityAttributeHandler handles DELETE requests for attributes of NGSI entities. All
+//instances of the attribute are deleted if deleteAll is true.
+func newDeleteEntityAttributeHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entityID := chi.URLParam(r, "entity")
+		attribute := chi.URLParam(r, "attr")
+		deleteAll := r.URL.Query().Get("deleteAll") == "true"
+
+		withDeletionSource(w, ctxReg, entityID, func(source DeletionContextSource) error {
+			return source.DeleteEntityAttribute(entityID, attribute, deleteAll)
+		})
+	})
+}
+
+//withDeletionSource passes the context source that provides an entity to a deletion, and
+//responds with 204 No Content if it succeeds or 404 Not Found if there is nothing to delete
+func withDeletionSource(w http.ResponseWriter, ctxReg ngsi.ContextRegistry, entityID string, deletion func(DeletionContextSource) error) {
+	for _, source := range ctxReg.GetContextSourcesForEntity(entityID) {
+		deletionSource, ok := source.(DeletionContextSource)
+		if !ok {
+			continue
+		}
+
+		err := deletion(deletionSource)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				reportResourceNotFound(w, fmt.Sprintf("Nothing to delete was found for the entity %s.", entityID))
+				return
+			}
+
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	reportResourceNotFound(w, fmt.Sprintf("The entity %s was not found.", entityID))
+}
+
+//reportResourceNotFound reports something that does not exist as a ResourceNotFound problem.
+//The ngsi-ld library has no such problem, and responds with 400 Bad Request to those it has.
+func reportResourceNotFound(w http.ResponseWriter, detail string) {
+	bytes, _ := json.MarshalIndent(struct {
+		Type   string `json:"type"`
+		Title  string `json:"title"`
+		Detail string `json:"detail"`
+	}{
+		Type:   "https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound",
+		Title:  "Resource Not Found",
+		Detail: detail,
+	}, "", "  ")
+
+	w.Header().Add("Content-Type", ngsierrors.ProblemReportContentType)
+	w.Header().Add("Content-Language", "en")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write(bytes)
+}
+
+//requestWrapper implements ngsi.Request for the handlers that replace those in the
+//ngsi-ld library
+type requestWrapper struct {
+	request *http.Request
+}
+
+func (rw *requestWrapper) Request() *http.Request {
+	return rw.request
+}
+
+func (rw *requestWrapper) BodyReader() io.Reader {
+	// Request bodies can only be read once, so keep a copy for any following reads
+	buf, _ := ioutil.ReadAll(rw.request.Body)
+	rw.request.Body = ioutil.NopCloser(bytes.NewBuffer(buf))
+	return bytes.NewReader(buf)
+}
+
+func (rw *requestWrapper) DecodeBodyInto(v interface{}) error {
+	return json.NewDecoder(rw.BodyReader()).Decode(v)
+}
+
+//reportQueryError reports errors caused by the client's query as BadRequestData and
+//anything else as an InternalError
+func reportQueryError(w http.ResponseWriter, err error) {
+	var badRequest *query.BadRequestDataError
+	if errors.As(err, &badRequest) {
+		ngsierrors.ReportNewBadRequestData(w, badRequest.Error())
+		return
+	}
+
+	ngsierrors.ReportNewInternalError(
+		w,
+		"An internal error was encountered when trying to get entities from the context source.",
+	)
+}
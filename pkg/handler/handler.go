@@ -9,6 +9,7 @@ import (
 	"github.com/go-chi/chi/middleware"
 	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
 	fiwarecontext "github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/context"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/servicearea"
 	"github.com/iot-for-tillgenglighet/messaging-golang/pkg/messaging"
 	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
 
@@ -23,9 +24,15 @@ type RequestRouter struct {
 }
 
 func (router *RequestRouter) addNGSIHandlers(contextRegistry ngsi.ContextRegistry) {
-	router.Get("/ngsi-ld/v1/entities", ngsi.NewQueryEntitiesHandler(contextRegistry))
+	router.Get("/ngsi-ld/v1/entities", newQueryEntitiesHandler(contextRegistry))
 	router.Post("/ngsi-ld/v1/entities", ngsi.NewCreateEntityHandler(contextRegistry))
+	router.Get("/ngsi-ld/v1/entities/{entity}", newRetrieveEntityHandler(contextRegistry))
 	router.Patch("/ngsi-ld/v1/entities/{entity}/attrs/", ngsi.NewUpdateEntityAttributesHandler(contextRegistry))
+	router.Delete("/ngsi-ld/v1/entities/{entity}", newDeleteEntityHandler(contextRegistry))
+	router.Delete("/ngsi-ld/v1/entities/{entity}/attrs/{attr}", newDeleteEntityAttributeHandler(contextRegistry))
+
+	router.Get("/ngsi-ld/v1/temporal/entities", newQueryTemporalEntitiesHandler(contextRegistry))
+	router.Get("/ngsi-ld/v1/temporal/entities/{entity}", newRetrieveTemporalEntityHandler(contextRegistry))
 }
 
 func (router *RequestRouter) addProbeHandlers() {
@@ -34,6 +41,10 @@ func (router *RequestRouter) addProbeHandlers() {
 	})
 }
 
+func (router *RequestRouter) Delete(pattern string, handlerFn http.HandlerFunc) {
+	router.impl.Delete(pattern, handlerFn)
+}
+
 func (router *RequestRouter) Patch(pattern string, handlerFn http.HandlerFunc) {
 	router.impl.Patch(pattern, handlerFn)
 }
@@ -56,18 +67,32 @@ func newRequestRouter() *RequestRouter {
 	}).Handler)
 
 	// Enable gzip compression for ngsi-ld responses
-	compressor := middleware.NewCompressor(flate.DefaultCompression, "application/json", "application/ld+json")
+	compressor := middleware.NewCompressor(flate.DefaultCompression, "application/json", "application/ld+json", "application/geo+json")
 	router.impl.Use(compressor.Handler)
 	router.impl.Use(middleware.Logger)
 
 	return router
 }
 
-func createRequestRouter(contextRegistry ngsi.ContextRegistry) *RequestRouter {
+func createRequestRouter(contextRegistry ngsi.ContextRegistry, db database.Datastore, area *servicearea.ServiceArea) *RequestRouter {
 	router := newRequestRouter()
 
 	router.addProbeHandlers()
 	router.addNGSIHandlers(contextRegistry)
+	router.addBatchHandlers(contextRegistry)
+	router.addSubscriptionHandlers(db)
+	router.addServiceAreaHandlers(area)
+
+	return router
+}
+
+//createAdminRouter creates a router for the endpoints that are only meant for operators, which
+//is served on a port of its own so that it is not exposed together with the NGSI-LD API
+func createAdminRouter(deadLetters DeadLetterQueue) *RequestRouter {
+	router := &RequestRouter{impl: chi.NewRouter()}
+	router.impl.Use(middleware.Logger)
+
+	router.addDeadLetterHandlers(deadLetters)
 
 	return router
 }
@@ -79,13 +104,29 @@ type MessagingContext interface {
 }
 
 //CreateRouterAndStartServing creates a request router, registers all handlers and starts serving requests.
-func CreateRouterAndStartServing(messenger MessagingContext, db database.Datastore) {
+//Observations, geo-queries and updates are restricted to the service area, and the options are
+//passed on to the context source. Messages that failed to be handled can be inspected, replayed
+//and discarded through the dead letter endpoints, which are served on the admin port.
+func CreateRouterAndStartServing(messenger MessagingContext, db database.Datastore, area *servicearea.ServiceArea, deadLetters DeadLetterQueue, options ...fiwarecontext.SourceOption) {
 
 	contextRegistry := ngsi.NewContextRegistry()
-	ctxSource := fiwarecontext.CreateSource(db, messenger)
+	ctxSource := fiwarecontext.CreateSource(db, messenger, append(options, fiwarecontext.WithServiceArea(area))...)
 	contextRegistry.Register(ctxSource)
 
-	router := createRequestRouter(contextRegistry)
+	router := createRequestRouter(contextRegistry, db, area)
+
+	if deadLetters != nil {
+		adminPort := os.Getenv("TRANSPORTATION_ADMIN_PORT")
+		if adminPort == "" {
+			adminPort = "8485"
+		}
+
+		log.Printf("Starting the admin endpoints of api-transportation on port %s.\n", adminPort)
+
+		go func() {
+			log.Fatal(http.ListenAndServe(":"+adminPort, createAdminRouter(deadLetters).impl))
+		}()
+	}
 
 	port := os.Getenv("TRANSPORTATION_API_PORT")
 	if port == "" {
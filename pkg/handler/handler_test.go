@@ -0,0 +1,1098 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/decay"
+	fiwarecontext "github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/context"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fusion"
+	intmsg "github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/messaging"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/messaging/commands"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/servicearea"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/surfacetype"
+	"github.com/iot-for-tillgenglighet/messaging-golang/pkg/messaging"
+	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
+	"github.com/streadway/amqp"
+)
+
+type messengerMock struct {
+	commands []messaging.CommandMessage
+	messages []messaging.TopicMessage
+}
+
+func (m *messengerMock) PublishOnTopic(message messaging.TopicMessage) error {
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+func (m *messengerMock) NoteToSelf(command messaging.CommandMessage) error {
+	m.commands = append(m.commands, command)
+	return nil
+}
+
+const testSeedData string = "21277:153930;21277:153930;62.389109;17.310863;62.389084;17.310852;62.389073;17.310854\n" +
+	"21277:153930;21277:153931;62.389073;17.310854;62.389059;17.310878;62.389057;17.310897\n"
+
+func newTestRouter(t *testing.T) (*RequestRouter, database.Datastore, *messengerMock) {
+	return newTestRouterWithOptions(t)
+}
+
+func newTestRouterWithOptions(t *testing.T, options ...fiwarecontext.SourceOption) (*RequestRouter, database.Datastore, *messengerMock) {
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(testSeedData))
+	if err != nil {
+		t.Fatalf("Failed to create test datastore: %s", err.Error())
+	}
+
+	messenger := &messengerMock{}
+
+	area := servicearea.Default()
+
+	contextRegistry := ngsi.NewContextRegistry()
+	contextRegistry.Register(fiwarecontext.CreateSource(db, messenger, append(options, fiwarecontext.WithServiceArea(area))...))
+
+	return createRequestRouter(contextRegistry, db, area), db, messenger
+}
+
+func testRequest(router *RequestRouter, method, path string, body io.Reader) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, body)
+	w := httptest.NewRecorder()
+	router.impl.ServeHTTP(w, req)
+	return w
+}
+
+func TestRetrieveRoadSegment(t *testing.T) {
+	router, _, _ := newTestRouter(t)
+
+	w := testRequest(router, "GET", "/ngsi-ld/v1/entities/urn:ngsi-ld:RoadSegment:21277:153931", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected response code %d when retrieving a road segment.", w.Code)
+	}
+
+	segment := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &segment)
+
+	if segment["id"] != "urn:ngsi-ld:RoadSegment:21277:153931" || segment["location"] == nil {
+		t.Errorf("Unexpected road segment returned: %s", w.Body.String())
+	}
+}
+
+func TestRetrieveRoadWithKeyValuesAndAttrs(t *testing.T) {
+	router, _, _ := newTestRouter(t)
+
+	w := testRequest(router, "GET", "/ngsi-ld/v1/entities/urn:ngsi-ld:Road:21277:153930?attrs=refRoadSegment&options=keyValues", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected response code %d when retrieving a road.", w.Code)
+	}
+
+	road := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &road)
+
+	if _, ok := road["name"]; ok {
+		t.Error("Attributes that were not requested should not be returned.")
+	}
+
+	segments, ok := road["refRoadSegment"].([]interface{})
+	if !ok || len(segments) != 2 {
+		t.Errorf("Expected refRoadSegment to be simplified into a list of two segment ids: %s", w.Body.String())
+	}
+}
+
+func TestRetrieveRoadSegmentWithSurfaceTypeDistribution(t *testing.T) {
+	router, db, _ := newTestRouter(t)
+
+	db.RoadSegmentSurfaceUpdated("21277:153931", database.SurfaceUpdate{Distribution: fusion.Distribution{"snow": 0.6, "slush": 0.3}, Timestamp: time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)})
+
+	w := testRequest(router, "GET", "/ngsi-ld/v1/entities/urn:ngsi-ld:RoadSegment:21277:153931", nil)
+	if strings.Contains(w.Body.String(), "surfaceTypeDistribution") {
+		t.Error("The surface type distribution should only be returned when asked for.")
+	}
+
+	w = testRequest(router, "GET", "/ngsi-ld/v1/entities/urn:ngsi-ld:RoadSegment:21277:153931?attrs=surfaceType,surfaceTypeDistribution&options=keyValues", nil)
+
+	segment := struct {
+		SurfaceType  string             `json:"surfaceType"`
+		Distribution map[string]float64 `json:"surfaceTypeDistribution"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &segment)
+
+	if segment.SurfaceType != "snow" || segment.Distribution["slush"] != 0.3 || len(segment.Distribution) != 2 {
+		t.Errorf("Unexpected road segment returned: %s", w.Body.String())
+	}
+}
+
+func TestStaleSurfaceTypesDecayAtQueryTime(t *testing.T) {
+	rules, _ := decay.Default(surfacetype.Default())
+	router, db, _ := newTestRouterWithOptions(t, fiwarecontext.WithDecayRules(rules))
+
+	db.RoadSegmentSurfaceUpdated("21277:153930", database.SurfaceUpdate{Distribution: fusion.Distribution{"snow": 0.8}, Timestamp: time.Now().Add(-6 * time.Hour)})
+	db.RoadSegmentSurfaceUpdated("21277:153931", database.SurfaceUpdate{Distribution: fusion.Distribution{"snow": 0.8}, Timestamp: time.Date(2021, 3, 10, 6, 0, 0, 0, time.UTC)})
+
+	entities := getEntities(t, router, "/ngsi-ld/v1/entities?type=RoadSegment&q=surfaceType==%22snow%22&options=keyValues", http.StatusOK)
+	if len(entities) != 1 || entities[0]["id"] != "urn:ngsi-ld:RoadSegment:21277:153930" {
+		t.Fatalf("Expected only the recently updated segment to still be covered by snow: %v", entities)
+	}
+
+	w := testRequest(router, "GET", "/ngsi-ld/v1/entities/urn:ngsi-ld:RoadSegment:21277:153931?options=keyValues", nil)
+
+	segment := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &segment)
+
+	if segment["surfaceType"] != "unknown" {
+		t.Errorf("Expected the snow from last March to have expired: %s", w.Body.String())
+	}
+}
+
+func TestRetrieveUnknownEntitiesReturnsNotFound(t *testing.T) {
+	router, _, _ := newTestRouter(t)
+
+	for _, id := range []string{
+		"urn:ngsi-ld:Road:nosuchroad",
+		"urn:ngsi-ld:RoadSegment:nosuchsegment",
+		"urn:ngsi-ld:RoadSurfaceObserved:nosuchobservation",
+		"urn:ngsi-ld:Beach:notoneofours",
+	} {
+		w := testRequest(router, "GET", "/ngsi-ld/v1/entities/"+id, nil)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Unexpected response code %d when retrieving %s.", w.Code, id)
+		}
+		expectResourceNotFound(t, w)
+	}
+}
+
+func expectResourceNotFound(t *testing.T, w *httptest.ResponseRecorder) {
+	problem := struct {
+		Type string `json:"type"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &problem)
+
+	if w.Header().Get("Content-Type") != "application/problem+json" || problem.Type != "https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound" {
+		t.Errorf("Expected a ResourceNotFound problem, but got %s: %s", w.Header().Get("Content-Type"), w.Body.String())
+	}
+}
+
+//unavailableDatastore fails every lookup of roads and segments
+type unavailableDatastore struct {
+	database.Datastore
+}
+
+func (db *unavailableDatastore) GetRoadByID(id string) (database.Road, error) {
+	return nil, errors.New("the database is unreachable")
+}
+
+func (db *unavailableDatastore) GetRoadSegmentByID(id string) (database.RoadSegment, error) {
+	return nil, errors.New("the database is unreachable")
+}
+
+func TestRetrieveEntitiesFromUnavailableDatastoreIsNotNotFound(t *testing.T) {
+	_, db, messenger := newTestRouter(t)
+
+	contextRegistry := ngsi.NewContextRegistry()
+	contextRegistry.Register(fiwarecontext.CreateSource(&unavailableDatastore{Datastore: db}, messenger))
+	router := createRequestRouter(contextRegistry, db, servicearea.Default())
+
+	for _, id := range []string{"urn:ngsi-ld:Road:21277:153930", "urn:ngsi-ld:RoadSegment:21277:153930"} {
+		w := testRequest(router, "GET", "/ngsi-ld/v1/entities/"+id, nil)
+		if w.Code == http.StatusNotFound || w.Code == http.StatusOK {
+			t.Errorf("Expected a failure to retrieve %s to be reported as an error, but got %d.", id, w.Code)
+		}
+	}
+}
+
+func TestRetrieveRoadSurfaceObserved(t *testing.T) {
+	router, db, _ := newTestRouter(t)
+
+	body := `{"id":"urn:ngsi-ld:RoadSurfaceObserved:ignored","type":"RoadSurfaceObserved",
+		"surfaceType":{"type":"Property","value":"snow","probability":0.75},
+		"location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[17.310863,62.389109]}}}`
+
+	w := testRequest(router, "POST", "/ngsi-ld/v1/entities", strings.NewReader(body))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Unexpected response code %d when creating a road surface observation.", w.Code)
+	}
+
+	observations, _ := db.GetRoadSurfacesObserved()
+	if len(observations) != 1 {
+		t.Fatalf("Expected exactly one road surface observation in the datastore.")
+	}
+
+	id := "urn:ngsi-ld:RoadSurfaceObserved:" + observations[0].RoadSurfaceObservedID
+
+	w = testRequest(router, "GET", "/ngsi-ld/v1/entities/"+id+"?options=keyValues", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected response code %d when retrieving %s.", w.Code, id)
+	}
+
+	observation := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &observation)
+
+	if observation["id"] != id || observation["surfaceType"] != "snow" {
+		t.Errorf("Unexpected road surface observation returned: %s", w.Body.String())
+	}
+}
+
+func TestRoadSurfaceObservedIsMatchedToNearestSegment(t *testing.T) {
+	router, db, messenger := newTestRouter(t)
+
+	observe := func(lon, lat float64) {
+		body := fmt.Sprintf(`{"id":"urn:ngsi-ld:RoadSurfaceObserved:ignored","type":"RoadSurfaceObserved",
+			"surfaceType":{"type":"Property","value":"snow","probability":0.75},
+			"location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[%f,%f]}}}`, lon, lat)
+
+		w := testRequest(router, "POST", "/ngsi-ld/v1/entities", strings.NewReader(body))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Unexpected response code %d when creating a road surface observation.", w.Code)
+		}
+	}
+
+	// A few meters from the second segment, and more than a kilometer from both
+	observe(17.310890, 62.389050)
+	observe(17.340000, 62.389050)
+
+	observations, _ := db.GetRoadSurfacesObserved()
+	if len(observations) != 2 {
+		t.Fatalf("Expected two road surface observations in the datastore, but found %d.", len(observations))
+	}
+
+	if observations[0].SegmentID != "21277:153931" || observations[0].RoadSegmentID == 0 {
+		t.Errorf("Expected the first observation to be matched to segment 21277:153931, but got %q", observations[0].SegmentID)
+	}
+
+	if observations[1].SegmentID != "" || observations[1].RoadSegmentID != 0 {
+		t.Errorf("Did not expect the second observation to be matched to a segment, but got %q", observations[1].SegmentID)
+	}
+
+	if len(messenger.commands) != 1 {
+		t.Fatalf("Expected one command to update the matched segment, but got %d", len(messenger.commands))
+	}
+
+	cmd, ok := messenger.commands[0].(*commands.UpdateRoadSegmentSurface)
+	if !ok || cmd.ID != "21277:153931" || cmd.SurfaceType != "snow" || cmd.Probability != 0.75 {
+		t.Errorf("Unexpected command %+v", messenger.commands[0])
+	}
+
+	id := "urn:ngsi-ld:RoadSurfaceObserved:" + observations[0].RoadSurfaceObservedID
+	w := testRequest(router, "GET", "/ngsi-ld/v1/entities/"+id, nil)
+	if !strings.Contains(w.Body.String(), `"refRoadSegment"`) || !strings.Contains(w.Body.String(), "urn:ngsi-ld:RoadSegment:21277:153931") {
+		t.Errorf("Expected the observation to refer to its road segment: %s", w.Body.String())
+	}
+}
+
+func getEntities(t *testing.T, router *RequestRouter, path string, expectedCode int) []map[string]interface{} {
+	w := testRequest(router, "GET", path, nil)
+	if w.Code != expectedCode {
+		t.Fatalf("Unexpected response code %d != %d for %s: %s", w.Code, expectedCode, path, w.Body.String())
+	}
+
+	entities := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &entities)
+	return entities
+}
+
+func TestSurfaceTypesAreValidatedAgainstVocabulary(t *testing.T) {
+	router, db, messenger := newTestRouter(t)
+
+	observation := `{"id":"urn:ngsi-ld:RoadSurfaceObserved:ignored","type":"RoadSurfaceObserved",
+		"surfaceType":{"type":"Property","value":"%s","probability":0.75},
+		"location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[17.310863,62.389109]}}}`
+
+	w := testRequest(router, "POST", "/ngsi-ld/v1/entities", strings.NewReader(fmt.Sprintf(observation, "Asphalt")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Unexpected response code %d when creating an observation with an alias.", w.Code)
+	}
+
+	w = testRequest(router, "POST", "/ngsi-ld/v1/entities", strings.NewReader(fmt.Sprintf(observation, "lava")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected response code %d when creating an observation with an unknown surface type.", w.Code)
+	}
+
+	observations, _ := db.GetRoadSurfacesObserved()
+	if len(observations) != 1 || observations[0].SurfaceType != "tarmac" {
+		t.Fatalf("Expected a single observation stored with the canonical surface type: %v", observations)
+	}
+
+	patch := `{"surfaceType":{"type":"Property","value":"%s","probability":0.9}}`
+	path := "/ngsi-ld/v1/entities/urn:ngsi-ld:RoadSegment:21277:153930/attrs/"
+
+	w = testRequest(router, "PATCH", path, strings.NewReader(fmt.Sprintf(patch, "snow_packed")))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Unexpected response code %d when updating a segment with an alias.", w.Code)
+	}
+
+	w = testRequest(router, "PATCH", path, strings.NewReader(fmt.Sprintf(patch, "lava")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected response code %d when updating a segment with an unknown surface type.", w.Code)
+	}
+
+	last := messenger.commands[len(messenger.commands)-1].(*commands.UpdateRoadSegmentSurface)
+	if len(messenger.commands) != 2 || last.SurfaceType != "packed_snow" {
+		t.Errorf("Expected the update to be sent with the canonical surface type, but got %v.", messenger.commands)
+	}
+}
+
+func TestQuerySegmentsNearPoint(t *testing.T) {
+	router, _, _ := newTestRouter(t)
+
+	entities := getEntities(t, router, "/ngsi-ld/v1/entities?type=RoadSegment&georel=near;maxDistance==2&geometry=Point&coordinates=[17.310863,62.389109]", http.StatusOK)
+	if len(entities) != 1 {
+		t.Errorf("Expected one segment near the point, but got %d.", len(entities))
+	}
+}
+
+func TestQuerySegmentsWithinLegacyRect(t *testing.T) {
+	router, _, _ := newTestRouter(t)
+
+	entities := getEntities(t, router, "/ngsi-ld/v1/entities?type=RoadSegment&georel=within&geometry=Polygon&coordinates=[[17.30,62.39],[17.32,62.38],[17.32,62.38]]", http.StatusOK)
+	if len(entities) != 2 {
+		t.Errorf("Expected two segments within the rect, but got %d.", len(entities))
+	}
+}
+
+func TestQuerySegmentsWithPolygons(t *testing.T) {
+	router, _, _ := newTestRouter(t)
+
+	// A rect that contains the first, but only parts of the second segment
+	rect := "[[[17.31084,62.38906],[17.31088,62.38906],[17.31088,62.38912],[17.31084,62.38912],[17.31084,62.38906]]]"
+
+	testCases := []struct {
+		georel   string
+		expected int
+	}{
+		{"within", 1},
+		{"intersects", 2},
+		{"overlaps", 1},
+		{"disjoint", 0},
+	}
+
+	for _, tc := range testCases {
+		path := "/ngsi-ld/v1/entities?type=RoadSegment&georel=" + tc.georel + "&geometry=Polygon&coordinates=" + rect
+		entities := getEntities(t, router, path, http.StatusOK)
+		if len(entities) != tc.expected {
+			t.Errorf("Expected %d segments for georel %s, but got %d.", tc.expected, tc.georel, len(entities))
+		}
+	}
+}
+
+func TestQueryRoadsIntersectingLineString(t *testing.T) {
+	router, _, _ := newTestRouter(t)
+
+	entities := getEntities(t, router, "/ngsi-ld/v1/entities?type=Road&georel=intersects&geometry=LineString&coordinates=[[17.31086,62.38900],[17.31086,62.38915]]", http.StatusOK)
+	if len(entities) != 1 {
+		t.Errorf("Expected one road to intersect the line string, but got %d.", len(entities))
+	}
+}
+
+func TestUnsupportedGeoQueriesAreBadRequests(t *testing.T) {
+	router, _, _ := newTestRouter(t)
+
+	for _, params := range []string{
+		"georel=within&geometry=LineString&coordinates=[[17.3108,62.3890],[17.3110,62.3891]]",
+		"georel=equals&geometry=Polygon&coordinates=[[[17.31,62.3895],[17.3109,62.3890],[17.3108,62.3890],[17.31,62.3895]]]",
+		"georel=near;minDistance==10&geometry=Point&coordinates=[17.310852,62.389084]",
+		"georel=intersects&geometry=Polygon&coordinates=[[[17.31,62.3895],[17.3109,62.3890],[17.3108,62.3890]]]",
+	} {
+		w := testRequest(router, "GET", "/ngsi-ld/v1/entities?type=RoadSegment&"+params, nil)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "BadRequestData") {
+			t.Errorf("Expected a BadRequestData response for %s, but got %d.", params, w.Code)
+		}
+	}
+}
+
+func newTestRouterWithServiceArea(t *testing.T, geoJSON string) (*RequestRouter, database.Datastore, *messengerMock) {
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(testSeedData))
+	if err != nil {
+		t.Fatalf("Failed to create test datastore: %s", err.Error())
+	}
+
+	area, err := servicearea.Load(strings.NewReader(geoJSON))
+	if err != nil {
+		t.Fatalf("Failed to load service area: %s", err.Error())
+	}
+
+	messenger := &messengerMock{}
+
+	contextRegistry := ngsi.NewContextRegistry()
+	contextRegistry.Register(fiwarecontext.CreateSource(db, messenger, fiwarecontext.WithServiceArea(area)))
+
+	return createRequestRouter(contextRegistry, db, area), db, messenger
+}
+
+// A service area in Timrå, just north of the test segments in Sundsvall
+const timraServiceArea string = `{"type":"Feature","properties":{"name":"Timrå"},"geometry":{"type":"Polygon",
+	"coordinates":[[[17.0,62.45],[17.5,62.45],[17.5,62.6],[17.0,62.6],[17.0,62.45]]]}}`
+
+func TestRetrieveServiceArea(t *testing.T) {
+	router, _, _ := newTestRouterWithServiceArea(t, timraServiceArea)
+
+	w := testRequest(router, "GET", "/servicearea", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected response code %d when retrieving the service area.", w.Code)
+	}
+
+	fc := struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &fc)
+
+	if fc.Type != "FeatureCollection" || len(fc.Features) != 1 || fc.Features[0].Properties["name"] != "Timrå" {
+		t.Errorf("Unexpected service area returned: %s", w.Body.String())
+	}
+}
+
+func TestRequestsOutsideOfServiceAreaAreRejected(t *testing.T) {
+	router, db, messenger := newTestRouterWithServiceArea(t, timraServiceArea)
+
+	body := `{"id":"urn:ngsi-ld:RoadSurfaceObserved:ignored","type":"RoadSurfaceObserved",
+		"surfaceType":{"type":"Property","value":"snow","probability":0.75},
+		"location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[17.310863,62.389109]}}}`
+
+	w := testRequest(router, "POST", "/ngsi-ld/v1/entities", strings.NewReader(body))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected response code %d when creating an observation outside of the service area.", w.Code)
+	}
+
+	if observations, _ := db.GetRoadSurfacesObserved(); len(observations) != 0 {
+		t.Errorf("Expected no observations to be stored, but found %d.", len(observations))
+	}
+
+	for _, params := range []string{
+		"georel=near;maxDistance==100&geometry=Point&coordinates=[17.310863,62.389109]",
+		"georel=within&geometry=Polygon&coordinates=[[[17.31,62.38],[17.32,62.38],[17.32,62.39],[17.31,62.39],[17.31,62.38]]]",
+		"georel=intersects&geometry=LineString&coordinates=[[17.3108,62.3890],[17.3110,62.3891]]",
+	} {
+		w = testRequest(router, "GET", "/ngsi-ld/v1/entities?type=RoadSegment&"+params, nil)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "BadRequestData") {
+			t.Errorf("Expected a BadRequestData response for %s, but got %d.", params, w.Code)
+		}
+	}
+
+	getEntities(t, router, "/ngsi-ld/v1/entities?type=RoadSegment&georel=near;maxDistance==100&geometry=Point&coordinates=[17.3,62.46]", http.StatusOK)
+
+	patch := `{"surfaceType":{"type":"Property","value":"snow","probability":0.9}}`
+	w = testRequest(router, "PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:RoadSegment:21277:153930/attrs/", strings.NewReader(patch))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected response code %d when updating a segment outside of the service area.", w.Code)
+	}
+
+	if len(messenger.commands) != 0 {
+		t.Errorf("Expected no commands to be sent, but %d were.", len(messenger.commands))
+	}
+}
+
+func TestTemporalRetrievalOfRoadSegmentSurfaceHistory(t *testing.T) {
+	router, db, _ := newTestRouter(t)
+
+	snowstorm := time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)
+	db.UpdateRoadSegmentSurface("21277:153931", "", "", fusion.Prediction{SurfaceType: "tarmac", Probability: 0.9, Timestamp: snowstorm.Add(-2 * time.Hour)}, fusion.DefaultModel())
+	db.UpdateRoadSegmentSurface("21277:153931", "", "", fusion.Prediction{SurfaceType: "snow", Probability: 0.6, Timestamp: snowstorm}, fusion.DefaultModel())
+	db.UpdateRoadSegmentSurface("21277:153931", "", "", fusion.Prediction{SurfaceType: "snow", Probability: 0.8, Timestamp: snowstorm.Add(1 * time.Hour)}, fusion.DefaultModel())
+	db.UpdateRoadSegmentSurface("21277:153931", "", "", fusion.Prediction{SurfaceType: "gravel", Probability: 0.7, Timestamp: snowstorm.Add(12 * time.Hour)}, fusion.DefaultModel())
+
+	w := testRequest(router, "GET", "/ngsi-ld/v1/temporal/entities/urn:ngsi-ld:RoadSegment:21277:153931?timerel=between&timeAt=2021-02-10T05:00:00Z&endTimeAt=2021-02-10T12:00:00Z", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected response code %d: %s", w.Code, w.Body.String())
+	}
+
+	entity := struct {
+		ID          string `json:"id"`
+		SurfaceType []struct {
+			Value       string  `json:"value"`
+			Probability float64 `json:"probability"`
+			ObservedAt  string  `json:"observedAt"`
+		} `json:"surfaceType"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &entity)
+
+	if len(entity.SurfaceType) != 2 {
+		t.Fatalf("Expected two surface type instances during the snowstorm: %s", w.Body.String())
+	}
+
+	if entity.SurfaceType[1].Value != "snow" || entity.SurfaceType[1].Probability != 0.8 || entity.SurfaceType[1].ObservedAt != "2021-02-10T07:00:00Z" {
+		t.Errorf("Unexpected surface type instance: %v", entity.SurfaceType[1])
+	}
+
+	entities := getEntities(t, router, "/ngsi-ld/v1/temporal/entities?type=RoadSegment&timerel=after&timeAt=2021-02-10T06:30:00Z&lastN=1", http.StatusOK)
+	if len(entities) != 1 || len(entities[0]["surfaceType"].([]interface{})) != 1 {
+		t.Errorf("Expected a single segment with a single instance: %v", entities)
+	}
+
+	getEntities(t, router, "/ngsi-ld/v1/temporal/entities?type=RoadSegment", http.StatusBadRequest)
+	getEntities(t, router, "/ngsi-ld/v1/temporal/entities?type=RoadSegment&timerel=between&timeAt=2021-02-10T06:30:00Z", http.StatusBadRequest)
+
+	w = testRequest(router, "GET", "/ngsi-ld/v1/temporal/entities/urn:ngsi-ld:RoadSegment:nosuchsegment", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected response code %d for a non existing segment.", w.Code)
+	}
+
+	if entities = getEntities(t, router, "/ngsi-ld/v1/temporal/entities?type=RoadSegment&timerel=after&timeAt=2021-02-10T06:30:00Z&attrs=name", http.StatusOK); len(entities) != 0 {
+		t.Errorf("Expected no segments to have the requested attributes, but got %v", entities)
+	}
+
+	w = testRequest(router, "GET", "/ngsi-ld/v1/temporal/entities/urn:ngsi-ld:RoadSegment:21277:153931?attrs=name", nil)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "surfaceType") {
+		t.Errorf("Expected a segment without its surface type when it is not requested, but got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTemporalQueryOfRoadSurfaceObservedByID(t *testing.T) {
+	router, _, _ := newTestRouter(t)
+
+	batch := "[" + strings.Join([]string{
+		batchObservation("urn:ngsi-ld:RoadSurfaceObserved:first", "snow", 0.75, 17.310890, 62.389050),
+		batchObservation("urn:ngsi-ld:RoadSurfaceObserved:second", "ice", 0.5, 17.340000, 62.389050),
+	}, ",") + "]"
+	testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/create", strings.NewReader(batch))
+
+	query := "/ngsi-ld/v1/temporal/entities?type=RoadSurfaceObserved&timerel=after&timeAt=2021-02-10T00:00:00Z"
+
+	if entities := getEntities(t, router, query, http.StatusOK); len(entities) != 2 {
+		t.Errorf("Expected both observations, but got %v", entities)
+	}
+
+	entities := getEntities(t, router, query+"&id=urn:ngsi-ld:RoadSurfaceObserved:second,urn:ngsi-ld:RoadSegment:21277:153930", http.StatusOK)
+	if len(entities) != 1 || entities[0]["id"] != "urn:ngsi-ld:RoadSurfaceObserved:second" {
+		t.Errorf("Expected only the requested observation, but got %v", entities)
+	}
+
+	if entities = getEntities(t, router, query+"&attrs=surfaceType,name", http.StatusOK); len(entities) != 2 {
+		t.Errorf("Expected observations when their surface type is one of the requested attributes, but got %v", entities)
+	}
+}
+
+func TestSubscriptionLifecycle(t *testing.T) {
+	router, _, _ := newTestRouter(t)
+
+	body := `{"id":"urn:ngsi-ld:Subscription:icy","type":"Subscription",
+		"entities":[{"type":"RoadSegment"}],"watchedAttributes":["surfaceType"],
+		"q":"surfaceType==\"ice\"","notification":{"endpoint":{"uri":"http://example.com/notify"}}}`
+
+	w := testRequest(router, "POST", "/ngsi-ld/v1/subscriptions", strings.NewReader(body))
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/ngsi-ld/v1/subscriptions/urn:ngsi-ld:Subscription:icy" {
+		t.Fatalf("Unexpected response %d when creating a subscription: %s", w.Code, w.Body.String())
+	}
+
+	w = testRequest(router, "POST", "/ngsi-ld/v1/subscriptions", strings.NewReader(body))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Unexpected response code %d when creating a duplicate subscription.", w.Code)
+	}
+
+	w = testRequest(router, "PATCH", "/ngsi-ld/v1/subscriptions/urn:ngsi-ld:Subscription:icy", strings.NewReader(`{"q":"surfaceType==\"snow\"","isActive":false}`))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Unexpected response code %d when updating a subscription: %s", w.Code, w.Body.String())
+	}
+
+	w = testRequest(router, "GET", "/ngsi-ld/v1/subscriptions/urn:ngsi-ld:Subscription:icy", nil)
+	subscription := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &subscription)
+
+	if subscription["q"] != `surfaceType=="snow"` || subscription["status"] != "paused" {
+		t.Errorf("Expected the subscription to have been updated: %s", w.Body.String())
+	}
+
+	subscriptions := getEntities(t, router, "/ngsi-ld/v1/subscriptions", http.StatusOK)
+	if len(subscriptions) != 1 {
+		t.Errorf("Expected a single subscription, but got %d.", len(subscriptions))
+	}
+
+	w = testRequest(router, "DELETE", "/ngsi-ld/v1/subscriptions/urn:ngsi-ld:Subscription:icy", nil)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Unexpected response code %d when deleting a subscription.", w.Code)
+	}
+
+	w = testRequest(router, "GET", "/ngsi-ld/v1/subscriptions/urn:ngsi-ld:Subscription:icy", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected response code %d when retrieving a deleted subscription.", w.Code)
+	}
+}
+
+func TestInvalidSubscriptionsAreBadRequests(t *testing.T) {
+	router, _, _ := newTestRouter(t)
+
+	for _, body := range []string{
+		`{"type":"Subscription","notification":{"endpoint":{"uri":"http://example.com"}}}`,
+		`{"type":"Subscription","entities":[{"type":"RoadSegment"}],"notification":{"endpoint":{"uri":"mailto:someone"}}}`,
+		`{"type":"Subscription","entities":[{"type":"RoadSegment"}],"q":"surfaceType==","notification":{"endpoint":{"uri":"http://example.com"}}}`,
+		`{"type":"Subscription","entities":[{"type":"RoadSegment"}],"geoQ":{"georel":"near","geometry":"Point","coordinates":[17.3,62.3]},"notification":{"endpoint":{"uri":"http://example.com"}}}`,
+	} {
+		w := testRequest(router, "POST", "/ngsi-ld/v1/subscriptions", strings.NewReader(body))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected response code %d for %s.", w.Code, body)
+		}
+	}
+}
+
+func TestQuerySegmentsWithAttributeFilter(t *testing.T) {
+	router, db, _ := newTestRouter(t)
+
+	db.RoadSegmentSurfaceUpdated("21277:153930", database.SurfaceUpdate{Distribution: fusion.Distribution{"snow": 0.8}, Timestamp: time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)})
+	db.RoadSegmentSurfaceUpdated("21277:153931", database.SurfaceUpdate{Distribution: fusion.Distribution{"snow": 0.6}, Timestamp: time.Date(2020, 12, 24, 6, 0, 0, 0, time.UTC)})
+
+	near := "&georel=near;maxDistance==200&geometry=Point&coordinates=[17.310863,62.389109]"
+
+	for q, expected := range map[string]int{
+		`surfaceType==%22snow%22`:                              2,
+		`surfaceType==%22snow%22;surfaceType.probability>0.7`:  1,
+		`surfaceType==%22ice%22|surfaceType.probability<0.7`:   1,
+		`dateModified>2021-01-01T00:00:00Z`:                    1,
+		`surfaceType==%22ice%22`:                               0,
+		`refRoad==%22urn:ngsi-ld:Road:21277:153930%22`:         2,
+		`surfaceType==%22snow%22;name==%2221277:153931%22`:     1,
+		`(surfaceType==%22ice%22|surfaceType==%22snow%22);id`:  2,
+		`surfaceType.probability==0.5..0.7;surfaceType~=^sn.*`: 1,
+		`surfaceType==%22slippery%22`:                          2,
+		`surfaceType!=%22slippery%22`:                          0,
+		`surfaceType==%22Snowy%22`:                             2,
+		`surfaceType==%22packed_snow%22`:                       0,
+	} {
+		entities := getEntities(t, router, "/ngsi-ld/v1/entities?type=RoadSegment&q="+q+near, http.StatusOK)
+		if len(entities) != expected {
+			t.Errorf("Expected %d segments to match %s, but got %d.", expected, q, len(entities))
+		}
+	}
+
+	// A q filter does not require a geo-query
+	entities := getEntities(t, router, "/ngsi-ld/v1/entities?type=RoadSegment&q=surfaceType.probability>0.7", http.StatusOK)
+	if len(entities) != 1 || entities[0]["id"] != "urn:ngsi-ld:RoadSegment:21277:153930" {
+		t.Errorf("Unexpected segments returned by q filter: %v", entities)
+	}
+
+	getEntities(t, router, "/ngsi-ld/v1/entities?type=RoadSegment&q=surfaceType==", http.StatusBadRequest)
+	getEntities(t, router, "/ngsi-ld/v1/entities?type=RoadSegment&q=surfaceType==%22lava%22", http.StatusBadRequest)
+}
+
+func getFeatureCollection(t *testing.T, router *RequestRouter, path string) map[string]interface{} {
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Header.Add("Accept", "application/geo+json")
+	w := httptest.NewRecorder()
+	router.impl.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/geo+json") {
+		t.Fatalf("Unexpected response %d (%s) for %s.", w.Code, w.Header().Get("Content-Type"), path)
+	}
+
+	fc := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &fc)
+
+	if fc["type"] != "FeatureCollection" {
+		t.Fatalf("Expected a FeatureCollection: %s", w.Body.String())
+	}
+
+	return fc
+}
+
+func TestCursorPaginationOfSegments(t *testing.T) {
+	router, db, _ := newTestRouter(t)
+
+	const near string = "/ngsi-ld/v1/entities?type=RoadSegment&georel=near;maxDistance==200&geometry=Point&coordinates=[17.310863,62.389109]"
+
+	w := testRequest(router, "GET", near+"&limit=1&count=true", nil)
+	if w.Code != http.StatusOK || w.Header().Get("NGSILD-Results-Count") != "2" {
+		t.Fatalf("Expected the total number of segments to be returned: %d %v", w.Code, w.Header())
+	}
+
+	firstPage := []map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &firstPage)
+
+	link := w.Header().Get("Link")
+	if len(firstPage) != 1 || firstPage[0]["id"] != "urn:ngsi-ld:RoadSegment:21277:153930" || !strings.HasSuffix(link, `>; rel="next"; type="application/ld+json"`) {
+		t.Fatalf("Unexpected first page %v with link %s", firstPage, link)
+	}
+
+	// Updates between pages must not move segments between pages
+	db.RoadSegmentSurfaceUpdated("21277:153931", database.SurfaceUpdate{Distribution: fusion.Distribution{"snow": 0.8}, Timestamp: time.Now()})
+
+	next := strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"; type="application/ld+json"`)
+	secondPage := getEntities(t, router, next, http.StatusOK)
+	if len(secondPage) != 1 || secondPage[0]["id"] != "urn:ngsi-ld:RoadSegment:21277:153931" {
+		t.Fatalf("Unexpected second page %v from %s", secondPage, next)
+	}
+
+	w = testRequest(router, "GET", next, nil)
+	if w.Header().Get("Link") != "" || w.Header().Get("NGSILD-Results-Count") != "2" {
+		t.Errorf("Expected no link after the last page, but the count on every page: %v", w.Header())
+	}
+
+	w = testRequest(router, "GET", near, nil)
+	if w.Header().Get("NGSILD-Results-Count") != "" {
+		t.Errorf("Expected no count unless asked for: %v", w.Header())
+	}
+
+	w = testRequest(router, "GET", near+"&limit=0&count=true", nil)
+	if w.Code != http.StatusOK || w.Header().Get("NGSILD-Results-Count") != "2" || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("Expected only the number of segments to be returned: %d %s", w.Code, w.Body.String())
+	}
+
+	getEntities(t, router, near+"&limit=0", http.StatusBadRequest)
+	getEntities(t, router, near+"&cursor=!!!", http.StatusBadRequest)
+}
+
+func TestQuerySegmentsAsGeoJSON(t *testing.T) {
+	router, db, _ := newTestRouter(t)
+
+	db.RoadSegmentSurfaceUpdated("21277:153931", database.SurfaceUpdate{Distribution: fusion.Distribution{"snow": 0.8}, Timestamp: time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)})
+
+	fc := getFeatureCollection(t, router, "/ngsi-ld/v1/entities?type=RoadSegment&q=surfaceType==%22snow%22")
+
+	features := fc["features"].([]interface{})
+	if len(features) != 1 {
+		t.Fatalf("Expected a single feature, but got %d.", len(features))
+	}
+
+	feature := features[0].(map[string]interface{})
+	geometry := feature["geometry"].(map[string]interface{})
+	properties := feature["properties"].(map[string]interface{})
+
+	if feature["id"] != "urn:ngsi-ld:RoadSegment:21277:153931" || geometry["type"] != "LineString" || len(geometry["coordinates"].([]interface{})) != 3 {
+		t.Errorf("Unexpected feature: %v", feature)
+	}
+
+	if properties["surfaceType"] != "snow" || properties["probability"] != 0.8 ||
+		properties["roadID"] != "21277:153930" || properties["dateModified"] != "2021-02-10T06:00:00Z" {
+		t.Errorf("Unexpected feature properties: %v", properties)
+	}
+
+	fc = getFeatureCollection(t, router, "/ngsi-ld/v1/entities/urn:ngsi-ld:RoadSegment:21277:153931?attrs=surfaceType")
+	features = fc["features"].([]interface{})
+	properties = features[0].(map[string]interface{})["properties"].(map[string]interface{})
+
+	if len(features) != 1 || properties["probability"] != 0.8 || properties["roadID"] != nil {
+		t.Errorf("Unexpected feature for a single retrieved segment: %v", features)
+	}
+
+	fc = getFeatureCollection(t, router, "/ngsi-ld/v1/entities?type=RoadSegment&georel=near;maxDistance==200&geometry=Point&coordinates=[17.310863,62.389109]&limit=1&offset=1")
+	if len(fc["features"].([]interface{})) != 1 {
+		t.Errorf("Expected pagination to apply to GeoJSON responses: %v", fc)
+	}
+
+	req, _ := http.NewRequest("GET", "/ngsi-ld/v1/entities?type=RoadSegment&georel=near;maxDistance==200&geometry=Point&coordinates=[17.310863,62.389109]&limit=1", nil)
+	req.Header.Add("Accept", "application/geo+json")
+	w := httptest.NewRecorder()
+	router.impl.ServeHTTP(w, req)
+
+	if link := w.Header().Get("Link"); !strings.HasSuffix(link, `>; rel="next"; type="application/geo+json"`) {
+		t.Errorf("Expected the next page of a GeoJSON response to be linked as GeoJSON, but got %s", link)
+	}
+}
+
+func TestDeadLetterLifecycle(t *testing.T) {
+	db, err := database.NewDatabaseConnection(database.NewSQLiteConnector(), strings.NewReader(testSeedData))
+	if err != nil {
+		t.Fatalf("Failed to create test datastore: %s", err.Error())
+	}
+
+	deadLetters := intmsg.NewDeadLetters(db, "replica-0", intmsg.DefaultRetryPolicy())
+	receiver := intmsg.CreateRoadSegmentSurfaceUpdatedReceiver(db, deadLetters)
+	receiver(amqp.Delivery{Body: []byte("not json")})
+
+	public := createRequestRouter(ngsi.NewContextRegistry(), db, servicearea.Default())
+	if w := testRequest(public, "GET", "/admin/deadletters", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected the dead letters not to be served with the NGSI-LD API, but got %d.", w.Code)
+	}
+
+	router := createAdminRouter(deadLetters)
+
+	w := testRequest(router, "GET", "/admin/deadletters", nil)
+	dead := []struct {
+		ID        uint        `json:"id"`
+		Body      interface{} `json:"body"`
+		LastError string      `json:"lastError"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &dead)
+
+	if w.Code != http.StatusOK || len(dead) != 1 || dead[0].Body != "not json" || dead[0].LastError == "" {
+		t.Fatalf("Unexpected dead letters (%d): %s", w.Code, w.Body.String())
+	}
+
+	path := fmt.Sprintf("/admin/deadletters/%d", dead[0].ID)
+
+	if w = testRequest(router, "GET", path, nil); w.Code != http.StatusOK {
+		t.Errorf("Unexpected response code %d when retrieving a dead letter.", w.Code)
+	}
+
+	if w = testRequest(router, "POST", path+"/replay", nil); w.Code == http.StatusNoContent || !strings.Contains(w.Body.String(), "failed again") {
+		t.Errorf("Expected replaying a message that fails again to be an error, but got %d.", w.Code)
+	}
+
+	if w = testRequest(router, "GET", path, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected a message that fails to be replayed to be kept, but got %d.", w.Code)
+	}
+
+	if w = testRequest(router, "DELETE", path, nil); w.Code != http.StatusNoContent {
+		t.Errorf("Unexpected response code %d when discarding a dead letter.", w.Code)
+	}
+
+	for _, method := range []string{"GET", "DELETE"} {
+		if w = testRequest(router, method, path, nil); w.Code != http.StatusNotFound {
+			t.Errorf("Expected %s of a discarded dead letter to return 404, but got %d.", method, w.Code)
+		}
+	}
+}
+
+func batchObservation(id, surfaceType string, probability, lon, lat float64) string {
+	return fmt.Sprintf(`{"id":"%s","type":"RoadSurfaceObserved",
+		"surfaceType":{"type":"Property","value":"%s","probability":%f},
+		"location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[%f,%f]}}}`,
+		id, surfaceType, probability, lon, lat)
+}
+
+func TestBatchCreateReportsErrorsPerEntity(t *testing.T) {
+	router, db, messenger := newTestRouter(t)
+
+	batch := "[" + strings.Join([]string{
+		batchObservation("urn:ngsi-ld:RoadSurfaceObserved:first", "snow", 0.75, 17.310890, 62.389050),
+		batchObservation("urn:ngsi-ld:RoadSurfaceObserved:second", "lava", 0.75, 17.310890, 62.389050),
+		batchObservation("urn:ngsi-ld:RoadSurfaceObserved:third", "ice", 1.5, 17.310890, 62.389050),
+		batchObservation("urn:ngsi-ld:RoadSurfaceObserved:first", "ice", 0.5, 17.310890, 62.389050),
+		`{"id":"urn:ngsi-ld:Road:21277","type":"Road"}`,
+	}, ",") + "]"
+
+	w := testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/create", strings.NewReader(batch))
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("Unexpected response code %d when creating a partly invalid batch.", w.Code)
+	}
+
+	result := fiwarecontext.BatchOperationResult{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+
+	if len(result.Success) != 1 || result.Success[0] != "urn:ngsi-ld:RoadSurfaceObserved:first" || len(result.Errors) != 4 {
+		t.Fatalf("Expected one created observation and four errors, but got %s", w.Body.String())
+	}
+
+	for _, e := range result.Errors {
+		if e.EntityID == "" || e.Error.Type != "https://uri.etsi.org/ngsi-ld/errors/BadRequestData" || e.Error.Detail == "" {
+			t.Errorf("Expected every error to be reported as BadRequestData with an entity id: %+v", e)
+		}
+	}
+
+	observations, _ := db.GetRoadSurfacesObserved()
+	if len(observations) != 1 || observations[0].RoadSurfaceObservedID != "first" || observations[0].SegmentID != "21277:153931" {
+		t.Fatalf("Expected only the valid observation to be stored and matched: %v", observations)
+	}
+
+	if len(messenger.commands) != 1 {
+		t.Errorf("Expected one command to update the matched segment, but got %d.", len(messenger.commands))
+	}
+
+	w = testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/create", strings.NewReader(
+		"["+batchObservation("urn:ngsi-ld:RoadSurfaceObserved:first", "snow", 0.75, 17.310890, 62.389050)+"]"))
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "AlreadyExists") {
+		t.Errorf("Expected creating an existing observation to fail with AlreadyExists, but got %d: %s", w.Code, w.Body.String())
+	}
+
+	for _, body := range []string{"", "[]", "{}", `[{"id":"urn:ngsi-ld:RoadSurfaceObserved:untyped"}]`} {
+		if w = testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/create", strings.NewReader(body)); w.Code != http.StatusBadRequest {
+			t.Errorf("Unexpected response code %d for the batch %q.", w.Code, body)
+		}
+	}
+}
+
+func TestBatchUpsertIsIdempotent(t *testing.T) {
+	router, db, messenger := newTestRouter(t)
+
+	batch := "[" + strings.Join([]string{
+		batchObservation("urn:ngsi-ld:RoadSurfaceObserved:first", "snow", 0.75, 17.310890, 62.389050),
+		batchObservation("urn:ngsi-ld:RoadSurfaceObserved:second", "ice", 0.5, 17.340000, 62.389050),
+	}, ",") + "]"
+
+	w := testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/upsert", strings.NewReader(batch))
+	created := []string{}
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	if w.Code != http.StatusCreated || len(created) != 2 {
+		t.Fatalf("Expected both observations to be created by the first upsert, but got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/upsert", strings.NewReader(batch))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the repeated upsert to succeed without creating anything, but got %d: %s", w.Code, w.Body.String())
+	}
+
+	observations, _ := db.GetRoadSurfacesObserved()
+	if len(observations) != 2 || len(messenger.commands) != 1 {
+		t.Errorf("Expected the observations to be stored and applied once, but got %d observations and %d commands.", len(observations), len(messenger.commands))
+	}
+
+	segment := `[{"id":"urn:ngsi-ld:RoadSegment:21277:153930","type":"RoadSegment",
+		"surfaceType":{"type":"Property","value":"gravel","probability":0.9}}]`
+	if w = testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/upsert", strings.NewReader(segment)); w.Code != http.StatusNoContent {
+		t.Errorf("Unexpected response code %d when upserting a road segment.", w.Code)
+	}
+}
+
+func TestBatchCreateOfObservationsThatAlreadyExist(t *testing.T) {
+	router, db, _ := newTestRouter(t)
+
+	batch := "[" + strings.Join([]string{
+		batchObservation("urn:ngsi-ld:RoadSurfaceObserved:kept", "snow", 0.75, 17.310890, 62.389050),
+		batchObservation("urn:ngsi-ld:RoadSurfaceObserved:deleted", "ice", 0.5, 17.340000, 62.389050),
+	}, ",") + "]"
+	testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/create", strings.NewReader(batch))
+	testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/delete", strings.NewReader(`["urn:ngsi-ld:RoadSurfaceObserved:deleted"]`))
+
+	batch = "[" + strings.Join([]string{
+		batchObservation("urn:ngsi-ld:RoadSurfaceObserved:kept", "snow", 0.75, 17.310890, 62.389050),
+		batchObservation("urn:ngsi-ld:RoadSurfaceObserved:deleted", "ice", 0.5, 17.340000, 62.389050),
+		batchObservation("urn:ngsi-ld:RoadSurfaceObserved:new", "ice", 0.5, 17.340000, 62.389050),
+	}, ",") + "]"
+
+	for _, operation := range []string{"create", "upsert"} {
+		w := testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/"+operation, strings.NewReader(batch))
+
+		result := fiwarecontext.BatchOperationResult{}
+		json.Unmarshal(w.Body.Bytes(), &result)
+
+		alreadyExists := map[string]bool{}
+		for _, e := range result.Errors {
+			alreadyExists[e.EntityID] = e.Error.Type == "https://uri.etsi.org/ngsi-ld/errors/AlreadyExists"
+		}
+
+		if w.Code != http.StatusMultiStatus || !alreadyExists["urn:ngsi-ld:RoadSurfaceObserved:deleted"] || alreadyExists["urn:ngsi-ld:RoadSurfaceObserved:kept"] != (operation == "create") {
+			t.Errorf("Unexpected result of %s of observations that already exist (%d): %s", operation, w.Code, w.Body.String())
+		}
+	}
+
+	if observations, _ := db.GetRoadSurfacesObserved(); len(observations) != 2 {
+		t.Errorf("Expected the new observation to be stored once, but found %d observations.", len(observations))
+	}
+}
+
+func TestBatchUpdateOfRoadSegments(t *testing.T) {
+	router, _, messenger := newTestRouter(t)
+
+	batch := `[{"id":"urn:ngsi-ld:RoadSegment:21277:153930","type":"RoadSegment",
+		"surfaceType":{"type":"Property","value":"snow_packed","probability":0.9}},
+		{"id":"urn:ngsi-ld:RoadSegment:21277:153931","type":"RoadSegment",
+		"surfaceType":{"type":"Property","value":"ice","probability":0.6}}]`
+
+	w := testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/update", strings.NewReader(batch))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Unexpected response code %d when updating a batch of segments: %s", w.Code, w.Body.String())
+	}
+
+	if len(messenger.commands) != 2 || messenger.commands[0].(*commands.UpdateRoadSegmentSurface).SurfaceType != "packed_snow" {
+		t.Fatalf("Expected a command to update each segment, but got %v.", messenger.commands)
+	}
+
+	batch = `[{"id":"urn:ngsi-ld:RoadSegment:21277:999999","type":"RoadSegment",
+		"surfaceType":{"type":"Property","value":"ice","probability":0.6}},
+		{"id":"urn:ngsi-ld:RoadSegment:21277:153930","type":"RoadSegment"}]`
+
+	w = testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/update", strings.NewReader(batch))
+	result := fiwarecontext.BatchOperationResult{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+
+	if w.Code != http.StatusMultiStatus || len(result.Errors) != 2 || result.Errors[0].Error.Type != "https://uri.etsi.org/ngsi-ld/errors/ResourceNotFound" {
+		t.Errorf("Expected unknown segments and missing attributes to be reported per entity, but got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestBatchDelete(t *testing.T) {
+	router, db, messenger := newTestRouter(t)
+
+	batch := "[" + strings.Join([]string{
+		batchObservation("urn:ngsi-ld:RoadSurfaceObserved:first", "snow", 0.75, 17.310890, 62.389050),
+		batchObservation("urn:ngsi-ld:RoadSurfaceObserved:second", "ice", 0.5, 17.340000, 62.389050),
+	}, ",") + "]"
+
+	if w := testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/create", strings.NewReader(batch)); w.Code != http.StatusCreated {
+		t.Fatalf("Unexpected response code %d when creating a batch of observations.", w.Code)
+	}
+
+	ids := `["urn:ngsi-ld:RoadSurfaceObserved:first","urn:ngsi-ld:RoadSurfaceObserved:unknown"]`
+	w := testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/delete", strings.NewReader(ids))
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "ResourceNotFound") {
+		t.Fatalf("Expected the unknown observation to be reported as not found, but got %d: %s", w.Code, w.Body.String())
+	}
+
+	observations, _ := db.GetRoadSurfacesObserved()
+	if len(observations) != 1 || observations[0].RoadSurfaceObservedID != "second" {
+		t.Fatalf("Expected only the second observation to remain: %v", observations)
+	}
+
+	getEntities(t, router, "/ngsi-ld/v1/entities/urn:ngsi-ld:RoadSurfaceObserved:first", http.StatusNotFound)
+
+	if retraction, ok := messenger.commands[len(messenger.commands)-1].(*commands.RetractRoadSegmentSurface); !ok || retraction.ObservationID != "first" {
+		t.Errorf("Expected the prediction from the deleted observation to be retracted, but got %+v.", messenger.commands)
+	}
+
+	w = testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/delete", strings.NewReader(`["urn:ngsi-ld:RoadSurfaceObserved:second"]`))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Unexpected response code %d when deleting an observation.", w.Code)
+	}
+}
+
+func TestDeleteObservationRetractsItsPrediction(t *testing.T) {
+	router, db, messenger := newTestRouter(t)
+
+	batch := "[" + batchObservation("urn:ngsi-ld:RoadSurfaceObserved:wrong", "ice", 0.9, 17.310890, 62.389050) + "]"
+	if w := testRequest(router, "POST", "/ngsi-ld/v1/entityOperations/create", strings.NewReader(batch)); w.Code != http.StatusCreated {
+		t.Fatalf("Unexpected response code %d when creating an observation.", w.Code)
+	}
+
+	path := "/ngsi-ld/v1/entities/urn:ngsi-ld:RoadSurfaceObserved:wrong"
+	if w := testRequest(router, "DELETE", path, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("Unexpected response code %d when deleting an observation.", w.Code)
+	}
+
+	if observations, _ := db.GetRoadSurfacesObserved(); len(observations) != 0 {
+		t.Errorf("Expected the observation to be deleted, but found %d.", len(observations))
+	}
+
+	retraction, ok := messenger.commands[len(messenger.commands)-1].(*commands.RetractRoadSegmentSurface)
+	if !ok || retraction.ID != "21277:153931" || retraction.ObservationID != "wrong" {
+		t.Fatalf("Expected the prediction from the observation to be retracted, but got %+v.", messenger.commands)
+	}
+
+	for _, p := range []string{path, "/ngsi-ld/v1/entities/urn:ngsi-ld:RoadSegment:21277:153931", path + "/attrs/surfaceType"} {
+		if w := testRequest(router, "DELETE", p, nil); w.Code == http.StatusNoContent {
+			t.Errorf("Expected the deletion of %s to fail.", p)
+		}
+	}
+}
+
+func TestDeleteSurfaceTypeRetractsUpdatesFromTheAPI(t *testing.T) {
+	router, db, messenger := newTestRouter(t)
+	path := "/ngsi-ld/v1/entities/urn:ngsi-ld:RoadSegment:21277:153930/attrs/surfaceType"
+
+	if w := testRequest(router, "DELETE", path, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 when there is no update to retract, but got %d.", w.Code)
+	} else {
+		expectResourceNotFound(t, w)
+	}
+
+	snowstorm := time.Date(2021, 2, 10, 6, 0, 0, 0, time.UTC)
+	db.UpdateRoadSegmentSurface("21277:153930", "", "", fusion.Prediction{SurfaceType: "snow", Probability: 0.8, Source: fusion.SourceAPI, Timestamp: snowstorm}, fusion.DefaultModel())
+	db.UpdateRoadSegmentSurface("21277:153930", "", "", fusion.Prediction{SurfaceType: "ice", Probability: 0.8, Source: fusion.SourceObservation, Timestamp: snowstorm.Add(time.Minute)}, fusion.DefaultModel())
+	db.UpdateRoadSegmentSurface("21277:153930", "", "", fusion.Prediction{SurfaceType: "lava", Probability: 0.9, Source: fusion.SourceAPI, Timestamp: snowstorm.Add(2 * time.Minute)}, fusion.DefaultModel())
+
+	if w := testRequest(router, "DELETE", path, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("Unexpected response code %d when deleting the surfaceType of a segment.", w.Code)
+	}
+
+	if w := testRequest(router, "DELETE", path+"?deleteAll=true", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("Unexpected response code %d when deleting every surfaceType of a segment.", w.Code)
+	}
+
+	latest := messenger.commands[0].(*commands.RetractRoadSegmentSurface)
+	all := messenger.commands[1].(*commands.RetractRoadSegmentSurface)
+	if latest.ID != "21277:153930" || len(latest.Predictions) != 1 || latest.Predictions[0] != 3 || len(all.Predictions) != 2 {
+		t.Errorf("Expected the latest update from the API to be retracted, and then all of them: %+v %+v", latest, all)
+	}
+
+	if w := testRequest(router, "DELETE", "/ngsi-ld/v1/entities/urn:ngsi-ld:RoadSegment:21277:999999/attrs/surfaceType", nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for the surfaceType of an unknown segment, but got %d.", w.Code)
+	} else {
+		expectResourceNotFound(t, w)
+	}
+}
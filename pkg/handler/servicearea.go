@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/format"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/servicearea"
+	ngsierrors "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+func (router *RequestRouter) addServiceAreaHandlers(area *servicearea.ServiceArea) {
+	router.Get("/servicearea", newServiceAreaHandler(area))
+}
+
+//newServiceAreaHandler handles GET requests for the active service area, which is returned
+//as a GeoJSON FeatureCollection with one feature per area
+func newServiceAreaHandler(area *servicearea.ServiceArea) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bytes, err := json.MarshalIndent(area, "", "  ")
+		if err != nil {
+			ngsierrors.ReportNewInternalError(w, "Failed to encode response.")
+			return
+		}
+
+		w.Header().Add("Content-Type", format.GeoJSONContentType+";charset=utf-8")
+		w.Write(bytes)
+	})
+}
@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/database"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/subscriptions"
+	ngsierrors "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+func (router *RequestRouter) addSubscriptionHandlers(db database.Datastore) {
+	router.Post("/ngsi-ld/v1/subscriptions", newCreateSubscriptionHandler(db))
+	router.Get("/ngsi-ld/v1/subscriptions", newQuerySubscriptionsHandler(db))
+	router.Get("/ngsi-ld/v1/subscriptions/{subscription}", newRetrieveSubscriptionHandler(db))
+	router.Patch("/ngsi-ld/v1/subscriptions/{subscription}", newUpdateSubscriptionHandler(db))
+	router.Delete("/ngsi-ld/v1/subscriptions/{subscription}", newDeleteSubscriptionHandler(db))
+}
+
+//newCreateSubscriptionHandler handles POST requests for new subscriptions
+func newCreateSubscriptionHandler(db database.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			ngsierrors.ReportNewInvalidRequest(w, "Unable to read request body.")
+			return
+		}
+
+		subscription, err := subscriptions.NewSubscription(body)
+		if err != nil {
+			reportQueryError(w, err)
+			return
+		}
+
+		if _, err := db.GetSubscriptionByID(subscription.ID); err == nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		stored, err := subscription.ToPersistence()
+		if err == nil {
+			err = db.CreateSubscription(stored)
+		}
+
+		if err != nil {
+			ngsierrors.ReportNewInternalError(w, "Failed to store subscription.")
+			return
+		}
+
+		w.Header().Add("Location", "/ngsi-ld/v1/subscriptions/"+subscription.ID)
+		w.WriteHeader(http.StatusCreated)
+	})
+}
+
+//newQuerySubscriptionsHandler handles GET requests for all subscriptions
+func newQuerySubscriptionsHandler(db database.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stored, err := db.GetSubscriptions()
+		if err != nil {
+			ngsierrors.ReportNewInternalError(w, "Failed to load subscriptions.")
+			return
+		}
+
+		result := []*subscriptions.Subscription{}
+
+		for idx := range stored {
+			subscription, err := subscriptions.FromPersistence(&stored[idx])
+			if err != nil {
+				ngsierrors.ReportNewInternalError(w, "Failed to load subscriptions.")
+				return
+			}
+			result = append(result, subscription)
+		}
+
+		writeSubscriptionResponse(w, result)
+	})
+}
+
+//newRetrieveSubscriptionHandler handles GET requests for a single subscription
+func newRetrieveSubscriptionHandler(db database.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subscription, err := getSubscription(db, chi.URLParam(r, "subscription"))
+		if err != nil {
+			reportSubscriptionError(w, err)
+			return
+		}
+
+		writeSubscriptionResponse(w, subscription)
+	})
+}
+
+//newUpdateSubscriptionHandler handles PATCH requests that update parts of a subscription
+func newUpdateSubscriptionHandler(db database.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subscription, err := getSubscription(db, chi.URLParam(r, "subscription"))
+		if err != nil {
+			reportSubscriptionError(w, err)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			ngsierrors.ReportNewInvalidRequest(w, "Unable to read request body.")
+			return
+		}
+
+		err = subscription.Patch(body)
+		if err != nil {
+			reportQueryError(w, err)
+			return
+		}
+
+		stored, err := subscription.ToPersistence()
+		if err == nil {
+			err = db.UpdateSubscription(stored)
+		}
+
+		if err != nil {
+			reportSubscriptionError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+//newDeleteSubscriptionHandler handles DELETE requests for subscriptions
+func newDeleteSubscriptionHandler(db database.Datastore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := db.DeleteSubscription(chi.URLParam(r, "subscription"))
+		if err != nil {
+			reportSubscriptionError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func getSubscription(db database.Datastore, id string) (*subscriptions.Subscription, error) {
+	stored, err := db.GetSubscriptionByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return subscriptions.FromPersistence(stored)
+}
+
+func reportSubscriptionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, database.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ngsierrors.ReportNewInternalError(w, "An internal error was encountered when accessing the subscription.")
+}
+
+func writeSubscriptionResponse(w http.ResponseWriter, response interface{}) {
+	bytes, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		ngsierrors.ReportNewInternalError(w, "Failed to encode response.")
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/ld+json;charset=utf-8")
+	w.Write(bytes)
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/iot-for-tillgenglighet/api-transportation/internal/pkg/fiware/query"
+	ngsi "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld"
+	ngsierrors "github.com/iot-for-tillgenglighet/ngsi-ld-golang/pkg/ngsi-ld/errors"
+)
+
+//TemporalContextSource is implemented by context sources that keep track of how the
+//attributes of their entities have changed over time
+type TemporalContextSource interface {
+	GetTemporalEntities(tq *query.TemporalQuery, callback ngsi.QueryEntitiesCallback) error
+	RetrieveTemporalEntity(entityID string, tq *query.TemporalQuery) (ngsi.Entity, error)
+}
+
+//newQueryTemporalEntitiesHandler handles GET requests for the temporal evolution of entities
+func newQueryTemporalEntitiesHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tq, err := query.NewTemporalQueryFromRequest(r, true)
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		if len(tq.Types) == 0 {
+			ngsierrors.ReportNewBadRequestData(w, "A temporal query MUST specify the type parameter.")
+			return
+		}
+
+		entityMaxCount := ngsi.QueryDefaultPaginationLimit
+		if tq.Limit > 0 {
+			entityMaxCount = tq.Limit
+		}
+
+		entities := []ngsi.Entity{}
+
+		for _, typeName := range tq.Types {
+			typeQuery := *tq
+			typeQuery.Types = []string{typeName}
+
+			for _, source := range ctxReg.GetContextSourcesForEntityType(typeName) {
+				temporalSource, ok := source.(TemporalContextSource)
+				if !ok {
+					continue
+				}
+
+				err = temporalSource.GetTemporalEntities(&typeQuery, func(entity ngsi.Entity) error {
+					if uint64(len(entities)) < entityMaxCount {
+						entities = append(entities, entity)
+					}
+					return nil
+				})
+				if err != nil {
+					reportQueryError(w, err)
+					return
+				}
+			}
+		}
+
+		bytes, err := json.MarshalIndent(entities, "", "  ")
+		if err != nil {
+			ngsierrors.ReportNewInternalError(w, "Failed to encode response.")
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json;charset=utf-8")
+		w.Write(bytes)
+	})
+}
+
+//newRetrieveTemporalEntityHandler handles GET requests for the temporal evolution of a single entity
+func newRetrieveTemporalEntityHandler(ctxReg ngsi.ContextRegistry) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entityID := chi.URLParam(r, "entity")
+
+		tq, err := query.NewTemporalQueryFromRequest(r, false)
+		if err != nil {
+			ngsierrors.ReportNewBadRequestData(w, err.Error())
+			return
+		}
+
+		var entity ngsi.Entity
+
+		for _, source := range ctxReg.GetContextSourcesForEntity(entityID) {
+			temporalSource, ok := source.(TemporalContextSource)
+			if !ok {
+				continue
+			}
+
+			entity, err = temporalSource.RetrieveTemporalEntity(entityID, tq)
+			if err != nil {
+				reportQueryError(w, err)
+				return
+			}
+			break
+		}
+
+		if entity == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		bytes, err := json.MarshalIndent(entity, "", "  ")
+		if err != nil {
+			ngsierrors.ReportNewInternalError(w, "Failed to encode response.")
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json;charset=utf-8")
+		w.Write(bytes)
+	})
+}